@@ -0,0 +1,61 @@
+package btc
+
+// The wallet and chain operations used by decloud. RpcBackend talks to a
+// bitcoind; FakeWallet simulates one in memory for tests.
+type Backend interface {
+	NewAddress() (string, error)
+
+	// Total received by each wallet address, counting only txns with at least
+	// minConf confirmations. Amounts are in satoshis.
+	ListReceived(minConf int) (map[string]int64, error)
+
+	// Adds an address the wallet has no key for, so that payments to it are
+	// counted by ListReceived
+	WatchAddress(addr string) error
+
+	ListUnspent(minConf int) ([]Unspent, error)
+
+	// Confirmed unspent outputs of any address, not only wallet addresses
+	AddressUnspent(addr string) ([]Unspent, error)
+
+	// Signatures are in the format of bitcoind's signmessage
+	SignMessage(addr string, message string) (string, error)
+	VerifyMessage(addr string, sig string, message string) (bool, error)
+
+	// Pays amount satoshis from the wallet to addr, and returns the txid
+	Send(addr string, amount int64) (string, error)
+
+	DecodeTxn(txnHex string) (*Txn, error)
+
+	// Whether the output exists and is unspent, counting unconfirmed spends
+	IsUnspent(op OutPoint) (bool, error)
+
+	// Broadcasts a signed raw txn
+	SendRawTxn(txnHex string) error
+
+	BlockCount() (int, error)
+
+	// Confirmations of a wallet txn: 0 while in the mempool, and -1 if it is
+	// neither in the mempool nor the chain, eg. after a reorg or double spend
+	TxnConfirmations(txid string) (int, error)
+
+	// Builds and signs a txn paying amount from the wallet to addr, without
+	// broadcasting it
+	CreateTxn(addr string, amount int64) (string, error)
+
+	// Multisig and raw txns, as used by payment channels. Public keys are hex
+	// encoded and compressed.
+	NewPubKey() (string, error)
+	AddMultisigAddr(nRequired int, pubKeys []string) (string, error)
+	CreateRawTxn(inputs []OutPoint, outputs []TxOut, lockTime int) (string, error)
+	// Adds the wallet's signatures, and returns whether the txn is fully
+	// signed. prevTxns are raw txns, not yet on the chain, that it spends.
+	SignRawTxn(txnHex string, prevTxns []string) (string, bool, error)
+}
+
+type Unspent struct {
+	OutPoint
+	Address       string
+	Amount        int64
+	Confirmations int
+}
@@ -1,13 +1,176 @@
 package btc
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
 	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+type TxnError string
+
+const (
+	INVALID_ENCODING TxnError = "invalid-encoding"
+	INVALID_INPUT    TxnError = "invalid-input"
+	UNDERPAID        TxnError = "underpaid"
+	DOUBLE_SPEND     TxnError = "double-spend"
+	REJECTED         TxnError = "rejected"
 )
 
-func SubmitTxn(b64txn string) error {
+func (te TxnError) Error() string {
+	return string(te)
+}
+
+type OutPoint struct {
+	Txid string
+	Vout int
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%v:%v", op.Txid, op.Vout)
+}
+
+type TxOut struct {
+	Addr   string `json:"addr"`
+	Amount int64  `json:"amount"` // satoshis
+}
+
+// Input sequence numbers. LockTime is only enforced if some input's sequence
+// is below MAX_SEQUENCE.
+const MAX_SEQUENCE = 0xffffffff
+
+// LockTimes from here on are unix times, rather than block heights
+const LOCKTIME_THRESHOLD = 500000000
+
+// A transaction attached to a request as payment.
+type Txn struct {
+	Txid      string
+	Hex       string
+	Inputs    []OutPoint
+	Sequences []uint32         // of each input
+	Outputs   map[string]int64 // address -> satoshis
+	Outs      []TxOut          // outputs in order, for finding vouts
+	LockTime  int
+}
+
+// Whether the txn can't be mined before the given block height: its lock time
+// is a height no earlier than that, and enforced.
+func (t *Txn) LockedUntil(height int) bool {
+	if t.LockTime < height || t.LockTime >= LOCKTIME_THRESHOLD ||
+		len(t.Sequences) != len(t.Inputs) {
+		return false
+	}
+	for _, seq := range t.Sequences {
+		if seq == MAX_SEQUENCE {
+			return false
+		}
+	}
+	return true
+}
+
+// Amount paid, in satoshis, to any of the given addresses.
+func (t *Txn) AmountTo(addrs []string) int64 {
+	amt := int64(0)
+	for _, addr := range addrs {
+		amt += t.Outputs[addr]
+	}
+	return amt
+}
+
+// Encodes a hex raw transaction for attaching to a request.
+func EncodeTxn(txnHex string) (string, error) {
+	raw, err := hex.DecodeString(txnHex)
+	if err != nil || len(raw) == 0 {
+		return "", INVALID_ENCODING
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Decodes a base64 encoded raw transaction.
+func DecodeTxn(b64txn string, b Backend) (*Txn, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64txn)
+	if err != nil || len(raw) == 0 {
+		return nil, INVALID_ENCODING
+	}
+	txn, err := b.DecodeTxn(hex.EncodeToString(raw))
+	if err != nil {
+		return nil, err
+	}
+	if txn.Txid == "" || len(txn.Inputs) == 0 {
+		return nil, INVALID_ENCODING
+	}
+	return txn, nil
+}
+
+func spentDBPath() string {
+	return util.AppDir() + "/btc-spent-outpoints.db"
+}
+
+// Returns the txid of an earlier attached transaction that spent op, if any.
+func spentBy(op OutPoint) string {
+	d := util.GetOrCreateDB(spentDBPath())
+	txid, _ := d.Read(op.String())
+	return string(txid)
+}
+
+// Checks that b64txn is a well formed transaction with unspent inputs, that
+// pays at least pv to the given addresses, and that does not spend the inputs
+// of an earlier attached transaction.
+func CheckTxn(b64txn string, pv *msg.PaymentValue, payTo []string, b Backend) (*Txn, error) {
+	if pv == nil || pv.Currency != msg.BTC {
+		return nil, fmt.Errorf("expected BTC payment value, got %v", pv)
+	}
+	txn, err := DecodeTxn(b64txn, b)
+	if err != nil {
+		return nil, err
+	}
+	if txn.AmountTo(payTo) < pv.Amount {
+		return nil, UNDERPAID
+	}
+	for _, op := range txn.Inputs {
+		if spentBy(op) != "" {
+			return nil, DOUBLE_SPEND
+		}
+		ok, err := b.IsUnspent(op)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, INVALID_INPUT
+		}
+	}
+	return txn, nil
+}
+
+// Broadcasts the transaction, and remembers its inputs as spent.
+func SubmitTxn(txn *Txn, b Backend) error {
+	// TODO(ortutay): two requests attaching conflicting txns can both pass
+	// CheckTxn; bitcoind will reject whichever is broadcast second.
+	err := b.SendRawTxn(txn.Hex)
+	if err != nil {
+		fmt.Printf("broadcast of %v failed: %v\n", txn.Txid, err)
+		return REJECTED
+	}
+	d := util.GetOrCreateDB(spentDBPath())
+	for _, op := range txn.Inputs {
+		err := d.Write(op.String(), []byte(txn.Txid))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func TxnIsValid(b64txn string, pv *msg.PaymentValue) bool {
-	return false
+// Maps errors from CheckTxn and SubmitTxn to a response status.
+func StatusForTxnError(err error) msg.OcRespStatus {
+	switch err {
+	case UNDERPAID:
+		return msg.TOO_LOW
+	case INVALID_ENCODING, INVALID_INPUT, DOUBLE_SPEND, REJECTED:
+		return msg.INVALID_TXN
+	default:
+		return msg.SERVER_ERROR
+	}
 }
@@ -0,0 +1,104 @@
+package btc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/testutil"
+)
+
+// Returns a server wallet, and a client wallet holding one confirmed coin.
+func newTestWallets(t *testing.T, amount int64) (*FakeChain, *FakeWallet, *FakeWallet) {
+	chain := NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	addr, err := client.NewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Fund(addr, amount)
+	chain.Mine(1)
+	return chain, server, client
+}
+
+// Base64 encoding of a raw txn, as attached to requests
+func attachable(t *testing.T, txnHex string) string {
+	raw, err := hex.DecodeString(txnHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestCheckAndSubmitTxn(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, server, client := newTestWallets(t, 5e6)
+	payAddr, _ := server.NewAddress()
+	payTo := []string{payAddr}
+	pv := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+
+	txnHex, err := client.CreateTxn(payAddr, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn, err := CheckTxn(attachable(t, txnHex), &pv, payTo, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.AmountTo(payTo) != 1e6 {
+		t.Fatalf("unexpected txn: %+v", txn)
+	}
+	err = SubmitTxn(txn, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(1)
+	received, _ := server.ListReceived(1)
+	if received[payAddr] != 1e6 {
+		t.Fatalf("expected 1e6 received, got %v", received[payAddr])
+	}
+
+	// The same inputs can't pay twice
+	_, err = CheckTxn(attachable(t, txnHex), &pv, payTo, server)
+	if err != DOUBLE_SPEND {
+		t.Fatalf("expected %v on replay, got %v", DOUBLE_SPEND, err)
+	}
+}
+
+func TestCheckTxnRejects(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, server, client := newTestWallets(t, 5e6)
+	payAddr, _ := server.NewAddress()
+	otherAddr, _ := chain.NewWallet("other").NewAddress()
+	pv := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+
+	low, _ := client.CreateTxn(payAddr, 1e6-1)
+	other, _ := client.CreateTxn(otherAddr, 1e6)
+	// Spend the coin, so txns built from it have spent inputs
+	spent, _ := client.CreateTxn(payAddr, 1e6)
+	if _, err := client.Send(otherAddr, 5e6); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		b64 string
+		err error
+	}{
+		{"not base64!", INVALID_ENCODING},
+		{base64.StdEncoding.EncodeToString([]byte("garbage")), INVALID_ENCODING},
+		{attachable(t, low), UNDERPAID},
+		{attachable(t, other), UNDERPAID},
+		{attachable(t, spent), INVALID_INPUT},
+	}
+	for _, test := range tests {
+		_, err := CheckTxn(test.b64, &pv, []string{payAddr}, server)
+		if err != test.err {
+			t.Errorf("%v: expected %v, got %v", test.b64, test.err, err)
+		}
+	}
+	if status := StatusForTxnError(UNDERPAID); status != msg.TOO_LOW {
+		t.Errorf("expected %v, got %v", msg.TOO_LOW, status)
+	}
+}
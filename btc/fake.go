@@ -0,0 +1,609 @@
+package btc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Simulates a bitcoin network in memory, with blocks mined on demand. Wallets
+// made with NewWallet share the chain, so they can pay each other. Addresses
+// are real testnet P2PKH addresses, and messages are signed as bitcoind would.
+// Everything is deterministic, and txns pay no fees.
+type FakeChain struct {
+	mu       sync.Mutex
+	height   int
+	txns     map[string]*fakeTxnRecord
+	order    []string // txids, in the order they were accepted
+	unspent  map[OutPoint]bool
+	keys     map[string]*big.Int // address -> private key
+	pubKeys  map[string]*big.Int // hex public key -> private key
+	multisig map[string]*fakeMultisig
+	nonce    int
+}
+
+type fakeMultisig struct {
+	nRequired int
+	pubKeys   []string
+}
+
+// The "raw" form of a fake txn is its hex encoded JSON. Only inputs from
+// multisig addresses need signatures; wallets are trusted with their own coins.
+type fakeTxn struct {
+	Inputs    []OutPoint        `json:"inputs"`
+	Sequences []uint32          `json:"sequences,omitempty"` // absent if all MAX_SEQUENCE
+	Outputs   []TxOut           `json:"outputs"`
+	Nonce     int               `json:"nonce"` // distinguishes otherwise equal txns
+	LockTime  int               `json:"lockTime,omitempty"`
+	Sigs      map[string]string `json:"sigs,omitempty"` // public key -> sig of txid
+}
+
+func (txn *fakeTxn) sequences() []uint32 {
+	if txn.Sequences != nil {
+		return txn.Sequences
+	}
+	seqs := make([]uint32, len(txn.Inputs))
+	for i := range seqs {
+		seqs[i] = MAX_SEQUENCE
+	}
+	return seqs
+}
+
+// As bitcoind: the lock time is enforced unless every input is final, and is
+// a unix time from LOCKTIME_THRESHOLD on.
+func (txn *fakeTxn) isLocked(height int) bool {
+	final := true
+	for _, seq := range txn.sequences() {
+		if seq != MAX_SEQUENCE {
+			final = false
+		}
+	}
+	if final {
+		return false
+	}
+	if txn.LockTime >= LOCKTIME_THRESHOLD {
+		return int64(txn.LockTime) > time.Now().Unix()
+	}
+	return txn.LockTime > height
+}
+
+type fakeTxnRecord struct {
+	txn    *fakeTxn
+	height int // 0 while in the mempool
+}
+
+func NewFakeChain() *FakeChain {
+	return &FakeChain{
+		txns:     make(map[string]*fakeTxnRecord),
+		unspent:  make(map[OutPoint]bool),
+		keys:     make(map[string]*big.Int),
+		pubKeys:  make(map[string]*big.Int),
+		multisig: make(map[string]*fakeMultisig),
+	}
+}
+
+func (fc *FakeChain) Height() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.height
+}
+
+// Mines n blocks. Txns in the mempool go in the first one.
+func (fc *FakeChain) Mine(n int) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if n <= 0 {
+		return
+	}
+	for _, rec := range fc.txns {
+		if rec.height == 0 {
+			rec.height = fc.height + 1
+		}
+	}
+	fc.height += n
+}
+
+// Undoes the last n blocks. Their txns go back to the mempool, except for
+// those in drop, which vanish along with any txns spending them, as if
+// replaced by a double spend on the new chain.
+func (fc *FakeChain) Reorg(n int, drop ...string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if n > fc.height {
+		n = fc.height
+	}
+	fc.height -= n
+	for _, rec := range fc.txns {
+		if rec.height > fc.height {
+			rec.height = 0
+		}
+	}
+	for _, txid := range drop {
+		fc.remove(txid)
+	}
+}
+
+// Removes txid and its descendants, restoring the outputs they spent. Caller
+// must hold the lock.
+func (fc *FakeChain) remove(txid string) {
+	rec, ok := fc.txns[txid]
+	if !ok {
+		return
+	}
+	// Collected first, as removing them changes fc.order
+	var children []string
+	for _, other := range fc.order {
+		for _, op := range fc.txns[other].txn.Inputs {
+			if op.Txid == txid {
+				children = append(children, other)
+				break
+			}
+		}
+	}
+	for _, child := range children {
+		fc.remove(child)
+	}
+	for i := range rec.txn.Outputs {
+		delete(fc.unspent, OutPoint{Txid: txid, Vout: i})
+	}
+	for _, op := range rec.txn.Inputs {
+		fc.unspent[op] = true
+	}
+	delete(fc.txns, txid)
+	for i, other := range fc.order {
+		if other == txid {
+			fc.order = append(fc.order[:i], fc.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Creates coins out of nothing, paying amount satoshis to addr in a new
+// mempool txn. Returns its txid.
+func (fc *FakeChain) Fund(addr string, amount int64) string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.nonce++
+	txn := fakeTxn{
+		Outputs: []TxOut{TxOut{Addr: addr, Amount: amount}},
+		Nonce:   fc.nonce,
+	}
+	txid, _ := fc.accept(&txn)
+	return txid
+}
+
+func (fc *FakeChain) confirmations(rec *fakeTxnRecord) int {
+	if rec.height == 0 {
+		return 0
+	}
+	return fc.height - rec.height + 1
+}
+
+// Returns the raw txn and its txid. Like a segwit txid, it doesn't cover
+// signatures, so signing doesn't change it.
+func encodeFakeTxn(txn *fakeTxn) (string, string) {
+	ser, err := json.Marshal(txn)
+	if err != nil {
+		panic(err)
+	}
+	unsigned := *txn
+	unsigned.Sigs = nil
+	unsignedSer, err := json.Marshal(&unsigned)
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.Sum256(unsignedSer)
+	return hex.EncodeToString(ser), hex.EncodeToString(h[:])
+}
+
+func decodeFakeTxn(txnHex string) (*fakeTxn, error) {
+	ser, err := hex.DecodeString(txnHex)
+	if err != nil {
+		return nil, INVALID_ENCODING
+	}
+	var txn fakeTxn
+	err = json.Unmarshal(ser, &txn)
+	if err != nil {
+		return nil, INVALID_ENCODING
+	}
+	return &txn, nil
+}
+
+// Adds txn to the mempool, spending its inputs. Caller must hold the lock.
+func (fc *FakeChain) accept(txn *fakeTxn) (string, error) {
+	_, txid := encodeFakeTxn(txn)
+	if _, ok := fc.txns[txid]; ok {
+		return "", errors.New("txn already known")
+	}
+	if txn.isLocked(fc.height) {
+		return "", fmt.Errorf("txn locked until %v", txn.LockTime)
+	}
+	in := int64(0)
+	for _, op := range txn.Inputs {
+		if !fc.unspent[op] {
+			return "", fmt.Errorf("input %v missing or spent", op)
+		}
+		if !fc.isSigned(txn, op) {
+			return "", fmt.Errorf("input %v is not fully signed", op)
+		}
+		in += fc.txns[op.Txid].txn.Outputs[op.Vout].Amount
+	}
+	out := int64(0)
+	for _, o := range txn.Outputs {
+		if o.Amount <= 0 {
+			return "", fmt.Errorf("invalid output amount %v", o.Amount)
+		}
+		out += o.Amount
+	}
+	if len(txn.Inputs) > 0 && out > in {
+		return "", fmt.Errorf("outputs %v exceed inputs %v", out, in)
+	}
+	for _, op := range txn.Inputs {
+		delete(fc.unspent, op)
+	}
+	for i := range txn.Outputs {
+		fc.unspent[OutPoint{Txid: txid, Vout: i}] = true
+	}
+	fc.txns[txid] = &fakeTxnRecord{txn: txn}
+	fc.order = append(fc.order, txid)
+	return txid, nil
+}
+
+// The address paid by op, looking in prevTxns for txns not yet on the chain.
+// Caller must hold the lock.
+func (fc *FakeChain) outputAddr(op OutPoint, prevTxns []*fakeTxn) (string, bool) {
+	var txn *fakeTxn
+	if rec, ok := fc.txns[op.Txid]; ok {
+		txn = rec.txn
+	}
+	for _, prev := range prevTxns {
+		if _, txid := encodeFakeTxn(prev); txid == op.Txid {
+			txn = prev
+		}
+	}
+	if txn == nil || op.Vout >= len(txn.Outputs) {
+		return "", false
+	}
+	return txn.Outputs[op.Vout].Addr, true
+}
+
+// Whether input op of txn has enough valid signatures. Caller must hold the
+// lock.
+func (fc *FakeChain) isSigned(txn *fakeTxn, op OutPoint) bool {
+	addr, ok := fc.outputAddr(op, nil)
+	return ok && fc.hasSigs(txn, addr)
+}
+
+// Whether txn has enough valid signatures to spend from addr. Caller must hold
+// the lock.
+func (fc *FakeChain) hasSigs(txn *fakeTxn, addr string) bool {
+	ms, ok := fc.multisig[addr]
+	if !ok {
+		return true
+	}
+	_, txid := encodeFakeTxn(txn)
+	valid := 0
+	for _, pubKey := range ms.pubKeys {
+		sig, ok := txn.Sigs[pubKey]
+		if ok && verifyPubKeySig(pubKey, sig, txid) {
+			valid++
+		}
+	}
+	return valid >= ms.nRequired
+}
+
+// A wallet on a FakeChain. Implements Backend.
+type FakeWallet struct {
+	chain   *FakeChain
+	name    string
+	addrs   []string
+	mine    map[string]bool
+	minePub map[string]bool
+	watched map[string]bool
+}
+
+// Wallets with the same name generate the same addresses.
+func (fc *FakeChain) NewWallet(name string) *FakeWallet {
+	return &FakeWallet{
+		chain:   fc,
+		name:    name,
+		mine:    make(map[string]bool),
+		minePub: make(map[string]bool),
+		watched: make(map[string]bool),
+	}
+}
+
+func (fw *FakeWallet) NewAddress() (string, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	return fw.newAddress(), nil
+}
+
+func (fw *FakeWallet) newAddress() string {
+	secret := sha256.Sum256([]byte(fmt.Sprintf("%v/%v", fw.name, len(fw.addrs))))
+	// Private keys are in [1, n-1]
+	priv := new(big.Int).SetBytes(secret[:])
+	priv.Mod(priv, new(big.Int).Sub(curveN, big.NewInt(1)))
+	priv.Add(priv, big.NewInt(1))
+	pub := Secp256k1PubKey(priv)
+	addr := PubKeyAddress(pub, TESTNET_P2PKH)
+	fw.chain.keys[addr] = priv
+	fw.chain.pubKeys[hex.EncodeToString(pub)] = priv
+	fw.addrs = append(fw.addrs, addr)
+	fw.mine[addr] = true
+	fw.minePub[hex.EncodeToString(pub)] = true
+	return addr
+}
+
+func (fw *FakeWallet) NewPubKey() (string, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	priv := fw.chain.keys[fw.newAddress()]
+	return hex.EncodeToString(Secp256k1PubKey(priv)), nil
+}
+
+func (fw *FakeWallet) AddMultisigAddr(nRequired int, pubKeys []string) (string, error) {
+	if nRequired < 1 || nRequired > len(pubKeys) {
+		return "", fmt.Errorf("can't require %v of %v keys", nRequired, len(pubKeys))
+	}
+	script := []byte{byte(nRequired)}
+	for _, pubKey := range pubKeys {
+		b, err := hex.DecodeString(pubKey)
+		if err != nil || len(b) != 33 {
+			return "", fmt.Errorf("invalid public key %v", pubKey)
+		}
+		script = append(script, b...)
+	}
+	addr := encodeAddress(TESTNET_P2SH, hash160(script))
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	fw.chain.multisig[addr] = &fakeMultisig{nRequired: nRequired, pubKeys: pubKeys}
+	return addr, nil
+}
+
+func (fw *FakeWallet) ListReceived(minConf int) (map[string]int64, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	received := make(map[string]int64)
+	for _, txid := range fw.chain.order {
+		rec := fw.chain.txns[txid]
+		if fw.chain.confirmations(rec) < minConf {
+			continue
+		}
+		for _, out := range rec.txn.Outputs {
+			if fw.mine[out.Addr] || fw.watched[out.Addr] {
+				received[out.Addr] += out.Amount
+			}
+		}
+	}
+	return received, nil
+}
+
+func (fw *FakeWallet) WatchAddress(addr string) error {
+	_, _, err := decodeAddress(addr)
+	if err != nil {
+		return err
+	}
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	fw.watched[addr] = true
+	return nil
+}
+
+func (fw *FakeWallet) ListUnspent(minConf int) ([]Unspent, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	return fw.listUnspent(minConf), nil
+}
+
+func (fw *FakeWallet) listUnspent(minConf int) []Unspent {
+	return fw.chain.unspentWhere(minConf, func(addr string) bool {
+		return fw.mine[addr]
+	})
+}
+
+func (fw *FakeWallet) AddressUnspent(addr string) ([]Unspent, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	return fw.chain.unspentWhere(1, func(a string) bool {
+		return a == addr
+	}), nil
+}
+
+// Caller must hold the lock.
+func (fc *FakeChain) unspentWhere(minConf int, match func(addr string) bool) []Unspent {
+	unspent := make([]Unspent, 0)
+	for _, txid := range fc.order {
+		rec := fc.txns[txid]
+		confs := fc.confirmations(rec)
+		if confs < minConf {
+			continue
+		}
+		for i, out := range rec.txn.Outputs {
+			op := OutPoint{Txid: txid, Vout: i}
+			if !match(out.Addr) || !fc.unspent[op] {
+				continue
+			}
+			unspent = append(unspent, Unspent{
+				OutPoint:      op,
+				Address:       out.Addr,
+				Amount:        out.Amount,
+				Confirmations: confs,
+			})
+		}
+	}
+	return unspent
+}
+
+func (fw *FakeWallet) SignMessage(addr string, message string) (string, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	if !fw.mine[addr] {
+		return "", fmt.Errorf("private key for %v is not known", addr)
+	}
+	return signMessage(fw.chain.keys[addr], true, message), nil
+}
+
+func (fw *FakeWallet) VerifyMessage(addr string, sig string, message string) (bool, error) {
+	return VerifyMessage(addr, sig, message)
+}
+
+// Builds a txn paying amount to addr from the wallet's coins, without
+// broadcasting it. Change goes to a new address.
+func (fw *FakeWallet) CreateTxn(addr string, amount int64) (string, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	var txn fakeTxn
+	total := int64(0)
+	for _, u := range fw.listUnspent(0) {
+		if total >= amount {
+			break
+		}
+		txn.Inputs = append(txn.Inputs, u.OutPoint)
+		total += u.Amount
+	}
+	if total < amount {
+		return "", fmt.Errorf("insufficient funds: have %v, need %v", total, amount)
+	}
+	txn.Outputs = append(txn.Outputs, TxOut{Addr: addr, Amount: amount})
+	if total > amount {
+		change := fw.newAddress()
+		txn.Outputs = append(txn.Outputs,
+			TxOut{Addr: change, Amount: total - amount})
+	}
+	fw.chain.nonce++
+	txn.Nonce = fw.chain.nonce
+	txnHex, _ := encodeFakeTxn(&txn)
+	return txnHex, nil
+}
+
+func (fw *FakeWallet) Send(addr string, amount int64) (string, error) {
+	txnHex, err := fw.CreateTxn(addr, amount)
+	if err != nil {
+		return "", err
+	}
+	txn, err := decodeFakeTxn(txnHex)
+	if err != nil {
+		return "", err
+	}
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	return fw.chain.accept(txn)
+}
+
+func (fw *FakeWallet) DecodeTxn(txnHex string) (*Txn, error) {
+	ft, err := decodeFakeTxn(txnHex)
+	if err != nil {
+		return nil, err
+	}
+	_, txid := encodeFakeTxn(ft)
+	txn := Txn{
+		Txid:      txid,
+		Hex:       txnHex,
+		Inputs:    ft.Inputs,
+		Sequences: ft.sequences(),
+		Outputs:   make(map[string]int64),
+		Outs:      ft.Outputs,
+		LockTime:  ft.LockTime,
+	}
+	for _, out := range ft.Outputs {
+		txn.Outputs[out.Addr] += out.Amount
+	}
+	return &txn, nil
+}
+
+func (fw *FakeWallet) CreateRawTxn(inputs []OutPoint, outputs []TxOut, lockTime int) (string, error) {
+	txn := fakeTxn{Inputs: inputs, Outputs: outputs, LockTime: lockTime}
+	if lockTime != 0 {
+		// As bitcoind does, so the lock time is enforced
+		txn.Sequences = make([]uint32, len(inputs))
+		for i := range inputs {
+			txn.Sequences[i] = MAX_SEQUENCE - 1
+		}
+	}
+	txnHex, _ := encodeFakeTxn(&txn)
+	return txnHex, nil
+}
+
+// Adds the wallet's signatures for multisig inputs.
+func (fw *FakeWallet) SignRawTxn(txnHex string, prevTxns []string) (string, bool, error) {
+	txn, err := decodeFakeTxn(txnHex)
+	if err != nil {
+		return "", false, err
+	}
+	var prevs []*fakeTxn
+	for _, prevHex := range prevTxns {
+		prev, err := decodeFakeTxn(prevHex)
+		if err != nil {
+			return "", false, err
+		}
+		prevs = append(prevs, prev)
+	}
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	_, txid := encodeFakeTxn(txn)
+	complete := true
+	for _, op := range txn.Inputs {
+		addr, ok := fw.chain.outputAddr(op, prevs)
+		if !ok {
+			complete = false
+			continue
+		}
+		ms, ok := fw.chain.multisig[addr]
+		if !ok {
+			complete = complete && fw.mine[addr]
+			continue
+		}
+		for _, pubKey := range ms.pubKeys {
+			if !fw.minePub[pubKey] {
+				continue
+			}
+			if txn.Sigs == nil {
+				txn.Sigs = make(map[string]string)
+			}
+			txn.Sigs[pubKey] = signMessage(fw.chain.pubKeys[pubKey], true, txid)
+		}
+		complete = complete && fw.chain.hasSigs(txn, addr)
+	}
+	signed, _ := encodeFakeTxn(txn)
+	return signed, complete, nil
+}
+
+func (fw *FakeWallet) BlockCount() (int, error) {
+	return fw.chain.Height(), nil
+}
+
+func (fw *FakeWallet) TxnConfirmations(txid string) (int, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	rec, ok := fw.chain.txns[txid]
+	if !ok {
+		return -1, nil
+	}
+	return fw.chain.confirmations(rec), nil
+}
+
+func (fw *FakeWallet) IsUnspent(op OutPoint) (bool, error) {
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	return fw.chain.unspent[op], nil
+}
+
+func (fw *FakeWallet) SendRawTxn(txnHex string) error {
+	txn, err := decodeFakeTxn(txnHex)
+	if err != nil {
+		return err
+	}
+	if len(txn.Inputs) == 0 {
+		return errors.New("txn has no inputs")
+	}
+	fw.chain.mu.Lock()
+	defer fw.chain.mu.Unlock()
+	_, err = fw.chain.accept(txn)
+	return err
+}
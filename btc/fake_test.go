@@ -0,0 +1,192 @@
+package btc
+
+import (
+	"testing"
+)
+
+func TestFakeConfirmations(t *testing.T) {
+	chain := NewFakeChain()
+	w := chain.NewWallet("w")
+	addr, _ := w.NewAddress()
+	chain.Fund(addr, 100)
+
+	received, _ := w.ListReceived(0)
+	if received[addr] != 100 {
+		t.Fatalf("expected 100 unconfirmed, got %v", received[addr])
+	}
+	received, _ = w.ListReceived(1)
+	if received[addr] != 0 {
+		t.Fatalf("expected 0 confirmed, got %v", received[addr])
+	}
+
+	chain.Mine(3)
+	unspent, _ := w.ListUnspent(3)
+	if len(unspent) != 1 || unspent[0].Confirmations != 3 || unspent[0].Amount != 100 {
+		t.Fatalf("unexpected unspent: %v", unspent)
+	}
+	unspent, _ = w.ListUnspent(4)
+	if len(unspent) != 0 {
+		t.Fatalf("unexpected unspent: %v", unspent)
+	}
+}
+
+func TestFakeSend(t *testing.T) {
+	chain := NewFakeChain()
+	alice := chain.NewWallet("alice")
+	bob := chain.NewWallet("bob")
+	aliceAddr, _ := alice.NewAddress()
+	bobAddr, _ := bob.NewAddress()
+	chain.Fund(aliceAddr, 100)
+	chain.Mine(1)
+
+	_, err := alice.Send(bobAddr, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(1)
+	received, _ := bob.ListReceived(1)
+	if received[bobAddr] != 30 {
+		t.Fatalf("expected 30, got %v", received[bobAddr])
+	}
+	// Change comes back to alice
+	total := int64(0)
+	unspent, _ := alice.ListUnspent(1)
+	for _, u := range unspent {
+		total += u.Amount
+	}
+	if total != 70 {
+		t.Fatalf("expected 70 change, got %v", total)
+	}
+
+	if _, err := alice.Send(bobAddr, 71); err == nil {
+		t.Fatalf("expected insufficient funds")
+	}
+}
+
+func TestFakeDoubleSpend(t *testing.T) {
+	chain := NewFakeChain()
+	alice := chain.NewWallet("alice")
+	bobAddr, _ := chain.NewWallet("bob").NewAddress()
+	aliceAddr, _ := alice.NewAddress()
+	chain.Fund(aliceAddr, 100)
+
+	txn1, _ := alice.CreateTxn(bobAddr, 50)
+	txn2, _ := alice.CreateTxn(bobAddr, 60)
+	if err := alice.SendRawTxn(txn1); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendRawTxn(txn2); err == nil {
+		t.Fatalf("expected double spend to be rejected")
+	}
+	decoded, err := alice.DecodeTxn(txn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := alice.IsUnspent(decoded.Inputs[0]); ok {
+		t.Fatalf("expected %v to be spent", decoded.Inputs[0])
+	}
+	if ok, _ := alice.IsUnspent(OutPoint{decoded.Txid, 0}); !ok {
+		t.Fatalf("expected output of %v to be unspent", decoded.Txid)
+	}
+}
+
+func TestFakeSignVerify(t *testing.T) {
+	chain := NewFakeChain()
+	alice := chain.NewWallet("alice")
+	bob := chain.NewWallet("bob")
+	addr, _ := alice.NewAddress()
+	sig, err := alice.SignMessage(addr, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := bob.VerifyMessage(addr, sig, "hello"); !ok || err != nil {
+		t.Fatalf("expected sig to verify, got %v %v", ok, err)
+	}
+	if ok, _ := bob.VerifyMessage(addr, sig, "goodbye"); ok {
+		t.Fatalf("expected sig not to verify for other message")
+	}
+	if _, err := bob.SignMessage(addr, "hello"); err == nil {
+		t.Fatalf("expected bob not to sign for alice's address")
+	}
+
+	// Same name, same addresses
+	addr2, _ := NewFakeChain().NewWallet("alice").NewAddress()
+	if addr != addr2 {
+		t.Fatalf("expected deterministic addresses, got %v %v", addr, addr2)
+	}
+}
+
+func TestFakeReorg(t *testing.T) {
+	chain := NewFakeChain()
+	alice := chain.NewWallet("alice")
+	bob := chain.NewWallet("bob")
+	aliceAddr, _ := alice.NewAddress()
+	bobAddr, _ := bob.NewAddress()
+	funding := chain.Fund(aliceAddr, 1000)
+	chain.Mine(1)
+	txid, err := alice.Send(bobAddr, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(2)
+	if confs, _ := bob.TxnConfirmations(txid); confs != 2 {
+		t.Fatalf("expected 2 confirmations, got %v", confs)
+	}
+
+	// Undone blocks put txns back in the mempool
+	chain.Reorg(2)
+	if confs, _ := bob.TxnConfirmations(txid); confs != 0 {
+		t.Fatalf("expected 0 confirmations, got %v", confs)
+	}
+	if confs, _ := alice.TxnConfirmations(funding); confs != 1 {
+		t.Fatalf("expected funding to keep 1 confirmation, got %v", confs)
+	}
+
+	// Dropped txns vanish, and their inputs can be spent again
+	chain.Reorg(0, txid)
+	if confs, _ := bob.TxnConfirmations(txid); confs != -1 {
+		t.Fatalf("expected txn to vanish, got %v confirmations", confs)
+	}
+	received, _ := bob.ListReceived(0)
+	if received[bobAddr] != 0 {
+		t.Fatalf("expected nothing received, got %v", received[bobAddr])
+	}
+	_, err = alice.Send(bobAddr, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeReorgChain(t *testing.T) {
+	chain := NewFakeChain()
+	alice := chain.NewWallet("alice")
+	bob := chain.NewWallet("bob")
+	carol := chain.NewWallet("carol")
+	aliceAddr, _ := alice.NewAddress()
+	bobAddr, _ := bob.NewAddress()
+	carolAddr, _ := carol.NewAddress()
+	funding := chain.Fund(aliceAddr, 1000)
+	chain.Mine(1)
+	toBob, err := alice.Send(bobAddr, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(1)
+	toCarol, err := bob.Send(carolAddr, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(1)
+
+	// Dropping the funding takes both spends after it
+	chain.Reorg(3, funding)
+	for _, txid := range []string{funding, toBob, toCarol} {
+		if confs, _ := carol.TxnConfirmations(txid); confs != -1 {
+			t.Fatalf("expected %v to vanish, got %v confirmations", txid, confs)
+		}
+	}
+	received, _ := carol.ListReceived(0)
+	if received[carolAddr] != 0 {
+		t.Fatalf("expected nothing received, got %v", received[carolAddr])
+	}
+}
@@ -0,0 +1,166 @@
+package btc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// BIP32 extended public keys, so a server can derive payment addresses
+// without holding any private keys. Only public (non-hardened) derivation is
+// supported.
+
+const (
+	XPUB_LEN         = 78
+	HARDENED_INDEX   = 0x80000000
+	MASTER_HMAC_KEY  = "Bitcoin seed"
+	CHAIN_CODE_LEN   = 32
+	FINGERPRINT_LEN  = 4
+	XPUB_VERSION_LEN = 4
+)
+
+var (
+	MAINNET_XPUB = [XPUB_VERSION_LEN]byte{0x04, 0x88, 0xb2, 0x1e} // "xpub"
+	TESTNET_XPUB = [XPUB_VERSION_LEN]byte{0x04, 0x35, 0x87, 0xcf} // "tpub"
+)
+
+var (
+	INVALID_XPUB  = errors.New("invalid extended public key")
+	INVALID_CHILD = errors.New("invalid child key; skip to the next index")
+)
+
+type ExtPubKey struct {
+	Version     [XPUB_VERSION_LEN]byte
+	Depth       byte
+	Fingerprint [FINGERPRINT_LEN]byte // of the parent
+	ChildNum    uint32
+	ChainCode   []byte
+	pub         *secp256k1.PublicKey
+}
+
+// The master public key for seed, as derived by a wallet holding the seed.
+// For tests, and for operators deriving keys off the serving machine.
+func NewMasterExtPubKey(seed []byte, version [XPUB_VERSION_LEN]byte) (*ExtPubKey, error) {
+	mac := hmac.New(sha512.New, []byte(MASTER_HMAC_KEY))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(curveN) >= 0 {
+		return nil, errors.New("invalid seed")
+	}
+	// k is secret, so its public key is derived in constant time
+	pub, _ := parseCompressedPubKey(Secp256k1PubKey(k))
+	return &ExtPubKey{
+		Version:   version,
+		ChainCode: sum[32:],
+		pub:       pub,
+	}, nil
+}
+
+func ParseExtPubKey(s string) (*ExtPubKey, error) {
+	decoded, ok := base58Decode(s)
+	if !ok || len(decoded) != XPUB_LEN+ADDRESS_CHECKSUM_LEN {
+		return nil, INVALID_XPUB
+	}
+	payload := decoded[:XPUB_LEN]
+	if !bytes.Equal(checksum(payload), decoded[XPUB_LEN:]) {
+		return nil, INVALID_XPUB
+	}
+	var k ExtPubKey
+	copy(k.Version[:], payload[0:4])
+	if k.Version != MAINNET_XPUB && k.Version != TESTNET_XPUB {
+		return nil, fmt.Errorf("unsupported extended key version %x", k.Version)
+	}
+	k.Depth = payload[4]
+	copy(k.Fingerprint[:], payload[5:9])
+	k.ChildNum = binary.BigEndian.Uint32(payload[9:13])
+	k.ChainCode = append([]byte{}, payload[13:45]...)
+	keyBytes := payload[45:78]
+	pub, ok := parseCompressedPubKey(keyBytes)
+	if !ok {
+		return nil, INVALID_XPUB
+	}
+	k.pub = pub
+	return &k, nil
+}
+
+func (k *ExtPubKey) String() string {
+	var buf bytes.Buffer
+	buf.Write(k.Version[:])
+	buf.WriteByte(k.Depth)
+	buf.Write(k.Fingerprint[:])
+	binary.Write(&buf, binary.BigEndian, k.ChildNum)
+	buf.Write(k.ChainCode)
+	buf.Write(k.PubKey())
+	payload := buf.Bytes()
+	return base58Encode(append(payload, checksum(payload)...))
+}
+
+// Compressed public key.
+func (k *ExtPubKey) PubKey() []byte {
+	return serializePubKey(k.pub, true)
+}
+
+// The P2PKH address of the key, for the network of the key's version.
+func (k *ExtPubKey) Address() string {
+	version := MAINNET_P2PKH
+	if k.Version == TESTNET_XPUB {
+		version = TESTNET_P2PKH
+	}
+	return PubKeyAddress(k.PubKey(), version)
+}
+
+// Derives child i. Returns INVALID_CHILD for the rare indexes that have no
+// key, which callers should skip.
+func (k *ExtPubKey) Child(i uint32) (*ExtPubKey, error) {
+	if i >= HARDENED_INDEX {
+		return nil, errors.New("can't derive hardened child from public key")
+	}
+	data := k.PubKey()
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], i)
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	var il secp256k1.ModNScalar
+	if overflow := il.SetByteSlice(sum[:32]); overflow {
+		return nil, INVALID_CHILD
+	}
+	var ilG, parent, point secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&il, &ilG)
+	k.pub.AsJacobian(&parent)
+	secp256k1.AddNonConst(&ilG, &parent, &point)
+	if (point.X.IsZero() && point.Y.IsZero()) || point.Z.IsZero() {
+		return nil, INVALID_CHILD
+	}
+	point.ToAffine()
+	pub := secp256k1.NewPublicKey(&point.X, &point.Y)
+	child := ExtPubKey{
+		Version:   k.Version,
+		Depth:     k.Depth + 1,
+		ChildNum:  i,
+		ChainCode: sum[32:],
+		pub:       pub,
+	}
+	copy(child.Fingerprint[:], hash160(k.PubKey())[:FINGERPRINT_LEN])
+	return &child, nil
+}
+
+// Derives the key at path, eg. []uint32{3, 7} for k/3/7.
+func (k *ExtPubKey) Derive(path []uint32) (*ExtPubKey, error) {
+	key := k
+	for _, i := range path {
+		var err error
+		key, err = key.Child(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,76 @@
+package btc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// From BIP32 test vector 1
+const (
+	TEST_SEED   = "000102030405060708090a0b0c0d0e0f"
+	TEST_MASTER = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+	TEST_M_0H   = "xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw"
+	TEST_M_0H_1 = "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"
+)
+
+func TestMasterExtPubKey(t *testing.T) {
+	seed, _ := hex.DecodeString(TEST_SEED)
+	k, err := NewMasterExtPubKey(seed, MAINNET_XPUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.String() != TEST_MASTER {
+		t.Fatalf("expected %v, got %v", TEST_MASTER, k.String())
+	}
+}
+
+func TestExtPubKeyChild(t *testing.T) {
+	k, err := ParseExtPubKey(TEST_M_0H)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.String() != TEST_M_0H {
+		t.Fatalf("round trip failed: %v", k.String())
+	}
+	child, err := k.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.String() != TEST_M_0H_1 {
+		t.Fatalf("expected %v, got %v", TEST_M_0H_1, child.String())
+	}
+	_, err = k.Child(HARDENED_INDEX)
+	if err == nil {
+		t.Fatalf("expected error deriving hardened child")
+	}
+}
+
+func TestParseExtPubKeyInvalid(t *testing.T) {
+	bad := TEST_MASTER[:len(TEST_MASTER)-1] + "9"
+	_, err := ParseExtPubKey(bad)
+	if err == nil {
+		t.Fatalf("expected checksum error")
+	}
+	_, err = ParseExtPubKey("mpXwg4jMtRhuSpVq4xS3HFHmCmWp9NyGKt")
+	if err == nil {
+		t.Fatalf("expected error for address")
+	}
+}
+
+func TestExtPubKeyAddress(t *testing.T) {
+	seed, _ := hex.DecodeString(TEST_SEED)
+	k, _ := NewMasterExtPubKey(seed, TESTNET_XPUB)
+	a, _ := k.Derive([]uint32{0, 1})
+	b, _ := k.Derive([]uint32{0, 2})
+	if a.Address() == b.Address() || a.Address()[0] != 'm' && a.Address()[0] != 'n' {
+		t.Fatalf("unexpected addresses %v %v", a.Address(), b.Address())
+	}
+	parsed, err := ParseExtPubKey(k.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := parsed.Derive([]uint32{0, 1})
+	if c.Address() != a.Address() {
+		t.Fatalf("derivation is not deterministic")
+	}
+}
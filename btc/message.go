@@ -0,0 +1,236 @@
+package btc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Address version bytes
+const (
+	MAINNET_P2PKH byte = 0x00
+	TESTNET_P2PKH byte = 0x6f
+	MAINNET_P2SH  byte = 0x05
+	TESTNET_P2SH  byte = 0xc4
+)
+
+const (
+	MESSAGE_MAGIC        = "Bitcoin Signed Message:\n"
+	COMPACT_SIG_LEN      = 65
+	COMPACT_HEADER_BASE  = 27
+	COMPACT_COMPRESSED   = 4
+	BASE58_ALPHABET      = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	ADDRESS_CHECKSUM_LEN = 4
+)
+
+// Same messages as bitcoind's verifymessage errors
+var (
+	INVALID_ADDRESS  = errors.New("Invalid address")
+	MALFORMED_BASE64 = errors.New("Malformed base64 encoding")
+)
+
+// Verifies a signature in the format of bitcoind's signmessage, without
+// bitcoind: the public key is recovered from the compact signature, and its
+// hash compared to the P2PKH address. Mainnet and testnet addresses are
+// accepted.
+func VerifyMessage(addr string, sig string, message string) (bool, error) {
+	version, hash, err := decodeAddress(addr)
+	if err != nil {
+		return false, err
+	}
+	if version != MAINNET_P2PKH && version != TESTNET_P2PKH {
+		return false, INVALID_ADDRESS
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false, MALFORMED_BASE64
+	}
+	pub, compressed, ok := recoverCompact(sigBytes, messageHash(message))
+	if !ok {
+		return false, nil
+	}
+	return bytes.Equal(hash160(serializePubKey(pub, compressed)), hash), nil
+}
+
+// The P2PKH address for a serialized public key.
+func PubKeyAddress(pubKey []byte, version byte) string {
+	return encodeAddress(version, hash160(pubKey))
+}
+
+func encodeAddress(version byte, hash []byte) string {
+	payload := append([]byte{version}, hash...)
+	return base58Encode(append(payload, checksum(payload)...))
+}
+
+// Whether sig is a signature of message by the hex encoded public key.
+func verifyPubKeySig(pubKey string, sig string, message string) bool {
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	pub, compressed, ok := recoverCompact(sigBytes, messageHash(message))
+	if !ok {
+		return false
+	}
+	return hex.EncodeToString(serializePubKey(pub, compressed)) == pubKey
+}
+
+func messageHash(message string) []byte {
+	var buf bytes.Buffer
+	writeVarString(&buf, MESSAGE_MAGIC)
+	writeVarString(&buf, message)
+	return doubleSha256(buf.Bytes())
+}
+
+func writeVarString(buf *bytes.Buffer, s string) {
+	n := uint64(len(s))
+	var b [9]byte
+	switch {
+	case n < 0xfd:
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		b[0] = 0xfd
+		binary.LittleEndian.PutUint16(b[1:], uint16(n))
+		buf.Write(b[:3])
+	case n <= 0xffffffff:
+		b[0] = 0xfe
+		binary.LittleEndian.PutUint32(b[1:], uint32(n))
+		buf.Write(b[:5])
+	default:
+		b[0] = 0xff
+		binary.LittleEndian.PutUint64(b[1:], n)
+		buf.Write(b[:9])
+	}
+	buf.WriteString(s)
+}
+
+// Recovers the public key from a compact signature. The header byte gives the
+// recovery ID, and whether the key is compressed.
+func recoverCompact(sig []byte, hash []byte) (*secp256k1.PublicKey, bool, bool) {
+	pub, compressed, err := ecdsa.RecoverCompact(sig, hash)
+	if err != nil {
+		return nil, false, false
+	}
+	return pub, compressed, true
+}
+
+// Signs message with priv, in the format of bitcoind's signmessage. Used by
+// FakeWallet.
+func signMessage(priv *big.Int, compressed bool, message string) string {
+	r, s, recID := sign(priv, messageHash(message))
+	header := COMPACT_HEADER_BASE + recID
+	if compressed {
+		header += COMPACT_COMPRESSED
+	}
+	sig := append([]byte{byte(header)}, padTo32(r.Bytes())...)
+	sig = append(sig, padTo32(s.Bytes())...)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// ECDSA signature of hash by priv, with low s, and the recovery ID of R.
+// Nonces are deterministic, as in RFC 6979.
+func sign(priv *big.Int, hash []byte) (*big.Int, *big.Int, int) {
+	key := secp256k1.PrivKeyFromBytes(padTo32(priv.Bytes()))
+	defer key.Zero()
+	sig := ecdsa.SignCompact(key, hash, false)
+	recID := int(sig[0]-COMPACT_HEADER_BASE) & 3
+	r := new(big.Int).SetBytes(sig[1:33])
+	s := new(big.Int).SetBytes(sig[33:65])
+	return r, s, recID
+}
+
+func doubleSha256(b []byte) []byte {
+	h := sha256.Sum256(b)
+	h = sha256.Sum256(h[:])
+	return h[:]
+}
+
+func hash160(b []byte) []byte {
+	h := sha256.Sum256(b)
+	r := ripemd160.New()
+	r.Write(h[:])
+	return r.Sum(nil)
+}
+
+func checksum(payload []byte) []byte {
+	return doubleSha256(payload)[:ADDRESS_CHECKSUM_LEN]
+}
+
+// Returns the version byte and hash160 of a base58check P2PKH address.
+func decodeAddress(addr string) (byte, []byte, error) {
+	decoded, ok := base58Decode(addr)
+	if !ok || len(decoded) != 1+ripemd160.Size+ADDRESS_CHECKSUM_LEN {
+		return 0, nil, INVALID_ADDRESS
+	}
+	payload := decoded[:len(decoded)-ADDRESS_CHECKSUM_LEN]
+	if !bytes.Equal(checksum(payload), decoded[len(payload):]) {
+		return 0, nil, INVALID_ADDRESS
+	}
+	return payload[0], payload[1:], nil
+}
+
+// The payload with a checksum, in base58.
+func Base58CheckEncode(payload []byte) string {
+	return base58Encode(append(append([]byte{}, payload...), checksum(payload)...))
+}
+
+// The payload of a base58check string. ok is false if the string isn't base58,
+// or the checksum doesn't match.
+func Base58CheckDecode(s string) ([]byte, bool) {
+	decoded, ok := base58Decode(s)
+	if !ok || len(decoded) < ADDRESS_CHECKSUM_LEN {
+		return nil, false
+	}
+	payload := decoded[:len(decoded)-ADDRESS_CHECKSUM_LEN]
+	if !bytes.Equal(checksum(payload), decoded[len(payload):]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, BASE58_ALPHABET[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, BASE58_ALPHABET[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, bool) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range []byte(s) {
+		i := bytes.IndexByte([]byte(BASE58_ALPHABET), c)
+		if i < 0 {
+			return nil, false
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == BASE58_ALPHABET[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
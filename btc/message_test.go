@@ -0,0 +1,129 @@
+package btc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// Signed with private key 0x1111...11
+const (
+	testMessage         = "hello decloud"
+	testCompressedSig   = "IGaZzwWbu16tkztj4bjnU93gB2BjofOrbbc442IBWNGbTkh8+BkDbXBRRo8M4hJLAjzBsq0UreaewNfs0q7Q9gw="
+	testUncompressedSig = "HGaZzwWbu16tkztj4bjnU93gB2BjofOrbbc442IBWNGbTkh8+BkDbXBRRo8M4hJLAjzBsq0UreaewNfs0q7Q9gw="
+)
+
+func TestVerifyMessage(t *testing.T) {
+	tests := []struct {
+		addr string
+		sig  string
+		ok   bool
+	}{
+		{"1Q1pE5vPGEEMqRcVRMbtBK842Y6Pzo6nK9", testCompressedSig, true},
+		{"n4XmX91N5FfccY678vaG1ELNtXh6skVES7", testCompressedSig, true},
+		{"1MsHWS1BnwMc3tLE8G35UXsS58fKipzB7a", testUncompressedSig, true},
+		{"n2PEoV6Abxnrpzoqqq1TJT5kw8G2dMPpBd", testUncompressedSig, true},
+		// Key is compressed, but address is for the uncompressed key
+		{"1MsHWS1BnwMc3tLE8G35UXsS58fKipzB7a", testCompressedSig, false},
+		{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", testCompressedSig, false},
+	}
+	for _, test := range tests {
+		ok, err := VerifyMessage(test.addr, test.sig, testMessage)
+		if err != nil {
+			t.Fatalf("%v: %v", test.addr, err)
+		}
+		if ok != test.ok {
+			t.Errorf("%v %v: expected %v, got %v", test.addr, test.sig, test.ok, ok)
+		}
+	}
+
+	ok, _ := VerifyMessage("1Q1pE5vPGEEMqRcVRMbtBK842Y6Pzo6nK9", testCompressedSig, "other")
+	if ok {
+		t.Errorf("expected sig not to verify for other message")
+	}
+}
+
+func TestVerifyMessageErrors(t *testing.T) {
+	addr := "1Q1pE5vPGEEMqRcVRMbtBK842Y6Pzo6nK9"
+	if _, err := VerifyMessage(addr[:len(addr)-1]+"8", testCompressedSig, testMessage); err != INVALID_ADDRESS {
+		t.Errorf("expected %v for bad checksum, got %v", INVALID_ADDRESS, err)
+	}
+	if _, err := VerifyMessage("1Q1pE5vPGEEMqRcVRMbtBK842Y6Pzo6nK0", testCompressedSig, testMessage); err != INVALID_ADDRESS {
+		t.Errorf("expected %v for bad character, got %v", INVALID_ADDRESS, err)
+	}
+	if _, err := VerifyMessage(addr, "not base64!", testMessage); err != MALFORMED_BASE64 {
+		t.Errorf("expected %v, got %v", MALFORMED_BASE64, err)
+	}
+	// Well formed, but not a signature
+	ok, err := VerifyMessage(addr, "AAAA", testMessage)
+	if ok || err != nil {
+		t.Errorf("expected false, nil; got %v, %v", ok, err)
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	priv := new(big.Int).SetBytes(bytes.Repeat([]byte{0x11}, 32))
+	if sig := signMessage(priv, true, testMessage); sig != testCompressedSig {
+		t.Errorf("expected %v, got %v", testCompressedSig, sig)
+	}
+	if sig := signMessage(priv, false, testMessage); sig != testUncompressedSig {
+		t.Errorf("expected %v, got %v", testUncompressedSig, sig)
+	}
+	pub := Secp256k1PubKey(priv)
+	if hex.EncodeToString(pub) != "034f355bdcb7cc0af728ef3cceb9615d90684bb5b2ca5f859ab0f0b704075871aa" {
+		t.Errorf("unexpected public key %x", pub)
+	}
+}
+
+func TestSecp256k1SignVerify(t *testing.T) {
+	priv := new(big.Int).SetBytes(bytes.Repeat([]byte{0x11}, 32))
+	pub := Secp256k1PubKey(priv)
+	if !ValidSecp256k1PubKey(pub) {
+		t.Fatalf("expected %x to be valid", pub)
+	}
+	hash := messageHash(testMessage)
+	r, s := Secp256k1Sign(priv, hash)
+	if s.Cmp(curveHalfN) > 0 {
+		t.Errorf("expected low s")
+	}
+	if !Secp256k1Verify(pub, hash, r, s) {
+		t.Fatalf("expected signature to verify")
+	}
+	if Secp256k1Verify(pub, messageHash("other"), r, s) {
+		t.Errorf("expected signature of other message to fail")
+	}
+	if Secp256k1Verify(pub, hash, r, new(big.Int).Sub(curveN, s)) {
+		t.Errorf("expected high s to be refused")
+	}
+	other := Secp256k1PubKey(big.NewInt(2))
+	if Secp256k1Verify(other, hash, r, s) {
+		t.Errorf("expected signature by other key to fail")
+	}
+	bad := append([]byte{0x02}, bytes.Repeat([]byte{0xff}, 32)...)
+	if ValidSecp256k1PubKey(bad) || Secp256k1Verify(bad, hash, r, s) {
+		t.Errorf("expected x >= p to be invalid")
+	}
+}
+
+func TestDecodeWIF(t *testing.T) {
+	expected := "0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d"
+	for _, wif := range []string{
+		"5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ",
+		"KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617",
+	} {
+		priv, err := DecodeWIF(wif)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(padTo32(priv.Bytes())) != expected {
+			t.Errorf("unexpected key %x for %v", priv, wif)
+		}
+	}
+	for _, bad := range []string{"", "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTj",
+		Base58CheckEncode(append([]byte{0x80}, make([]byte, 32)...))} {
+		if _, err := DecodeWIF(bad); err != INVALID_WIF {
+			t.Errorf("expected %v for %q, got %v", INVALID_WIF, bad, err)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package btc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/conformal/btcjson"
+	"github.com/ortutay/decloud/util"
+)
+
+// Maximum confirmations passed to listunspent; bitcoind's own default
+const MAX_CONF = 9999999
+
+// A Backend that makes JSON-RPC calls to bitcoind.
+type RpcBackend struct {
+	Conf *util.BitcoindConf
+}
+
+func NewRpcBackend(conf *util.BitcoindConf) *RpcBackend {
+	return &RpcBackend{Conf: conf}
+}
+
+func (rb *RpcBackend) send(cmd btcjson.Cmd, cmdErr error) (interface{}, error) {
+	if cmdErr != nil {
+		return nil, fmt.Errorf("error while making cmd: %v", cmdErr.Error())
+	}
+	if rb.Conf == nil {
+		return nil, fmt.Errorf("no bitcoind conf for %v", cmd.Method())
+	}
+	resp, err := util.SendBtcRpc(cmd, rb.Conf)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("bitcoind %v error: %v", cmd.Method(), resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// Copies a JSON-RPC result into v. btcjson returns typed structs for some
+// methods and generic maps for others; a round trip through JSON handles both.
+// Returns false if the result was null.
+func resultInto(result interface{}, v interface{}) (bool, error) {
+	ser, err := json.Marshal(result)
+	if err != nil {
+		return false, err
+	}
+	if string(ser) == "null" {
+		return false, nil
+	}
+	err = json.Unmarshal(ser, v)
+	if err != nil {
+		return false, fmt.Errorf("unexpected bitcoind result %v: %v",
+			string(ser), err.Error())
+	}
+	return true, nil
+}
+
+func (rb *RpcBackend) NewAddress() (string, error) {
+	result, err := rb.send(btcjson.NewGetNewAddressCmd(""))
+	if err != nil {
+		return "", err
+	}
+	addr, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", result)
+	}
+	return addr, nil
+}
+
+func (rb *RpcBackend) ListReceived(minConf int) (map[string]int64, error) {
+	// Include watch-only addresses, as used with an extended public key
+	result, err := rb.send(btcjson.NewRawCmd("", "listreceivedbyaddress",
+		[]interface{}{minConf, false, true}))
+	if err != nil {
+		return nil, err
+	}
+	var received []struct {
+		Address string  `json:"address"`
+		Amount  float64 `json:"amount"`
+	}
+	_, err = resultInto(result, &received)
+	if err != nil {
+		return nil, err
+	}
+	amounts := make(map[string]int64)
+	for _, r := range received {
+		amounts[r.Address] += util.B2S(r.Amount)
+	}
+	return amounts, nil
+}
+
+func (rb *RpcBackend) WatchAddress(addr string) error {
+	// New addresses have no history, so there's nothing to rescan
+	_, err := rb.send(btcjson.NewRawCmd("", "importaddress",
+		[]interface{}{addr, "", false}))
+	return err
+}
+
+func (rb *RpcBackend) ListUnspent(minConf int) ([]Unspent, error) {
+	result, err := rb.send(btcjson.NewListUnspentCmd("", minConf, MAX_CONF))
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Txid          string  `json:"txid"`
+		Vout          float64 `json:"vout"`
+		Address       string  `json:"address"`
+		Amount        float64 `json:"amount"`
+		Confirmations float64 `json:"confirmations"`
+	}
+	_, err = resultInto(result, &results)
+	if err != nil {
+		return nil, err
+	}
+	unspent := make([]Unspent, len(results))
+	for i, r := range results {
+		unspent[i] = Unspent{
+			OutPoint:      OutPoint{Txid: r.Txid, Vout: int(r.Vout)},
+			Address:       r.Address,
+			Amount:        util.B2S(r.Amount),
+			Confirmations: int(r.Confirmations),
+		}
+	}
+	return unspent, nil
+}
+
+// Uses scantxoutset, which scans the whole UTXO set and can take a while;
+// callers should cache the results.
+func (rb *RpcBackend) AddressUnspent(addr string) ([]Unspent, error) {
+	params := []interface{}{"start", []interface{}{"addr(" + addr + ")"}}
+	result, err := rb.send(btcjson.NewRawCmd("", "scantxoutset", params))
+	if err != nil {
+		return nil, err
+	}
+	var scan struct {
+		Height   float64 `json:"height"`
+		Unspents []struct {
+			Txid   string  `json:"txid"`
+			Vout   float64 `json:"vout"`
+			Amount float64 `json:"amount"`
+			Height float64 `json:"height"`
+		} `json:"unspents"`
+	}
+	_, err = resultInto(result, &scan)
+	if err != nil {
+		return nil, err
+	}
+	unspent := make([]Unspent, len(scan.Unspents))
+	for i, u := range scan.Unspents {
+		unspent[i] = Unspent{
+			OutPoint:      OutPoint{Txid: u.Txid, Vout: int(u.Vout)},
+			Address:       addr,
+			Amount:        util.B2S(u.Amount),
+			Confirmations: int(scan.Height-u.Height) + 1,
+		}
+	}
+	return unspent, nil
+}
+
+func (rb *RpcBackend) SignMessage(addr string, message string) (string, error) {
+	result, err := rb.send(btcjson.NewSignMessageCmd(nil, addr, message))
+	if err != nil {
+		return "", err
+	}
+	sig, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", result)
+	}
+	return sig, nil
+}
+
+func (rb *RpcBackend) VerifyMessage(addr string, sig string, message string) (bool, error) {
+	result, err := rb.send(btcjson.NewVerifyMessageCmd(nil, addr, sig, message))
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := result.(bool)
+	if !isBool {
+		return false, fmt.Errorf("error during bitcoind JSON-RPC: %v", result)
+	}
+	return ok, nil
+}
+
+func (rb *RpcBackend) Send(addr string, amount int64) (string, error) {
+	result, err := rb.send(btcjson.NewSendToAddressCmd("", addr, amount))
+	if err != nil {
+		return "", err
+	}
+	txid, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", result)
+	}
+	return txid, nil
+}
+
+func (rb *RpcBackend) DecodeTxn(txnHex string) (*Txn, error) {
+	result, err := rb.send(btcjson.NewDecodeRawTransactionCmd("", txnHex))
+	if err != nil {
+		// bitcoind answers with an error for undecodable transactions
+		return nil, INVALID_ENCODING
+	}
+	var decoded struct {
+		Txid     string  `json:"txid"`
+		LockTime float64 `json:"locktime"`
+		Vin      []struct {
+			Coinbase string  `json:"coinbase"`
+			Txid     string  `json:"txid"`
+			Vout     float64 `json:"vout"`
+			Sequence float64 `json:"sequence"`
+		} `json:"vin"`
+		Vout []struct {
+			Value        float64 `json:"value"`
+			ScriptPubKey struct {
+				Address   string   `json:"address"`
+				Addresses []string `json:"addresses"`
+			} `json:"scriptPubKey"`
+		} `json:"vout"`
+	}
+	_, err = resultInto(result, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	txn := Txn{
+		Txid:     decoded.Txid,
+		Hex:      txnHex,
+		Outputs:  make(map[string]int64),
+		LockTime: int(decoded.LockTime),
+	}
+	for _, in := range decoded.Vin {
+		if in.Coinbase != "" || in.Txid == "" {
+			// Coinbase inputs cannot be attached as payment
+			return nil, INVALID_INPUT
+		}
+		txn.Inputs = append(txn.Inputs, OutPoint{Txid: in.Txid, Vout: int(in.Vout)})
+		txn.Sequences = append(txn.Sequences, uint32(in.Sequence))
+	}
+	for _, out := range decoded.Vout {
+		addrs := out.ScriptPubKey.Addresses
+		if out.ScriptPubKey.Address != "" {
+			addrs = []string{out.ScriptPubKey.Address}
+		}
+		// Outputs to multiple addresses (bare multisig) don't pay any one of
+		// them, but keep their place in Outs
+		addr := ""
+		if len(addrs) == 1 {
+			addr = addrs[0]
+			txn.Outputs[addr] += util.B2S(out.Value)
+		}
+		txn.Outs = append(txn.Outs, TxOut{Addr: addr, Amount: util.B2S(out.Value)})
+	}
+	return &txn, nil
+}
+
+func (rb *RpcBackend) IsUnspent(op OutPoint) (bool, error) {
+	// Include the mempool, so inputs spent by unconfirmed txns are rejected
+	result, err := rb.send(btcjson.NewGetTxOutCmd("", op.Txid, op.Vout, true))
+	if err != nil {
+		return false, err
+	}
+	var out struct{}
+	return resultInto(result, &out)
+}
+
+func (rb *RpcBackend) SendRawTxn(txnHex string) error {
+	_, err := rb.send(btcjson.NewSendRawTransactionCmd("", txnHex))
+	return err
+}
+
+func (rb *RpcBackend) BlockCount() (int, error) {
+	result, err := rb.send(btcjson.NewGetBlockCountCmd(""))
+	if err != nil {
+		return 0, err
+	}
+	var count float64
+	_, err = resultInto(result, &count)
+	return int(count), err
+}
+
+func (rb *RpcBackend) TxnConfirmations(txid string) (int, error) {
+	result, err := rb.send(btcjson.NewRawCmd("", "gettransaction",
+		[]interface{}{txid}))
+	if err != nil {
+		// TODO(ortutay): distinguish unknown txns from other errors
+		return -1, nil
+	}
+	var txn struct {
+		Confirmations int `json:"confirmations"`
+	}
+	_, err = resultInto(result, &txn)
+	if err != nil {
+		return 0, err
+	}
+	// Conflicted txns have negative confirmations
+	if txn.Confirmations < 0 {
+		return -1, nil
+	}
+	return txn.Confirmations, nil
+}
+
+func (rb *RpcBackend) CreateTxn(addr string, amount int64) (string, error) {
+	txnHex, err := rb.CreateRawTxn([]OutPoint{}, []TxOut{TxOut{addr, amount}}, 0)
+	if err != nil {
+		return "", err
+	}
+	result, err := rb.send(btcjson.NewRawCmd("", "fundrawtransaction",
+		[]interface{}{txnHex}))
+	if err != nil {
+		return "", err
+	}
+	var funded struct {
+		Hex string `json:"hex"`
+	}
+	_, err = resultInto(result, &funded)
+	if err != nil {
+		return "", err
+	}
+	signed, complete, err := rb.SignRawTxn(funded.Hex, nil)
+	if err != nil {
+		return "", err
+	}
+	if !complete {
+		return "", fmt.Errorf("could not sign txn paying %v", addr)
+	}
+	return signed, nil
+}
+
+func (rb *RpcBackend) NewPubKey() (string, error) {
+	addr, err := rb.NewAddress()
+	if err != nil {
+		return "", err
+	}
+	result, err := rb.send(btcjson.NewRawCmd("", "getaddressinfo",
+		[]interface{}{addr}))
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		PubKey string `json:"pubkey"`
+	}
+	_, err = resultInto(result, &info)
+	if err != nil {
+		return "", err
+	}
+	if info.PubKey == "" {
+		return "", fmt.Errorf("no public key for %v", addr)
+	}
+	return info.PubKey, nil
+}
+
+// Uses addmultisigaddress rather than createmultisig, so that the wallet can
+// sign for the address.
+func (rb *RpcBackend) AddMultisigAddr(nRequired int, pubKeys []string) (string, error) {
+	keys := make([]interface{}, len(pubKeys))
+	for i, k := range pubKeys {
+		keys[i] = k
+	}
+	result, err := rb.send(btcjson.NewRawCmd("", "addmultisigaddress",
+		[]interface{}{nRequired, keys}))
+	if err != nil {
+		return "", err
+	}
+	// Older bitcoind returns the address; newer returns an object
+	if addr, ok := result.(string); ok {
+		return addr, nil
+	}
+	var multisig struct {
+		Address string `json:"address"`
+	}
+	_, err = resultInto(result, &multisig)
+	if err != nil {
+		return "", err
+	}
+	return multisig.Address, nil
+}
+
+func (rb *RpcBackend) CreateRawTxn(inputs []OutPoint, outputs []TxOut, lockTime int) (string, error) {
+	ins := make([]interface{}, len(inputs))
+	for i, op := range inputs {
+		ins[i] = map[string]interface{}{"txid": op.Txid, "vout": op.Vout}
+	}
+	// A list of outputs, rather than an object, keeps their order
+	outs := make([]interface{}, len(outputs))
+	for i, out := range outputs {
+		outs[i] = map[string]interface{}{out.Addr: util.S2B(out.Amount)}
+	}
+	result, err := rb.send(btcjson.NewRawCmd("", "createrawtransaction",
+		[]interface{}{ins, outs, lockTime}))
+	if err != nil {
+		return "", err
+	}
+	txnHex, ok := result.(string)
+	if !ok {
+		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", result)
+	}
+	return txnHex, nil
+}
+
+func (rb *RpcBackend) SignRawTxn(txnHex string, prevTxns []string) (string, bool, error) {
+	prevOuts, err := rb.prevOuts(prevTxns)
+	if err != nil {
+		return "", false, err
+	}
+	result, err := rb.send(btcjson.NewRawCmd("", "signrawtransactionwithwallet",
+		[]interface{}{txnHex, prevOuts}))
+	if err != nil {
+		return "", false, err
+	}
+	var signed struct {
+		Hex      string `json:"hex"`
+		Complete bool   `json:"complete"`
+	}
+	_, err = resultInto(result, &signed)
+	if err != nil {
+		return "", false, err
+	}
+	return signed.Hex, signed.Complete, nil
+}
+
+// Outputs of raw txns, in the form signrawtransactionwithwallet takes them.
+func (rb *RpcBackend) prevOuts(prevTxns []string) ([]interface{}, error) {
+	prevOuts := make([]interface{}, 0)
+	for _, prevHex := range prevTxns {
+		result, err := rb.send(btcjson.NewDecodeRawTransactionCmd("", prevHex))
+		if err != nil {
+			return nil, INVALID_ENCODING
+		}
+		var decoded struct {
+			Txid string `json:"txid"`
+			Vout []struct {
+				Value        float64 `json:"value"`
+				N            float64 `json:"n"`
+				ScriptPubKey struct {
+					Hex string `json:"hex"`
+				} `json:"scriptPubKey"`
+			} `json:"vout"`
+		}
+		_, err = resultInto(result, &decoded)
+		if err != nil {
+			return nil, err
+		}
+		for _, out := range decoded.Vout {
+			prevOuts = append(prevOuts, map[string]interface{}{
+				"txid":         decoded.Txid,
+				"vout":         out.N,
+				"scriptPubKey": out.ScriptPubKey.Hex,
+				"amount":       out.Value,
+			})
+		}
+	}
+	return prevOuts, nil
+}
@@ -0,0 +1,210 @@
+package btc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/testutil"
+)
+
+const serverAddr = "1ServerAddrXXXXXXXXXXXXXXXXXXXXXX"
+
+// A bitcoind that knows a fixed set of raw txns and unspent outputs
+type mockChain struct {
+	txns      map[string]map[string]interface{} // hex -> decoded
+	unspent   map[string]bool                   // "txid:vout"
+	broadcast []string
+	reject    bool
+}
+
+func newMockChain() *mockChain {
+	return &mockChain{
+		txns:    make(map[string]map[string]interface{}),
+		unspent: map[string]bool{"in1:0": true, "in2:1": true},
+	}
+}
+
+// Adds a txn spending the given outpoint, paying btc to addr. Returns it
+// base64 encoded.
+func (mc *mockChain) addTxn(txid string, in OutPoint, addr string, btc float64) string {
+	raw := []byte("raw-" + txid)
+	mc.txns[hex.EncodeToString(raw)] = map[string]interface{}{
+		"txid": txid,
+		"vin": []interface{}{
+			map[string]interface{}{"txid": in.Txid, "vout": float64(in.Vout)},
+		},
+		"vout": []interface{}{
+			map[string]interface{}{
+				"value": btc,
+				"n":     float64(0),
+				"scriptPubKey": map[string]interface{}{
+					"addresses": []interface{}{addr},
+				},
+			},
+		},
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func (mc *mockChain) handle(method string, params []interface{}) (interface{}, error) {
+	switch method {
+	case "decoderawtransaction":
+		decoded, ok := mc.txns[params[0].(string)]
+		if !ok {
+			return nil, errors.New("TX decode failed")
+		}
+		return decoded, nil
+	case "gettxout":
+		op := fmt.Sprintf("%v:%v", params[0], params[1])
+		if !mc.unspent[op] {
+			return nil, nil
+		}
+		return map[string]interface{}{"value": 1.0}, nil
+	case "sendrawtransaction":
+		if mc.reject {
+			return nil, errors.New("txn-mempool-conflict")
+		}
+		mc.broadcast = append(mc.broadcast, params[0].(string))
+		return "txid", nil
+	}
+	return nil, fmt.Errorf("unexpected method %v", method)
+}
+
+func TestRpcCheckAndSubmitTxn(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	mc := newMockChain()
+	server, btcConf := testutil.NewMockBitcoind(mc.handle)
+	b := NewRpcBackend(btcConf)
+	defer server.Close()
+
+	pv := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+	payTo := []string{serverAddr}
+	b64 := mc.addTxn("t1", OutPoint{"in1", 0}, serverAddr, .01)
+	txn, err := CheckTxn(b64, &pv, payTo, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Txid != "t1" || txn.AmountTo(payTo) != 1e6 {
+		t.Fatalf("unexpected txn: %+v", txn)
+	}
+	err = SubmitTxn(txn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.broadcast) != 1 || mc.broadcast[0] != txn.Hex {
+		t.Fatalf("expected %v broadcast, got %v", txn.Hex, mc.broadcast)
+	}
+
+	// The same input can't pay twice, even before bitcoind sees it as spent
+	again := mc.addTxn("t2", OutPoint{"in1", 0}, serverAddr, .01)
+	_, err = CheckTxn(again, &pv, payTo, b)
+	if err != DOUBLE_SPEND {
+		t.Fatalf("expected %v, got %v", DOUBLE_SPEND, err)
+	}
+	_, err = CheckTxn(b64, &pv, payTo, b)
+	if err != DOUBLE_SPEND {
+		t.Fatalf("expected %v on replay, got %v", DOUBLE_SPEND, err)
+	}
+}
+
+func TestRpcCheckTxnRejects(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	mc := newMockChain()
+	server, btcConf := testutil.NewMockBitcoind(mc.handle)
+	b := NewRpcBackend(btcConf)
+	defer server.Close()
+
+	pv := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+	payTo := []string{serverAddr}
+	tests := []struct {
+		b64 string
+		err error
+	}{
+		{"not base64!", INVALID_ENCODING},
+		{base64.StdEncoding.EncodeToString([]byte("garbage")), INVALID_ENCODING},
+		{mc.addTxn("t1", OutPoint{"in2", 1}, serverAddr, .009), UNDERPAID},
+		{mc.addTxn("t2", OutPoint{"in2", 1}, "1SomeoneElse", .01), UNDERPAID},
+		{mc.addTxn("t3", OutPoint{"spent", 0}, serverAddr, .01), INVALID_INPUT},
+	}
+	for _, test := range tests {
+		_, err := CheckTxn(test.b64, &pv, payTo, b)
+		if err != test.err {
+			t.Errorf("%v: expected %v, got %v", test.b64, test.err, err)
+		}
+	}
+}
+
+func TestRpcSubmitTxnRejected(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	mc := newMockChain()
+	mc.reject = true
+	server, btcConf := testutil.NewMockBitcoind(mc.handle)
+	b := NewRpcBackend(btcConf)
+	defer server.Close()
+
+	pv := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+	b64 := mc.addTxn("t1", OutPoint{"in1", 0}, serverAddr, .01)
+	txn, err := CheckTxn(b64, &pv, []string{serverAddr}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SubmitTxn(txn, b); err != REJECTED {
+		t.Fatalf("expected %v, got %v", REJECTED, err)
+	}
+	// A rejected txn did not spend its inputs
+	if spentBy(OutPoint{"in1", 0}) != "" {
+		t.Fatalf("expected in1:0 to be unspent")
+	}
+}
+
+func TestRpcListUnspent(t *testing.T) {
+	server, btcConf := testutil.NewMockBitcoind(
+		func(method string, params []interface{}) (interface{}, error) {
+			if method != "listunspent" {
+				return nil, fmt.Errorf("unexpected method %v", method)
+			}
+			if params[0].(float64) != 1 {
+				return nil, fmt.Errorf("expected minconf 1, got %v", params[0])
+			}
+			return []interface{}{
+				map[string]interface{}{
+					"txid":          "t1",
+					"vout":          2.0,
+					"address":       "1Addr",
+					"amount":        0.5,
+					"confirmations": 3.0,
+				},
+			}, nil
+		})
+	defer server.Close()
+	unspent, err := NewRpcBackend(btcConf).ListUnspent(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Unspent{
+		OutPoint:      OutPoint{"t1", 2},
+		Address:       "1Addr",
+		Amount:        5e7,
+		Confirmations: 3,
+	}
+	if len(unspent) != 1 || unspent[0] != expected {
+		t.Fatalf("expected %v, got %v", expected, unspent)
+	}
+}
+
+func TestRpcError(t *testing.T) {
+	server, btcConf := testutil.NewMockBitcoind(
+		func(method string, params []interface{}) (interface{}, error) {
+			return nil, errors.New("Invalid address")
+		})
+	defer server.Close()
+	_, err := NewRpcBackend(btcConf).VerifyMessage("1Addr", "sig", "msg")
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
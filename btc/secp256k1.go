@@ -0,0 +1,102 @@
+package btc
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// The curve order, and half of it, above which s is high.
+var (
+	curveN     = secp256k1.Params().N
+	curveHalfN = new(big.Int).Rsh(curveN, 1)
+)
+
+func serializePubKey(pub *secp256k1.PublicKey, compressed bool) []byte {
+	if compressed {
+		return pub.SerializeCompressed()
+	}
+	return pub.SerializeUncompressed()
+}
+
+func padTo32(b []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
+
+// ECDSA over secp256k1, for IDs that share a key with a bitcoin wallet.
+
+const (
+	WIF_MAINNET byte = 0x80
+	WIF_TESTNET byte = 0xef
+)
+
+var INVALID_WIF = errors.New("invalid private key")
+
+func ValidSecp256k1PrivKey(priv *big.Int) bool {
+	return priv.Sign() > 0 && priv.Cmp(curveN) < 0
+}
+
+// Compressed public key of priv.
+func Secp256k1PubKey(priv *big.Int) []byte {
+	key := secp256k1.PrivKeyFromBytes(padTo32(priv.Bytes()))
+	defer key.Zero()
+	return key.PubKey().SerializeCompressed()
+}
+
+// Signature of hash by priv, with low s.
+func Secp256k1Sign(priv *big.Int, hash []byte) (*big.Int, *big.Int) {
+	r, s, _ := sign(priv, hash)
+	return r, s
+}
+
+func parseCompressedPubKey(pubKey []byte) (*secp256k1.PublicKey, bool) {
+	if len(pubKey) != secp256k1.PubKeyBytesLenCompressed {
+		return nil, false
+	}
+	pub, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, false
+	}
+	return pub, true
+}
+
+// Whether pubKey is a compressed public key on the curve.
+func ValidSecp256k1PubKey(pubKey []byte) bool {
+	_, ok := parseCompressedPubKey(pubKey)
+	return ok
+}
+
+// Whether r, s is a signature of hash by the compressed public key pubKey. High
+// s is refused, so a signature can't be altered into another valid one.
+func Secp256k1Verify(pubKey []byte, hash []byte, r *big.Int, s *big.Int) bool {
+	pub, ok := parseCompressedPubKey(pubKey)
+	if !ok {
+		return false
+	}
+	if r.Sign() <= 0 || r.Cmp(curveN) >= 0 || s.Sign() <= 0 || s.Cmp(curveHalfN) > 0 {
+		return false
+	}
+	var rs, ss secp256k1.ModNScalar
+	rs.SetByteSlice(r.Bytes())
+	ss.SetByteSlice(s.Bytes())
+	return ecdsa.NewSignature(&rs, &ss).Verify(hash, pub)
+}
+
+// The private key in a wallet import format string, as from bitcoind's
+// dumpprivkey.
+func DecodeWIF(wif string) (*big.Int, error) {
+	payload, ok := Base58CheckDecode(wif)
+	if !ok || (len(payload) != 33 && !(len(payload) == 34 && payload[33] == 0x01)) ||
+		(payload[0] != WIF_MAINNET && payload[0] != WIF_TESTNET) {
+		return nil, INVALID_WIF
+	}
+	priv := new(big.Int).SetBytes(payload[1:33])
+	if !ValidSecp256k1PrivKey(priv) {
+		return nil, INVALID_WIF
+	}
+	return priv, nil
+}
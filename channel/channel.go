@@ -0,0 +1,412 @@
+package channel
+
+// Micropayment channels. The client funds a 2-of-2 multisig address shared
+// with the server. Before the funding txn is broadcast, the server signs a
+// refund txn returning the funds to the client, locked until the channel
+// expires. Each request then carries an update: a txn spending the funding
+// output that pays the server a little more than the last one, signed by the
+// client. The server signs and broadcasts the latest update to close the
+// channel, which it must do before the refund unlocks.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// In blocks; about a week
+const DEFAULT_DURATION = 1008
+
+// Updates are refused, and channels closed, this many blocks before expiry
+const CLOSE_MARGIN = 6
+
+// In satoshis; taken from the client's share of the refund and updates
+const CLOSE_FEE = 1e4
+
+type State string
+
+const (
+	OPENING State = "opening" // waiting for the refund to be signed
+	OPEN          = "open"
+	CLOSED        = "closed"
+)
+
+type ChannelError string
+
+const (
+	UNKNOWN_CHANNEL ChannelError = "unknown-channel"
+	WRONG_OWNER     ChannelError = "wrong-owner"
+	NOT_OPEN        ChannelError = "channel-not-open"
+	EXPIRING        ChannelError = "channel-expiring"
+	INVALID_FUNDING ChannelError = "invalid-funding"
+	INVALID_REFUND  ChannelError = "invalid-refund"
+	INVALID_UPDATE  ChannelError = "invalid-update"
+	UNDERPAID       ChannelError = "underpaid"
+)
+
+func (ce ChannelError) Error() string {
+	return string(ce)
+}
+
+// Server side state of a channel.
+type Channel struct {
+	ID           string   `json:"id"` // the multisig address
+	OcID         msg.OcID `json:"ocID"`
+	ClientPubKey string   `json:"clientPubKey"`
+	ServerPubKey string   `json:"serverPubKey"`
+	ServerAddr   string   `json:"serverAddr"` // where updates pay the server
+	Expiry       int      `json:"expiry"`     // block height the refund unlocks
+	State        State    `json:"state"`
+
+	Funding  btc.OutPoint `json:"funding"`
+	Capacity int64        `json:"capacity"`
+
+	// Latest update, signed by both parties
+	Paid      int64  `json:"paid"`
+	LatestTxn string `json:"latestTxn"`
+	CloseTxid string `json:"closeTxid"`
+}
+
+// What the server sends a client opening a channel.
+type Offer struct {
+	ID           string `json:"id"`
+	ServerPubKey string `json:"serverPubKey"`
+	ServerAddr   string `json:"serverAddr"`
+	Expiry       int    `json:"expiry"`
+}
+
+// Attached to requests with the CHANNEL payment type.
+type Update struct {
+	ChannelID string `json:"channelID"`
+	Txn       string `json:"txn"` // hex, signed by the client
+}
+
+func (u *Update) Encode() string {
+	ser, err := json.Marshal(u)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(ser)
+}
+
+func DecodeUpdate(paymentTxn string) (*Update, error) {
+	ser, err := base64.StdEncoding.DecodeString(paymentTxn)
+	if err != nil {
+		return nil, INVALID_UPDATE
+	}
+	var u Update
+	err = json.Unmarshal(ser, &u)
+	if err != nil || u.ChannelID == "" || u.Txn == "" {
+		return nil, INVALID_UPDATE
+	}
+	return &u, nil
+}
+
+// Each channel is locked from reading it through writing it back, so
+// concurrent requests can't both build on the same state
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*sync.Mutex)
+)
+
+// Locks the channel id; returns the unlock function.
+func lock(id string) func() {
+	locksMu.Lock()
+	l, ok := locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		locks[id] = l
+	}
+	locksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func dbPath() string {
+	return util.AppDir() + "/channels.db"
+}
+
+func Get(id string) (*Channel, error) {
+	d := util.GetOrCreateDB(dbPath())
+	ser, err := d.Read(id)
+	if err != nil || len(ser) == 0 {
+		return nil, UNKNOWN_CHANNEL
+	}
+	var ch Channel
+	err = json.Unmarshal(ser, &ch)
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+func Put(ch *Channel) error {
+	ser, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	d := util.GetOrCreateDB(dbPath())
+	return d.Write(ch.ID, ser)
+}
+
+// Calls fn on each channel in the ledger.
+func ForEach(fn func(ch *Channel)) error {
+	d := util.GetOrCreateDB(dbPath())
+	for id := range d.Keys() {
+		ch, err := Get(id)
+		if err != nil {
+			return err
+		}
+		fn(ch)
+	}
+	return nil
+}
+
+// Total paid to the server in channels that are not yet closed. Once closed,
+// the payment is seen on chain instead.
+func PaidInOpenChannels(ocID msg.OcID) (int64, error) {
+	paid := int64(0)
+	err := ForEach(func(ch *Channel) {
+		if ch.OcID == ocID && ch.State == OPEN {
+			paid += ch.Paid
+		}
+	})
+	return paid, err
+}
+
+// Starts a channel with the client's public key. Payments in the channel go
+// to serverAddr.
+func Open(b btc.Backend, ocID msg.OcID, clientPubKey string, serverAddr string) (*Offer, error) {
+	height, err := b.BlockCount()
+	if err != nil {
+		return nil, err
+	}
+	serverPubKey, err := b.NewPubKey()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := b.AddMultisigAddr(2, []string{clientPubKey, serverPubKey})
+	if err != nil {
+		return nil, err
+	}
+	ch := Channel{
+		ID:           addr,
+		OcID:         ocID,
+		ClientPubKey: clientPubKey,
+		ServerPubKey: serverPubKey,
+		ServerAddr:   serverAddr,
+		Expiry:       height + DEFAULT_DURATION,
+		State:        OPENING,
+	}
+	err = Put(&ch)
+	if err != nil {
+		return nil, err
+	}
+	offer := Offer{
+		ID:           ch.ID,
+		ServerPubKey: ch.ServerPubKey,
+		ServerAddr:   ch.ServerAddr,
+		Expiry:       ch.Expiry,
+	}
+	return &offer, nil
+}
+
+func getOwned(id string, ocID msg.OcID) (*Channel, error) {
+	ch, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if ch.OcID != ocID {
+		return nil, WRONG_OWNER
+	}
+	return ch, nil
+}
+
+// Checks that the funding txn pays the channel, and that the refund spends it
+// no earlier than the expiry height, then signs the refund. The client broadcasts the
+// funding txn once it has the signed refund.
+func SignRefund(b btc.Backend, ocID msg.OcID, id string, fundingHex string, refundHex string) (string, error) {
+	defer lock(id)()
+	ch, err := getOwned(id, ocID)
+	if err != nil {
+		return "", err
+	}
+	if ch.State != OPENING {
+		return "", NOT_OPEN
+	}
+	funding, err := b.DecodeTxn(fundingHex)
+	if err != nil {
+		return "", INVALID_FUNDING
+	}
+	vout := -1
+	for i, out := range funding.Outs {
+		if out.Addr == ch.ID {
+			vout = i
+			break
+		}
+	}
+	if vout == -1 || funding.Outs[vout].Amount <= 0 {
+		return "", INVALID_FUNDING
+	}
+	fundingOp := btc.OutPoint{Txid: funding.Txid, Vout: vout}
+
+	refund, err := b.DecodeTxn(refundHex)
+	if err != nil {
+		return "", INVALID_REFUND
+	}
+	// The lock time must be a height, and enforced, or the refund could be
+	// broadcast right away
+	if len(refund.Inputs) != 1 || refund.Inputs[0] != fundingOp ||
+		!refund.LockedUntil(ch.Expiry) {
+		return "", INVALID_REFUND
+	}
+	signed, complete, err := b.SignRawTxn(refundHex, []string{fundingHex})
+	if err != nil {
+		return "", err
+	}
+	if !complete {
+		return "", INVALID_REFUND
+	}
+
+	ch.Funding = fundingOp
+	ch.Capacity = funding.Outs[vout].Amount
+	ch.State = OPEN
+	err = Put(ch)
+	if err != nil {
+		return "", err
+	}
+	return signed, nil
+}
+
+// Accepts an update paying at least amount more than the last one, and
+// strictly more, so no update is accepted twice. Returns the channel with the
+// update applied.
+func Accept(b btc.Backend, ocID msg.OcID, u *Update, amount int64) (*Channel, error) {
+	defer lock(u.ChannelID)()
+	ch, err := getOwned(u.ChannelID, ocID)
+	if err != nil {
+		return nil, err
+	}
+	if ch.State != OPEN {
+		return nil, NOT_OPEN
+	}
+	height, err := b.BlockCount()
+	if err != nil {
+		return nil, err
+	}
+	if height >= ch.Expiry-CLOSE_MARGIN {
+		return nil, EXPIRING
+	}
+	// The funding txn must be on the chain, and not spent by the refund
+	ok, err := b.IsUnspent(ch.Funding)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, INVALID_FUNDING
+	}
+
+	txn, err := b.DecodeTxn(u.Txn)
+	if err != nil {
+		return nil, INVALID_UPDATE
+	}
+	if len(txn.Inputs) != 1 || txn.Inputs[0] != ch.Funding || txn.LockTime != 0 {
+		return nil, INVALID_UPDATE
+	}
+	total := int64(0)
+	for _, out := range txn.Outs {
+		total += out.Amount
+	}
+	if total > ch.Capacity {
+		return nil, INVALID_UPDATE
+	}
+	paid := txn.Outputs[ch.ServerAddr]
+	if paid <= ch.Paid || paid-ch.Paid < amount {
+		return nil, UNDERPAID
+	}
+	// Our signature completes the txn only if the client's is valid
+	signed, complete, err := b.SignRawTxn(u.Txn, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return nil, INVALID_UPDATE
+	}
+	ch.Paid = paid
+	ch.LatestTxn = signed
+	err = Put(ch)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Broadcasts the latest update.
+func Close(b btc.Backend, id string) (string, error) {
+	defer lock(id)()
+	ch, err := Get(id)
+	if err != nil {
+		return "", err
+	}
+	if ch.State != OPEN {
+		return "", NOT_OPEN
+	}
+	if ch.LatestTxn == "" {
+		// Nothing was paid; the client takes the refund once it unlocks
+		ch.State = CLOSED
+		return "", Put(ch)
+	}
+	err = b.SendRawTxn(ch.LatestTxn)
+	if err != nil {
+		return "", fmt.Errorf("broadcast of channel %v close failed: %v", id, err)
+	}
+	txn, err := b.DecodeTxn(ch.LatestTxn)
+	if err != nil {
+		return "", err
+	}
+	ch.State = CLOSED
+	ch.CloseTxid = txn.Txid
+	return ch.CloseTxid, Put(ch)
+}
+
+// Closes open channels that are about to expire.
+func CloseExpiring(b btc.Backend) error {
+	height, err := b.BlockCount()
+	if err != nil {
+		return err
+	}
+	var expiring []string
+	err = ForEach(func(ch *Channel) {
+		if ch.State == OPEN && height >= ch.Expiry-CLOSE_MARGIN {
+			expiring = append(expiring, ch.ID)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expiring {
+		_, err := Close(b, id)
+		if err != nil {
+			log.Printf("error closing expiring channel %v: %v\n", id, err)
+		}
+	}
+	return nil
+}
+
+func StatusForError(err error) msg.OcRespStatus {
+	switch err {
+	case UNDERPAID:
+		return msg.TOO_LOW
+	case UNKNOWN_CHANNEL, WRONG_OWNER, NOT_OPEN, EXPIRING, INVALID_FUNDING,
+		INVALID_REFUND, INVALID_UPDATE:
+		return msg.INVALID_CHANNEL
+	default:
+		return msg.SERVER_ERROR
+	}
+}
@@ -0,0 +1,338 @@
+package channel
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/testutil"
+)
+
+const TEST_ID msg.OcID = "test-id"
+
+type testChannel struct {
+	chain      *btc.FakeChain
+	server     *btc.FakeWallet
+	client     *btc.FakeWallet
+	serverAddr string
+	cc         *ClientChannel
+	refund     string // signed by both
+}
+
+// Opens a funded channel between a server and client on a fake chain.
+func newTestChannel(t *testing.T, capacity int64) *testChannel {
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	addr, _ := client.NewAddress()
+	chain.Fund(addr, 1e8)
+	chain.Mine(1)
+
+	serverAddr, _ := server.NewAddress()
+	clientPubKey, _ := client.NewPubKey()
+	offer, err := Open(server, TEST_ID, clientPubKey, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, refundHex, err := NewClientChannel(client, offer, clientPubKey, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := SignRefund(server, TEST_ID, offer.ID, cc.FundingTxn, refundHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendRawTxn(cc.FundingTxn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.Mine(1)
+	return &testChannel{chain, server, client, serverAddr, cc, refund}
+}
+
+func (tc *testChannel) pay(t *testing.T, amount int64) {
+	u, err := tc.cc.Pay(tc.client, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Accept(tc.server, TEST_ID, u, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.cc.Accepted(amount)
+}
+
+func TestPayAndClose(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	tc.pay(t, 1e5)
+	tc.pay(t, 2e5)
+
+	paid, err := PaidInOpenChannels(TEST_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid != 3e5 {
+		t.Fatalf("expected 3e5 paid, got %v", paid)
+	}
+	received, _ := tc.server.ListReceived(0)
+	if received[tc.serverAddr] != 0 {
+		t.Fatalf("nothing should be on chain before close, got %v", received)
+	}
+
+	txid, err := Close(tc.server, tc.cc.Offer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txid == "" {
+		t.Fatalf("expected close txid")
+	}
+	tc.chain.Mine(1)
+	received, _ = tc.server.ListReceived(1)
+	if received[tc.serverAddr] != 3e5 {
+		t.Fatalf("expected 3e5 received on close, got %v", received)
+	}
+	paid, _ = PaidInOpenChannels(TEST_ID)
+	if paid != 0 {
+		t.Fatalf("expected nothing in open channels, got %v", paid)
+	}
+	ch, _ := Get(tc.cc.Offer.ID)
+	if ch.State != CLOSED || ch.CloseTxid != txid {
+		t.Fatalf("unexpected channel after close: %+v", ch)
+	}
+	// The refund can't be used once the funds are spent
+	tc.chain.Mine(DEFAULT_DURATION)
+	err = tc.client.SendRawTxn(tc.refund)
+	if err == nil {
+		t.Fatalf("expected refund to fail after close")
+	}
+}
+
+func TestAcceptRejects(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	tc.pay(t, 1e5)
+	old, _ := tc.cc.Pay(tc.client, 0)
+
+	u, _ := tc.cc.Pay(tc.client, 1e5)
+	_, err := Accept(tc.server, TEST_ID, u, 2e5)
+	if err != UNDERPAID {
+		t.Fatalf("expected %v, got %v", UNDERPAID, err)
+	}
+	_, err = Accept(tc.server, "other-id", u, 1e5)
+	if err != WRONG_OWNER {
+		t.Fatalf("expected %v, got %v", WRONG_OWNER, err)
+	}
+	// Replaying an earlier state pays nothing more
+	_, err = Accept(tc.server, TEST_ID, old, 1)
+	if err != UNDERPAID {
+		t.Fatalf("expected %v, got %v", UNDERPAID, err)
+	}
+
+	// Updates must carry the client's signature
+	unsigned, _ := tc.client.CreateRawTxn([]btc.OutPoint{tc.cc.Funding},
+		[]btc.TxOut{btc.TxOut{Addr: tc.serverAddr, Amount: 5e5}}, 0)
+	_, err = Accept(tc.server, TEST_ID,
+		&Update{ChannelID: tc.cc.Offer.ID, Txn: unsigned}, 1e5)
+	if err != INVALID_UPDATE {
+		t.Fatalf("expected %v, got %v", INVALID_UPDATE, err)
+	}
+	_, err = Accept(tc.server, TEST_ID,
+		&Update{ChannelID: "no-such-channel", Txn: u.Txn}, 1e5)
+	if err != UNKNOWN_CHANNEL {
+		t.Fatalf("expected %v, got %v", UNKNOWN_CHANNEL, err)
+	}
+
+	// The rejected updates did not change the channel
+	_, err = Accept(tc.server, TEST_ID, u, 1e5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := Get(tc.cc.Offer.ID)
+	if ch.Paid != 2e5 {
+		t.Fatalf("expected 2e5 paid, got %v", ch.Paid)
+	}
+}
+
+func TestAcceptOnce(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	u, _ := tc.cc.Pay(tc.client, 1e5)
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := Accept(tc.server, TEST_ID, u, 1e5)
+			errs <- err
+		}()
+	}
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err == nil {
+			accepted++
+		} else if err != UNDERPAID {
+			t.Fatalf("expected %v, got %v", UNDERPAID, err)
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("expected the update accepted once, got %v", accepted)
+	}
+
+	// Nor for nothing more
+	_, err := Accept(tc.server, TEST_ID, u, 0)
+	if err != UNDERPAID {
+		t.Fatalf("expected %v, got %v", UNDERPAID, err)
+	}
+}
+
+func TestOverCapacity(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	_, err := tc.cc.Pay(tc.client, 1e6)
+	if err != UNDERPAID {
+		t.Fatalf("expected %v, got %v", UNDERPAID, err)
+	}
+	tc.pay(t, 1e6-CLOSE_FEE)
+}
+
+func TestSignRefundRejects(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	addr, _ := client.NewAddress()
+	chain.Fund(addr, 1e8)
+	chain.Mine(1)
+	serverAddr, _ := server.NewAddress()
+	clientPubKey, _ := client.NewPubKey()
+	offer, _ := Open(server, TEST_ID, clientPubKey, serverAddr)
+	cc, _, err := NewClientChannel(client, offer, clientPubKey, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refund unlocking before the channel expires
+	early, _ := client.CreateRawTxn([]btc.OutPoint{cc.Funding},
+		[]btc.TxOut{btc.TxOut{Addr: cc.RefundAddr, Amount: 1e6}}, offer.Expiry-1)
+	early, _, _ = client.SignRawTxn(early, []string{cc.FundingTxn})
+	_, err = SignRefund(server, TEST_ID, offer.ID, cc.FundingTxn, early)
+	if err != INVALID_REFUND {
+		t.Fatalf("expected %v, got %v", INVALID_REFUND, err)
+	}
+
+	// Refunds spendable right away: a lock time that is a past unix time, or
+	// one not enforced since the input is final
+	stamped, _ := client.CreateRawTxn([]btc.OutPoint{cc.Funding},
+		[]btc.TxOut{btc.TxOut{Addr: cc.RefundAddr, Amount: 1e6}}, btc.LOCKTIME_THRESHOLD)
+	final := withSequences(t, early, offer.Expiry, btc.MAX_SEQUENCE)
+	for _, refund := range []string{stamped, final} {
+		refund, _, _ = client.SignRawTxn(refund, []string{cc.FundingTxn})
+		_, err = SignRefund(server, TEST_ID, offer.ID, cc.FundingTxn, refund)
+		if err != INVALID_REFUND {
+			t.Fatalf("expected %v, got %v", INVALID_REFUND, err)
+		}
+	}
+
+	// Funding that doesn't pay the channel
+	other, _ := client.CreateTxn(serverAddr, 1e6)
+	_, err = SignRefund(server, TEST_ID, offer.ID, other, early)
+	if err != INVALID_FUNDING {
+		t.Fatalf("expected %v, got %v", INVALID_FUNDING, err)
+	}
+
+	_, err = SignRefund(server, "other-id", offer.ID, cc.FundingTxn, early)
+	if err != WRONG_OWNER {
+		t.Fatalf("expected %v, got %v", WRONG_OWNER, err)
+	}
+	ch, _ := Get(offer.ID)
+	if ch.State != OPENING {
+		t.Fatalf("expected channel still opening, got %v", ch.State)
+	}
+}
+
+// Sets the lock time and input sequences of a fake txn, dropping signatures.
+func withSequences(t *testing.T, txnHex string, lockTime int, seq uint32) string {
+	ser, err := hex.DecodeString(txnHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txn map[string]interface{}
+	err = json.Unmarshal(ser, &txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := make([]uint32, len(txn["inputs"].([]interface{})))
+	for i := range seqs {
+		seqs[i] = seq
+	}
+	txn["sequences"] = seqs
+	txn["lockTime"] = lockTime
+	delete(txn, "sigs")
+	ser, _ = json.Marshal(txn)
+	return hex.EncodeToString(ser)
+}
+
+func TestRefundAfterExpiry(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	err := tc.client.SendRawTxn(tc.refund)
+	if err == nil {
+		t.Fatalf("expected refund to be locked")
+	}
+	tc.chain.Mine(DEFAULT_DURATION)
+	err = tc.client.SendRawTxn(tc.refund)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := tc.cc.Pay(tc.client, 1e5)
+	_, err = Accept(tc.server, TEST_ID, u, 1e5)
+	if err != EXPIRING {
+		t.Fatalf("expected %v, got %v", EXPIRING, err)
+	}
+}
+
+func TestCloseExpiring(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestChannel(t, 1e6)
+	tc.pay(t, 1e5)
+	err := CloseExpiring(tc.server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := Get(tc.cc.Offer.ID)
+	if ch.State != OPEN {
+		t.Fatalf("expected channel to stay open, got %v", ch.State)
+	}
+
+	tc.chain.Mine(DEFAULT_DURATION - CLOSE_MARGIN)
+	err = CloseExpiring(tc.server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ = Get(tc.cc.Offer.ID)
+	if ch.State != CLOSED {
+		t.Fatalf("expected channel to be closed, got %v", ch.State)
+	}
+	tc.chain.Mine(1)
+	received, _ := tc.server.ListReceived(1)
+	if received[tc.serverAddr] != 1e5 {
+		t.Fatalf("expected 1e5 received on close, got %v", received)
+	}
+}
+
+func TestEncodeUpdate(t *testing.T) {
+	u := Update{ChannelID: "channel", Txn: "abcd"}
+	decoded, err := DecodeUpdate(u.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != u {
+		t.Fatalf("expected %v, got %v", u, decoded)
+	}
+	_, err = DecodeUpdate("not base64")
+	if err != INVALID_UPDATE {
+		t.Fatalf("expected %v, got %v", INVALID_UPDATE, err)
+	}
+}
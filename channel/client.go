@@ -0,0 +1,100 @@
+package channel
+
+import (
+	"github.com/ortutay/decloud/btc"
+)
+
+// Client side state of a channel.
+type ClientChannel struct {
+	Offer      Offer        `json:"offer"`
+	PubKey     string       `json:"pubKey"`
+	RefundAddr string       `json:"refundAddr"`
+	Funding    btc.OutPoint `json:"funding"`
+	FundingTxn string       `json:"fundingTxn"`
+	Capacity   int64        `json:"capacity"`
+	Paid       int64        `json:"paid"`
+}
+
+// Makes the funding and unsigned refund txns for a channel offered by a
+// server. The refund should be sent to the server to sign before the funding
+// txn is broadcast.
+func NewClientChannel(b btc.Backend, offer *Offer, pubKey string, capacity int64) (*ClientChannel, string, error) {
+	addr, err := b.AddMultisigAddr(2, []string{pubKey, offer.ServerPubKey})
+	if err != nil {
+		return nil, "", err
+	}
+	if addr != offer.ID {
+		return nil, "", INVALID_FUNDING
+	}
+	fundingHex, err := b.CreateTxn(addr, capacity)
+	if err != nil {
+		return nil, "", err
+	}
+	funding, err := b.DecodeTxn(fundingHex)
+	if err != nil {
+		return nil, "", err
+	}
+	vout := -1
+	for i, out := range funding.Outs {
+		if out.Addr == addr {
+			vout = i
+		}
+	}
+	if vout == -1 {
+		return nil, "", INVALID_FUNDING
+	}
+	refundAddr, err := b.NewAddress()
+	if err != nil {
+		return nil, "", err
+	}
+	cc := ClientChannel{
+		Offer:      *offer,
+		PubKey:     pubKey,
+		RefundAddr: refundAddr,
+		Funding:    btc.OutPoint{Txid: funding.Txid, Vout: vout},
+		FundingTxn: fundingHex,
+		Capacity:   capacity,
+	}
+	if capacity <= CLOSE_FEE {
+		return nil, "", INVALID_FUNDING
+	}
+	refundHex, err := b.CreateRawTxn([]btc.OutPoint{cc.Funding},
+		[]btc.TxOut{btc.TxOut{Addr: refundAddr, Amount: capacity - CLOSE_FEE}},
+		offer.Expiry)
+	if err != nil {
+		return nil, "", err
+	}
+	refundHex, _, err = b.SignRawTxn(refundHex, []string{fundingHex})
+	if err != nil {
+		return nil, "", err
+	}
+	return &cc, refundHex, nil
+}
+
+// Makes an update paying amount more to the server. Call Accepted once the
+// server accepts it.
+func (cc *ClientChannel) Pay(b btc.Backend, amount int64) (*Update, error) {
+	paid := cc.Paid + amount
+	if paid+CLOSE_FEE > cc.Capacity {
+		return nil, UNDERPAID
+	}
+	outs := []btc.TxOut{btc.TxOut{Addr: cc.Offer.ServerAddr, Amount: paid}}
+	if paid+CLOSE_FEE < cc.Capacity {
+		outs = append(outs, btc.TxOut{Addr: cc.RefundAddr,
+			Amount: cc.Capacity - paid - CLOSE_FEE})
+	}
+	txnHex, err := b.CreateRawTxn([]btc.OutPoint{cc.Funding}, outs, 0)
+	if err != nil {
+		return nil, err
+	}
+	signed, _, err := b.SignRawTxn(txnHex, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Update{ChannelID: cc.Offer.ID, Txn: signed}, nil
+}
+
+// Records that the server accepted an update paying amount more.
+func (cc *ClientChannel) Accepted(amount int64) {
+	cc.Paid += amount
+}
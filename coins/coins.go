@@ -0,0 +1,156 @@
+package coins
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+)
+
+// About one block; balances can't change faster than that
+const CACHE_TTL = 10 * time.Minute
+
+// Addresses come from clients, so the cache is bounded; the least recently
+// used are dropped first
+const MAX_CACHED = 10000
+
+// The confirmed coins held by a set of bitcoin addresses.
+type Info struct {
+	Addrs    []string
+	Unspent  []btc.Unspent
+	Resolved time.Time
+}
+
+// Total of unspent outputs with at least minConf confirmations, in satoshis.
+func (i *Info) Balance(minConf int) int64 {
+	total := int64(0)
+	for _, u := range i.Unspent {
+		if u.Confirmations >= minConf {
+			total += u.Amount
+		}
+	}
+	return total
+}
+
+// Number of blocks for which the addresses have held at least amount
+// satoshis. Returns 0 if they don't hold that much.
+func (i *Info) Age(amount int64) int {
+	unspent := make([]btc.Unspent, len(i.Unspent))
+	copy(unspent, i.Unspent)
+	sort.Sort(byConfirmations(unspent))
+	total := int64(0)
+	for _, u := range unspent {
+		total += u.Amount
+		if total >= amount {
+			return u.Confirmations
+		}
+	}
+	return 0
+}
+
+type byConfirmations []btc.Unspent
+
+func (b byConfirmations) Len() int           { return len(b) }
+func (b byConfirmations) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byConfirmations) Less(i, j int) bool { return b[i].Confirmations > b[j].Confirmations }
+
+// Looks up the coins held by bitcoin address credentials, and caches them.
+type Resolver struct {
+	Btc       btc.Backend
+	TTL       time.Duration
+	MaxCached int // 0 is MAX_CACHED
+
+	mu    sync.Mutex
+	cache map[string]*list.Element // of *Info, in lru
+	lru   *list.List               // most recently used first
+}
+
+func NewResolver(b btc.Backend) *Resolver {
+	return &Resolver{Btc: b, TTL: CACHE_TTL}
+}
+
+// Cached info for addr, if it is fresh. Call with mu held.
+func (r *Resolver) cached(addr string) *Info {
+	if r.cache == nil {
+		r.cache = make(map[string]*list.Element)
+		r.lru = list.New()
+	}
+	e, ok := r.cache[addr]
+	if !ok {
+		return nil
+	}
+	info := e.Value.(*Info)
+	if time.Since(info.Resolved) >= r.TTL {
+		r.lru.Remove(e)
+		delete(r.cache, addr)
+		return nil
+	}
+	r.lru.MoveToFront(e)
+	return info
+}
+
+// Caches info for addr, dropping expired and least recently used entries
+// over the limit. Call with mu held.
+func (r *Resolver) store(addr string, info *Info) {
+	if e, ok := r.cache[addr]; ok {
+		r.lru.Remove(e)
+	}
+	r.cache[addr] = r.lru.PushFront(info)
+	max := r.MaxCached
+	if max == 0 {
+		max = MAX_CACHED
+	}
+	for e := r.lru.Back(); e != nil; e = r.lru.Back() {
+		old := e.Value.(*Info)
+		if r.lru.Len() <= max && time.Since(old.Resolved) < r.TTL {
+			break
+		}
+		r.lru.Remove(e)
+		delete(r.cache, old.Addrs[0])
+	}
+}
+
+func (r *Resolver) Resolve(addr string) (*Info, error) {
+	r.mu.Lock()
+	info := r.cached(addr)
+	r.mu.Unlock()
+	if info != nil {
+		return info, nil
+	}
+
+	unspent, err := r.Btc.AddressUnspent(addr)
+	if err != nil {
+		return nil, err
+	}
+	info = &Info{Addrs: []string{addr}, Unspent: unspent, Resolved: time.Now()}
+	r.mu.Lock()
+	r.store(addr, info)
+	r.mu.Unlock()
+	return info, nil
+}
+
+// Combined coins of all the credentials on a request.
+func (r *Resolver) ResolveReq(req *msg.OcReq) (*Info, error) {
+	combined := Info{Resolved: time.Now()}
+	seen := make(map[string]bool)
+	for _, coin := range req.Coins {
+		// Coins listed twice don't count twice
+		if seen[coin] {
+			continue
+		}
+		seen[coin] = true
+		info, err := r.Resolve(coin)
+		if err != nil {
+			return nil, err
+		}
+		combined.Addrs = append(combined.Addrs, coin)
+		combined.Unspent = append(combined.Unspent, info.Unspent...)
+		if info.Resolved.Before(combined.Resolved) {
+			combined.Resolved = info.Resolved
+		}
+	}
+	return &combined, nil
+}
@@ -0,0 +1,121 @@
+package coins
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+)
+
+func TestResolve(t *testing.T) {
+	chain := btc.NewFakeChain()
+	w := chain.NewWallet("w")
+	addr, _ := w.NewAddress()
+	chain.Fund(addr, 100)
+	chain.Mine(10)
+	chain.Fund(addr, 50)
+	chain.Mine(1)
+	chain.Fund(addr, 25) // unconfirmed
+
+	info, err := NewResolver(w).Resolve(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Balance(1) != 150 {
+		t.Fatalf("expected 150 confirmed, got %v", info.Balance(1))
+	}
+	if info.Balance(2) != 100 {
+		t.Fatalf("expected 100 with 2 confirmations, got %v", info.Balance(2))
+	}
+	tests := []struct {
+		amount int64
+		age    int
+	}{
+		{1, 11},
+		{100, 11},
+		{101, 1},
+		{150, 1},
+		{151, 0},
+	}
+	for _, test := range tests {
+		if age := info.Age(test.amount); age != test.age {
+			t.Errorf("age of %v: expected %v, got %v", test.amount, test.age, age)
+		}
+	}
+}
+
+func TestResolveCached(t *testing.T) {
+	chain := btc.NewFakeChain()
+	w := chain.NewWallet("w")
+	addr, _ := w.NewAddress()
+	chain.Fund(addr, 100)
+	chain.Mine(1)
+
+	r := NewResolver(w)
+	info, _ := r.Resolve(addr)
+	if info.Balance(1) != 100 {
+		t.Fatalf("expected 100, got %v", info.Balance(1))
+	}
+	chain.Fund(addr, 100)
+	chain.Mine(1)
+	info, _ = r.Resolve(addr)
+	if info.Balance(1) != 100 {
+		t.Fatalf("expected cached 100, got %v", info.Balance(1))
+	}
+	r.TTL = 0
+	info, _ = r.Resolve(addr)
+	if info.Balance(1) != 200 {
+		t.Fatalf("expected 200 after expiry, got %v", info.Balance(1))
+	}
+}
+
+func TestResolveCacheBounded(t *testing.T) {
+	chain := btc.NewFakeChain()
+	w := chain.NewWallet("w")
+	r := NewResolver(w)
+	r.MaxCached = 2
+	addrs := make([]string, 3)
+	for i := range addrs {
+		addrs[i], _ = w.NewAddress()
+		chain.Fund(addrs[i], 100)
+	}
+	chain.Mine(1)
+	r.Resolve(addrs[0])
+	r.Resolve(addrs[1])
+	r.Resolve(addrs[0])
+	r.Resolve(addrs[2])
+	if len(r.cache) != 2 || r.lru.Len() != 2 {
+		t.Fatalf("expected 2 cached, got %v", len(r.cache))
+	}
+	if _, ok := r.cache[addrs[1]]; ok {
+		t.Fatalf("expected the least recently used to be dropped")
+	}
+
+	// Expired entries are swept as others are added
+	time.Sleep(2 * time.Millisecond)
+	r.TTL = time.Millisecond
+	r.Resolve(addrs[1])
+	if len(r.cache) > 1 {
+		t.Fatalf("expected expired entries swept, got %v", len(r.cache))
+	}
+}
+
+func TestResolveReq(t *testing.T) {
+	chain := btc.NewFakeChain()
+	w := chain.NewWallet("w")
+	addr1, _ := w.NewAddress()
+	addr2, _ := w.NewAddress()
+	chain.Fund(addr1, 100)
+	chain.Fund(addr2, 50)
+	chain.Mine(1)
+
+	req := msg.OcReq{Coins: []string{addr1, addr2, addr1}}
+	info, err := NewResolver(w).ResolveReq(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Balance(1) != 150 {
+		t.Fatalf("expected 150, got %v", info.Balance(1))
+	}
+}
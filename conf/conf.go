@@ -2,6 +2,8 @@ package conf
 
 import (
 	"fmt"
+
+	"github.com/ortutay/decloud/msg"
 )
 
 type BtcAddr string
@@ -13,21 +15,31 @@ const (
 	DENY                = "deny"
 	MIN_FEE             = "min-fee"
 	MIN_COINS           = "min-coins"
+	MIN_COIN_AGE        = "min-coin-age" // in blocks
 	MAX_WORK            = "max-work"
 	MAX_BALANCE         = "max-balance"
+	MIN_CONF            = "min-conf" // for payments to count toward max-balance
+	REFUND_MIN          = "refund-min"
+	REFUND_COOLDOWN     = "refund-cooldown" // in seconds, between refunds to an ID
+	REFUND_APPROVAL     = "refund-approval" // refunds wait for the operator
+	KEY_TYPES           = "key-types"       // OcID key types accepted, eg. "ed25519"
 	// TODO(ortutay): add rate-limit
 	// TODO(ortutay): additional policy commands
 
 	// "store" service commands
 	STORE_DIR             = "store-dir"
+	STORE_BACKEND         = "store-backend"
 	STORE_MAX_SPACE       = "store-max-space"
 	STORE_GB_PRICE_PER_MO = "store-gb-price-per-mo"
 )
 
+// Without a min-conf policy, unconfirmed payments count
+const DEFAULT_MIN_CONF = 0
+
 type PolicySelector struct {
 	Service string
 	Method  string
-	// TODO(ortutay): ID based policies
+	ID      msg.OcID // only min-conf policies select by ID
 }
 
 type Policy struct {
@@ -56,6 +68,9 @@ func (c *Conf) AddPolicy(policy *Policy) {
 // }
 
 func (c *Conf) PolicyForCmd(cmd PolicyCmd) (*Policy, error) {
+	if c == nil {
+		return nil, nil
+	}
 	var p *Policy
 	for i, policy := range c.Policies {
 		if policy.Cmd == cmd {
@@ -73,6 +88,9 @@ func (c *Conf) MatchingPolicies(service string, method string) []*Policy {
 	fmt.Printf("compare %v %v to policies: %v\n", service, method, c.Policies)
 	matching := make([]*Policy, 0)
 	for i, policy := range c.Policies {
+		if policy.Selector.ID != "" {
+			continue
+		}
 		if policy.Selector.Service != "" &&
 			policy.Selector.Service != service {
 			continue
@@ -86,3 +104,25 @@ func (c *Conf) MatchingPolicies(service string, method string) []*Policy {
 	fmt.Printf("matching: %v\n", matching)
 	return matching
 }
+
+// Confirmations needed for payments from id to count toward its balance. A
+// min-conf policy for id, eg. a trusted peer, takes precedence over one for
+// all IDs.
+func (c *Conf) MinConf(id msg.OcID) int {
+	minConf := DEFAULT_MIN_CONF
+	if c == nil {
+		return minConf
+	}
+	for _, policy := range c.Policies {
+		if policy.Cmd != MIN_CONF {
+			continue
+		}
+		if policy.Selector.ID == id {
+			return policy.Args[0].(int)
+		}
+		if policy.Selector.ID == "" {
+			minConf = policy.Args[0].(int)
+		}
+	}
+	return minConf
+}
@@ -0,0 +1,29 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestMinConf(t *testing.T) {
+	var c *Conf
+	if c.MinConf("id") != DEFAULT_MIN_CONF {
+		t.Fatalf("expected default min conf")
+	}
+	c = &Conf{}
+	c.AddPolicy(&Policy{Cmd: MIN_CONF, Args: []interface{}{6}})
+	c.AddPolicy(&Policy{
+		Selector: PolicySelector{ID: "trusted-id"},
+		Cmd:      MIN_CONF,
+		Args:     []interface{}{0},
+	})
+	if c.MinConf("unknown-id") != 6 {
+		t.Fatalf("expected 6 for unknown ID, got %v", c.MinConf("unknown-id"))
+	}
+	if c.MinConf("trusted-id") != 0 {
+		t.Fatalf("expected 0 for trusted ID, got %v", c.MinConf("trusted-id"))
+	}
+	// ID policies don't apply to every request
+	if len(c.MatchingPolicies("calc", "calc")) != 1 {
+		t.Fatalf("expected only the general policy to match")
+	}
+}
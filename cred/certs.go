@@ -0,0 +1,155 @@
+package cred
+
+// Certs let an identity outlive its key. A ROTATE cert hands all of an ID's
+// authority to a new key, eg. after the old one leaked; a DELEGATE cert lets
+// a key, such as one kept on another device, act for the ID within a scope
+// until it expires. Requests name the identity in ID, and carry the certs
+// from it to the key that signed. Delegated keys may delegate further, within
+// their own scope, but not rotate.
+
+import (
+	"errors"
+
+	"github.com/ortutay/decloud/msg"
+)
+
+var (
+	INVALID_CERT = errors.New("invalid cert")
+	CERT_EXPIRED = errors.New("cert expired")
+	OUT_OF_SCOPE = errors.New("request is outside of the cert's scope")
+)
+
+// The ID this key acts for: the issuer of its first cert, if it has any.
+func (o *OcCred) Identity() msg.OcID {
+	if len(o.Certs) != 0 {
+		return o.Certs[0].Issuer
+	}
+	return o.ID()
+}
+
+func (o *OcCred) isDelegated() bool {
+	for _, c := range o.Certs {
+		if c.Kind == msg.DELEGATE {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OcCred) issue(kind msg.CertKind, subject msg.OcID, scope []string, expires int64) (*msg.OcCert, error) {
+	c := msg.OcCert{
+		Kind:    kind,
+		Issuer:  o.ID(),
+		Subject: subject,
+		Scope:   scope,
+		Expires: expires,
+	}
+	sig, err := o.Sign(c.SignablePortion())
+	if err != nil {
+		return nil, err
+	}
+	c.Sig = sig
+	return &c, nil
+}
+
+// A new key, of o's type, that acts for o's identity, for requests in scope,
+// until expires. It shares o's store key.
+func NewDelegatedOcCred(o *OcCred, scope []string, expires int64) (*OcCred, error) {
+	if len(scope) == 0 {
+		return nil, INVALID_CERT
+	}
+	sub, err := NewOcCredOfType(o.KeyType())
+	if err != nil {
+		return nil, err
+	}
+	c, err := o.issue(msg.DELEGATE, sub.ID(), scope, expires)
+	if err != nil {
+		return nil, err
+	}
+	sub.Certs = append(append([]msg.OcCert{}, o.Certs...), *c)
+	sub.storeKey = o.StoreKey()
+	return sub, nil
+}
+
+// A new key, of o's type, that replaces o, keeping its store key. Servers
+// stop accepting o, and keys delegated by it, once they see the new key.
+func NewRotatedOcCred(o *OcCred) (*OcCred, error) {
+	if o.isDelegated() {
+		return nil, INVALID_CERT
+	}
+	sub, err := NewOcCredOfType(o.KeyType())
+	if err != nil {
+		return nil, err
+	}
+	c, err := o.issue(msg.ROTATE, sub.ID(), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	sub.Certs = append(append([]msg.OcCert{}, o.Certs...), *c)
+	sub.storeKey = o.StoreKey()
+	return sub, nil
+}
+
+// Whether scope allows service.method.
+func ScopeAllows(scope []string, service string, method string) bool {
+	for _, s := range scope {
+		if s == "*" || s == service+".*" || s == service+"."+method {
+			return true
+		}
+	}
+	return false
+}
+
+// Follows certs from id, checking each is signed by the key before it, and
+// that delegations are unexpired at now and allow service.method. Returns
+// the key at the end of the chain, which should have signed the request.
+func VerifyCertChain(id msg.OcID, certs []msg.OcCert, service string, method string, now int64) (msg.OcID, error) {
+	cur, err := CanonicalOcID(id)
+	if err != nil {
+		return "", INVALID_CERT
+	}
+	delegated := false
+	for i := range certs {
+		c := &certs[i]
+		issuer, err := CanonicalOcID(c.Issuer)
+		if err != nil || issuer != cur || !VerifyOcSig(c.Issuer, c.SignablePortion(), c.Sig) {
+			return "", INVALID_CERT
+		}
+		switch c.Kind {
+		case msg.ROTATE:
+			if delegated {
+				return "", INVALID_CERT
+			}
+		case msg.DELEGATE:
+			delegated = true
+			if c.Expires != 0 && now >= c.Expires {
+				return "", CERT_EXPIRED
+			}
+			if !ScopeAllows(c.Scope, service, method) {
+				return "", OUT_OF_SCOPE
+			}
+		default:
+			return "", INVALID_CERT
+		}
+		cur, err = CanonicalOcID(c.Subject)
+		if err != nil {
+			return "", INVALID_CERT
+		}
+	}
+	return cur, nil
+}
+
+// IDs of the keys in req's cert chain that rotated, in order, each paired with
+// the key that replaced it. Only rotations before any delegation count.
+func Rotations(req *msg.OcReq) [][2]msg.OcID {
+	rotations := make([][2]msg.OcID, 0)
+	for _, c := range req.Certs {
+		if c.Kind != msg.ROTATE {
+			break
+		}
+		issuer, _ := CanonicalOcID(c.Issuer)
+		subject, _ := CanonicalOcID(c.Subject)
+		rotations = append(rotations, [2]msg.OcID{issuer, subject})
+	}
+	return rotations
+}
@@ -0,0 +1,116 @@
+package cred
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortutay/decloud/msg"
+)
+
+func signedReq(t *testing.T, o *OcCred, service string, method string) *msg.OcReq {
+	req := newReq()
+	req.Service, req.Method = service, method
+	err := o.SignOcReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestDelegatedReq(t *testing.T) {
+	root := NewOcCred()
+	device, err := NewDelegatedOcCred(root, []string{"store.get", "calc.*"},
+		time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Identity() != root.ID() || device.ID() == root.ID() {
+		t.Fatalf("expected %v to act for %v", device.ID(), root.ID())
+	}
+
+	for _, call := range [][2]string{{"store", "get"}, {"calc", "calc"}} {
+		req := signedReq(t, device, call[0], call[1])
+		if req.ID != root.ID() || len(req.Certs) != 1 {
+			t.Fatalf("expected a request from %v with a cert, got %v", root.ID(), req)
+		}
+		ok, err := VerifyOcReqSig(req)
+		if err != nil || !ok {
+			t.Fatalf("expected %v to verify, got %v %v", call, ok, err)
+		}
+	}
+	req := signedReq(t, device, "store", "put")
+	if ok, _ := VerifyOcReqSig(req); ok {
+		t.Fatalf("expected store.put to be out of scope")
+	}
+
+	// Sub-delegation only narrows the scope
+	sub, err := NewDelegatedOcCred(device, []string{"*"}, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyOcReqSig(signedReq(t, sub, "store", "get")); !ok {
+		t.Fatalf("expected store.get to verify")
+	}
+	if ok, _ := VerifyOcReqSig(signedReq(t, sub, "store", "put")); ok {
+		t.Fatalf("expected store.put to be out of scope")
+	}
+	if _, err := NewRotatedOcCred(device); err != INVALID_CERT {
+		t.Fatalf("expected delegated keys not to rotate, got %v", err)
+	}
+}
+
+func TestCertChainRejects(t *testing.T) {
+	root := NewOcCred()
+	now := time.Now().Unix()
+	device, _ := NewDelegatedOcCred(root, []string{"*"}, now+60)
+
+	_, err := VerifyCertChain(root.ID(), device.Certs, "calc", "calc", now+60)
+	if err != CERT_EXPIRED {
+		t.Fatalf("expected %v, got %v", CERT_EXPIRED, err)
+	}
+	_, err = VerifyCertChain(NewOcCred().ID(), device.Certs, "calc", "calc", now)
+	if err != INVALID_CERT {
+		t.Fatalf("expected a chain from another ID to fail, got %v", err)
+	}
+	widened := device.Certs[0]
+	widened.Expires += 3600
+	_, err = VerifyCertChain(root.ID(), []msg.OcCert{widened}, "calc", "calc", now)
+	if err != INVALID_CERT {
+		t.Fatalf("expected an altered cert to fail, got %v", err)
+	}
+
+	// A request signed by the root, with the device's certs, doesn't verify
+	req := signedReq(t, root, "calc", "calc")
+	req.Certs = device.Certs
+	if ok, _ := VerifyOcReqSig(req); ok {
+		t.Fatalf("expected a signature by the wrong key to fail")
+	}
+}
+
+func TestRotatedReq(t *testing.T) {
+	root := NewOcCred()
+	rotated, err := NewRotatedOcCred(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewRotatedOcCred(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := NewDelegatedOcCred(again, []string{"store.*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := signedReq(t, device, "store", "put")
+	if req.ID != root.ID() || len(req.Certs) != 3 {
+		t.Fatalf("expected a request from %v with 3 certs, got %v", root.ID(), req)
+	}
+	if ok, err := VerifyOcReqSig(req); !ok || err != nil {
+		t.Fatalf("expected the request to verify, got %v %v", ok, err)
+	}
+	rotations := Rotations(req)
+	if len(rotations) != 2 || rotations[0][0] != root.ID() ||
+		rotations[0][1] != rotated.ID() || rotations[1][1] != again.ID() {
+		t.Fatalf("unexpected rotations: %v", rotations)
+	}
+}
@@ -0,0 +1,308 @@
+package cred
+
+// Picks which bitcoin addresses to present as coin credentials. Every address
+// shown with a request is linked to the request's ID, by the server and by
+// anyone it tells, so selection is by privacy first: the fewest addresses not
+// already linked to the ID, then the fewest addresses, then the largest total
+// within range. Addresses the client has shown under another ID are skipped.
+// The search is branch and bound over addresses, those already linked and then
+// the largest first, with at most maxAddrs in a set; it stops after
+// MAX_COIN_SELECT_TRIES, with the best set found by then.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+const (
+	DEFAULT_MAX_COIN_ADDRS = 3
+	MAX_COIN_SELECT_TRIES  = 100000
+)
+
+type CoinSelectOpts struct {
+	ID       msg.OcID            // IDs other than this one may not have bound addresses
+	Bound    map[string]msg.OcID // address to the ID it was shown under
+	MaxAddrs int                 // 0 is DEFAULT_MAX_COIN_ADDRS
+}
+
+// Why no addresses fit, with enough detail for the user to adjust the range.
+type NoCoinsError struct {
+	Min, Max      int64
+	MaxAddrs      int
+	NumAddrs      int   // usable addresses
+	Total         int64 // in usable addresses
+	Largest       int64
+	SkippedBound  int // addresses bound to other IDs
+	SkippedAmount int64
+}
+
+func (e *NoCoinsError) Error() string {
+	reasons := make([]string, 0)
+	switch {
+	case e.NumAddrs == 0:
+		reasons = append(reasons, "no addresses have confirmed coins")
+	case e.Total < e.Min:
+		reasons = append(reasons, fmt.Sprintf("%v addresses hold %vBTC in all",
+			e.NumAddrs, util.S2B(e.Total)))
+	default:
+		reasons = append(reasons, fmt.Sprintf(
+			"%v addresses hold %vBTC in all, the largest %vBTC, but no %v or fewer sum to within range",
+			e.NumAddrs, util.S2B(e.Total), util.S2B(e.Largest), e.MaxAddrs))
+	}
+	if e.SkippedBound != 0 {
+		reasons = append(reasons, fmt.Sprintf(
+			"%v addresses holding %vBTC were skipped, since they are bound to other IDs",
+			e.SkippedBound, util.S2B(e.SkippedAmount)))
+	}
+	return fmt.Sprintf("no coins between %vBTC and %vBTC: %v", util.S2B(e.Min),
+		util.S2B(e.Max), strings.Join(reasons, "; "))
+}
+
+type addressBalance struct {
+	Address string
+	Amount  int64
+	Bound   bool // to the ID the coins are for
+}
+
+// Already bound addresses first, then by amount, descending, so good sets are
+// found early.
+type bySearchOrder []addressBalance
+
+func (a bySearchOrder) Len() int      { return len(a) }
+func (a bySearchOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySearchOrder) Less(i, j int) bool {
+	if a[i].Bound != a[j].Bound {
+		return a[i].Bound
+	}
+	if a[i].Amount != a[j].Amount {
+		return a[i].Amount > a[j].Amount
+	}
+	return a[i].Address < a[j].Address
+}
+
+// A candidate set's cost; lower is better.
+type selectCost struct {
+	newLinks int
+	addrs    int
+	total    int64
+}
+
+func (c selectCost) less(o selectCost) bool {
+	if c.newLinks != o.newLinks {
+		return c.newLinks < o.newLinks
+	}
+	if c.addrs != o.addrs {
+		return c.addrs < o.addrs
+	}
+	return c.total > o.total
+}
+
+type coinSearch struct {
+	addrs    []addressBalance // in search order
+	suffix   []int64          // suffix[i] is the total of addrs[i:]
+	min, max int64
+	maxAddrs int
+	tries    int
+
+	cur      []int
+	best     []int
+	bestCost selectCost
+}
+
+func (cs *coinSearch) search(i int, cost selectCost) {
+	cs.tries++
+	if cs.tries > MAX_COIN_SELECT_TRIES {
+		return
+	}
+	// With no minimum, showing no addresses is best, as it links none
+	if (cost.addrs > 0 || cs.min <= 0) && cost.total >= cs.min &&
+		(cs.best == nil || cost.less(cs.bestCost)) {
+		cs.best = append([]int{}, cs.cur...)
+		cs.bestCost = cost
+	}
+	if i == len(cs.addrs) || cost.addrs == cs.maxAddrs {
+		return
+	}
+	// Adding an address only adds cost, unless the set is short of min
+	if cs.best != nil && cost.total >= cs.min {
+		return
+	}
+	if cost.total+cs.suffix[i] < cs.min {
+		return
+	}
+	for j := i; j < len(cs.addrs); j++ {
+		a := cs.addrs[j]
+		next := cost
+		next.addrs++
+		next.total += a.Amount
+		if !a.Bound {
+			next.newLinks++
+		}
+		if next.total > cs.max {
+			// Smaller addresses may still fit
+			continue
+		}
+		// Any set through next costs at least next, ignoring the total
+		if cs.best != nil && (next.newLinks > cs.bestCost.newLinks ||
+			(next.newLinks == cs.bestCost.newLinks && next.addrs > cs.bestCost.addrs)) {
+			continue
+		}
+		cs.cur = append(cs.cur, j)
+		cs.search(j+1, next)
+		cs.cur = cs.cur[:len(cs.cur)-1]
+	}
+}
+
+// The best set of addresses holding between min and max in total.
+func selectAddrs(balances []addressBalance, min, max int64, maxAddrs int) ([]addressBalance, bool) {
+	addrs := append([]addressBalance{}, balances...)
+	sort.Sort(bySearchOrder(addrs))
+	cs := coinSearch{
+		addrs:    addrs,
+		suffix:   make([]int64, len(addrs)+1),
+		min:      min,
+		max:      max,
+		maxAddrs: maxAddrs,
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		cs.suffix[i] = cs.suffix[i+1] + addrs[i].Amount
+	}
+	cs.search(0, selectCost{})
+	if cs.best == nil {
+		return nil, false
+	}
+	use := make([]addressBalance, len(cs.best))
+	for i, j := range cs.best {
+		use[i] = addrs[j]
+	}
+	return use, true
+}
+
+// Addresses with confirmed coins, between min and max in total, picked as
+// described above. If min is 0, none are needed, so none are picked.
+func SelectBtcCreds(min, max int64, b btc.Backend, opts *CoinSelectOpts) ([]BtcCred, error) {
+	if opts == nil {
+		opts = &CoinSelectOpts{}
+	}
+	maxAddrs := opts.MaxAddrs
+	if maxAddrs == 0 {
+		maxAddrs = DEFAULT_MAX_COIN_ADDRS
+	}
+	unspent, err := b.ListUnspent(1)
+	if err != nil {
+		return nil, fmt.Errorf("error while listing unspent: %v", err.Error())
+	}
+	byAddr := make(map[string]int64)
+	for _, u := range unspent {
+		byAddr[u.Address] += u.Amount
+	}
+	noCoins := NoCoinsError{Min: min, Max: max, MaxAddrs: maxAddrs}
+	balances := make([]addressBalance, 0, len(byAddr))
+	for addr, amt := range byAddr {
+		if amt <= 0 {
+			continue
+		}
+		boundTo, isBound := opts.Bound[addr]
+		if isBound && boundTo != opts.ID {
+			noCoins.SkippedBound++
+			noCoins.SkippedAmount += amt
+			continue
+		}
+		balances = append(balances, addressBalance{
+			Address: addr,
+			Amount:  amt,
+			Bound:   isBound,
+		})
+		noCoins.NumAddrs++
+		noCoins.Total += amt
+		if amt > noCoins.Largest {
+			noCoins.Largest = amt
+		}
+	}
+	use, ok := selectAddrs(balances, min, max, maxAddrs)
+	if !ok {
+		return nil, &noCoins
+	}
+	creds := make([]BtcCred, len(use))
+	for i, ab := range use {
+		creds[i] = BtcCred{Addr: ab.Address}
+	}
+	return creds, nil
+}
+
+// Coins between min and max, with the default options.
+func GetBtcCredInRange(min, max int64, b btc.Backend) (*[]BtcCred, error) {
+	creds, err := SelectBtcCreds(min, max, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func coinBindingsDBPath() string {
+	return util.AppDir() + "/coin-bindings-diskv.db"
+}
+
+// Addresses this client has shown as coins, each with the ID it was shown
+// under.
+func CoinBindings() (map[string]msg.OcID, error) {
+	d := util.GetOrCreateDB(coinBindingsDBPath())
+	bound := make(map[string]msg.OcID)
+	for addr := range d.Keys() {
+		id, err := d.Read(addr)
+		if err != nil {
+			return nil, err
+		}
+		bound[addr] = msg.OcID(id)
+	}
+	return bound, nil
+}
+
+// Records that coins are shown under id, so they aren't picked for another ID.
+func BindCoins(id msg.OcID, coins []BtcCred) error {
+	d := util.GetOrCreateDB(coinBindingsDBPath())
+	for _, bc := range coins {
+		err := d.Write(bc.Addr, []byte(id.String()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forgets which ID coin was shown under, eg. once the server released it.
+func UnbindCoin(coin string) error {
+	d := util.GetOrCreateDB(coinBindingsDBPath())
+	if !d.Has(coin) {
+		return nil
+	}
+	return d.Erase(coin)
+}
+
+// Coins for id, between min and max, at most maxAddrs of them, avoiding
+// addresses this client has shown under other IDs. The picked addresses are
+// bound to id.
+func GetBtcCredForID(id msg.OcID, min, max int64, maxAddrs int, b btc.Backend) ([]BtcCred, error) {
+	bound, err := CoinBindings()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := SelectBtcCreds(min, max, b, &CoinSelectOpts{
+		ID:       id,
+		Bound:    bound,
+		MaxAddrs: maxAddrs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = BindCoins(id, creds)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -0,0 +1,151 @@
+package cred
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/testutil"
+)
+
+func TestGetBtcCredInRange(t *testing.T) {
+	chain := btc.NewFakeChain()
+	wallet := chain.NewWallet("cred-test")
+	amounts := []int64{100, 200, 300}
+	addrs := make(map[string]int64)
+	for _, amt := range amounts {
+		addr, err := wallet.NewAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.Fund(addr, amt)
+		addrs[addr] = amt
+	}
+
+	// Unconfirmed coins are not used
+	_, err := GetBtcCredInRange(150, 350, wallet)
+	if err == nil {
+		t.Fatalf("expected no coins before confirmation")
+	}
+	// Nothing is needed for a min of 0, even without confirmed coins
+	none, err := GetBtcCredInRange(0, 350, wallet)
+	if err != nil || len(*none) != 0 {
+		t.Fatalf("expected no coins and no error, got %v, %v", none, err)
+	}
+
+	chain.Mine(1)
+	creds, err := GetBtcCredInRange(150, 350, wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, bc := range *creds {
+		total += addrs[bc.Addr]
+	}
+	if total < 150 || total > 350 {
+		t.Fatalf("expected total in [150, 350], got %v", total)
+	}
+	if len(*creds) != 1 {
+		t.Fatalf("expected a single address, got %v", *creds)
+	}
+}
+
+func addrsOf(use []addressBalance) string {
+	addrs := make([]string, len(use))
+	for i, ab := range use {
+		addrs[i] = ab.Address
+	}
+	return strings.Join(addrs, ",")
+}
+
+func TestSelectAddrs(t *testing.T) {
+	balances := []addressBalance{
+		addressBalance{Amount: 100, Address: "123"},
+		addressBalance{Amount: 200, Address: "456"},
+		addressBalance{Amount: 300, Address: "789", Bound: true},
+		addressBalance{Amount: 300, Address: "012"},
+	}
+	tests := []struct {
+		min, max int64
+		maxAddrs int
+		expected string
+	}{
+		// One address, already bound if possible, and the largest that fits
+		{150, 350, 3, "789"},
+		{150, 250, 3, "456"},
+		// Bound addresses save a new link
+		{550, 700, 3, "789,012"},
+		{450, 550, 3, "789,456"},
+		{350, 450, 3, "789,123"},
+		{600, 600, 3, "789,012"},
+		{900, 900, 3, ""},
+		{900, 900, 4, "789,012,456,123"},
+		{50, 99, 3, ""},
+	}
+	for _, test := range tests {
+		use, ok := selectAddrs(balances, test.min, test.max, test.maxAddrs)
+		if ok != (test.expected != "") || addrsOf(use) != test.expected {
+			t.Errorf("%v: expected %q, got %q", test, test.expected, addrsOf(use))
+		}
+	}
+	// No minimum needs no addresses
+	if use, ok := selectAddrs(balances, 0, 1000, 3); !ok || len(use) != 0 {
+		t.Errorf("expected no addresses for min 0, got %q", addrsOf(use))
+	}
+	if use, ok := selectAddrs(nil, 0, 1000, 3); !ok || len(use) != 0 {
+		t.Errorf("expected no addresses from an empty wallet, got %q", addrsOf(use))
+	}
+}
+
+func TestSelectAddrsManyAddrs(t *testing.T) {
+	balances := make([]addressBalance, 0)
+	for i := 0; i < 2000; i++ {
+		balances = append(balances, addressBalance{
+			Address: string(rune('a'+i%26)) + string(rune('a'+i/26%26)) + string(rune('a'+i/676)),
+			Amount:  int64(10 + i%7),
+		})
+	}
+	use, ok := selectAddrs(balances, 45, 47, 3)
+	if !ok || len(use) != 3 {
+		t.Fatalf("expected 3 addresses, got %v", use)
+	}
+	if _, ok := selectAddrs(balances, 100, 200, 3); ok {
+		t.Fatalf("expected no 3 addresses to hold 100")
+	}
+}
+
+func TestGetBtcCredForID(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	wallet := chain.NewWallet("cred-test")
+	for _, amt := range []int64{100, 200} {
+		addr, _ := wallet.NewAddress()
+		chain.Fund(addr, amt)
+	}
+	chain.Mine(1)
+	alice, bob := NewOcCred(), NewOcCred()
+
+	creds, err := GetBtcCredForID(alice.ID(), 150, 250, 0, wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := GetBtcCredForID(alice.ID(), 50, 250, 0, wallet)
+	if err != nil || len(again) != 1 || again[0] != creds[0] {
+		t.Fatalf("expected %v again, got %v %v", creds, again, err)
+	}
+
+	// Alice's address isn't linked to Bob
+	_, err = GetBtcCredForID(bob.ID(), 150, 250, 0, wallet)
+	noCoins, ok := err.(*NoCoinsError)
+	if !ok || noCoins.SkippedBound != 1 || noCoins.SkippedAmount != 200 {
+		t.Fatalf("expected a skipped address, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "bound to other IDs") {
+		t.Fatalf("expected an explanation, got %v", err)
+	}
+	creds, err = GetBtcCredForID(bob.ID(), 50, 250, 0, wallet)
+	if err != nil || len(creds) != 1 || creds[0] == again[0] {
+		t.Fatalf("expected the other address, got %v %v", creds, err)
+	}
+}
@@ -4,29 +4,23 @@ package cred
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
-	"sort"
-	"strings"
+	"time"
 
-	"github.com/conformal/btcjson"
+	"github.com/ortutay/decloud/btc"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/util"
 )
 
 const (
-	PRIVATE_KEY_FILENAME   = "nodeid-priv"
-	OC_ID_PREFIX           = 'c' // "c" for open"c"loud
-	NODE_ID_RAND_NUM_BYTES = 256
-	SIG_RAND_NUM_BYTES     = 256
+	PRIVATE_KEY_FILENAME = "nodeid-priv"
+	OC_ID_PREFIX         = 'c' // "c" for open"c"loud
 )
 
 type Signer interface {
@@ -34,19 +28,19 @@ type Signer interface {
 }
 
 type Cred struct {
-	OcCred  OcCred
-	BtcConf *util.BitcoindConf
-	Coins   []BtcCred
+	OcCred OcCred
+	Btc    btc.Backend
+	Coins  []BtcCred
 }
 
-func (c *Cred) SignOcReq(req *msg.OcReq, bConf *util.BitcoindConf) error {
+func (c *Cred) SignOcReq(req *msg.OcReq, b btc.Backend) error {
 	err := c.OcCred.SignOcReq(req)
 	if err != nil {
 		return fmt.Errorf("error while signing: %v", err.Error())
 	}
 
 	for _, coin := range c.Coins {
-		err := coin.SignOcReq(req, bConf)
+		err := coin.SignOcReq(req, b)
 		if err != nil {
 			return fmt.Errorf("error while signing: %v", err.Error())
 		}
@@ -55,26 +49,40 @@ func (c *Cred) SignOcReq(req *msg.OcReq, bConf *util.BitcoindConf) error {
 }
 
 type OcCred struct {
-	Priv *ecdsa.PrivateKey // TODO(ortutay): make private field?
+	key   privKey
+	Certs []msg.OcCert // From the identity to this key, if it isn't the identity's own
+
+	// Inherited from the key this one was rotated or delegated from; see StoreKey
+	storeKey []byte
 }
 
+const STORE_KEY_BYTES = 64
+
+// A new P-256 key.
 func NewOcCred() *OcCred {
-	randBytes := make([]byte, NODE_ID_RAND_NUM_BYTES)
-	_, err := rand.Read(randBytes)
+	ocCred, err := NewOcCredOfType(KEY_TYPE_P256)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return ocCred
+}
 
-	curve := elliptic.P256()
-	priv, err := ecdsa.GenerateKey(curve, bytes.NewReader(randBytes))
+func NewOcCredOfType(t KeyType) (*OcCred, error) {
+	key, err := generateKey(t)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return &OcCred{key: key}, nil
+}
 
-	ocCred := OcCred{
-		Priv: priv,
+// The secp256k1 key in wif, as from bitcoind's dumpprivkey, so the ID is the
+// same key as a wallet address.
+func NewOcCredFromWIF(wif string) (*OcCred, error) {
+	d, err := btc.DecodeWIF(wif)
+	if err != nil {
+		return nil, err
 	}
-	return &ocCred
+	return newOcCredFromBytes(KEY_TYPE_SECP256K1, d.Bytes())
 }
 
 func NewOcCredLoadOrCreate(filename string) (*OcCred, error) {
@@ -102,24 +110,21 @@ func NewOcCredLoadFromFile(filename string) (*OcCred, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error getting app data: %v", err.Error())
 	}
+	defer file.Close()
 	var d big.Int
-	fmt.Fscanf(file, "%x\n", &d)
-	curve := elliptic.P256()
-	x, y := curve.ScalarBaseMult(d.Bytes())
-	priv := ecdsa.PrivateKey{
-		PublicKey: ecdsa.PublicKey{
-			Curve: curve,
-			X:     x,
-			Y:     y,
-		},
-		D: &d,
+	_, err = fmt.Fscanf(file, "%x\n", &d)
+	if err != nil {
+		return nil, fmt.Errorf("error reading private key: %v", err.Error())
 	}
+	return newOcCredFromBytes(KEY_TYPE_P256, d.Bytes())
+}
 
-	ocCred := OcCred{
-		Priv: &priv,
+func newOcCredFromBytes(t KeyType, b []byte) (*OcCred, error) {
+	key, err := privKeyFromBytes(t, b)
+	if err != nil {
+		return nil, err
 	}
-
-	return &ocCred, nil
+	return &OcCred{key: key}, nil
 }
 
 func getReqSigDataHash(req *msg.OcReq) ([]byte, error) {
@@ -137,16 +142,41 @@ func getReqSigDataHash(req *msg.OcReq) ([]byte, error) {
 }
 
 func (o *OcCred) ID() msg.OcID {
-	// TODO(ortutay): compress pub key
-	return msg.OcID(fmt.Sprintf("%c%x,%x",
-		OC_ID_PREFIX, o.Priv.PublicKey.X, o.Priv.PublicKey.Y))
+	return encodeOcID(o.key.Public())
+}
+
+func (o *OcCred) KeyType() KeyType {
+	return o.key.Public().Type()
 }
 
+// The key for data the identity stores, such as encrypted uploads. It is
+// derived from the private key, unless the key inherited one from the key it
+// was rotated or delegated from.
+func (o *OcCred) StoreKey() []byte {
+	if o.storeKey != nil {
+		return o.storeKey
+	}
+	return append(o.DeriveKey("store-master"), o.DeriveKey("store-convergence")...)
+}
+
+// Derives a 32 byte secret key from the private key. Different purposes yield
+// independent keys.
+func (o *OcCred) DeriveKey(purpose string) []byte {
+	// Without leading zeros, so P-256 keys derive what they did as big.Ints
+	h := hmac.New(sha256.New, bytes.TrimLeft(o.key.Bytes(), "\x00"))
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// Stores the key in the old, unencrypted format, which is only for P-256 keys.
 func (o *OcCred) StorePrivateKey(filename string) error {
+	if o.KeyType() != KEY_TYPE_P256 {
+		return UNKNOWN_KEY_TYPE
+	}
 	if filename == "" {
 		filename = PRIVATE_KEY_FILENAME
 	}
-	d := fmt.Sprintf("%x\n", o.Priv.D)
+	d := fmt.Sprintf("%x\n", new(big.Int).SetBytes(o.key.Bytes()))
 	err := util.StoreAppData(filename, []byte(d), 0600)
 	if err != nil {
 		return fmt.Errorf("error storing app data: %v", err.Error())
@@ -159,31 +189,46 @@ func (o *OcCred) SignOcReq(req *msg.OcReq) error {
 	if err != nil {
 		return err
 	}
-
-	randBytes := make([]byte, SIG_RAND_NUM_BYTES)
-	_, err = rand.Read(randBytes)
-	if err != nil {
-		return errors.New("error generating random bytes")
-	}
-
-	r, s, err := ecdsa.Sign(bytes.NewReader(randBytes), o.Priv, h)
+	sig, err := o.key.Sign(h)
 	if err != nil {
-		return fmt.Errorf("error during ECDSA signature: %v", err.Error())
+		return err
 	}
-	req.ID = o.ID()
-	req.Sig = fmt.Sprintf("%x,%x", r, s)
+	req.ID = o.Identity()
+	req.Certs = o.Certs
+	req.Sig = sig
 
 	return nil
 }
 
-func VerifyOcReqSig(req *msg.OcReq, conf *util.BitcoindConf) (bool, error) {
+// Signs arbitrary data, such as statements given to peers. Verify with
+// VerifyOcSig.
+func (o *OcCred) Sign(data []byte) (string, error) {
+	h := sha256.Sum256(data)
+	return o.key.Sign(h[:])
+}
+
+// Whether sig is a signature of data by ocID, as made by OcCred.Sign.
+func VerifyOcSig(ocID msg.OcID, data []byte, sig string) bool {
+	h := sha256.Sum256(data)
+	return verifyOcSig(h[:], ocID, sig)
+}
+
+func VerifyOcReqSig(req *msg.OcReq) (bool, error) {
 	h, err := getReqSigDataHash(req)
 	if err != nil {
 		return false, err
 	}
 
 	if req.ID != "" {
-		ok := verifyOcSig(h, req.ID, req.Sig)
+		signer := req.ID
+		if len(req.Certs) != 0 {
+			signer, err = VerifyCertChain(req.ID, req.Certs, req.Service, req.Method,
+				time.Now().Unix())
+			if err != nil {
+				return false, nil
+			}
+		}
+		ok := verifyOcSig(h, signer, req.Sig)
 		if !ok {
 			return false, nil
 		}
@@ -196,10 +241,7 @@ func VerifyOcReqSig(req *msg.OcReq, conf *util.BitcoindConf) (bool, error) {
 
 		switch coin[0] {
 		case '1', 'm', 'n':
-			if conf == nil {
-				return false, errors.New("need bitcoind conf to verify btc cred")
-			}
-			ok, err := verifyBtcSig(h, coin, coinSig, conf)
+			ok, err := verifyBtcSig(h, coin, coinSig)
 			if err != nil {
 				return false, err
 			}
@@ -216,144 +258,27 @@ func VerifyOcReqSig(req *msg.OcReq, conf *util.BitcoindConf) (bool, error) {
 }
 
 func verifyOcSig(reqHash []byte, ocID msg.OcID, sig string) bool {
-	ocCredReader := strings.NewReader(ocID.String())
-	var x, y, r, s big.Int
-	n, err := fmt.Fscanf(ocCredReader, string(OC_ID_PREFIX)+"%x,%x", &x, &y)
+	pub, err := ParseOcID(ocID)
 	if err != nil {
 		return false
 	}
-	n, err = ocCredReader.Read(make([]byte, 1))
-	if n != 0 || err != io.EOF {
-		return false
-	}
-
-	sigReader := strings.NewReader(sig)
-	n, err = fmt.Fscanf(sigReader, "%x,%x", &r, &s)
-	if err != nil {
-		return false
-	}
-	n, err = sigReader.Read(make([]byte, 1))
-	if n != 0 || err != io.EOF {
-		return false
-	}
-
-	curve := elliptic.P256()
-	pub := ecdsa.PublicKey{
-		Curve: curve,
-		X:     &x,
-		Y:     &y,
-	}
-	return ecdsa.Verify(&pub, reqHash, &r, &s)
+	return pub.Verify(reqHash, sig)
 }
 
 type BtcCred struct {
 	Addr string
 }
 
-type addressBalance struct {
-	Address string
-	Amount  int64
-}
-
-type byAmount []addressBalance
-
-func (a byAmount) Len() int           { return len(a) }
-func (a byAmount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byAmount) Less(i, j int) bool { return a[i].Amount < a[j].Amount }
-
-func inputsInRange(unspent *[]addressBalance, min, max int64, iter int, right int) (*[]BtcCred, error) {
-	// Assume list is already sorted
-	if iter == 0 {
-		return nil, fmt.Errorf("couldn't find matching inputs")
-	}
-	for i := right; i >= 0; i-- {
-		u := (*unspent)[i]
-		bc := BtcCred{Addr: u.Address}
-		amt := u.Amount
-		if amt > max {
-			continue
-		}
-		if iter == 1 {
-			if amt >= min {
-				return &[]BtcCred{bc}, nil
-			}
-		} else {
-			r, _ := inputsInRange(unspent, min-amt, max-amt, iter-1, i-1)
-			if r != nil {
-				result := append(*r, bc)
-				return &result, nil
-			}
-		}
-	}
-	return nil, fmt.Errorf("couldn't find matching inputs")
-}
-
-func GetBtcCredInRange(min, max int64, conf *util.BitcoindConf) (*[]BtcCred, error) {
-	cmd, err := btcjson.NewListUnspentCmd("")
-	if err != nil {
-		return nil, fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	resp, err := util.SendBtcRpc(cmd, conf)
-	if err != nil {
-		return nil, fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	if resp.Error != nil {
-		return nil, fmt.Errorf("error during bitcoind JSON-RPC: %v", resp.Error)
-	}
-	addrs := make(map[string]*addressBalance)
-	unspent := resp.Result.([]btcjson.ListUnSpentResult)
-	for _, u := range unspent {
-		if _, ok := addrs[u.Address]; !ok {
-			addrs[u.Address] = &addressBalance{
-				Address: u.Address,
-				Amount:  0,
-			}
-		}
-		ab := addrs[u.Address]
-		ab.Amount += util.B2S(u.Amount)
-	}
-	addrsList := make([]addressBalance, len(addrs))
-	i := 0
-	for _, v := range addrs {
-		addrsList[i] = *v
-		i++
-	}
-	sort.Sort(byAmount(addrsList))
-	var use *[]BtcCred
-	for iter := 1; iter <= 5; iter++ {
-		use, err = inputsInRange(&addrsList, min, max, iter, len(addrsList)-1)
-		if use != nil {
-			break
-		}
-	}
-	if err != nil {
-		return nil, err
-	}
-	return use, nil
-}
-
-func (bc *BtcCred) SignOcReq(req *msg.OcReq, conf *util.BitcoindConf) error {
+func (bc *BtcCred) SignOcReq(req *msg.OcReq, b btc.Backend) error {
 	h, err := getReqSigDataHash(req)
 	if err != nil {
 		return err
 	}
 	hb64 := base64.StdEncoding.EncodeToString(h)
 
-	msg, err := btcjson.NewSignMessageCmd(nil, bc.Addr, hb64)
-	if err != nil {
-		return fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	json, err := msg.MarshalJSON()
-	if err != nil {
-		return fmt.Errorf("error while marshaling: %v", err.Error())
-	}
-	resp, err := btcjson.RpcCommand(conf.User, conf.Password, conf.Server, json)
+	sig, err := b.SignMessage(bc.Addr, hb64)
 	if err != nil {
-		return fmt.Errorf("error while making bitcoind JSON-RPC: %v", err.Error())
-	}
-	sig, ok := resp.Result.(string)
-	if !ok {
-		return errors.New("error during bitcoind JSON-RPC")
+		return fmt.Errorf("error while signing with %v: %v", bc.Addr, err.Error())
 	}
 
 	req.Coins = append(req.Coins, fmt.Sprintf(bc.Addr))
@@ -362,29 +287,8 @@ func (bc *BtcCred) SignOcReq(req *msg.OcReq, conf *util.BitcoindConf) error {
 	return nil
 }
 
-func verifyBtcSig(reqHash []byte, addr string, sig string, conf *util.BitcoindConf) (bool, error) {
+// Verified natively, so no bitcoind is needed to authenticate coins.
+func verifyBtcSig(reqHash []byte, addr string, sig string) (bool, error) {
 	hb64 := base64.StdEncoding.EncodeToString(reqHash)
-
-	msg, err := btcjson.NewVerifyMessageCmd(nil, addr, sig, hb64)
-	if err != nil {
-		return false, fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	json, err := msg.MarshalJSON()
-	if err != nil {
-		return false, fmt.Errorf("error while marshaling: %v", err.Error())
-	}
-	resp, err := btcjson.RpcCommand(conf.User, conf.Password, conf.Server, json)
-	if err != nil {
-		return false, fmt.Errorf(
-			"error while making bitcoind JSON-RPC: %v", err.Error())
-	}
-	if resp.Error != nil {
-		return false, resp.Error
-	}
-	verifyResult, ok := resp.Result.(bool)
-	if !ok {
-		return false, fmt.Errorf("error during bitcoind JSON-RPC: %v", err.Error())
-	}
-
-	return verifyResult, nil
+	return btc.VerifyMessage(addr, sig, hb64)
 }
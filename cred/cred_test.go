@@ -1,15 +1,15 @@
 package cred
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
-	"github.com/conformal/btcjson"
+	"github.com/ortutay/decloud/btc"
 	"github.com/ortutay/decloud/msg"
-	"github.com/ortutay/decloud/util"
 )
 
 var _ = fmt.Printf
@@ -32,9 +32,9 @@ func newReq() *msg.OcReq {
 }
 
 func TestNewOcCred(t *testing.T) {
-	_, err := NewOcCred()
-	if err != nil {
-		t.Errorf("%v", err)
+	ocCred := NewOcCred()
+	if ocCred.key == nil || ocCred.KeyType() != KEY_TYPE_P256 {
+		t.Errorf("expected a P-256 private key")
 	}
 }
 
@@ -42,10 +42,7 @@ func TestStoreAndLoadOcCred(t *testing.T) {
 	destDir, err := ioutil.TempDir("", "msgtest")
 	dest := destDir + "/tmp-nodeid-priv"
 
-	ocCred, err := NewOcCred()
-	if err != nil {
-		t.Errorf("%v", err)
-	}
+	ocCred := NewOcCred()
 
 	err = ocCred.StorePrivateKey(dest)
 	if err != nil {
@@ -57,12 +54,9 @@ func TestStoreAndLoadOcCred(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	priv := ocCred.Priv
-	priv2 := ocCred2.Priv
-	if priv.D.Cmp(priv2.D) != 0 ||
-		priv.PublicKey.X.Cmp(priv2.PublicKey.X) != 0 ||
-		priv.PublicKey.Y.Cmp(priv2.PublicKey.Y) != 0 {
-		t.Errorf("private keys differ:\n%v\n%v\n", priv.D, priv2.D)
+	if !bytes.Equal(ocCred.key.Bytes(), ocCred2.key.Bytes()) ||
+		ocCred.ID() != ocCred2.ID() {
+		t.Errorf("private keys differ:\n%x\n%x\n", ocCred.key.Bytes(), ocCred2.key.Bytes())
 	}
 
 	err = os.RemoveAll(destDir)
@@ -74,17 +68,14 @@ func TestStoreAndLoadOcCred(t *testing.T) {
 func TestSignRequest(t *testing.T) {
 	ocReq := newReq()
 
-	ocCred, err := NewOcCred()
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
+	ocCred := NewOcCred()
 
-	err = ocCred.SignOcReq(ocReq)
+	err := ocCred.SignOcReq(ocReq)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
-	ok, err := VerifyOcReqSig(ocReq, nil)
+	ok, err := VerifyOcReqSig(ocReq)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -95,104 +86,57 @@ func TestSignRequest(t *testing.T) {
 
 func TestInvalidOcSignatureFails(t *testing.T) {
 	ocReq := newReq()
-	ocCred, err := NewOcCred()
-	if err != nil {
-		t.Errorf("%v", err)
-	}
+	ocCred := NewOcCred()
 
-	err = ocCred.SignOcReq(ocReq)
+	err := ocCred.SignOcReq(ocReq)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
 
 	originalSig := ocReq.Sig
 	ocReq.Sig = originalSig[0:len(originalSig)-2] + "1"
-	if ok, _ := VerifyOcReqSig(ocReq, nil); ok {
+	if ok, _ := VerifyOcReqSig(ocReq); ok {
 		t.Errorf("invalid sig %v verified", ocReq.Sig)
 	}
 
 	ocReq.Sig = originalSig + "x"
-	if ok, _ := VerifyOcReqSig(ocReq, nil); ok {
+	if ok, _ := VerifyOcReqSig(ocReq); ok {
 		t.Errorf("invalid sig %v verified", ocReq.Sig)
 	}
 
 	originalID := ocReq.ID
 	ocReq.ID = originalID[1:] + "1"
-	if ok, _ := VerifyOcReqSig(ocReq, nil); ok {
+	if ok, _ := VerifyOcReqSig(ocReq); ok {
 		t.Errorf("invalid node id %v verified", ocReq.ID)
 	}
 
-	if ok, _ := VerifyOcReqSig(ocReq, nil); ok {
+	if ok, _ := VerifyOcReqSig(ocReq); ok {
 		t.Errorf("invalid node id %v verified", ocReq.ID)
 	}
 }
 
-type AddressResult struct {
-	Address       string  `json:"address"`
-	Account       string  `json:"account"`
-	Amount        float64 `json:"amount"`
-	Confirmations int     `json:"confirmations"`
-}
-
-type ListReceivedByAddressResult struct {
-	Addresses []AddressResult
-}
-
-func getAnyBtcAddr(conf *util.BitcoindConf) (string, error) {
-	msg, err := btcjson.NewListReceivedByAddressCmd(nil, 0, true)
-	if err != nil {
-		return "", err
-	}
-
-	json, err := msg.MarshalJSON()
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := btcjson.RpcCommand(conf.User, conf.Password, conf.Server, json)
+func newTestWallet(t *testing.T) (*btc.FakeWallet, string) {
+	wallet := btc.NewFakeChain().NewWallet("cred-test")
+	addr, err := wallet.NewAddress()
 	if err != nil {
-		return "", err
+		t.Fatal(err)
 	}
-
-	for _, r := range resp.Result.([]interface{}) {
-		result := r.(map[string]interface{})
-		return result["address"].(string), nil
-	}
-
-	return "", errors.New("no address found")
-}
-
-func printBitcoindExpected() {
-	println("Note: bitcoind daemon expected to be running")
+	return wallet, addr
 }
 
 func TestBtcCredSign(t *testing.T) {
-	printBitcoindExpected()
-	conf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf("%v", err)
-	}
-
+	wallet, addr := newTestWallet(t)
 	ocReq := newReq()
-
-	addr, err := getAnyBtcAddr(conf)
-	if err != nil {
-		t.Errorf("%v", err)
-	}
-
-	if err != nil {
-		t.Errorf("%v", err)
-	}
 	btcCred := BtcCred{
 		Addr: addr,
 	}
 
-	err = btcCred.SignOcReq(ocReq, conf)
+	err := btcCred.SignOcReq(ocReq, wallet)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
 
-	ok, err := VerifyOcReqSig(ocReq, conf)
+	ok, err := VerifyOcReqSig(ocReq)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -202,77 +146,53 @@ func TestBtcCredSign(t *testing.T) {
 }
 
 func TestInvalidBtcSignatureFails(t *testing.T) {
-	printBitcoindExpected()
-	conf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf("%v", err)
-	}
-
+	wallet, addr := newTestWallet(t)
 	ocReq := newReq()
-
-	addr, err := getAnyBtcAddr(conf)
-	if err != nil {
-		t.Errorf("%v", err)
-	}
-
-	if err != nil {
-		t.Errorf("%v", err)
-	}
 	btcCred := BtcCred{
 		Addr: addr,
 	}
 
-	err = btcCred.SignOcReq(ocReq, conf)
+	err := btcCred.SignOcReq(ocReq, wallet)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
 
 	originalSig := ocReq.CoinSigs[0]
 	ocReq.CoinSigs[0] = originalSig[0:len(originalSig)-2] + "1"
-	ok, err := VerifyOcReqSig(ocReq, conf)
+	ok, err := VerifyOcReqSig(ocReq)
 	if ok {
 		t.Errorf("invalid sig %v verified", ocReq.CoinSigs[0])
 	}
-	if err == nil || err.Error() != "-5: Malformed base64 encoding" {
+	if err == nil || !strings.Contains(err.Error(), "Malformed base64 encoding") {
 		t.Errorf("expected malformed base64 encoding error, but got  %v", err)
 	}
+	ocReq.CoinSigs[0] = originalSig
 
 	originalID := ocReq.Coins[0]
 	ocReq.Coins[0] = originalID[0:len(originalID)-2] + "1"
-	ok, err = VerifyOcReqSig(ocReq, conf)
+	ok, err = VerifyOcReqSig(ocReq)
 	if ok {
 		t.Errorf("invalid node id %v verified", ocReq.Coins[0])
 	}
-	if err == nil || err.Error() != "-3: Invalid address" {
+	if err == nil || !strings.Contains(err.Error(), "Invalid address") {
 		t.Errorf("expected invalid address error, but got  %v", err)
 	}
 }
 
-func TestInputsInRangeFound(t *testing.T) {
-	addrsList := []addressBalance{
-		addressBalance{Amount: 100, Address: "123"},
-		addressBalance{Amount: 200, Address: "456"},
-		addressBalance{Amount: 300, Address: "789"},
-		addressBalance{Amount: 300, Address: "012"},
-	}
-	use, err := inputsInRange(&addrsList, 150, 350, 2, len(addrsList)-1)
+func TestSignData(t *testing.T) {
+	ocCred := NewOcCred()
+	data := []byte("statement")
+	sig, err := ocCred.Sign(data)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if (*use)[0].Addr != "123" || (*use)[1].Addr != "456" {
-		t.FailNow()
+	if !VerifyOcSig(ocCred.ID(), data, sig) {
+		t.Fatalf("expected signature to verify")
 	}
-}
-
-func TestInputsInRangeNotFound(t *testing.T) {
-	addrsList := []addressBalance{
-		addressBalance{Amount: 100, Address: "123"},
-		addressBalance{Amount: 200, Address: "456"},
-		addressBalance{Amount: 300, Address: "789"},
-		addressBalance{Amount: 300, Address: "012"},
+	if VerifyOcSig(ocCred.ID(), []byte("other statement"), sig) {
+		t.Fatalf("expected signature of other data to fail")
 	}
-	_, err := inputsInRange(&addrsList, 150, 350, 3, len(addrsList)-1)
-	if err == nil {
-		t.FailNow()
+	if VerifyOcSig(NewOcCred().ID(), data, sig) {
+		t.Fatalf("expected signature by other ID to fail")
 	}
 }
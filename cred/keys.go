@@ -0,0 +1,278 @@
+package cred
+
+// Keys an OcID can name. The type is carried in the ID's version byte, so any
+// ID can be verified without knowing its type up front. P-256 is the default;
+// secp256k1 lets an ID be the same key as a bitcoin wallet's, and Ed25519 is
+// the fastest to sign and verify. ECDSA signatures are the hex r and s, comma
+// separated; Ed25519 signatures are hex. Either way, what's signed is a
+// SHA-256 hash.
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+)
+
+type KeyType string
+
+const (
+	KEY_TYPE_P256      KeyType = "p256"
+	KEY_TYPE_SECP256K1 KeyType = "secp256k1"
+	KEY_TYPE_ED25519   KeyType = "ed25519"
+)
+
+var KEY_TYPES = []KeyType{KEY_TYPE_P256, KEY_TYPE_SECP256K1, KEY_TYPE_ED25519}
+
+var (
+	UNKNOWN_KEY_TYPE = errors.New("unknown key type")
+	INVALID_KEY      = errors.New("invalid private key")
+)
+
+// OcID version bytes, by key type.
+var ocIDVersions = map[KeyType]byte{
+	KEY_TYPE_P256:      0x01,
+	KEY_TYPE_SECP256K1: 0x02,
+	KEY_TYPE_ED25519:   0x03,
+}
+
+func ParseKeyType(s string) (KeyType, error) {
+	for _, t := range KEY_TYPES {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", UNKNOWN_KEY_TYPE
+}
+
+type PubKey interface {
+	Type() KeyType
+	Bytes() []byte // as encoded in the OcID
+	Verify(hash []byte, sig string) bool
+}
+
+type privKey interface {
+	Public() PubKey
+	Sign(hash []byte) (string, error)
+	Bytes() []byte // the secret, as kept in the keystore
+}
+
+func generateKey(t KeyType) (privKey, error) {
+	switch t {
+	case KEY_TYPE_P256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return p256Priv{priv}, nil
+	case KEY_TYPE_SECP256K1:
+		for {
+			scalar := make([]byte, 32)
+			_, err := rand.Read(scalar)
+			if err != nil {
+				return nil, err
+			}
+			if k, err := privKeyFromBytes(t, scalar); err == nil {
+				return k, nil
+			}
+		}
+	case KEY_TYPE_ED25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519Priv(priv), nil
+	}
+	return nil, UNKNOWN_KEY_TYPE
+}
+
+func privKeyFromBytes(t KeyType, b []byte) (privKey, error) {
+	switch t {
+	case KEY_TYPE_P256:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(b)
+		if d.Sign() <= 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, INVALID_KEY
+		}
+		x, y := curve.ScalarBaseMult(d.Bytes())
+		return p256Priv{&ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			D:         d,
+		}}, nil
+	case KEY_TYPE_SECP256K1:
+		d := new(big.Int).SetBytes(b)
+		if !btc.ValidSecp256k1PrivKey(d) {
+			return nil, INVALID_KEY
+		}
+		return secp256k1Priv{d}, nil
+	case KEY_TYPE_ED25519:
+		if len(b) != ed25519.SeedSize {
+			return nil, INVALID_KEY
+		}
+		return ed25519Priv(ed25519.NewKeyFromSeed(b)), nil
+	}
+	return nil, UNKNOWN_KEY_TYPE
+}
+
+func pubKeyFromBytes(t KeyType, b []byte) (PubKey, error) {
+	switch t {
+	case KEY_TYPE_P256:
+		curve := elliptic.P256()
+		x, y := elliptic.UnmarshalCompressed(curve, b)
+		if x == nil {
+			return nil, INVALID_OC_ID
+		}
+		return p256Pub{&ecdsa.PublicKey{Curve: curve, X: x, Y: y}}, nil
+	case KEY_TYPE_SECP256K1:
+		if !btc.ValidSecp256k1PubKey(b) {
+			return nil, INVALID_OC_ID
+		}
+		return secp256k1Pub(b), nil
+	case KEY_TYPE_ED25519:
+		if len(b) != ed25519.PublicKeySize {
+			return nil, INVALID_OC_ID
+		}
+		return ed25519Pub(b), nil
+	}
+	return nil, UNKNOWN_KEY_TYPE
+}
+
+func formatECDSASig(r *big.Int, s *big.Int) string {
+	return fmt.Sprintf("%x,%x", r, s)
+}
+
+func parseECDSASig(sig string) (*big.Int, *big.Int, bool) {
+	var r, s big.Int
+	sigReader := strings.NewReader(sig)
+	_, err := fmt.Fscanf(sigReader, "%x,%x", &r, &s)
+	if err != nil {
+		return nil, nil, false
+	}
+	n, err := sigReader.Read(make([]byte, 1))
+	if n != 0 || err != io.EOF {
+		return nil, nil, false
+	}
+	return &r, &s, true
+}
+
+func padTo32(b []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
+
+type p256Priv struct {
+	*ecdsa.PrivateKey
+}
+
+func (k p256Priv) Public() PubKey {
+	return p256Pub{&k.PublicKey}
+}
+
+func (k p256Priv) Sign(hash []byte) (string, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, k.PrivateKey, hash)
+	if err != nil {
+		return "", fmt.Errorf("error during ECDSA signature: %v", err.Error())
+	}
+	return formatECDSASig(r, s), nil
+}
+
+func (k p256Priv) Bytes() []byte {
+	return padTo32(k.D.Bytes())
+}
+
+type p256Pub struct {
+	*ecdsa.PublicKey
+}
+
+func (k p256Pub) Type() KeyType { return KEY_TYPE_P256 }
+
+func (k p256Pub) Bytes() []byte {
+	return elliptic.MarshalCompressed(k.Curve, k.X, k.Y)
+}
+
+func (k p256Pub) Verify(hash []byte, sig string) bool {
+	r, s, ok := parseECDSASig(sig)
+	return ok && ecdsa.Verify(k.PublicKey, hash, r, s)
+}
+
+type secp256k1Priv struct {
+	d *big.Int
+}
+
+func (k secp256k1Priv) Public() PubKey {
+	return secp256k1Pub(btc.Secp256k1PubKey(k.d))
+}
+
+func (k secp256k1Priv) Sign(hash []byte) (string, error) {
+	r, s := btc.Secp256k1Sign(k.d, hash)
+	return formatECDSASig(r, s), nil
+}
+
+func (k secp256k1Priv) Bytes() []byte {
+	return padTo32(k.d.Bytes())
+}
+
+type secp256k1Pub []byte // compressed
+
+func (k secp256k1Pub) Type() KeyType { return KEY_TYPE_SECP256K1 }
+
+func (k secp256k1Pub) Bytes() []byte { return []byte(k) }
+
+func (k secp256k1Pub) Verify(hash []byte, sig string) bool {
+	r, s, ok := parseECDSASig(sig)
+	return ok && btc.Secp256k1Verify(k, hash, r, s)
+}
+
+type ed25519Priv ed25519.PrivateKey
+
+func (k ed25519Priv) Public() PubKey {
+	return ed25519Pub(ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+
+func (k ed25519Priv) Sign(hash []byte) (string, error) {
+	return hex.EncodeToString(ed25519.Sign(ed25519.PrivateKey(k), hash)), nil
+}
+
+func (k ed25519Priv) Bytes() []byte {
+	return ed25519.PrivateKey(k).Seed()
+}
+
+type ed25519Pub []byte
+
+func (k ed25519Pub) Type() KeyType { return KEY_TYPE_ED25519 }
+
+func (k ed25519Pub) Bytes() []byte { return []byte(k) }
+
+func (k ed25519Pub) Verify(hash []byte, sig string) bool {
+	b, err := hex.DecodeString(sig)
+	return err == nil && len(b) == ed25519.SignatureSize &&
+		ed25519.Verify(ed25519.PublicKey(k), hash, b)
+}
+
+// Types of the keys req's identity passes through: its ID's, and each cert
+// subject's, down to the key that signed.
+func ReqKeyTypes(req *msg.OcReq) ([]KeyType, error) {
+	ids := []msg.OcID{req.ID}
+	for _, c := range req.Certs {
+		ids = append(ids, c.Subject)
+	}
+	types := make([]KeyType, 0, len(ids))
+	for _, id := range ids {
+		pub, err := ParseOcID(id)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, pub.Type())
+	}
+	return types, nil
+}
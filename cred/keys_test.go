@@ -0,0 +1,92 @@
+package cred
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/testutil"
+)
+
+func TestKeyTypes(t *testing.T) {
+	for i, keyType := range KEY_TYPES {
+		ocCred, err := NewOcCredOfType(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ParseOcID(ocCred.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub.Type() != keyType || ocCred.KeyType() != keyType {
+			t.Fatalf("expected %v, got %v", keyType, pub.Type())
+		}
+
+		req := signedReq(t, ocCred, "calc", "calc")
+		if ok, err := VerifyOcReqSig(req); !ok || err != nil {
+			t.Fatalf("expected %v request to verify, got %v %v", keyType, ok, err)
+		}
+		req.Args = []string{"456"}
+		if ok, _ := VerifyOcReqSig(req); ok {
+			t.Fatalf("expected altered %v request to fail", keyType)
+		}
+
+		// Signatures don't verify under a key of another type
+		other, _ := NewOcCredOfType(KEY_TYPES[(i+1)%len(KEY_TYPES)])
+		sig, _ := ocCred.Sign([]byte("data"))
+		if !VerifyOcSig(ocCred.ID(), []byte("data"), sig) ||
+			VerifyOcSig(other.ID(), []byte("data"), sig) {
+			t.Fatalf("unexpected verification of %v signature", keyType)
+		}
+	}
+	if _, err := NewOcCredOfType("rsa"); err != UNKNOWN_KEY_TYPE {
+		t.Fatalf("expected %v, got %v", UNKNOWN_KEY_TYPE, err)
+	}
+}
+
+func TestOcCredFromWIF(t *testing.T) {
+	ocCred, err := NewOcCredFromWIF("KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := ParseOcID(ocCred.ID())
+	if btc.PubKeyAddress(pub.Bytes(), 0x00) != "1LoVGDgRs9hTfTNJNuXKSpywcbdvwRXpmK" {
+		t.Fatalf("expected the wallet's key, got %x", pub.Bytes())
+	}
+	if _, err := NewOcCredFromWIF("not a key"); err != btc.INVALID_WIF {
+		t.Fatalf("expected %v, got %v", btc.INVALID_WIF, err)
+	}
+}
+
+func TestKeystoreKeyTypes(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, _ := LoadKeystore("")
+	for _, keyType := range KEY_TYPES {
+		ocCred, _ := NewOcCredOfType(keyType)
+		ks.Add(string(keyType), ocCred, "pass")
+		unlocked, err := ks.Unlock(string(keyType), "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unlocked.ID() != ocCred.ID() {
+			t.Fatalf("expected %v, got %v", ocCred.ID(), unlocked.ID())
+		}
+	}
+}
+
+func TestReqKeyTypes(t *testing.T) {
+	root, _ := NewOcCredOfType(KEY_TYPE_SECP256K1)
+	device, _ := NewDelegatedOcCred(root, []string{"*"}, time.Now().Add(time.Hour).Unix())
+	types, err := ReqKeyTypes(signedReq(t, device, "calc", "calc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0] != KEY_TYPE_SECP256K1 || types[1] != KEY_TYPE_SECP256K1 {
+		t.Fatalf("unexpected key types: %v", types)
+	}
+	if _, err := ReqKeyTypes(&msg.OcReq{ID: "cbad"}); err == nil {
+		t.Fatalf("expected error for an invalid ID")
+	}
+}
@@ -0,0 +1,401 @@
+package cred
+
+// Passphrase protected storage for identities. The keystore is a versioned
+// JSON file of named identities; each private key is encrypted with
+// AES-256-GCM, under a key derived from the passphrase with scrypt. The GCM
+// tag catches corruption and wrong passphrases, and the decrypted key must
+// match the ID stored with it.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KEYSTORE_FILENAME = "keystore.json"
+	KEYSTORE_VERSION  = 1
+	DEFAULT_IDENTITY  = "default"
+	PASSPHRASE_ENV    = "DECLOUD_PASSPHRASE"
+
+	KDF_SCRYPT = "scrypt"
+	CIPHER_AES = "aes-256-gcm"
+
+	SCRYPT_N       = 1 << 15
+	SCRYPT_R       = 8
+	SCRYPT_P       = 1
+	SCRYPT_KEY_LEN = 32
+	SALT_BYTES     = 16
+)
+
+var (
+	WRONG_PASSPHRASE = errors.New("wrong passphrase, or corrupt key")
+	UNKNOWN_IDENTITY = errors.New("no identity by that name")
+	IDENTITY_EXISTS  = errors.New("an identity by that name exists")
+	CORRUPT_KEYSTORE = errors.New("corrupt keystore")
+	EMPTY_PASSPHRASE = errors.New("empty passphrase; give one, or allow an empty one explicitly")
+)
+
+type KeyInfo struct {
+	Name    string   `json:"name"`
+	ID      msg.OcID `json:"id"`
+	KeyType KeyType  `json:"keyType"`
+	Created int64    `json:"created"`
+
+	// Certs from the identity the key acts for; they carry their own
+	// signatures
+	Certs []msg.OcCert `json:"certs,omitempty"`
+}
+
+type ScryptParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"` // hex
+}
+
+type EncryptedKey struct {
+	KeyInfo
+	KDF        string       `json:"kdf"`
+	KDFParams  ScryptParams `json:"kdfParams"`
+	Cipher     string       `json:"cipher"`
+	Nonce      string       `json:"nonce"`      // hex
+	Ciphertext string       `json:"ciphertext"` // hex, of the private scalar or Ed25519 seed
+
+	// An inherited store key, under the same key; absent if it is derived
+	StoreNonce      string `json:"storeNonce,omitempty"`      // hex
+	StoreCiphertext string `json:"storeCiphertext,omitempty"` // hex
+}
+
+type Keystore struct {
+	Version    int                      `json:"version"`
+	Identities map[string]*EncryptedKey `json:"identities"`
+
+	filename string
+}
+
+// Loads the keystore in the app dir, or an empty one if there is none yet.
+// An empty filename is KEYSTORE_FILENAME.
+func LoadKeystore(filename string) (*Keystore, error) {
+	if filename == "" {
+		filename = KEYSTORE_FILENAME
+	}
+	ks := Keystore{
+		Version:    KEYSTORE_VERSION,
+		Identities: make(map[string]*EncryptedKey),
+		filename:   filename,
+	}
+	file, err := util.GetAppData(filename)
+	if os.IsNotExist(err) {
+		return &ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &ks)
+	if err != nil || ks.Identities == nil {
+		return nil, CORRUPT_KEYSTORE
+	}
+	if ks.Version != KEYSTORE_VERSION {
+		return nil, fmt.Errorf("unsupported keystore version %v", ks.Version)
+	}
+	return &ks, nil
+}
+
+func (ks *Keystore) Save() error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.StoreAppData(ks.filename, data, 0600)
+}
+
+// Identities in the keystore, by name.
+func (ks *Keystore) List() []KeyInfo {
+	infos := make([]KeyInfo, 0, len(ks.Identities))
+	for _, ek := range ks.Identities {
+		infos = append(infos, ek.KeyInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Adds o as name, encrypted with passphrase. Call Save to keep it.
+func (ks *Keystore) Add(name string, o *OcCred, passphrase string) error {
+	if _, ok := ks.Identities[name]; ok {
+		return IDENTITY_EXISTS
+	}
+	ek, err := encryptKey(name, o, passphrase, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	ks.Identities[name] = ek
+	return nil
+}
+
+func (ks *Keystore) Remove(name string) error {
+	if _, ok := ks.Identities[name]; !ok {
+		return UNKNOWN_IDENTITY
+	}
+	delete(ks.Identities, name)
+	return nil
+}
+
+// Decrypts the identity called name.
+func (ks *Keystore) Unlock(name string, passphrase string) (*OcCred, error) {
+	ek, ok := ks.Identities[name]
+	if !ok {
+		return nil, UNKNOWN_IDENTITY
+	}
+	return ek.decrypt(passphrase)
+}
+
+func (ks *Keystore) ChangePassphrase(name string, old string, new string) error {
+	o, err := ks.Unlock(name, old)
+	if err != nil {
+		return err
+	}
+	ek, err := encryptKey(name, o, new, ks.Identities[name].Created)
+	if err != nil {
+		return err
+	}
+	ks.Identities[name] = ek
+	return nil
+}
+
+// The identity called name, still encrypted, for moving to another keystore
+// with Import.
+func (ks *Keystore) Export(name string) ([]byte, error) {
+	ek, ok := ks.Identities[name]
+	if !ok {
+		return nil, UNKNOWN_IDENTITY
+	}
+	return json.MarshalIndent(ek, "", "  ")
+}
+
+// Adds an exported identity as name, once it is checked to decrypt with its
+// passphrase.
+func (ks *Keystore) Import(name string, data []byte, passphrase string) error {
+	if _, ok := ks.Identities[name]; ok {
+		return IDENTITY_EXISTS
+	}
+	var ek EncryptedKey
+	err := json.Unmarshal(data, &ek)
+	if err != nil {
+		return CORRUPT_KEYSTORE
+	}
+	_, err = ek.decrypt(passphrase)
+	if err != nil {
+		return err
+	}
+	ek.Name = name
+	ks.Identities[name] = &ek
+	return nil
+}
+
+func scryptKey(passphrase string, params *ScryptParams) ([]byte, error) {
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, CORRUPT_KEYSTORE
+	}
+	return scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P,
+		SCRYPT_KEY_LEN)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptKey(name string, o *OcCred, passphrase string, created int64) (*EncryptedKey, error) {
+	salt := make([]byte, SALT_BYTES)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	ek := EncryptedKey{
+		KeyInfo: KeyInfo{
+			Name:    name,
+			ID:      o.ID(),
+			KeyType: o.KeyType(),
+			Created: created,
+			Certs:   o.Certs,
+		},
+		KDF: KDF_SCRYPT,
+		KDFParams: ScryptParams{
+			N:    SCRYPT_N,
+			R:    SCRYPT_R,
+			P:    SCRYPT_P,
+			Salt: hex.EncodeToString(salt),
+		},
+		Cipher: CIPHER_AES,
+	}
+	key, err := scryptKey(passphrase, &ek.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	ek.Nonce = hex.EncodeToString(nonce)
+	ek.Ciphertext = hex.EncodeToString(gcm.Seal(nil, nonce, o.key.Bytes(), ek.additionalData()))
+	if o.storeKey != nil {
+		storeNonce := make([]byte, gcm.NonceSize())
+		_, err = rand.Read(storeNonce)
+		if err != nil {
+			return nil, err
+		}
+		ek.StoreNonce = hex.EncodeToString(storeNonce)
+		ek.StoreCiphertext = hex.EncodeToString(gcm.Seal(nil, storeNonce, o.storeKey,
+			ek.storeAdditionalData()))
+	}
+	return &ek, nil
+}
+
+// The metadata is authenticated along with the key, so it can't be altered
+// either.
+func (ek *EncryptedKey) additionalData() []byte {
+	return []byte(fmt.Sprintf("%v|%v|%v", ek.ID, ek.KeyType, ek.Created))
+}
+
+func (ek *EncryptedKey) storeAdditionalData() []byte {
+	return append(ek.additionalData(), "|store"...)
+}
+
+func (ek *EncryptedKey) decrypt(passphrase string) (*OcCred, error) {
+	if _, err := ParseKeyType(string(ek.KeyType)); ek.KDF != KDF_SCRYPT || ek.Cipher != CIPHER_AES || err != nil {
+		return nil, fmt.Errorf("unsupported key: %v, %v, %v", ek.KDF, ek.Cipher, ek.KeyType)
+	}
+	key, err := scryptKey(passphrase, &ek.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(ek.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, CORRUPT_KEYSTORE
+	}
+	ciphertext, err := hex.DecodeString(ek.Ciphertext)
+	if err != nil {
+		return nil, CORRUPT_KEYSTORE
+	}
+	secret, err := gcm.Open(nil, nonce, ciphertext, ek.additionalData())
+	if err != nil {
+		return nil, WRONG_PASSPHRASE
+	}
+	o, err := newOcCredFromBytes(ek.KeyType, secret)
+	if err != nil {
+		return nil, err
+	}
+	if o.ID() != ek.ID {
+		return nil, CORRUPT_KEYSTORE
+	}
+	o.Certs = ek.Certs
+	if ek.StoreCiphertext != "" {
+		storeNonce, err := hex.DecodeString(ek.StoreNonce)
+		if err != nil || len(storeNonce) != gcm.NonceSize() {
+			return nil, CORRUPT_KEYSTORE
+		}
+		storeCiphertext, err := hex.DecodeString(ek.StoreCiphertext)
+		if err != nil {
+			return nil, CORRUPT_KEYSTORE
+		}
+		o.storeKey, err = gcm.Open(nil, storeNonce, storeCiphertext, ek.storeAdditionalData())
+		if err != nil || len(o.storeKey) != STORE_KEY_BYTES {
+			return nil, CORRUPT_KEYSTORE
+		}
+	}
+	return o, nil
+}
+
+// The passphrase in filename, or if empty, in the DECLOUD_PASSPHRASE
+// environment variable. An empty passphrase, eg. from an unset variable, is
+// EMPTY_PASSPHRASE unless allowEmpty.
+func ReadPassphrase(filename string, allowEmpty bool) (string, error) {
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if filename != "" {
+		data, err := ioutil.ReadFile(util.ExpandHome(filename))
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	if passphrase == "" && !allowEmpty {
+		return "", EMPTY_PASSPHRASE
+	}
+	return passphrase, nil
+}
+
+// Unlocks the identity called name, creating it if the keystore has none by
+// that name. A key stored in the old PRIVATE_KEY_FILENAME format becomes the
+// default identity, and the old file is removed.
+func LoadIdentity(name string, passphrase string) (*OcCred, error) {
+	if name == "" {
+		name = DEFAULT_IDENTITY
+	}
+	ks, err := LoadKeystore("")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ks.Identities[name]; ok {
+		return ks.Unlock(name, passphrase)
+	}
+	var o *OcCred
+	migrated := false
+	if file, _ := util.GetAppData(PRIVATE_KEY_FILENAME); file != nil && name == DEFAULT_IDENTITY {
+		file.Close()
+		o, err = NewOcCredLoadFromFile(PRIVATE_KEY_FILENAME)
+		if err != nil {
+			return nil, err
+		}
+		migrated = true
+	} else {
+		o = NewOcCred()
+	}
+	err = ks.Add(name, o, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = ks.Save()
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		// The key is in the keystore now; don't leave it in plaintext too
+		err = os.Remove(util.AppDir() + "/" + PRIVATE_KEY_FILENAME)
+		if err != nil {
+			log.Printf("couldn't remove old key file %v: %v\n", PRIVATE_KEY_FILENAME, err)
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,211 @@
+package cred
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/testutil"
+	"github.com/ortutay/decloud/util"
+)
+
+func TestKeystore(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, err := LoadKeystore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocCred := NewOcCred()
+	err = ks.Add("alice", ocCred, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ks.Add("alice", NewOcCred(), "hunter2")
+	if err != IDENTITY_EXISTS {
+		t.Fatalf("expected %v, got %v", IDENTITY_EXISTS, err)
+	}
+	err = ks.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err = LoadKeystore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := ks.List()
+	if len(infos) != 1 || infos[0].Name != "alice" || infos[0].ID != ocCred.ID() {
+		t.Fatalf("unexpected identities: %v", infos)
+	}
+	_, err = ks.Unlock("alice", "wrong")
+	if err != WRONG_PASSPHRASE {
+		t.Fatalf("expected %v, got %v", WRONG_PASSPHRASE, err)
+	}
+	_, err = ks.Unlock("bob", "hunter2")
+	if err != UNKNOWN_IDENTITY {
+		t.Fatalf("expected %v, got %v", UNKNOWN_IDENTITY, err)
+	}
+	unlocked, err := ks.Unlock("alice", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlocked.key.Bytes(), ocCred.key.Bytes()) {
+		t.Fatalf("unlocked a different key")
+	}
+
+	err = ks.ChangePassphrase("alice", "hunter2", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ks.Unlock("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeystoreTampered(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, _ := LoadKeystore("")
+	ks.Add("alice", NewOcCred(), "")
+
+	// Metadata is authenticated with the key
+	ks.Identities["alice"].Created++
+	_, err := ks.Unlock("alice", "")
+	if err != WRONG_PASSPHRASE {
+		t.Fatalf("expected %v, got %v", WRONG_PASSPHRASE, err)
+	}
+
+	err = util.StoreAppData(KEYSTORE_FILENAME, []byte("{\"version\": 1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadKeystore("")
+	if err != CORRUPT_KEYSTORE {
+		t.Fatalf("expected %v, got %v", CORRUPT_KEYSTORE, err)
+	}
+}
+
+func TestKeystoreExportImport(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, _ := LoadKeystore("")
+	ocCred := NewOcCred()
+	ks.Add("alice", ocCred, "pass")
+	data, err := ks.Export("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks2, _ := LoadKeystore("other.json")
+	err = ks2.Import("work", data, "wrong")
+	if err != WRONG_PASSPHRASE {
+		t.Fatalf("expected %v, got %v", WRONG_PASSPHRASE, err)
+	}
+	err = ks2.Import("work", data, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked, err := ks2.Unlock("work", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked.ID() != ocCred.ID() {
+		t.Fatalf("imported a different key")
+	}
+
+	var ek EncryptedKey
+	json.Unmarshal(data, &ek)
+	ek.ID = NewOcCred().ID()
+	data, _ = json.Marshal(&ek)
+	err = ks2.Import("other", data, "pass")
+	if err == nil {
+		t.Fatalf("expected error importing a key with the wrong ID")
+	}
+}
+
+func TestLoadIdentityMigrates(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ocCred := NewOcCred()
+	err := ocCred.StorePrivateKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIdentity("", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID() != ocCred.ID() {
+		t.Fatalf("expected the legacy key to be migrated")
+	}
+	if file, _ := util.GetAppData(PRIVATE_KEY_FILENAME); file != nil {
+		file.Close()
+		t.Fatalf("expected the legacy key file to be removed")
+	}
+	loaded, err = LoadIdentity(DEFAULT_IDENTITY, "pass")
+	if err != nil || loaded.ID() != ocCred.ID() {
+		t.Fatalf("expected the same key, got %v, %v", loaded, err)
+	}
+	_, err = LoadIdentity(DEFAULT_IDENTITY, "wrong")
+	if err != WRONG_PASSPHRASE {
+		t.Fatalf("expected %v, got %v", WRONG_PASSPHRASE, err)
+	}
+	other, err := LoadIdentity("other", "pass")
+	if err != nil || other.ID() == ocCred.ID() {
+		t.Fatalf("expected a new identity, got %v, %v", other, err)
+	}
+}
+
+func TestLoadCorruptPrivateKey(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	for _, data := range []string{"", "zz\n", "0\n",
+		"ffffffff00000000ffffffffffffffffbce6faada7179e84f3b9cac2fc632551\n"} {
+		util.StoreAppData(PRIVATE_KEY_FILENAME, []byte(data), 0600)
+		_, err := NewOcCredLoadFromFile("")
+		if err == nil {
+			t.Errorf("expected error loading %q", data)
+		}
+	}
+}
+
+func TestKeystoreKeepsCerts(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, _ := LoadKeystore("")
+	root := NewOcCred()
+	device, _ := NewDelegatedOcCred(root, []string{"store.get"}, 1234)
+	ks.Add("device", device, "")
+	unlocked, err := ks.Unlock("device", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked.Identity() != root.ID() || len(unlocked.Certs) != 1 {
+		t.Fatalf("expected the device's certs, got %v", unlocked.Certs)
+	}
+}
+
+func TestKeystoreKeepsStoreKey(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ks, _ := LoadKeystore("")
+	plain := NewOcCred()
+	ks.Add("plain", plain, "pass")
+	if ks.Identities["plain"].StoreCiphertext != "" {
+		t.Fatalf("expected no store key for a key that derives it")
+	}
+	inherited := NewOcCred()
+	inherited.storeKey = NewOcCred().StoreKey()
+	ks.Add("inherited", inherited, "pass")
+	ks.ChangePassphrase("inherited", "pass", "new pass")
+	ks.Save()
+
+	ks, _ = LoadKeystore("")
+	unlocked, err := ks.Unlock("inherited", "new pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unlocked.StoreKey(), inherited.StoreKey()) {
+		t.Fatalf("expected the inherited store key")
+	}
+	unlocked, _ = ks.Unlock("plain", "pass")
+	if !bytes.Equal(unlocked.StoreKey(), plain.StoreKey()) {
+		t.Fatalf("expected the derived store key")
+	}
+}
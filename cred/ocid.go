@@ -0,0 +1,99 @@
+package cred
+
+// OcIDs are OC_ID_PREFIX followed by the base58check encoding of a version
+// byte, which gives the key type, and the public key, so a mistyped ID fails
+// its checksum rather than naming some other key. IDs used to be the prefix
+// and the hex X and Y coordinates of a P-256 key, comma separated; those still
+// parse, and CanonicalOcID turns them into the compact form.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+)
+
+var INVALID_OC_ID = errors.New("invalid OcID")
+
+func encodeOcID(pub PubKey) msg.OcID {
+	payload := append([]byte{ocIDVersions[pub.Type()]}, pub.Bytes()...)
+	return msg.OcID(string(OC_ID_PREFIX) + btc.Base58CheckEncode(payload))
+}
+
+// The public key named by ocID, in either the compact or the long form.
+func ParseOcID(ocID msg.OcID) (PubKey, error) {
+	s := ocID.String()
+	if len(s) == 0 || s[0] != OC_ID_PREFIX {
+		return nil, INVALID_OC_ID
+	}
+	if IsLegacyOcID(ocID) {
+		return parseLegacyOcID(s)
+	}
+	payload, ok := btc.Base58CheckDecode(s[1:])
+	if !ok || len(payload) == 0 {
+		return nil, INVALID_OC_ID
+	}
+	for t, version := range ocIDVersions {
+		if payload[0] == version {
+			return pubKeyFromBytes(t, payload[1:])
+		}
+	}
+	return nil, INVALID_OC_ID
+}
+
+func parseLegacyOcID(s string) (PubKey, error) {
+	var x, y big.Int
+	r := strings.NewReader(s)
+	_, err := fmt.Fscanf(r, string(OC_ID_PREFIX)+"%x,%x", &x, &y)
+	if err != nil {
+		return nil, INVALID_OC_ID
+	}
+	n, err := r.Read(make([]byte, 1))
+	if n != 0 || err != io.EOF {
+		return nil, INVALID_OC_ID
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(&x, &y) {
+		return nil, INVALID_OC_ID
+	}
+	return p256Pub{&ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}}, nil
+}
+
+// Whether ocID is in the long form, which may need migrating.
+func IsLegacyOcID(ocID msg.OcID) bool {
+	return strings.Contains(ocID.String(), ",")
+}
+
+// The compact form of ocID.
+func CanonicalOcID(ocID msg.OcID) (msg.OcID, error) {
+	if !IsLegacyOcID(ocID) {
+		// Still validated, so callers can rely on the result being an ID
+		_, err := ParseOcID(ocID)
+		return ocID, err
+	}
+	pub, err := ParseOcID(ocID)
+	if err != nil {
+		return "", err
+	}
+	return encodeOcID(pub), nil
+}
+
+// The long form of ocID, for finding data stored under it. Only P-256 IDs have
+// one.
+func LegacyOcID(ocID msg.OcID) (msg.OcID, error) {
+	pub, err := ParseOcID(ocID)
+	if err != nil {
+		return "", err
+	}
+	p256, ok := pub.(p256Pub)
+	if !ok {
+		return "", INVALID_OC_ID
+	}
+	return msg.OcID(fmt.Sprintf("%c%x,%x", OC_ID_PREFIX, p256.X, p256.Y)), nil
+}
@@ -0,0 +1,76 @@
+package cred
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ortutay/decloud/msg"
+)
+
+func TestOcIDRoundTrip(t *testing.T) {
+	ocCred := NewOcCred()
+	id := ocCred.ID()
+	if len(id) > 60 || id[0] != OC_ID_PREFIX || IsLegacyOcID(id) {
+		t.Fatalf("expected a compact ID, got %v", id)
+	}
+	pub, err := ParseOcID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Bytes(), ocCred.key.Public().Bytes()) {
+		t.Fatalf("parsed a different key")
+	}
+}
+
+func TestOcIDRejectsTypos(t *testing.T) {
+	id := string(NewOcCred().ID())
+	for i := 1; i < len(id); i++ {
+		c := byte('2')
+		if id[i] == c {
+			c = '3'
+		}
+		typo := msg.OcID(id[:i] + string(c) + id[i+1:])
+		if _, err := ParseOcID(typo); err != INVALID_OC_ID {
+			t.Fatalf("expected %v for %v, got %v", INVALID_OC_ID, typo, err)
+		}
+	}
+	for _, bad := range []string{"", "c", "x" + id[1:], id[:len(id)-1], id + "1"} {
+		if _, err := ParseOcID(msg.OcID(bad)); err != INVALID_OC_ID {
+			t.Errorf("expected %v for %q, got %v", INVALID_OC_ID, bad, err)
+		}
+	}
+}
+
+func TestLegacyOcID(t *testing.T) {
+	ocCred := NewOcCred()
+	legacy, err := LegacyOcID(ocCred.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLegacyOcID(legacy) || !strings.HasPrefix(legacy.String(), "c") {
+		t.Fatalf("expected a long form ID, got %v", legacy)
+	}
+	canonical, err := CanonicalOcID(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical != ocCred.ID() {
+		t.Fatalf("expected %v, got %v", ocCred.ID(), canonical)
+	}
+	if _, err := CanonicalOcID("c1234,5678"); err != INVALID_OC_ID {
+		t.Fatalf("expected %v for a point off the curve, got %v", INVALID_OC_ID, err)
+	}
+
+	// Requests signed under the long form still verify
+	req := newReq()
+	err = ocCred.SignOcReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ID = legacy
+	ok, err := VerifyOcReqSig(req)
+	if err != nil || !ok {
+		t.Fatalf("expected the long form ID to verify, got %v %v", ok, err)
+	}
+}
@@ -0,0 +1,161 @@
+package crypt
+
+// Client side encryption for data handed to storage servers. The operator sees
+// only ciphertext, and blob IDs are hashes of the ciphertext, so stored data
+// cannot be read or fingerprinted.
+//
+// Every encrypted blob has its own content key, which is wrapped with the
+// user's master key and stored in the blob header:
+//
+//   [magic 4] [mode 1] [wrap nonce 12] [wrapped key 48] [data nonce 12] [data]
+//
+// In RANDOM mode the content key and nonces are random. In CONVERGENT mode
+// they are derived from the plaintext (keyed with a per-user secret), so the
+// same file stored twice by the same user yields the same blob and is
+// de-duplicated by the server.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/ortutay/decloud/cred"
+)
+
+type Mode byte
+
+const (
+	RANDOM     Mode = 0
+	CONVERGENT Mode = 1
+)
+
+const (
+	KEY_BYTES    = 32
+	NONCE_BYTES  = 12
+	TAG_BYTES    = 16
+	HEADER_BYTES = 4 + 1 + NONCE_BYTES + KEY_BYTES + TAG_BYTES + NONCE_BYTES
+)
+
+var MAGIC = []byte("DCE1")
+
+var ErrNotEncrypted = errors.New("data is not encrypted")
+var ErrDecrypt = errors.New("could not decrypt, wrong key or corrupt data")
+
+// Keys used to encrypt store data, from the credential's store key.
+type Keys struct {
+	Master      []byte
+	Convergence []byte
+}
+
+func NewKeys(master []byte, convergence []byte) (*Keys, error) {
+	if len(master) != KEY_BYTES || len(convergence) != KEY_BYTES {
+		return nil, fmt.Errorf("expected %v byte keys", KEY_BYTES)
+	}
+	return &Keys{Master: master, Convergence: convergence}, nil
+}
+
+func NewKeysFromOcCred(ocCred *cred.OcCred) *Keys {
+	storeKey := ocCred.StoreKey()
+	return &Keys{
+		Master:      storeKey[:KEY_BYTES],
+		Convergence: storeKey[KEY_BYTES:],
+	}
+}
+
+func IsEncrypted(data []byte) bool {
+	return len(data) >= HEADER_BYTES && bytes.Equal(data[:len(MAGIC)], MAGIC)
+}
+
+func Encrypt(keys *Keys, plaintext []byte, mode Mode) ([]byte, error) {
+	var contentKey, wrapNonce, dataNonce []byte
+	switch mode {
+	case RANDOM:
+		contentKey = randBytes(KEY_BYTES)
+		wrapNonce = randBytes(NONCE_BYTES)
+		dataNonce = randBytes(NONCE_BYTES)
+	case CONVERGENT:
+		h := sha256.Sum256(plaintext)
+		contentKey = mac(keys.Convergence, h[:])
+		wrapNonce = mac(contentKey, []byte("wrap-nonce"))[:NONCE_BYTES]
+		dataNonce = mac(contentKey, []byte("data-nonce"))[:NONCE_BYTES]
+	default:
+		return nil, fmt.Errorf("unknown mode %v", mode)
+	}
+	if contentKey == nil || wrapNonce == nil || dataNonce == nil {
+		return nil, errors.New("error generating random bytes")
+	}
+
+	wrap, err := newGCM(keys.Master)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(MAGIC)
+	buf.WriteByte(byte(mode))
+	buf.Write(wrapNonce)
+	buf.Write(wrap.Seal(nil, wrapNonce, contentKey, MAGIC))
+	buf.Write(dataNonce)
+	buf.Write(data.Seal(nil, dataNonce, plaintext, MAGIC))
+	return buf.Bytes(), nil
+}
+
+func Decrypt(keys *Keys, ciphertext []byte) ([]byte, error) {
+	if !IsEncrypted(ciphertext) {
+		return nil, ErrNotEncrypted
+	}
+	r := ciphertext[len(MAGIC)+1:]
+	wrapNonce, r := r[:NONCE_BYTES], r[NONCE_BYTES:]
+	wrappedKey, r := r[:KEY_BYTES+TAG_BYTES], r[KEY_BYTES+TAG_BYTES:]
+	dataNonce, r := r[:NONCE_BYTES], r[NONCE_BYTES:]
+
+	wrap, err := newGCM(keys.Master)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := wrap.Open(nil, wrapNonce, wrappedKey, MAGIC)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	data, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := data.Open(nil, dataNonce, r, MAGIC)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error while making cipher: %v", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil
+	}
+	return b
+}
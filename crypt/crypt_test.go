@@ -0,0 +1,121 @@
+package crypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ortutay/decloud/cred"
+)
+
+func testKeys(t *testing.T, seed byte) *Keys {
+	keys, err := NewKeys(bytes.Repeat([]byte{seed}, KEY_BYTES),
+		bytes.Repeat([]byte{seed + 1}, KEY_BYTES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestRoundTrip(t *testing.T) {
+	keys := testKeys(t, 1)
+	plaintext := []byte("some data, stored on someone else's disk")
+	for _, mode := range []Mode{RANDOM, CONVERGENT} {
+		ct, err := Encrypt(keys, plaintext, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(ct) {
+			t.Fatalf("expected encrypted data")
+		}
+		if bytes.Contains(ct, plaintext) {
+			t.Fatalf("plaintext visible in ciphertext")
+		}
+		pt, err := Decrypt(keys, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pt, plaintext) {
+			t.Fatalf("%v != %v", string(pt), string(plaintext))
+		}
+	}
+}
+
+func TestConvergentIsDeterministic(t *testing.T) {
+	keys := testKeys(t, 1)
+	plaintext := []byte("same file twice")
+	ct1, err := Encrypt(keys, plaintext, CONVERGENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct2, err := Encrypt(keys, plaintext, CONVERGENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ct1, ct2) {
+		t.Fatalf("expected identical ciphertexts")
+	}
+	ct3, err := Encrypt(testKeys(t, 5), plaintext, CONVERGENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ct1, ct3) {
+		t.Fatalf("expected different users to get different ciphertexts")
+	}
+	ct4, err := Encrypt(keys, plaintext, RANDOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ct1, ct4) {
+		t.Fatalf("expected random mode to differ")
+	}
+}
+
+func TestWrongKeyFails(t *testing.T) {
+	ct, err := Encrypt(testKeys(t, 1), []byte("secret"), RANDOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Decrypt(testKeys(t, 5), ct)
+	if err != ErrDecrypt {
+		t.Fatalf("expected %v, got %v", ErrDecrypt, err)
+	}
+	ct[len(ct)-1] ^= 1
+	_, err = Decrypt(testKeys(t, 1), ct)
+	if err != ErrDecrypt {
+		t.Fatalf("expected %v, got %v", ErrDecrypt, err)
+	}
+	_, err = Decrypt(testKeys(t, 1), []byte("plain"))
+	if err != ErrNotEncrypted {
+		t.Fatalf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+}
+
+func TestKeysFromOcCred(t *testing.T) {
+	ocCred := cred.NewOcCred()
+	keys := NewKeysFromOcCred(ocCred)
+	if bytes.Equal(keys.Master, keys.Convergence) {
+		t.Fatalf("expected independent keys")
+	}
+	if !bytes.Equal(keys.Master, NewKeysFromOcCred(ocCred).Master) {
+		t.Fatalf("expected keys to be stable")
+	}
+	if bytes.Equal(keys.Master, NewKeysFromOcCred(cred.NewOcCred()).Master) {
+		t.Fatalf("expected keys to differ per credential")
+	}
+}
+
+func TestRotatedKeyDecrypts(t *testing.T) {
+	ocCred := cred.NewOcCred()
+	ct, err := Encrypt(NewKeysFromOcCred(ocCred), []byte("data"), RANDOM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := cred.NewRotatedOcCred(ocCred)
+	device, _ := cred.NewDelegatedOcCred(rotated, []string{"store.*"}, 1234)
+	for _, o := range []*cred.OcCred{rotated, device} {
+		pt, err := Decrypt(NewKeysFromOcCred(o), ct)
+		if err != nil || string(pt) != "data" {
+			t.Fatalf("expected %v to decrypt, got %q, %v", o.ID(), pt, err)
+		}
+	}
+}
@@ -7,14 +7,21 @@ import (
 	"os"
 	"strings"
 	"io/ioutil"
+	"time"
 
 	"github.com/droundy/goopt"
+	"github.com/ortutay/decloud/btc"
 	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/crypt"
+	"github.com/ortutay/decloud/fulfill"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/node"
+	"github.com/ortutay/decloud/price"
 	"github.com/ortutay/decloud/rep"
 	"github.com/ortutay/decloud/services/calc"
 	"github.com/ortutay/decloud/services/payment"
+	"github.com/ortutay/decloud/services/store"
+	"github.com/ortutay/decloud/stripe"
 	"github.com/ortutay/decloud/util"
 
 	"github.com/andrew-d/go-termutil"
@@ -25,23 +32,61 @@ var fAddr = goopt.String([]string{"-a", "--addr"}, "", "Remote host address")
 var fAppDir = goopt.String([]string{"--app-dir"}, "~/.decloud", "")
 var fCoinsLower = goopt.String([]string{"--coins-lower"}, "0btc", "")
 var fCoinsUpper = goopt.String([]string{"--coins-upper"}, "10btc", "")
+var fCoinsMaxAddrs = goopt.Int([]string{"--coins-max-addrs"}, cred.DEFAULT_MAX_COIN_ADDRS, "Most bitcoin addresses to link to the ID as coins")
 var fVerbosity = goopt.Int([]string{"-v", "--verbosity"}, 0, "")
+var fID = goopt.String([]string{"--id"}, cred.DEFAULT_IDENTITY, "Name of the identity to use from the keystore")
+var fPassphraseFile = goopt.String([]string{"--passphrase-file"}, "", "File with the keystore passphrase; defaults to $"+cred.PASSPHRASE_ENV)
+var fAllowEmptyPassphrase = goopt.Flag([]string{"--allow-empty-passphrase"}, nil, "Allow an empty keystore passphrase", "")
+var fNewPassphraseFile = goopt.String([]string{"--new-passphrase-file"}, "", "File with the new passphrase for \"id passwd\"")
 
 // var fTestNet = goopt.Flag([]string{"-t", "--test-net"}, []string{"--main-net"}, "Use testnet", "Use mainnet")
 
 // Cross-service flags
 var fDefer = goopt.String([]string{"--defer"}, "", "Promise deferred payment")
+var fPrices = goopt.String([]string{"--prices"}, "", "BTC prices for payments in other currencies: USD=60000,EUR=55000, a JSON file, or an http URL")
+
+// Bidding flags; bidding is on if --bid.max is set
+var fBidMax = goopt.String([]string{"--bid.max"}, "", "Most to offer for a request")
+var fBidStep = goopt.String([]string{"--bid.step"}, ".0001btc", "How much to raise declined bids by")
+var fBidAttach = goopt.Flag([]string{"--bid.attach"}, []string{"--bid.no-attach"}, "Attach payment if deferred payment is declined", "Only offer deferred payment (default)")
+var fBidShop = goopt.String([]string{"--bid.shop"}, "", "Comma separated servers to try after --addr")
+
+// Daemon flags
+var fDaemonBudget = goopt.String([]string{"--daemon.budget"}, "0.01btc", "Most to pay for deferred payments, counting earlier payments")
+var fDaemonPeriod = goopt.String([]string{"--daemon.period"}, "1m", "How often to check balances")
 
 // Store service flags
 var fStoreFile = goopt.String([]string{"--store.file"}, "", "File to store")
 var fStoreFor = goopt.String([]string{"--store.for"}, "1h", "How long to store")
 var fStoreGbPricePerMo = goopt.String([]string{"--store.gb-price-per-mo"}, ".001BTC", "")
+var fStoreNoEncrypt = goopt.Flag([]string{"--store.no-encrypt"}, []string{"--store.encrypt"}, "Upload plaintext", "Encrypt uploads (default)")
+var fStoreConvergent = goopt.Flag([]string{"--store.convergent"}, []string{"--store.random-key"}, "Derive keys from content, so identical files de-duplicate", "Use a random key per upload (default)")
+
+// Striping flags
+var fStripeAddrs = goopt.String([]string{"--stripe.addrs"}, "", "Comma separated store servers, one shard per server")
+var fStripeK = goopt.Int([]string{"--stripe.k"}, 2, "Number of servers needed to get the file back")
+var fStripeSpares = goopt.String([]string{"--stripe.spares"}, "", "Comma separated servers to move failed shards to")
 
 func main() {
 	goopt.Parse(nil)
 	util.SetAppDir(*fAppDir)
 
-	ocCred, err := cred.NewOcCredLoadOrCreate("")
+	cmdArgs := make([]string, 0)
+	for _, arg := range os.Args[1:] {
+		if arg[0] != '-' {
+			cmdArgs = append(cmdArgs, arg)
+		}
+	}
+	passphrase, err := cred.ReadPassphrase(*fPassphraseFile, *fAllowEmptyPassphrase)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(cmdArgs) > 0 && cmdArgs[0] == "id" {
+		runIDCmd(cmdArgs[1:], passphrase)
+		return
+	}
+
+	ocCred, err := cred.LoadIdentity(*fID, passphrase)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -50,6 +95,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	btcBackend := btc.NewRpcBackend(bConf)
 
 	pvLower, err := msg.NewPaymentValueParseString(*fCoinsLower)
 	if err != nil {
@@ -59,18 +105,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	coins, err := cred.GetBtcCredInRange(pvLower.Amount, pvUpper.Amount, bConf)
+	coins, err := cred.GetBtcCredForID(ocCred.Identity(), pvLower.Amount,
+		pvUpper.Amount, *fCoinsMaxAddrs, btcBackend)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	c := node.Client{
-		BtcConf: bConf,
+		Btc: btcBackend,
 		Cred: cred.Cred{
-			OcCred:  *ocCred,
-			BtcConf: bConf,
-			Coins:   *coins,
+			OcCred: *ocCred,
+			Btc:    btcBackend,
+			Coins:  coins,
 		},
+		Bidding: makeBidStrategy(),
 	}
 
 	var body []byte
@@ -80,12 +128,6 @@ func main() {
 		util.Ferr(err)
 	}
 
-	cmdArgs := make([]string, 0)
-	for _, arg := range os.Args[1:] {
-		if arg[0] != '-' {
-			cmdArgs = append(cmdArgs, arg)
-		}
-	}
 	if len(cmdArgs) == 0 {
 		// TODO(ortutay): print usage info
 		return
@@ -112,8 +154,25 @@ func main() {
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		if req.Service == store.SERVICE_NAME && req.Method == store.PUT_METHOD {
+			addStoreDuration(req)
+			if *fStoreFile != "" {
+				data, err := ioutil.ReadFile(*fStoreFile)
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+				req.SetBody(data)
+			}
+			if !*fStoreNoEncrypt && len(req.Body) > 0 {
+				encryptBody(ocCred, req)
+			}
+		}
 		resp := sendRequest(&c, req)
 		switch fmt.Sprintf("%v.%v", req.Service, req.Method) {
+		case "store.get":
+			if resp.Status == msg.OK {
+				writeStoreData(ocCred, resp.Body)
+			}
 		case "payment.balance": {
 			var br payment.BalanceResponse
 			err := json.Unmarshal(resp.Body, &br)
@@ -123,10 +182,38 @@ func main() {
 			fmt.Printf("\nServer reports balance of %v%v (max allowed is %v%v)\n",
 				util.S2B(br.Balance.Amount), br.Balance.Currency,
 				util.S2B(br.MaxBalance.Amount), br.MaxBalance.Currency)
+			if br.Pending != nil && br.Pending.Amount > 0 {
+				fmt.Printf("%v%v paid is waiting for %v confirmations\n",
+					util.S2B(br.Pending.Amount), br.Pending.Currency, br.MinConf)
+			}
+		}
+		case "payment.invoice", "payment.receipt":
+			if resp.Status == msg.OK {
+				var st payment.Statement
+				var body interface{}
+				err := json.Unmarshal(resp.Body, &st)
+				if err == nil {
+					err = st.Verify(&body)
+				}
+				if err != nil {
+					log.Fatalf("bad statement: %v", err)
+				}
+				fmt.Printf("\nStatement signed by %v\n", st.ServerID)
+			}
 		}
+	case "stripe-put", "stripe-get", "stripe-repair":
+		if len(cmdArgs) != 2 {
+			log.Fatalf("usage: %v [name]", cmdArgs[0])
 		}
+		runStripe(&c, ocCred, cmdArgs[0], cmdArgs[1], body)
 	case "pay":
 		payBtc(&c, cmdArgs)
+	case "refund":
+		refund(&c, ocCred, cmdArgs)
+	case "release-coin":
+		releaseCoin(&c, ocCred, cmdArgs)
+	case "daemon":
+		runDaemon(&c, ocCred)
 	case "listrep":
 		sel := rep.Record{}
 		if len(cmdArgs) > 1 {
@@ -146,9 +233,36 @@ func main() {
 	}
 }
 
-func sendRequest(c *node.Client, req *msg.OcReq) *msg.OcResp {
-	// Parse/attach payments
+// Returns nil, for no bidding, unless --bid.max is set. Bids start at
+// --defer.
+func makeBidStrategy() node.BidStrategy {
+	if *fBidMax == "" {
+		return nil
+	}
+	max, err := msg.NewPaymentValueParseString(*fBidMax)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	step, err := msg.NewPaymentValueParseString(*fBidStep)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	su := node.StepUp{Step: step, Max: max, Attach: *fBidAttach}
 	if *fDefer != "" {
+		su.Start, err = msg.NewPaymentValueParseString(*fDefer)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if *fBidShop == "" {
+		return &su
+	}
+	return &node.Shopper{PerServer: &su}
+}
+
+func sendRequest(c *node.Client, req *msg.OcReq) *msg.OcResp {
+	// Parse/attach payments; with bidding, the strategy attaches them
+	if *fDefer != "" && c.Bidding == nil {
 		pv, err := msg.NewPaymentValueParseString(*fDefer)
 		if err != nil {
 			log.Fatal(err.Error())
@@ -156,19 +270,30 @@ func sendRequest(c *node.Client, req *msg.OcReq) *msg.OcResp {
 		req.AttachDeferredPayment(pv)
 	}
 
-	// TODO(ortutay): handle non-deferred payments
-	err := c.SignRequest(req)
+	addrs := append([]string{*fAddr}, splitAddrs(*fBidShop)...)
+	if *fVerbosity > 0 {
+		fmt.Printf("sending request to %v\n%v\n\n", addrs, req.String())
+	}
+	resp, addr, err := c.SendWithBids(addrs, req)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	if *fVerbosity > 0 {
-		fmt.Printf("sending request to %v\n%v\n\n", *fAddr, req.String())
+	if addr != *fAddr {
+		fmt.Printf("request served by %v\n", addr)
 	}
-	resp, err := c.SendRequest(*fAddr, req)
+	prices, err := price.NewOracle(*fPrices)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	fmt.Printf("%v\n", resp.String())
+	err = fulfill.RecordPromise(addr, req, resp, prices)
+	if err != nil {
+		log.Printf("error recording deferred payment: %v\n", err)
+	}
+	isStoreData := req.Service == store.SERVICE_NAME &&
+		req.Method == store.GET_METHOD && resp.Status == msg.OK
+	if !isStoreData || *fVerbosity > 0 {
+		fmt.Printf("%v\n", resp.String())
+	}
 	if resp.Status == msg.PLEASE_PAY {
 		var pr msg.PaymentRequest
 		err := json.Unmarshal(resp.Body, &pr)
@@ -177,10 +302,108 @@ func sendRequest(c *node.Client, req *msg.OcReq) *msg.OcResp {
 		}
 		fmt.Printf("Server is requesting payment: %v%v to %v\n",
 			util.S2B(pr.Amount), pr.Currency, pr.Addr)
+		fmt.Printf("Run \"dclient daemon\" to pay deferred payments automatically\n")
 	}
 	return resp
 }
 
+// Store put requests take [container-id] [blob-id] [duration]; fill in any
+// that were left off, with the duration taken from --store.for
+func addStoreDuration(req *msg.OcReq) {
+	for len(req.Args) < 2 {
+		req.Args = append(req.Args, ".")
+	}
+	if len(req.Args) == 2 {
+		req.Args = append(req.Args, *fStoreFor)
+	}
+}
+
+func encryptBody(ocCred *cred.OcCred, req *msg.OcReq) {
+	mode := crypt.RANDOM
+	if *fStoreConvergent {
+		mode = crypt.CONVERGENT
+	}
+	ct, err := crypt.Encrypt(crypt.NewKeysFromOcCred(ocCred), req.Body, mode)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	req.SetBody(ct)
+}
+
+// Decrypts data returned by a store get, if it was encrypted, and writes it
+// to --store.file or stdout
+func writeStoreData(ocCred *cred.OcCred, data []byte) {
+	if crypt.IsEncrypted(data) {
+		pt, err := crypt.Decrypt(crypt.NewKeysFromOcCred(ocCred), data)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		data = pt
+	}
+	if *fStoreFile != "" {
+		err := ioutil.WriteFile(*fStoreFile, data, 0600)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+	os.Stdout.Write(data)
+}
+
+func runStripe(c *node.Client, ocCred *cred.OcCred, cmd string, name string, body []byte) {
+	switch cmd {
+	case "stripe-put":
+		if *fStoreFile != "" {
+			data, err := ioutil.ReadFile(*fStoreFile)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			body = data
+		}
+		req := msg.OcReq{}
+		req.SetBody(body)
+		if !*fStoreNoEncrypt && len(req.Body) > 0 {
+			encryptBody(ocCred, &req)
+		}
+		addrs := splitAddrs(*fStripeAddrs)
+		m, err := stripe.Put(c, name, req.Body, *fStripeK, addrs, *fStoreFor)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("stored %v as %v-of-%v shards\n", name, m.K, m.N)
+	case "stripe-get":
+		m, err := stripe.LoadManifest(name)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		data, err := stripe.Get(c, m)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		writeStoreData(ocCred, data)
+	case "stripe-repair":
+		m, err := stripe.LoadManifest(name)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		repaired, err := stripe.Repair(c, m, splitAddrs(*fStripeSpares))
+		fmt.Printf("repaired shards: %v\n", repaired)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
+
+func splitAddrs(addrs string) []string {
+	r := make([]string, 0)
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr != "" {
+			r = append(r, addr)
+		}
+	}
+	return r
+}
+
 func payBtc(c *node.Client, cmdArgs []string) {
 	amt := cmdArgs[1]
 	addr := cmdArgs[2]
@@ -200,6 +423,233 @@ func payBtc(c *node.Client, cmdArgs []string) {
 	fmt.Printf("sent payment, txid: %v\n", txid)
 }
 
+// refund [addr] [amount]; asks the server to pay prepaid credit back to addr,
+// which must be in the wallet. Without an amount, asks for all of it.
+func refund(c *node.Client, ocCred *cred.OcCred, cmdArgs []string) {
+	if len(cmdArgs) != 2 && len(cmdArgs) != 3 {
+		log.Fatalf("usage: refund [addr] [amount]")
+	}
+	amount := int64(0)
+	if len(cmdArgs) == 3 {
+		pv, err := msg.NewPaymentValueParseString(cmdArgs[2])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if pv.Currency != msg.BTC {
+			log.Fatalf("refunds are paid in BTC, got %v", cmdArgs[2])
+		}
+		amount = pv.Amount
+	}
+	req, err := payment.NewRefundReq(c.Btc, ocCred.Identity(), cmdArgs[1], amount)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	resp := sendRequest(c, req)
+	if resp.Status != msg.OK {
+		return
+	}
+	var rr payment.RefundResponse
+	err = json.Unmarshal(resp.Body, &rr)
+	if err != nil {
+		log.Fatalf("malformed response")
+	}
+	if rr.Txid != "" {
+		fmt.Printf("\nRefunded %v%v to %v in %v\n", util.S2B(rr.Amount.Amount),
+			rr.Amount.Currency, rr.Addr, rr.Txid)
+	} else {
+		fmt.Printf("\nRefund %v of %v%v is waiting for the operator\n", rr.ID,
+			util.S2B(rr.Amount.Amount), rr.Amount.Currency)
+	}
+}
+
+// release-coin [addr]; releases addr from the ID it is bound to on the
+// server, eg. after selling its coins, so another ID can show it.
+func releaseCoin(c *node.Client, ocCred *cred.OcCred, cmdArgs []string) {
+	if len(cmdArgs) != 2 {
+		log.Fatalf("usage: release-coin [addr]")
+	}
+	req, err := payment.NewReleaseCoinReq(ocCred, cmdArgs[1])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// Showing the address again would bind it anew
+	coins := make([]cred.BtcCred, 0)
+	for _, bc := range c.Cred.Coins {
+		if bc.Addr != cmdArgs[1] {
+			coins = append(coins, bc)
+		}
+	}
+	c.Cred.Coins = coins
+	resp := sendRequest(c, req)
+	if resp.Status != msg.OK {
+		return
+	}
+	err = cred.UnbindCoin(cmdArgs[1])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	fmt.Printf("\nReleased %v\n", cmdArgs[1])
+}
+
+// id list|new [name] [type]|export [name] [file]|import [name] [file]
+//   |import-wif [name] [file]|passwd [name]|delegate [name] [scope] [for]
+//   |rotate [name]
+// Manages the identities in the keystore. new makes a p256, secp256k1, or
+// ed25519 key; p256 by default. import-wif takes a secp256k1 key from a
+// bitcoin wallet, as from "bitcoind dumpprivkey", so the ID is the wallet's
+// key. Exported identities stay encrypted with their passphrase. delegate
+// makes a key that acts for the --id identity, for requests in the comma
+// separated scope, eg. "store.get,calc.*", for a duration; rotate makes a key
+// that replaces it.
+func runIDCmd(cmdArgs []string, passphrase string) {
+	if len(cmdArgs) == 0 {
+		log.Fatalf("usage: id list|new|export|import|import-wif|passwd|delegate|rotate")
+	}
+	ks, err := cred.LoadKeystore("")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	name := cred.DEFAULT_IDENTITY
+	if len(cmdArgs) > 1 {
+		name = cmdArgs[1]
+	}
+	switch cmdArgs[0] {
+	case "list":
+		for _, info := range ks.List() {
+			fmt.Printf("%v\t%v\t%v\t%v", info.Name, info.ID, info.KeyType,
+				time.Unix(info.Created, 0).Format(time.RFC3339))
+			if len(info.Certs) != 0 {
+				last := info.Certs[len(info.Certs)-1]
+				fmt.Printf("\t%v for %v", last.Kind, info.Certs[0].Issuer)
+				if len(last.Scope) != 0 {
+					fmt.Printf(" %v", strings.Join(last.Scope, ","))
+				}
+				if last.Expires != 0 {
+					fmt.Printf(" until %v", time.Unix(last.Expires, 0).Format(time.RFC3339))
+				}
+			}
+			fmt.Printf("\n")
+		}
+		return
+	case "new":
+		keyType := cred.KEY_TYPE_P256
+		if len(cmdArgs) > 2 {
+			keyType, err = cred.ParseKeyType(cmdArgs[2])
+			if err != nil {
+				log.Fatalf("%v: %v", err.Error(), cmdArgs[2])
+			}
+		}
+		var o *cred.OcCred
+		o, err = cred.NewOcCredOfType(keyType)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ks.Add(name, o, passphrase)
+	case "export":
+		if len(cmdArgs) != 3 {
+			log.Fatalf("usage: id export [name] [file]")
+		}
+		data, err := ks.Export(name)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ioutil.WriteFile(util.ExpandHome(cmdArgs[2]), data, 0600)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case "import":
+		if len(cmdArgs) != 3 {
+			log.Fatalf("usage: id import [name] [file]")
+		}
+		var data []byte
+		data, err = ioutil.ReadFile(util.ExpandHome(cmdArgs[2]))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ks.Import(name, data, passphrase)
+	case "import-wif":
+		if len(cmdArgs) != 3 {
+			log.Fatalf("usage: id import-wif [name] [file]")
+		}
+		var data []byte
+		data, err = ioutil.ReadFile(util.ExpandHome(cmdArgs[2]))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		var o *cred.OcCred
+		o, err = cred.NewOcCredFromWIF(strings.TrimSpace(string(data)))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ks.Add(name, o, passphrase)
+	case "delegate", "rotate":
+		if (cmdArgs[0] == "delegate" && len(cmdArgs) != 4) ||
+			(cmdArgs[0] == "rotate" && len(cmdArgs) != 2) {
+			log.Fatalf("usage: id delegate [name] [scope] [for], or id rotate [name]")
+		}
+		var o, sub *cred.OcCred
+		o, err = ks.Unlock(*fID, passphrase)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if cmdArgs[0] == "delegate" {
+			var d time.Duration
+			d, err = util.DurationParseString(cmdArgs[3])
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			sub, err = cred.NewDelegatedOcCred(o, strings.Split(cmdArgs[2], ","),
+				time.Now().Add(d).Unix())
+		} else {
+			sub, err = cred.NewRotatedOcCred(o)
+		}
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ks.Add(name, sub, passphrase)
+	case "passwd":
+		var newPassphrase string
+		newPassphrase, err = cred.ReadPassphrase(*fNewPassphraseFile, *fAllowEmptyPassphrase)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		err = ks.ChangePassphrase(name, passphrase, newPassphrase)
+	default:
+		log.Fatalf("unknown id command: %v", cmdArgs[0])
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	err = ks.Save()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	fmt.Printf("%v: %v\n", name, ks.Identities[name].ID)
+}
+
+// Pays deferred payments as servers ask for them, until killed.
+func runDaemon(c *node.Client, ocCred *cred.OcCred) {
+	budget, err := msg.NewPaymentValueParseString(*fDaemonBudget)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	period, err := time.ParseDuration(*fDaemonPeriod)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	d := fulfill.Daemon{
+		Client: c,
+		ID:     ocCred.Identity(),
+		Budget: budget,
+		Period: period,
+		Btc:    c.Btc,
+	}
+	fmt.Printf("paying deferred payments, budget %v%v\n",
+		util.S2B(budget.Amount), budget.Currency)
+	d.Run()
+}
+
 func makeQuoteReq(args []string) (*msg.OcReq, error) {
 	req, err := makeReq(args, nil)
 	if err != nil {
@@ -4,14 +4,22 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/droundy/goopt"
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/coins"
 	"github.com/ortutay/decloud/conf"
 	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/node"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/price"
 	"github.com/ortutay/decloud/services/calc"
+	"github.com/ortutay/decloud/services/escrow"
 	"github.com/ortutay/decloud/services/payment"
 	"github.com/ortutay/decloud/services/store"
 	"github.com/ortutay/decloud/util"
@@ -22,14 +30,30 @@ var fPort = goopt.Int([]string{"-p", "--port"}, 9443, "")
 var fAppDir = goopt.String([]string{"--app-dir"}, "~/.decloud", "")
 // var fTestNet = goopt.Flag([]string{"-t", "--test-net"}, []string{"--main-net"}, "Use testnet", "Use mainnet")
 var fMaxBalance = goopt.String([]string{"--max-balance"}, ".1BTC", "")
+var fMinConf = goopt.Int([]string{"--min-conf"}, 1, "Confirmations for payments to count toward max balance")
+var fTrusted = goopt.String([]string{"--trusted"}, "", "Comma separated IDs held to --trusted-min-conf instead")
+var fTrustedMinConf = goopt.Int([]string{"--trusted-min-conf"}, 0, "")
+var fXpub = goopt.String([]string{"--xpub"}, "", "Extended public key to derive payment addresses from, so the wallet can be watch-only")
+var fRefundMin = goopt.String([]string{"--refund-min"}, "", "Smallest refund of prepaid credit, e.g. .001BTC")
+var fRefundCooldown = goopt.Int([]string{"--refund-cooldown"}, 86400, "Seconds between refunds to an ID")
+var fRefundApproval = goopt.Flag([]string{"--refund-approval"}, []string{"--refund-auto"}, "Queue refunds for \"dcserverd approve-refund\"", "Pay refunds right away (default)")
+var fID = goopt.String([]string{"--id"}, cred.DEFAULT_IDENTITY, "Name of the identity to serve as, from the keystore")
+var fPassphraseFile = goopt.String([]string{"--passphrase-file"}, "", "File with the keystore passphrase; defaults to $"+cred.PASSPHRASE_ENV)
+var fAllowEmptyPassphrase = goopt.Flag([]string{"--allow-empty-passphrase"}, nil, "Allow an empty keystore passphrase", "")
+var fPrices = goopt.String([]string{"--prices"}, "", "BTC prices for fees in other currencies: USD=60000,EUR=55000, a JSON file, or an http URL")
 
 // Cross-service flags
 var fMinFee = goopt.String([]string{"--min-fee"}, "calc.calc=.01BTC", "") // TODO(ortutay) unused? remove?
-var fMinCoins = goopt.String([]string{"--min-coins"}, "calc.calc=.1BTC", "")
+var fMinCoins = goopt.String([]string{"--min-coins"}, "", "e.g. calc.calc=.1BTC")
+var fMinCoinAge = goopt.String([]string{"--min-coin-age"}, "", "in blocks, e.g. calc.calc=144")
+var fKeyTypes = goopt.String([]string{"--key-types"}, "", "Comma separated OcID key types to accept, of p256, secp256k1, and ed25519; all by default")
 var fMaxWork = goopt.String([]string{"--max-work"}, "calc.calc={\"bytes\": 1000, \"queries\": 100}", "")
 
 // Store service flags
 var fStoreDir = goopt.String([]string{"--store:dir"}, "~/.decloud-store", "")
+var fStoreBackend = goopt.String([]string{"--store:backend"}, "fs", "fs, bolt, or s3")
+var fStoreS3Endpoint = goopt.String([]string{"--store:s3-endpoint"}, "https://s3.amazonaws.com", "")
+var fStoreS3Bucket = goopt.String([]string{"--store:s3-bucket"}, "", "")
 var fStoreMaxSpace = goopt.String([]string{"--store:max-space"}, "1GB", "")
 var fStoreGbPricePerMo = goopt.String([]string{"--store:gb-price-per-mo"}, ".001BTC", "")
 
@@ -47,11 +71,87 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	for _, minCoinAgeArg := range strings.Split(*fMinCoinAge, ";") {
+		if minCoinAgeArg == "" {
+			continue
+		}
+		policy, err := getPolicy(minCoinAgeArg, conf.MIN_COIN_AGE, getBlocks)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		config.AddPolicy(policy)
+	}
+
+	if *fKeyTypes != "" {
+		keyTypes := make([]interface{}, 0)
+		for _, arg := range strings.Split(*fKeyTypes, ",") {
+			keyType, err := cred.ParseKeyType(arg)
+			if err != nil {
+				log.Fatalf("%v: %v", err.Error(), arg)
+			}
+			keyTypes = append(keyTypes, keyType)
+		}
+		config.AddPolicy(&conf.Policy{
+			Selector: conf.PolicySelector{},
+			Cmd:      conf.KEY_TYPES,
+			Args:     keyTypes,
+		})
+	}
+
+	maxBalance := getPaymentValue("", *fMaxBalance)
+	if maxBalance.(*msg.PaymentValue).Currency != msg.BTC {
+		// Balances settle in BTC
+		log.Fatalf("max balance must be in BTC, got %v", *fMaxBalance)
+	}
 	config.AddPolicy(&conf.Policy{
 		Selector: conf.PolicySelector{},
 		Cmd:      conf.MAX_BALANCE,
-		Args:     []interface{}{getPaymentValue("", *fMaxBalance)},
+		Args:     []interface{}{maxBalance},
+	})
+	config.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{},
+		Cmd:      conf.MIN_CONF,
+		Args:     []interface{}{*fMinConf},
+	})
+	for _, id := range strings.Split(*fTrusted, ",") {
+		if id == "" {
+			continue
+		}
+		ocID, err := cred.CanonicalOcID(msg.OcID(id))
+		if err != nil {
+			log.Fatalf("invalid --trusted ID %v: %v", id, err)
+		}
+		config.AddPolicy(&conf.Policy{
+			Selector: conf.PolicySelector{ID: ocID},
+			Cmd:      conf.MIN_CONF,
+			Args:     []interface{}{*fTrustedMinConf},
+		})
+	}
+	if *fRefundMin != "" {
+		refundMin := getPaymentValue("", *fRefundMin)
+		if refundMin.(*msg.PaymentValue).Currency != msg.BTC {
+			log.Fatalf("refund min must be in BTC, got %v", *fRefundMin)
+		}
+		config.AddPolicy(&conf.Policy{
+			Selector: conf.PolicySelector{Service: payment.SERVICE_NAME},
+			Cmd:      conf.REFUND_MIN,
+			Args:     []interface{}{refundMin},
+		})
+	}
+	config.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{Service: payment.SERVICE_NAME},
+		Cmd:      conf.REFUND_COOLDOWN,
+		Args:     []interface{}{*fRefundCooldown},
 	})
+	config.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{Service: payment.SERVICE_NAME},
+		Cmd:      conf.REFUND_APPROVAL,
+		Args:     []interface{}{*fRefundApproval},
+	})
+	prices, err := price.NewOracle(*fPrices)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
 	// TODO(ortutay): s/"store"/store.SERVICE_NAME/
 	config.AddPolicy(&conf.Policy{
@@ -59,6 +159,11 @@ func main() {
 		Cmd:      conf.STORE_DIR,
 		Args:     []interface{}{*fStoreDir},
 	})
+	config.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{Service: "store"},
+		Cmd:      conf.STORE_BACKEND,
+		Args:     []interface{}{*fStoreBackend, *fStoreS3Endpoint, *fStoreS3Bucket},
+	})
 	config.AddPolicy(&conf.Policy{
 		Selector: conf.PolicySelector{Service: "store"},
 		Cmd:      conf.STORE_MAX_SPACE,
@@ -72,7 +177,11 @@ func main() {
 	fmt.Printf("running with conf: %v\n", config)
 
 	util.SetAppDir(*fAppDir)
-	ocCred, err := cred.NewOcCredLoadOrCreate("")
+	passphrase, err := cred.ReadPassphrase(*fPassphraseFile, *fAllowEmptyPassphrase)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	ocCred, err := cred.LoadIdentity(*fID, passphrase)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -83,31 +192,62 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	btcBackend := btc.NewRpcBackend(bConf)
+	coinResolver := coins.NewResolver(btcBackend)
+	peer.SetCoinResolver(coinResolver)
+	if *fXpub != "" {
+		k, err := btc.ParseExtPubKey(*fXpub)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		peer.SetExtPubKey(k)
+	}
 
 	addr := fmt.Sprintf(":%v", *fPort)
 
 	// TODO(ortutay): configure which services to run from command line args
-	calcService := calc.CalcService{Conf: config}
-	paymentService := payment.PaymentService{Conf: config, BitcoindConf: bConf}
-	storeService := store.StoreService{Conf: config}
+	calcService := calc.CalcService{Conf: config, Btc: btcBackend, Prices: prices}
+	paymentService := payment.PaymentService{Conf: config, Btc: btcBackend, Cred: ocCred, Prices: prices}
+	n, err := peer.MigrateOcIDs()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if n != 0 {
+		log.Printf("moved %v peers to compact IDs\n", n)
+	}
+	if len(cmdArgs) > 0 {
+		runOperatorCmd(&paymentService, cmdArgs)
+		return
+	}
+	storeBackend, err := store.NewBackendFromConf(config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	storeService := store.StoreService{Conf: config, Btc: btcBackend, Backend: storeBackend}
+	_, err = storeService.Recover()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
 
 	services := make(map[string]node.Handler)
 	services[calc.SERVICE_NAME] = &calcService
 	services[payment.SERVICE_NAME] = &paymentService
 	services[store.SERVICE_NAME] = &storeService
+	services[escrow.SERVICE_NAME] = &escrow.EscrowService{Btc: btcBackend, Conf: config}
 	mux := node.ServiceMux{
 		Services: services,
 	}
 
-	wakers := []node.PeriodicWaker{&storeService}
+	wakers := []node.PeriodicWaker{&storeService, &paymentService}
 
 	s := node.Server{
 		Cred: &cred.Cred{
-			OcCred:  *ocCred,
-			BtcConf: bConf,
-			Coins:   []cred.BtcCred{},
+			OcCred: *ocCred,
+			Btc:    btcBackend,
+			Coins:  []cred.BtcCred{},
 		},
-		BtcConf: bConf,
+		Btc:     btcBackend,
+		Coins:   coinResolver,
 		Conf:    config,
 		Addr:    addr,
 		Handler: &mux,
@@ -119,6 +259,110 @@ func main() {
 	}
 }
 
+// Operator commands:
+//   refunds
+//   approve-refund [id]
+//   deny-refund [id]
+//   ledger-check
+//   coin-binding [addr]
+//   coin-bindings [id]
+//   settle-rotation [old-key-id] [new-key-id]
+func runOperatorCmd(ps *payment.PaymentService, cmdArgs []string) {
+	switch cmdArgs[0] {
+	case "refunds":
+		pending, err := payment.PendingRefunds()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, rec := range pending {
+			fmt.Printf("%v\t%v\t%vBTC\tto %v\n", rec.RowID, rec.ID,
+				util.S2B(rec.PaymentValue.Amount), rec.Addr)
+		}
+	case "approve-refund", "deny-refund":
+		if len(cmdArgs) != 2 {
+			log.Fatalf("usage: %v [id]", cmdArgs[0])
+		}
+		id, err := strconv.ParseInt(cmdArgs[1], 10, 64)
+		if err != nil {
+			log.Fatalf("could not parse refund id: %v", cmdArgs[1])
+		}
+		if cmdArgs[0] == "deny-refund" {
+			err = payment.DenyRefund(id)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			return
+		}
+		rec, err := ps.ApproveRefund(id)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("refunded in %v\n", rec.Txid)
+	case "ledger-check":
+		problems, err := ledger.Check()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if len(problems) != 0 {
+			log.Fatalf("ledger has %v problems", len(problems))
+		}
+		fmt.Printf("ledger ok\n")
+	case "coin-binding", "coin-bindings":
+		if len(cmdArgs) != 2 {
+			log.Fatalf("usage: coin-binding [addr], or coin-bindings [id]")
+		}
+		var bindings []*peer.CoinBinding
+		if cmdArgs[0] == "coin-binding" {
+			b, err := peer.CoinBindingOf(cmdArgs[1])
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			if b == nil {
+				fmt.Printf("%v is not bound\n", cmdArgs[1])
+				return
+			}
+			bindings = append(bindings, b)
+		} else {
+			id, err := cred.CanonicalOcID(msg.OcID(cmdArgs[1]))
+			if err != nil {
+				log.Fatalf("invalid ID %v: %v", cmdArgs[1], err)
+			}
+			bindings, err = peer.CoinBindingsOf(id)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		for _, b := range bindings {
+			bound, balance := "unknown", "unknown"
+			if b.Bound != 0 {
+				bound = time.Unix(b.Bound, 0).Format(time.RFC3339)
+			}
+			if b.Balance != peer.UNKNOWN_BALANCE {
+				balance = fmt.Sprintf("%vBTC", util.S2B(b.Balance))
+			}
+			fmt.Printf("%v\t%v\tsince %v\tholding %v\n", b.Coin, b.ID, bound, balance)
+		}
+	case "settle-rotation":
+		if len(cmdArgs) != 3 {
+			log.Fatalf("usage: settle-rotation [old-key-id] [new-key-id]")
+		}
+		var ids []msg.OcID
+		for _, arg := range cmdArgs[1:] {
+			id, err := cred.CanonicalOcID(msg.OcID(arg))
+			if err != nil {
+				log.Fatalf("invalid ID %v: %v", arg, err)
+			}
+			ids = append(ids, id)
+		}
+		err := peer.SettleRotation(ids[0], ids[1])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	default:
+		log.Fatalf("unknown command: %v", cmdArgs[0])
+	}
+}
+
 func makeConf(minFeeFlag string, minCoinsFlag string, maxWorkFlag string) (*conf.Conf, error) {
 	minFeeArgs := strings.Split(minFeeFlag, ";")
 	minCoinsArgs := strings.Split(minCoinsFlag, ";")
@@ -139,6 +383,9 @@ func makeConf(minFeeFlag string, minCoinsFlag string, maxWorkFlag string) (*conf
 
 	// Parse min coins
 	for _, minCoinsArg := range minCoinsArgs {
+		if minCoinsArg == "" {
+			continue
+		}
 		policy, err := getPolicy(minCoinsArg, conf.MIN_COINS, getPaymentValue)
 		if err != nil {
 			return nil, err
@@ -219,6 +466,14 @@ func getPaymentValue(srvMeth, pvStr string) interface{} {
 	return pv
 }
 
+func getBlocks(srvMeth, str string) interface{} {
+	blocks, err := strconv.Atoi(str)
+	if err != nil || blocks < 0 {
+		log.Fatalf("could not parse blocks: %v", str)
+	}
+	return blocks
+}
+
 func getWork(srvMeth, w string) interface{} {
 	switch srvMeth {
 	case "calc.calc":
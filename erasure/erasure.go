@@ -0,0 +1,256 @@
+package erasure
+
+// Systematic Reed-Solomon coding over GF(2^8). A blob is split into K data
+// shards, and N-K parity shards are added, such that any K of the N shards are
+// enough to rebuild the blob.
+
+import (
+	"errors"
+	"fmt"
+)
+
+const MAX_SHARDS = 255
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+var expTable [510]byte
+var logTable [256]byte
+
+func init() {
+	// Generator 2, with the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("inverse of zero")
+	}
+	return expTable[255-int(logTable[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m matrix) mul(o matrix) matrix {
+	r := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			r[i][j] = v
+		}
+	}
+	return r
+}
+
+// Gauss-Jordan elimination on a square matrix.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for i := 0; i < n; i++ {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], inv)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			f := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul(f, work[col][j])
+			}
+		}
+	}
+	r := newMatrix(n, n)
+	for i := range r {
+		copy(r[i], work[i][n:])
+	}
+	return r, nil
+}
+
+type Codec struct {
+	K int
+	N int
+	// N x K; the top K rows are the identity, so data shards are stored as-is
+	encode matrix
+}
+
+func NewCodec(k, n int) (*Codec, error) {
+	if k < 1 || n < k || n > MAX_SHARDS {
+		return nil, fmt.Errorf("invalid k-of-n: %v-of-%v", k, n)
+	}
+	vm := newMatrix(n, k)
+	for i := 0; i < n; i++ {
+		for j := 0; j < k; j++ {
+			vm[i][j] = gfPow(byte(i), j)
+		}
+	}
+	top, err := vm[:k].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{K: k, N: n, encode: vm.mul(top)}, nil
+}
+
+func (c *Codec) ShardSize(dataLen int) int {
+	size := (dataLen + c.K - 1) / c.K
+	if size == 0 {
+		size = 1
+	}
+	return size
+}
+
+// Splits data into N shards. The original length must be kept to undo the
+// padding on decode.
+func (c *Codec) Encode(data []byte) [][]byte {
+	size := c.ShardSize(len(data))
+	shards := make([][]byte, c.N)
+	for i := 0; i < c.K; i++ {
+		shards[i] = make([]byte, size)
+		start := i * size
+		if start < len(data) {
+			end := start + size
+			if end > len(data) {
+				end = len(data)
+			}
+			copy(shards[i], data[start:end])
+		}
+	}
+	for i := c.K; i < c.N; i++ {
+		shards[i] = c.combine(c.encode[i], shards[:c.K], size)
+	}
+	return shards
+}
+
+func (c *Codec) combine(row []byte, inputs [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for j, in := range inputs {
+		f := row[j]
+		if f == 0 {
+			continue
+		}
+		for b := 0; b < size; b++ {
+			out[b] ^= gfMul(f, in[b])
+		}
+	}
+	return out
+}
+
+// Fills in missing (nil) shards, as long as at least K are present.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.N {
+		return fmt.Errorf("expected %v shards, got %v", c.N, len(shards))
+	}
+	have := make([]int, 0, c.K)
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size == -1 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return fmt.Errorf("shard %v has size %v, expected %v",
+				i, len(shard), size)
+		}
+		if len(have) < c.K {
+			have = append(have, i)
+		}
+	}
+	if len(have) < c.K {
+		return ErrTooFewShards
+	}
+
+	sub := newMatrix(c.K, c.K)
+	inputs := make([][]byte, c.K)
+	for i, idx := range have {
+		copy(sub[i], c.encode[idx])
+		inputs[i] = shards[idx]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	data := make([][]byte, c.K)
+	for i := 0; i < c.K; i++ {
+		if shards[i] != nil {
+			data[i] = shards[i]
+		} else {
+			data[i] = c.combine(decode[i], inputs, size)
+			shards[i] = data[i]
+		}
+	}
+	for i := c.K; i < c.N; i++ {
+		if shards[i] == nil {
+			shards[i] = c.combine(c.encode[i], data, size)
+		}
+	}
+	return nil
+}
+
+// Rebuilds the original data of the given length from any K shards.
+func (c *Codec) Decode(shards [][]byte, dataLen int) ([]byte, error) {
+	err := c.Reconstruct(shards)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, c.K*len(shards[0]))
+	for i := 0; i < c.K; i++ {
+		data = append(data, shards[i]...)
+	}
+	if dataLen > len(data) {
+		return nil, fmt.Errorf("data length %v exceeds shard data", dataLen)
+	}
+	return data[:dataLen], nil
+}
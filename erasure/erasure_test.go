@@ -0,0 +1,63 @@
+package erasure
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	c, err := NewCodec(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	shards := c.Encode(data)
+	if len(shards) != 5 {
+		t.Fatalf("expected 5 shards, got %v", len(shards))
+	}
+	if !bytes.HasPrefix(data, shards[0]) {
+		t.Fatalf("expected data shards to hold data as-is")
+	}
+
+	// Every combination of 2 missing shards
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			copied := make([][]byte, 5)
+			copy(copied, shards)
+			copied[a] = nil
+			copied[b] = nil
+			out, err := c.Decode(copied, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("missing %v,%v: %v != %v", a, b, string(out), string(data))
+			}
+			if !bytes.Equal(copied[a], shards[a]) || !bytes.Equal(copied[b], shards[b]) {
+				t.Fatalf("missing %v,%v: shards not rebuilt", a, b)
+			}
+		}
+	}
+}
+
+func TestTooFewShards(t *testing.T) {
+	c, err := NewCodec(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := c.Encode([]byte("abcdef"))
+	shards[0], shards[1], shards[3] = nil, nil, nil
+	_, err = c.Decode(shards, 6)
+	if err != ErrTooFewShards {
+		t.Fatalf("expected %v, got %v", ErrTooFewShards, err)
+	}
+}
+
+func TestInvalidCodec(t *testing.T) {
+	if _, err := NewCodec(3, 2); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewCodec(0, 2); err == nil {
+		t.Fatalf("expected error")
+	}
+}
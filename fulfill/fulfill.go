@@ -0,0 +1,268 @@
+package fulfill
+
+// Fulfills deferred payments. Each request sent with a deferred payment is
+// recorded as a promise in the client's rep store. The daemon polls the
+// balance of each server it has made promises to, and pays what the server
+// says is due, up to what was promised and within a budget.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/price"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/services/payment"
+)
+
+// Method of client records for payments made by the daemon
+const PAY_METHOD = "pay"
+
+const DEFAULT_PERIOD = 1 * time.Minute
+
+// Satisfied by node.Client.
+type Client interface {
+	SignAndSend(addr string, req *msg.OcReq) (*msg.OcResp, error)
+	SendBtcPayment(payVal *msg.PaymentValue, payAddr *msg.PaymentAddr) (msg.BtcTxid, error)
+}
+
+// Records a deferred payment promised to the server at addr, if req has one.
+// Promises in other currencies than BTC are recorded with the current rate
+// from prices, which is then what they are paid at.
+func RecordPromise(addr string, req *msg.OcReq, resp *msg.OcResp, prices price.Oracle) error {
+	if req.PaymentType != msg.DEFER || req.PaymentValue == nil {
+		return nil
+	}
+	_, quote, err := price.Convert(prices, req.PaymentValue)
+	if err != nil {
+		return err
+	}
+	var status rep.Status = rep.SUCCESS_UNPAID
+	if resp.Status != msg.OK {
+		status = rep.FAILURE
+	}
+	pv := msg.PaymentValue(*req.PaymentValue)
+	rec := rep.Record{
+		Role:         rep.CLIENT,
+		Service:      req.Service,
+		Method:       req.Method,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           req.ID,
+		Status:       status,
+		PaymentType:  msg.DEFER,
+		PaymentValue: &pv,
+		Addr:         addr,
+	}
+	if quote != nil {
+		rec.Rate = quote.Rate
+	}
+	_, err = rep.Put(&rec)
+	return err
+}
+
+func sumBtc(sel *rep.Record) (int64, error) {
+	total := int64(0)
+	var convErr error
+	err := rep.Reduce(sel, func(rec *rep.Record) {
+		amount, err := rec.BtcAmount()
+		if err != nil {
+			convErr = err
+			return
+		}
+		total += amount
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, convErr
+}
+
+func promised(addr string) (int64, error) {
+	return sumBtc(&rep.Record{
+		Role:        rep.CLIENT,
+		Status:      rep.SUCCESS_UNPAID,
+		PaymentType: msg.DEFER,
+		Addr:        addr,
+	})
+}
+
+// Total paid by the daemon to addr, or to all servers if addr is empty.
+func paid(addr string) (int64, error) {
+	return sumBtc(&rep.Record{
+		Role:        rep.CLIENT,
+		Service:     payment.SERVICE_NAME,
+		Method:      PAY_METHOD,
+		Status:      rep.SUCCESS_PAID,
+		PaymentType: msg.TXID,
+		Addr:        addr,
+	})
+}
+
+// Amount promised to the server at addr that is not yet paid.
+func Owed(addr string) (*msg.PaymentValue, error) {
+	p, err := promised(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := paid(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &msg.PaymentValue{Amount: p - d, Currency: msg.BTC}, nil
+}
+
+// Addresses of servers that deferred payments were promised to.
+func Servers() ([]string, error) {
+	seen := make(map[string]bool)
+	servers := make([]string, 0)
+	sel := rep.Record{
+		Role:        rep.CLIENT,
+		Status:      rep.SUCCESS_UNPAID,
+		PaymentType: msg.DEFER,
+	}
+	err := rep.Reduce(&sel, func(rec *rep.Record) {
+		if rec.Addr != "" && !seen[rec.Addr] {
+			seen[rec.Addr] = true
+			servers = append(servers, rec.Addr)
+		}
+	})
+	return servers, err
+}
+
+type Daemon struct {
+	Client Client
+	ID     msg.OcID
+
+	// Most to pay in total, counting payments made by earlier runs
+	Budget *msg.PaymentValue
+
+	Period time.Duration
+
+	// If set, payments that vanish from the chain are reversed, so they are
+	// made again
+	Btc btc.Backend
+}
+
+// Pays servers every period, forever.
+func (d *Daemon) Run() {
+	period := d.Period
+	if period == 0 {
+		period = DEFAULT_PERIOD
+	}
+	for {
+		err := d.FulfillAll()
+		if err != nil {
+			log.Printf("error while fulfilling payments: %v\n", err)
+		}
+		time.Sleep(period)
+	}
+}
+
+func (d *Daemon) FulfillAll() error {
+	if d.Btc != nil {
+		reversed, err := rep.ReverseVanished(
+			&rep.Record{Role: rep.CLIENT, Method: PAY_METHOD},
+			d.Btc.TxnConfirmations, rep.FAILURE)
+		if err != nil {
+			return err
+		}
+		for _, rec := range reversed {
+			log.Printf("payment %v to %v vanished, reversed\n", rec.Txid, rec.Addr)
+		}
+	}
+	servers, err := Servers()
+	if err != nil {
+		return err
+	}
+	for _, addr := range servers {
+		pv, err := d.Fulfill(addr)
+		if err != nil {
+			log.Printf("error while paying %v: %v\n", addr, err)
+			continue
+		}
+		if pv.Amount > 0 {
+			fmt.Printf("paid %v%v to %v\n", pv.Amount, pv.Currency, addr)
+		}
+	}
+	return nil
+}
+
+// Pays the server at addr the balance it reports, up to what is owed and
+// what is left of the budget. Returns the amount paid.
+func (d *Daemon) Fulfill(addr string) (*msg.PaymentValue, error) {
+	none := &msg.PaymentValue{Amount: 0, Currency: msg.BTC}
+	owed, err := Owed(addr)
+	if err != nil {
+		return nil, err
+	}
+	if owed.Amount <= 0 {
+		return none, nil
+	}
+	resp, err := d.Client.SignAndSend(addr, payment.NewBalanceReq())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != msg.OK {
+		return nil, fmt.Errorf("balance request failed: %v", resp.Status)
+	}
+	var br payment.BalanceResponse
+	err = json.Unmarshal(resp.Body, &br)
+	if err != nil || br.Balance == nil {
+		return nil, fmt.Errorf("malformed balance response: %v", string(resp.Body))
+	}
+	if br.Balance.Currency != msg.BTC {
+		return nil, fmt.Errorf("unsupported currency %v", br.Balance.Currency)
+	}
+
+	amount := br.Balance.Amount
+	if br.Pending != nil {
+		// Already paid, waiting for confirmations
+		amount -= br.Pending.Amount
+	}
+	if amount > owed.Amount {
+		amount = owed.Amount
+	}
+	if d.Budget != nil {
+		spent, err := paid("")
+		if err != nil {
+			return nil, err
+		}
+		if left := d.Budget.Amount - spent; amount > left {
+			amount = left
+		}
+	}
+	if amount <= 0 {
+		return none, nil
+	}
+
+	pv := msg.PaymentValue{Amount: amount, Currency: msg.BTC}
+	txid, sendErr := d.Client.SendBtcPayment(&pv,
+		&msg.PaymentAddr{Currency: msg.BTC, Addr: br.Addr})
+	var status rep.Status = rep.SUCCESS_PAID
+	if sendErr != nil {
+		status = rep.FAILURE
+	}
+	rec := rep.Record{
+		Role:         rep.CLIENT,
+		Service:      payment.SERVICE_NAME,
+		Method:       PAY_METHOD,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           d.ID,
+		Status:       status,
+		PaymentType:  msg.TXID,
+		PaymentValue: &pv,
+		Addr:         addr,
+		Txid:         string(txid),
+	}
+	_, err = rep.Put(&rec)
+	if err != nil {
+		return nil, err
+	}
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	return &pv, nil
+}
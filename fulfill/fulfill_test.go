@@ -0,0 +1,216 @@
+package fulfill
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/price"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/services/payment"
+	"github.com/ortutay/decloud/testutil"
+)
+
+// Answers balance requests with a fixed balance, and pays from a fake wallet.
+type testClient struct {
+	chain    *btc.FakeChain
+	wallet   *btc.FakeWallet
+	balances map[string]int64
+	pending  map[string]int64
+	payAddrs map[string]string
+	sent     map[string]int64 // by payment address
+}
+
+func newTestClient(t *testing.T) *testClient {
+	chain := btc.NewFakeChain()
+	wallet := chain.NewWallet("client")
+	addr, _ := wallet.NewAddress()
+	chain.Fund(addr, 1e8)
+	chain.Mine(1)
+	return &testClient{
+		chain:    chain,
+		wallet:   wallet,
+		balances: make(map[string]int64),
+		pending:  make(map[string]int64),
+		payAddrs: make(map[string]string),
+		sent:     make(map[string]int64),
+	}
+}
+
+func (tc *testClient) SignAndSend(addr string, req *msg.OcReq) (*msg.OcResp, error) {
+	br := payment.BalanceResponse{
+		Balance:    &msg.PaymentValue{Amount: tc.balances[addr], Currency: msg.BTC},
+		MaxBalance: &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+		Addr:       tc.payAddrs[addr],
+		Pending:    &msg.PaymentValue{Amount: tc.pending[addr], Currency: msg.BTC},
+	}
+	body, _ := json.Marshal(&br)
+	return msg.NewRespOk(body), nil
+}
+
+func (tc *testClient) SendBtcPayment(payVal *msg.PaymentValue, payAddr *msg.PaymentAddr) (msg.BtcTxid, error) {
+	txid, err := tc.wallet.Send(payAddr.Addr, payVal.Amount)
+	if err != nil {
+		return "", err
+	}
+	tc.sent[payAddr.Addr] += payVal.Amount
+	return msg.BtcTxid(txid), nil
+}
+
+func promise(t *testing.T, addr string, amount int64, status msg.OcRespStatus) {
+	req := msg.OcReq{ID: "client-id", Service: "calc", Method: "calc"}
+	req.AttachDeferredPayment(&msg.PaymentValue{Amount: amount, Currency: msg.BTC})
+	err := RecordPromise(addr, &req, &msg.OcResp{Status: status}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFulfill(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestClient(t)
+	tc.payAddrs["a:9443"] = "mpXwg4jMtRhuSpVq4xS3HFHmCmWp9NyGKt"
+	tc.payAddrs["b:9443"] = "mwCwTceJvYV27KXBc3NJZys6CjsgsoeHmf"
+	promise(t, "a:9443", 3e5, msg.OK)
+	promise(t, "a:9443", 2e5, msg.OK)
+	promise(t, "a:9443", 9e5, msg.SERVER_ERROR)
+	promise(t, "b:9443", 1e5, msg.OK)
+
+	// Servers are paid what they ask for, up to what was promised
+	tc.balances["a:9443"] = 4e5
+	tc.balances["b:9443"] = 7e5
+	d := Daemon{Client: tc, ID: "client-id"}
+	err := d.FulfillAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.sent[tc.payAddrs["a:9443"]] != 4e5 {
+		t.Fatalf("expected 4e5 paid to a, got %v", tc.sent)
+	}
+	if tc.sent[tc.payAddrs["b:9443"]] != 1e5 {
+		t.Fatalf("expected 1e5 paid to b, got %v", tc.sent)
+	}
+	owed, _ := Owed("a:9443")
+	if owed.Amount != 1e5 {
+		t.Fatalf("expected 1e5 owed to a, got %v", owed.Amount)
+	}
+
+	// Nothing more is paid until the server reports a balance
+	tc.balances["a:9443"] = 0
+	pv, err := d.Fulfill("a:9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 0 {
+		t.Fatalf("expected nothing paid, got %v", pv.Amount)
+	}
+	tc.balances["a:9443"] = 3e5
+	pv, _ = d.Fulfill("a:9443")
+	if pv.Amount != 1e5 {
+		t.Fatalf("expected the remaining 1e5 paid, got %v", pv.Amount)
+	}
+}
+
+func TestFulfillWithinBudget(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestClient(t)
+	tc.payAddrs["a:9443"] = "mpXwg4jMtRhuSpVq4xS3HFHmCmWp9NyGKt"
+	promise(t, "a:9443", 5e5, msg.OK)
+	tc.balances["a:9443"] = 5e5
+
+	d := Daemon{
+		Client: tc,
+		ID:     "client-id",
+		Budget: &msg.PaymentValue{Amount: 2e5, Currency: msg.BTC},
+	}
+	pv, err := d.Fulfill("a:9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 2e5 {
+		t.Fatalf("expected 2e5 paid, got %v", pv.Amount)
+	}
+	// The budget counts earlier payments
+	d = Daemon{Client: tc, ID: "client-id", Budget: d.Budget}
+	pv, _ = d.Fulfill("a:9443")
+	if pv.Amount != 0 {
+		t.Fatalf("expected budget to be spent, got %v paid", pv.Amount)
+	}
+	servers, _ := Servers()
+	if len(servers) != 1 || servers[0] != "a:9443" {
+		t.Fatalf("unexpected servers: %v", servers)
+	}
+}
+
+func TestFulfillFiatPromise(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestClient(t)
+	tc.payAddrs["a:9443"] = "mpXwg4jMtRhuSpVq4xS3HFHmCmWp9NyGKt"
+	req := msg.OcReq{ID: "client-id", Service: "calc", Method: "calc"}
+	req.AttachDeferredPayment(&msg.PaymentValue{Amount: 250, Currency: msg.USD})
+	resp := msg.OcResp{Status: msg.OK}
+	err := RecordPromise("a:9443", &req, &resp, nil)
+	if err == nil {
+		t.Fatalf("expected error recording USD promise without prices")
+	}
+	// $2.50 at $50,000/BTC is 5000 satoshis
+	err = RecordPromise("a:9443", &req, &resp, price.StaticOracle{msg.USD: "50000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owed, err := Owed("a:9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owed.Amount != 5000 || owed.Currency != msg.BTC {
+		t.Fatalf("expected 5000 satoshis owed, got %v", owed)
+	}
+	tc.balances["a:9443"] = 1e5
+	d := Daemon{Client: tc, ID: "client-id"}
+	pv, err := d.Fulfill("a:9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 5000 {
+		t.Fatalf("expected 5000 paid, got %v", pv.Amount)
+	}
+}
+
+func TestFulfillPendingAndReorg(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	tc := newTestClient(t)
+	tc.payAddrs["a:9443"] = "mpXwg4jMtRhuSpVq4xS3HFHmCmWp9NyGKt"
+	promise(t, "a:9443", 5e5, msg.OK)
+	d := Daemon{Client: tc, ID: "client-id", Btc: tc.wallet}
+
+	// Payments waiting for confirmations are not made again
+	tc.balances["a:9443"] = 5e5
+	tc.pending["a:9443"] = 2e5
+	pv, err := d.Fulfill("a:9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 3e5 {
+		t.Fatalf("expected 3e5 paid, got %v", pv.Amount)
+	}
+	recs, _ := rep.Select(&rep.Record{Method: PAY_METHOD}, 0, 10)
+	if len(recs) != 1 || recs[0].Txid == "" {
+		t.Fatalf("expected payment recorded with txid, got %v", recs)
+	}
+
+	// A payment lost in a reorg is owed again
+	tc.chain.Reorg(1, recs[0].Txid)
+	err = d.FulfillAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owed, _ := Owed("a:9443")
+	if owed.Amount != 2e5 {
+		t.Fatalf("expected 2e5 owed after paying again, got %v", owed.Amount)
+	}
+	if tc.sent[tc.payAddrs["a:9443"]] != 6e5 {
+		t.Fatalf("expected payment to be made again, got %v", tc.sent)
+	}
+}
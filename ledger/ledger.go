@@ -0,0 +1,568 @@
+package ledger
+
+// Double-entry ledger of what peers owe the server. Every entry moves an
+// amount, in satoshis, from a credit account to a debit account, so the
+// balances of all accounts sum to zero. Peer accounts are debited for
+// charges and refunds, and credited for payments; a positive peer balance is
+// owed to the server. Entries are never changed: mistakes and reversals are
+// undone by further ADJUSTMENT entries. Each entry is hashed together with
+// the one before it, and balances are cached as entries are posted, so reading
+// a balance doesn't need the history. Check replays the history to verify
+// both.
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/util"
+)
+
+type Account string
+
+const (
+	WALLET  Account = "wallet"  // bitcoin received and sent by the server
+	REVENUE Account = "revenue" // services charged for
+)
+
+func PeerAccount(id msg.OcID) Account {
+	return Account("peer/" + id.String())
+}
+
+type Kind string
+
+const (
+	CHARGE     Kind = "charge"
+	PAYMENT    Kind = "payment"
+	REFUND     Kind = "refund"
+	ADJUSTMENT Kind = "adjustment"
+)
+
+var (
+	DUPLICATE_REF = errors.New("an entry with that ref is already posted")
+	UNKNOWN_REF   = errors.New("no entry with that ref")
+)
+
+// Cursor into rep for ImportCharges
+const REP_CURSOR = "rep"
+
+type Entry struct {
+	Seq       int64   `json:"seq"`
+	Timestamp int64   `json:"timestamp"`
+	Kind      Kind    `json:"kind"`
+	Debit     Account `json:"debit"`
+	Credit    Account `json:"credit"`
+	Amount    int64   `json:"amount"`
+	Ref       string  `json:"ref,omitempty"` // unique, if set; eg. the rep record charged for
+	Memo      string  `json:"memo,omitempty"`
+	Hash      string  `json:"hash"`
+}
+
+// Hash of the entry, chained to the hash of the entry before it.
+func (e *Entry) hash(prev string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%s|%s|%s|%d|%s|%s", prev, e.Seq, e.Timestamp,
+		e.Kind, e.Debit, e.Credit, e.Amount, e.Ref, e.Memo)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Posts are serialized, so the hash chain and balances stay consistent
+var ledgerLock sync.Mutex
+
+func sqliteDBPath() string {
+	return util.AppDir() + "/ledger-sqlite.db"
+}
+
+func open() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDBPath())
+	if err != nil {
+		return nil, fmt.Errorf("error while opening db %v: %v",
+			sqliteDBPath(), err.Error())
+	}
+	_, err = db.Exec(`
+CREATE TABLE IF NOT EXISTS entries (
+  seq INTEGER NOT NULL PRIMARY KEY,
+  timestamp INTEGER,
+  kind TEXT,
+  debit TEXT,
+  credit TEXT,
+  amount INTEGER,
+  ref TEXT UNIQUE,
+  memo TEXT,
+  hash TEXT
+);
+CREATE TABLE IF NOT EXISTS balances (
+  account TEXT NOT NULL PRIMARY KEY,
+  balance INTEGER
+);
+CREATE TABLE IF NOT EXISTS sources (
+  key TEXT NOT NULL PRIMARY KEY,
+  posted INTEGER
+);
+CREATE TABLE IF NOT EXISTS cursors (
+  name TEXT NOT NULL PRIMARY KEY,
+  pos INTEGER
+)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error while intializing tables: %v", err.Error())
+	}
+	return db, nil
+}
+
+// Posts e, setting its Seq, Hash, and Timestamp if unset. Returns
+// DUPLICATE_REF if e's ref is already posted.
+func Post(e *Entry) error {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = post(tx, e)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Caller must hold ledgerLock.
+func post(tx *sql.Tx, e *Entry) error {
+	if e.Amount <= 0 || e.Debit == "" || e.Credit == "" || e.Debit == e.Credit {
+		return fmt.Errorf("malformed entry: %+v", e)
+	}
+	var ref interface{}
+	if e.Ref != "" {
+		ref = e.Ref
+		var n int
+		err := tx.QueryRow("SELECT COUNT(*) FROM entries WHERE ref = ?", e.Ref).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			return DUPLICATE_REF
+		}
+	}
+	var prevSeq int64
+	var prevHash string
+	err := tx.QueryRow("SELECT seq, hash FROM entries ORDER BY seq DESC LIMIT 1").
+		Scan(&prevSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = time.Now().Unix()
+	}
+	e.Seq = prevSeq + 1
+	e.Hash = e.hash(prevHash)
+	_, err = tx.Exec(`
+INSERT INTO entries(seq, timestamp, kind, debit, credit, amount, ref, memo, hash)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Seq, e.Timestamp, string(e.Kind), string(e.Debit), string(e.Credit),
+		e.Amount, ref, e.Memo, e.Hash)
+	if err != nil {
+		return err
+	}
+	err = addToBalance(tx, e.Debit, e.Amount)
+	if err != nil {
+		return err
+	}
+	return addToBalance(tx, e.Credit, -e.Amount)
+}
+
+func addToBalance(tx *sql.Tx, a Account, amount int64) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO balances(account, balance) VALUES (?, 0)",
+		string(a))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE balances SET balance = balance + ? WHERE account = ?",
+		amount, string(a))
+	return err
+}
+
+// Posts an ADJUSTMENT undoing the entry with ref. It has the ref
+// "reverse/"+ref, so an entry is only reversed once.
+func Reverse(ref string, memo string) (*Entry, error) {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var debit, credit string
+	var amount int64
+	err = tx.QueryRow("SELECT debit, credit, amount FROM entries WHERE ref = ?", ref).
+		Scan(&debit, &credit, &amount)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, UNKNOWN_REF
+	} else if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	e := Entry{
+		Kind:   ADJUSTMENT,
+		Debit:  Account(credit),
+		Credit: Account(debit),
+		Amount: amount,
+		Ref:    "reverse/" + ref,
+		Memo:   memo,
+	}
+	err = post(tx, &e)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &e, tx.Commit()
+}
+
+// Debits less credits to a, from the cached balance.
+func Balance(a Account) (int64, error) {
+	db, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var balance int64
+	err = db.QueryRow("SELECT balance FROM balances WHERE account = ?", string(a)).
+		Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// Up to limit entries debiting or crediting a, oldest first, skipping the
+// first offset. An empty account selects all entries.
+func Entries(a Account, offset int, limit int) ([]*Entry, error) {
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	query := "SELECT seq, timestamp, kind, debit, credit, amount, ref, memo, hash FROM entries"
+	args := []interface{}{}
+	if a != "" {
+		query += " WHERE debit = ? OR credit = ?"
+		args = append(args, string(a), string(a))
+	}
+	query += " ORDER BY seq LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		var e Entry
+		var kind, debit, credit string
+		var ref, memo sql.NullString
+		err := rows.Scan(&e.Seq, &e.Timestamp, &kind, &debit, &credit, &e.Amount,
+			&ref, &memo, &e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		e.Kind, e.Debit, e.Credit = Kind(kind), Account(debit), Account(credit)
+		e.Ref, e.Memo = ref.String, memo.String
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// Brings the payments posted from an outside source, eg. a payment address,
+// up to total. An increase is posted as a PAYMENT from the source to a; a
+// decrease, eg. after a reorg, as an ADJUSTMENT back. Returns the entry
+// posted, if any.
+func SyncSource(key string, a Account, total int64) (*Entry, error) {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var posted int64
+	err = tx.QueryRow("SELECT posted FROM sources WHERE key = ?", key).Scan(&posted)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return nil, err
+	}
+	if total == posted {
+		tx.Rollback()
+		return nil, nil
+	}
+	e := Entry{Kind: PAYMENT, Debit: WALLET, Credit: a, Amount: total - posted, Memo: key}
+	if total < posted {
+		e = Entry{Kind: ADJUSTMENT, Debit: a, Credit: WALLET, Amount: posted - total,
+			Memo: key + " no longer paid"}
+	}
+	err = post(tx, &e)
+	if err == nil {
+		_, err = tx.Exec("INSERT OR REPLACE INTO sources(key, posted) VALUES (?, ?)",
+			key, total)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &e, tx.Commit()
+}
+
+// Accounts that have had entries posted.
+func Accounts() ([]Account, error) {
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT account FROM balances ORDER BY account")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := make([]Account, 0)
+	for rows.Next() {
+		var a string
+		err := rows.Scan(&a)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, Account(a))
+	}
+	return accounts, rows.Err()
+}
+
+// Posts an ADJUSTMENT moving all of from's balance to to, eg. when the ID an
+// account is named for changes form. Returns the entry posted, if any.
+func MoveBalance(from Account, to Account) (*Entry, error) {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var balance int64
+	err = tx.QueryRow("SELECT balance FROM balances WHERE account = ?", string(from)).
+		Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return nil, err
+	}
+	if balance == 0 {
+		tx.Rollback()
+		return nil, nil
+	}
+	e := Entry{Kind: ADJUSTMENT, Debit: to, Credit: from, Amount: balance,
+		Memo: "moved from " + string(from)}
+	if balance < 0 {
+		e.Debit, e.Credit, e.Amount = from, to, -balance
+	}
+	err = post(tx, &e)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &e, tx.Commit()
+}
+
+// Renames a source of payments for SyncSource, keeping what was posted from
+// it, so the payments aren't posted again under the new name.
+func RenameSource(from string, to string) error {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO sources(key, posted) VALUES (?, 0)", to)
+	if err == nil {
+		_, err = tx.Exec(`
+UPDATE sources SET posted = posted + (SELECT COALESCE(SUM(posted), 0) FROM sources WHERE key = ?)
+WHERE key = ?`, from, to)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM sources WHERE key = ?", from)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Posts CHARGEs for the billed server records put in rep since the last
+// import. Each has the ref "rep/" and the record's row ID, so records posted
+// some other way, like refunds, are skipped. Returns the number posted.
+func ImportCharges() (int, error) {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	db, err := open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var cursor int64
+	err = db.QueryRow("SELECT pos FROM cursors WHERE name = ?", REP_CURSOR).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	var recs []*rep.Record
+	err = rep.ReduceAfter(cursor, func(rec *rep.Record) {
+		recs = append(recs, rec)
+	})
+	if err != nil || len(recs) == 0 {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, rec := range recs {
+		if !isCharge(rec) {
+			continue
+		}
+		amount, err := rec.BtcAmount()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if amount <= 0 {
+			continue
+		}
+		e := Entry{
+			Timestamp: int64(rec.Timestamp),
+			Kind:      CHARGE,
+			Debit:     PeerAccount(rec.ID),
+			Credit:    REVENUE,
+			Amount:    amount,
+			Ref:       RepRef(rec.RowID),
+			Memo:      rec.Service + "." + rec.Method,
+		}
+		err = post(tx, &e)
+		if err == DUPLICATE_REF {
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO cursors(name, pos) VALUES (?, ?)",
+		REP_CURSOR, recs[len(recs)-1].RowID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func isCharge(rec *rep.Record) bool {
+	return rec.Role == rep.SERVER && rec.PaymentValue != nil &&
+		(rec.Status == rep.SUCCESS_UNPAID || rec.Status == rep.SUCCESS_PAID)
+}
+
+// Ref of the entry for a rep record.
+func RepRef(rowID int64) string {
+	return fmt.Sprintf("rep/%d", rowID)
+}
+
+// Replays the entries, and returns a description of each problem found: a
+// broken hash chain, cached balances that don't match the entries, or
+// balances that don't sum to zero.
+func Check() ([]string, error) {
+	entries, err := Entries("", 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]string, 0)
+	balances := make(map[Account]int64)
+	prevHash := ""
+	for i, e := range entries {
+		if e.Seq != int64(i+1) {
+			problems = append(problems, fmt.Sprintf("entry %v is out of sequence", e.Seq))
+		}
+		if e.hash(prevHash) != e.Hash {
+			problems = append(problems, fmt.Sprintf("entry %v does not match its hash", e.Seq))
+		}
+		prevHash = e.Hash
+		balances[e.Debit] += e.Amount
+		balances[e.Credit] -= e.Amount
+	}
+
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT account, balance FROM balances")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sum := int64(0)
+	cached := make(map[Account]bool)
+	for rows.Next() {
+		var a string
+		var balance int64
+		err := rows.Scan(&a, &balance)
+		if err != nil {
+			return nil, err
+		}
+		cached[Account(a)] = true
+		sum += balance
+		if balances[Account(a)] != balance {
+			problems = append(problems, fmt.Sprintf(
+				"cached balance of %v is %v, but entries sum to %v",
+				a, balance, balances[Account(a)]))
+		}
+	}
+	for a, balance := range balances {
+		if !cached[a] {
+			problems = append(problems, fmt.Sprintf(
+				"no cached balance for %v, but entries sum to %v", a, balance))
+		}
+	}
+	if sum != 0 {
+		problems = append(problems, fmt.Sprintf("balances sum to %v, not 0", sum))
+	}
+	for _, p := range problems {
+		log.Printf("ledger check: %v\n", p)
+	}
+	return problems, rows.Err()
+}
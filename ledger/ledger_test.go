@@ -0,0 +1,205 @@
+package ledger
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/testutil"
+)
+
+func balanceOf(t *testing.T, a Account) int64 {
+	balance, err := Balance(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestPostAndReverse(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	peer := PeerAccount("id-123")
+	err := Post(&Entry{Kind: CHARGE, Debit: peer, Credit: REVENUE, Amount: 1000, Ref: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Post(&Entry{Kind: PAYMENT, Debit: WALLET, Credit: peer, Amount: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := balanceOf(t, peer); b != -500 {
+		t.Fatalf("expected balance of -500, got %v", b)
+	}
+	err = Post(&Entry{Kind: CHARGE, Debit: peer, Credit: REVENUE, Amount: 1000, Ref: "a"})
+	if err != DUPLICATE_REF {
+		t.Fatalf("expected %v, got %v", DUPLICATE_REF, err)
+	}
+	err = Post(&Entry{Kind: CHARGE, Debit: peer, Credit: peer, Amount: 1000})
+	if err == nil {
+		t.Fatalf("expected error for entry with one account")
+	}
+
+	e, err := Reverse("a", "charged in error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind != ADJUSTMENT || e.Debit != REVENUE || e.Credit != peer {
+		t.Fatalf("unexpected reversal: %+v", e)
+	}
+	if b := balanceOf(t, peer); b != -1500 {
+		t.Fatalf("expected balance of -1500, got %v", b)
+	}
+	if _, err = Reverse("a", ""); err != DUPLICATE_REF {
+		t.Fatalf("expected %v, got %v", DUPLICATE_REF, err)
+	}
+	if _, err = Reverse("b", ""); err != UNKNOWN_REF {
+		t.Fatalf("expected %v, got %v", UNKNOWN_REF, err)
+	}
+	entries, err := Entries(peer, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].Ref != "reverse/a" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestSyncSource(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	peer := PeerAccount("id-123")
+	for _, total := range []int64{3000, 3000, 5000, 1000} {
+		_, err := SyncSource("addr/1abc", peer, total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := balanceOf(t, peer); b != -total {
+			t.Fatalf("expected balance of %v, got %v", -total, b)
+		}
+	}
+	entries, _ := Entries(peer, 0, 10)
+	if len(entries) != 3 || entries[2].Kind != ADJUSTMENT || entries[2].Amount != 4000 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+}
+
+func TestMoveBalanceAndRenameSource(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	from, to := PeerAccount("id-old"), PeerAccount("id-new")
+	_, err := SyncSource("channels/id-old", from, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := MoveBalance(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || balanceOf(t, from) != 0 || balanceOf(t, to) != -3000 {
+		t.Fatalf("expected the credit to move, got %v", e)
+	}
+	if e, _ := MoveBalance(from, to); e != nil {
+		t.Fatalf("expected nothing left to move, got %v", e)
+	}
+	err = RenameSource("channels/id-old", "channels/id-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := SyncSource("channels/id-new", to, 3000); e != nil {
+		t.Fatalf("expected the renamed source to be synced, got %v", e)
+	}
+	accounts, err := Accounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 3 {
+		t.Fatalf("expected 3 accounts, got %v", accounts)
+	}
+	if problems, _ := Check(); len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
+
+func TestImportCharges(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	id := msg.OcID("id-123")
+	put := func(status rep.Status, amount int64) int64 {
+		rowID, err := rep.Put(&rep.Record{
+			Role:         rep.SERVER,
+			Service:      "calc",
+			Method:       "calc",
+			ID:           id,
+			Status:       status,
+			PaymentType:  msg.DEFER,
+			PaymentValue: &msg.PaymentValue{Amount: amount, Currency: msg.BTC},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rowID
+	}
+	put(rep.SUCCESS_UNPAID, 1000)
+	put(rep.FAILURE, 2000)
+	put(rep.SUCCESS_PAID, 3000)
+	n, err := ImportCharges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || balanceOf(t, PeerAccount(id)) != 4000 {
+		t.Fatalf("expected 2 charges totalling 4000, got %v, %v",
+			n, balanceOf(t, PeerAccount(id)))
+	}
+
+	// Only records put since the last import are read, and those already
+	// posted are skipped
+	rowID := put(rep.SUCCESS_PAID, 500)
+	err = Post(&Entry{Kind: REFUND, Debit: PeerAccount(id), Credit: WALLET,
+		Amount: 500, Ref: RepRef(rowID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(rep.SUCCESS_UNPAID, 100)
+	n, err = ImportCharges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || balanceOf(t, PeerAccount(id)) != 4600 {
+		t.Fatalf("expected 1 charge and balance of 4600, got %v, %v",
+			n, balanceOf(t, PeerAccount(id)))
+	}
+	if n, _ = ImportCharges(); n != 0 {
+		t.Fatalf("expected nothing to import, got %v", n)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	peer := PeerAccount("id-123")
+	Post(&Entry{Kind: CHARGE, Debit: peer, Credit: REVENUE, Amount: 1000})
+	Post(&Entry{Kind: PAYMENT, Debit: WALLET, Credit: peer, Amount: 700})
+	problems, err := Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+
+	db, err := sql.Open("sqlite3", sqliteDBPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("UPDATE entries SET amount = 100 WHERE seq = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err = Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The altered entry no longer matches its hash, nor the cached balances
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems, got %v", problems)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"regexp"
+	"strings"
 
 	"github.com/ortutay/decloud/util"
 )
@@ -42,6 +44,7 @@ const (
 	TXID                 = "txid"
 	ATTACHED             = "attached"
 	DEFER                = "defer"
+	CHANNEL              = "channel"
 )
 
 type PaymentRequest struct {
@@ -82,8 +85,19 @@ func (c *Currency) String() string {
 const (
 	BTC Currency = "BTC"
 	USD          = "USD"
+	EUR          = "EUR"
 )
 
+// Number of decimal places in a whole unit of the currency
+func (c Currency) Decimals() int {
+	if c == BTC {
+		return 8
+	}
+	return 2
+}
+
+// Amount is in the currency's smallest unit: satoshis for BTC, cents for USD
+// and EUR.
 type PaymentValue struct {
 	Amount   int64    `json:"amount"`
 	Currency Currency `json:"currency"`
@@ -108,11 +122,23 @@ func NewPaymentValue(str string) (*PaymentValue, error) {
 }
 
 func NewPaymentValueParseString(str string) (*PaymentValue, error) {
-	re := regexp.MustCompile("(?i)(-?[0-9.]+) *(btc)")
+	re := regexp.MustCompile("(?i)(-?[0-9.]+) *(btc|usd|eur)")
 	m := re.FindStringSubmatch(str)
 	if len(m) != 3 {
 		return nil, fmt.Errorf("could not parse: %v", str)
 	}
+	if currency := Currency(strings.ToUpper(m[2])); currency != BTC {
+		r := new(big.Rat)
+		_, ok := r.SetString(m[1])
+		if !ok {
+			return nil, fmt.Errorf("could not parse: %v", m[1])
+		}
+		r.Mul(r, big.NewRat(100, 1))
+		if !r.IsInt() {
+			return nil, fmt.Errorf("max precision is 2 decimal places (%v)", m[1])
+		}
+		return &PaymentValue{Amount: r.Num().Int64(), Currency: currency}, nil
+	}
 	// r := new(big.Rat)
 	// _, err := fmt.Sscan(m[1], r)
 	// if err != nil {
@@ -146,9 +172,34 @@ type OcReq struct {
 	PaymentValue  *PaymentValue `json:"paymentValue,omitempty"`
 	PaymentTxn    string        `json:"paymentTxn,omitempty"`
 	ContentLength int           `json:"contentLength,omitempty"`
+	Certs         []OcCert      `json:"certs,omitempty"` // From ID to the key that signed
 	Body          []byte        `json:"-"`
 }
 
+type CertKind string
+
+const (
+	ROTATE   CertKind = "rotate"   // Subject replaces Issuer
+	DELEGATE CertKind = "delegate" // Subject may act for Issuer, within Scope
+)
+
+// A statement by Issuer about the key Subject, signed by Issuer. Scope is of
+// "service.method", "service.*" or "*"; Expires is a unix time, or zero.
+type OcCert struct {
+	Kind    CertKind `json:"kind"`
+	Issuer  OcID     `json:"issuer"`
+	Subject OcID     `json:"subject"`
+	Scope   []string `json:"scope,omitempty"`
+	Expires int64    `json:"expires,omitempty"`
+	Sig     string   `json:"sig"`
+}
+
+// What the issuer signs.
+func (c *OcCert) SignablePortion() []byte {
+	return []byte(fmt.Sprintf("decloud cert|%s|%s|%s|%s|%d", c.Kind, c.Issuer,
+		c.Subject, strings.Join(c.Scope, ","), c.Expires))
+}
+
 func (r *OcReq) SetBody(body []byte) {
 	r.ContentLength = len(body)
 	r.Body = body
@@ -221,6 +272,8 @@ const (
 	BAD_REQUEST         = CLIENT_ERROR + "/bad-request"
 	INVALID_SIGNATURE   = CLIENT_ERROR + "/invalid-signature"
 	COIN_REUSE   = CLIENT_ERROR + "/coin-reuse"
+	REVOKED_KEY         = CLIENT_ERROR + "/revoked-key"
+	KEY_TYPE_DENIED     = CLIENT_ERROR + "/key-type-denied"
 	SERVICE_UNSUPPORTED = CLIENT_ERROR + "/service-unsupported"
 	METHOD_UNSUPPORTED  = CLIENT_ERROR + "/method-unsupported"
 	INVALID_ARGUMENTS   = CLIENT_ERROR + "/invalid-arguments"
@@ -234,10 +287,14 @@ const (
 	CURRENCY_UNSUPPORTED = REQUEST_DECLINED + "/currency-unsupported"
 	PAYMENT_REQUIRED     = REQUEST_DECLINED + "/payment-required"
 	PLEASE_PAY     = REQUEST_DECLINED + "/please-pay"
+	INSUFFICIENT_COINS   = REQUEST_DECLINED + "/insufficient-coins"
+	REFUND_DECLINED      = REQUEST_DECLINED + "/refund"
 
 	PAYMENT_DECLINED = REQUEST_DECLINED + "/payment"
 	INVALID_TXN      = PAYMENT_DECLINED + "/invalid-transaction"
 	INVALID_TXID     = PAYMENT_DECLINED + "/invalid-txid"
+	INVALID_CHANNEL  = PAYMENT_DECLINED + "/invalid-channel"
+	INVALID_ESCROW   = PAYMENT_DECLINED + "/invalid-escrow"
 	TOO_LOW          = PAYMENT_DECLINED + "/too-low"
 	NO_DEFER         = PAYMENT_DECLINED + "/no-defer"
 )
@@ -102,3 +102,24 @@ func TestGetPaymentValueOverMaxPrecision(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestGetPaymentValueFiat(t *testing.T) {
+	pv, err := NewPaymentValueParseString("1.25usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Currency != USD || pv.Amount != 125 {
+		t.Fatalf("expected 125 USD, got %v", pv)
+	}
+	pv, err = NewPaymentValueParseString("3 EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Currency != EUR || pv.Amount != 300 {
+		t.Fatalf("expected 300 EUR, got %v", pv)
+	}
+	_, err = NewPaymentValueParseString("1.001usd")
+	if err == nil {
+		t.Fatalf("expected error for fractional cents")
+	}
+}
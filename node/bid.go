@@ -0,0 +1,230 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/services/payment"
+)
+
+// Guards against strategies that never give up
+const MAX_BIDS = 50
+
+// What to offer a server for a request.
+type Bid struct {
+	Addr         string
+	PaymentType  msg.PaymentType
+	PaymentValue *msg.PaymentValue // nil for no payment
+}
+
+// Decides what to offer for requests, and what to do when an offer is
+// declined.
+type BidStrategy interface {
+	// The first bid for req, to one of the servers at addrs
+	FirstBid(req *msg.OcReq, addrs []string) *Bid
+
+	// The bid to retry with after last was declined with status, or nil to
+	// give up
+	NextBid(req *msg.OcReq, addrs []string, last *Bid, status msg.OcRespStatus) *Bid
+}
+
+// Whether the server declined the payment offered, rather than the request.
+func IsBidDeclined(status msg.OcRespStatus) bool {
+	switch status {
+	case msg.PAYMENT_REQUIRED, msg.TOO_LOW, msg.NO_DEFER, msg.CURRENCY_UNSUPPORTED:
+		return true
+	default:
+		return false
+	}
+}
+
+// Bids start at Start, and go up by Step each time a bid is too low, up to
+// Max; Step and Max are required. If Attach is set, a server that won't take
+// a deferred payment is offered an attached one instead.
+type StepUp struct {
+	Start       *msg.PaymentValue // nil to first try without payment
+	Step        *msg.PaymentValue
+	Max         *msg.PaymentValue
+	PaymentType msg.PaymentType // DEFER if empty
+	Attach      bool
+}
+
+func (su *StepUp) paymentType() msg.PaymentType {
+	if su.PaymentType == "" {
+		return msg.DEFER
+	}
+	return su.PaymentType
+}
+
+func (su *StepUp) FirstBid(req *msg.OcReq, addrs []string) *Bid {
+	if len(addrs) == 0 {
+		return nil
+	}
+	bid := Bid{Addr: addrs[0], PaymentType: msg.NONE}
+	if su.Start != nil && su.Start.Amount > 0 {
+		pv := msg.PaymentValue(*su.Start)
+		bid.PaymentType = su.paymentType()
+		bid.PaymentValue = &pv
+	}
+	return &bid
+}
+
+func (su *StepUp) NextBid(req *msg.OcReq, addrs []string, last *Bid, status msg.OcRespStatus) *Bid {
+	next := *last
+	switch status {
+	case msg.PAYMENT_REQUIRED, msg.TOO_LOW:
+		if next.PaymentType == msg.NONE {
+			next.PaymentType = su.paymentType()
+		}
+		if su.Step == nil || su.Max == nil {
+			return nil
+		}
+		pv := msg.PaymentValue{Amount: 0, Currency: su.Step.Currency}
+		if last.PaymentValue != nil {
+			pv = *last.PaymentValue
+		}
+		if pv.Currency != su.Step.Currency || pv.Currency != su.Max.Currency {
+			return nil
+		}
+		if pv.Amount >= su.Max.Amount {
+			return nil
+		}
+		pv.Amount += su.Step.Amount
+		if pv.Amount > su.Max.Amount {
+			pv.Amount = su.Max.Amount
+		}
+		next.PaymentValue = &pv
+	case msg.NO_DEFER:
+		if !su.Attach || last.PaymentType != msg.DEFER {
+			return nil
+		}
+		next.PaymentType = msg.ATTACHED
+	default:
+		return nil
+	}
+	return &next
+}
+
+// Shops across servers: bids to each server in turn with PerServer, moving to
+// the next server when it gives up.
+type Shopper struct {
+	PerServer BidStrategy
+}
+
+func (s *Shopper) FirstBid(req *msg.OcReq, addrs []string) *Bid {
+	return s.firstBidFrom(req, addrs, 0)
+}
+
+func (s *Shopper) firstBidFrom(req *msg.OcReq, addrs []string, i int) *Bid {
+	if i >= len(addrs) {
+		return nil
+	}
+	return s.PerServer.FirstBid(req, addrs[i:i+1])
+}
+
+func (s *Shopper) NextBid(req *msg.OcReq, addrs []string, last *Bid, status msg.OcRespStatus) *Bid {
+	i := indexOf(addrs, last.Addr)
+	if i == -1 {
+		return nil
+	}
+	next := s.PerServer.NextBid(req, addrs[i:i+1], last, status)
+	if next != nil {
+		return next
+	}
+	return s.firstBidFrom(req, addrs, i+1)
+}
+
+func indexOf(addrs []string, addr string) int {
+	for i, a := range addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Sends req to one of the servers at addrs, bidding according to the client's
+// strategy, and retrying as long as bids are declined. Without a strategy, req
+// is sent once, as is, to the first server. On return, req is the request
+// last sent. Returns the last response, and the server it came from.
+func (c *Client) SendWithBids(addrs []string, req *msg.OcReq) (*msg.OcResp, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", fmt.Errorf("no servers to send to")
+	}
+	if c.Bidding == nil {
+		resp, err := c.SignAndSend(addrs[0], req)
+		return resp, addrs[0], err
+	}
+	orig := *req
+	var resp *msg.OcResp
+	var addr string
+	bid := c.Bidding.FirstBid(&orig, addrs)
+	for i := 0; bid != nil && i < MAX_BIDS; i++ {
+		*req = orig
+		err := c.applyBid(req, bid)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err = c.SignAndSend(bid.Addr, req)
+		if err != nil {
+			return nil, "", err
+		}
+		addr = bid.Addr
+		if !IsBidDeclined(resp.Status) {
+			break
+		}
+		fmt.Printf("bid of %v %v to %v declined: %v\n",
+			bid.PaymentValue, bid.PaymentType, bid.Addr, resp.Status)
+		bid = c.Bidding.NextBid(&orig, addrs, bid, resp.Status)
+	}
+	if resp == nil {
+		return nil, "", fmt.Errorf("no bid made for request")
+	}
+	return resp, addr, nil
+}
+
+func (c *Client) applyBid(req *msg.OcReq, bid *Bid) error {
+	switch bid.PaymentType {
+	case msg.NONE, "":
+		return nil
+	case msg.DEFER:
+		req.AttachDeferredPayment(bid.PaymentValue)
+		return nil
+	case msg.ATTACHED:
+		return c.attachPayment(bid.Addr, req, bid.PaymentValue)
+	default:
+		return fmt.Errorf("can't bid with payment type %v", bid.PaymentType)
+	}
+}
+
+// Attaches a txn paying pv to an address the server at addr gives for us.
+func (c *Client) attachPayment(addr string, req *msg.OcReq, pv *msg.PaymentValue) error {
+	if pv.Currency != msg.BTC {
+		return fmt.Errorf("can't attach payment in %v", pv.Currency)
+	}
+	resp, err := c.SignAndSend(addr, payment.NewPaymentAddrReq(msg.BTC))
+	if err != nil {
+		return err
+	}
+	if resp.Status != msg.OK {
+		return fmt.Errorf("couldn't get payment address: %v", resp.Status)
+	}
+	payAddr, err := msg.NewPaymentAddr(string(resp.Body))
+	if err != nil {
+		return err
+	}
+	txnHex, err := c.Btc.CreateTxn(payAddr.Addr, pv.Amount)
+	if err != nil {
+		return fmt.Errorf("error while creating payment: %v", err.Error())
+	}
+	b64txn, err := btc.EncodeTxn(txnHex)
+	if err != nil {
+		return err
+	}
+	pvCopy := msg.PaymentValue(*pv)
+	req.PaymentType = msg.ATTACHED
+	req.PaymentValue = &pvCopy
+	req.PaymentTxn = b64txn
+	return nil
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/services/payment"
+	"github.com/ortutay/decloud/testutil"
+)
+
+const BID_TEST_SERVICE = "bid-test"
+
+// Serves requests paying at least min, declining deferred payments if
+// noDefer is set.
+type bidTestHandler struct {
+	min     int64
+	noDefer bool
+}
+
+func (h *bidTestHandler) Handle(req *msg.OcReq) (*msg.OcResp, error) {
+	if req.PaymentValue == nil || req.PaymentType == msg.NONE {
+		return msg.NewRespError(msg.PAYMENT_REQUIRED), nil
+	}
+	if req.PaymentType == msg.DEFER && h.noDefer {
+		return msg.NewRespError(msg.NO_DEFER), nil
+	}
+	if req.PaymentValue.Amount < h.min {
+		return msg.NewRespError(msg.TOO_LOW), nil
+	}
+	return msg.NewRespOk([]byte("")), nil
+}
+
+// Starts a server on a free port, and returns its address.
+func startBidTestServer(t *testing.T, h *bidTestHandler, b btc.Backend) string {
+	maxBalance := msg.PaymentValue{Amount: 1e8, Currency: msg.BTC}
+	services := make(map[string]Handler)
+	services[BID_TEST_SERVICE] = h
+	services[payment.SERVICE_NAME] = &payment.PaymentService{Btc: b}
+	s := Server{
+		Btc: b,
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.MAX_BALANCE, Args: []interface{}{&maxBalance}},
+		}},
+		Handler: &ServiceMux{Services: services},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go (func() {
+		for s.Serve(listener) == nil {
+		}
+	})()
+	return listener.Addr().String()
+}
+
+func newBidTestReq() *msg.OcReq {
+	return &msg.OcReq{
+		Service:  BID_TEST_SERVICE,
+		Method:   "get",
+		Args:     []string{},
+		Coins:    []string{},
+		CoinSigs: []string{},
+		Body:     []byte(""),
+	}
+}
+
+func pvBtc(amount int64) *msg.PaymentValue {
+	return &msg.PaymentValue{Amount: amount, Currency: msg.BTC}
+}
+
+func TestStepUp(t *testing.T) {
+	su := StepUp{Step: pvBtc(10), Max: pvBtc(25)}
+	addrs := []string{"a"}
+	bid := su.FirstBid(nil, addrs)
+	if bid.PaymentType != msg.NONE || bid.PaymentValue != nil {
+		t.Fatalf("expected no payment, got %+v", bid)
+	}
+	var amounts []int64
+	for bid = su.NextBid(nil, addrs, bid, msg.PAYMENT_REQUIRED); bid != nil; bid = su.NextBid(nil, addrs, bid, msg.TOO_LOW) {
+		if bid.PaymentType != msg.DEFER {
+			t.Fatalf("expected deferred payment, got %+v", bid)
+		}
+		amounts = append(amounts, bid.PaymentValue.Amount)
+	}
+	if len(amounts) != 3 || amounts[0] != 10 || amounts[1] != 20 || amounts[2] != 25 {
+		t.Fatalf("unexpected bids: %v", amounts)
+	}
+
+	bid = &Bid{Addr: "a", PaymentType: msg.DEFER, PaymentValue: pvBtc(10)}
+	if su.NextBid(nil, addrs, bid, msg.NO_DEFER) != nil {
+		t.Fatalf("expected to give up without Attach")
+	}
+	su.Attach = true
+	next := su.NextBid(nil, addrs, bid, msg.NO_DEFER)
+	if next.PaymentType != msg.ATTACHED || next.PaymentValue.Amount != 10 {
+		t.Fatalf("expected attached payment of 10, got %+v", next)
+	}
+	if su.NextBid(nil, addrs, bid, msg.INVALID_ARGUMENTS) != nil {
+		t.Fatalf("expected to give up on other errors")
+	}
+}
+
+func TestShopper(t *testing.T) {
+	s := Shopper{PerServer: &StepUp{Start: pvBtc(10), Step: pvBtc(10), Max: pvBtc(10)}}
+	addrs := []string{"a", "b"}
+	bid := s.FirstBid(nil, addrs)
+	if bid.Addr != "a" || bid.PaymentValue.Amount != 10 {
+		t.Fatalf("unexpected first bid: %+v", bid)
+	}
+	bid = s.NextBid(nil, addrs, bid, msg.TOO_LOW)
+	if bid.Addr != "b" || bid.PaymentValue.Amount != 10 {
+		t.Fatalf("expected to move to the next server, got %+v", bid)
+	}
+	if s.NextBid(nil, addrs, bid, msg.TOO_LOW) != nil {
+		t.Fatalf("expected to give up after the last server")
+	}
+}
+
+func TestSendWithBids(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	cheap := startBidTestServer(t, &bidTestHandler{min: 30, noDefer: true}, server)
+	pricey := startBidTestServer(t, &bidTestHandler{min: 1000}, server)
+
+	c, _ := newClient(newTestWallet(chain, "client"))
+	c.Bidding = &Shopper{PerServer: &StepUp{
+		Step:   pvBtc(20),
+		Max:    pvBtc(50),
+		Attach: true,
+	}}
+	req := newBidTestReq()
+	resp, addr, err := c.SendWithBids([]string{pricey, cheap}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK || addr != cheap {
+		t.Fatalf("expected OK from %v, got %v from %v", cheap, resp.Status, addr)
+	}
+	if req.PaymentType != msg.ATTACHED || req.PaymentValue.Amount != 40 {
+		t.Fatalf("expected attached payment of 40, got %v %v",
+			req.PaymentType, req.PaymentValue)
+	}
+	txn, err := btc.DecodeTxn(req.PaymentTxn, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txn.Outs) == 0 || txn.Outs[0].Amount != 40 {
+		t.Fatalf("expected txn paying 40, got %+v", txn)
+	}
+
+	// Nothing is within the max
+	c.Bidding = &StepUp{Step: pvBtc(20), Max: pvBtc(50)}
+	resp, _, err = c.SendWithBids([]string{pricey}, newBidTestReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.TOO_LOW {
+		t.Fatalf("expected %v, got %v", msg.TOO_LOW, resp.Status)
+	}
+}
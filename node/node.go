@@ -8,19 +8,19 @@ import (
 	"net"
 	"time"
 
-	"github.com/conformal/btcjson"
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/coins"
 	"github.com/ortutay/decloud/conf"
 	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/peer"
-	"github.com/ortutay/decloud/util"
 )
 
-const SERVER_PAYMENT_MIN_CONF = 0
-
 type Client struct {
-	BtcConf *util.BitcoindConf
+	Btc     btc.Backend
 	Cred    cred.Cred
+	Bidding BidStrategy // nil to send requests as they are
 }
 
 func (c *Client) SignAndSend(addr string, req *msg.OcReq) (*msg.OcResp, error) {
@@ -37,7 +37,7 @@ func (c *Client) BtcSignRequest(min, max int64, req *msg.OcReq) error {
 
 func (c *Client) SignRequest(req *msg.OcReq) error {
 	// TODO(ortutay): add nonce support
-	err := c.Cred.SignOcReq(req, c.BtcConf)
+	err := c.Cred.SignOcReq(req, c.Btc)
 	if err != nil {
 		return fmt.Errorf("error while signing: %v", err.Error())
 	}
@@ -72,17 +72,9 @@ func (c *Client) SendBtcPayment(payVal *msg.PaymentValue, payAddr *msg.PaymentAd
 	if payVal.Currency != msg.BTC || payAddr.Currency != msg.BTC {
 		panic("unexpected currency: " + payVal.Currency + " " + payAddr.Currency)
 	}
-	cmd, err := btcjson.NewSendToAddressCmd("", payAddr.Addr, payVal.Amount)
-	if err != nil {
-		return "", fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	resp, err := util.SendBtcRpc(cmd, c.BtcConf)
+	txid, err := c.Btc.Send(payAddr.Addr, payVal.Amount)
 	if err != nil {
-		return "", fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	txid, ok := resp.Result.(string)
-	if !ok {
-		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", resp)
+		return "", fmt.Errorf("error while sending payment: %v", err.Error())
 	}
 	return msg.BtcTxid(txid), nil
 }
@@ -109,11 +101,19 @@ func (sm *ServiceMux) Handle(req *msg.OcReq) (*msg.OcResp, error) {
 
 type Server struct {
 	Cred    *cred.Cred
-	BtcConf *util.BitcoindConf
+	Btc     btc.Backend
 	Addr    string
 	Conf    *conf.Conf
 	Handler Handler
 	PeriodicWakers []PeriodicWaker
+	Coins   *coins.Resolver
+}
+
+func (s *Server) coinResolver() *coins.Resolver {
+	if s.Coins == nil {
+		s.Coins = coins.NewResolver(s.Btc)
+	}
+	return s.Coins
 }
 
 func (s *Server) ListenAndServe() error {
@@ -142,7 +142,6 @@ func (s *Server) ListenAndServe() error {
 			continue
 		}
 	}
-	return nil
 }
 
 func (s *Server) Serve(listener net.Listener) error {
@@ -168,13 +167,15 @@ func (s *Server) Serve(listener net.Listener) error {
 		// - check service available
 		// - check method available
 
-		p, err := peer.NewPeerFromReq(req, s.BtcConf)
+		p, err := peer.NewPeerFromReq(req)
 		if err != nil {
 			log.Printf("error generating peer: %v\n", err)
 			if err == peer.INVALID_SIGNATURE {
 				msg.NewRespError(msg.INVALID_SIGNATURE).Write(conn)
 			} else if err == peer.COIN_REUSE {
 				msg.NewRespError(msg.COIN_REUSE).Write(conn)
+			} else if err == peer.REVOKED_KEY {
+				msg.NewRespError(msg.REVOKED_KEY).Write(conn)
 			} else {
 				msg.NewRespError(msg.SERVER_ERROR).Write(conn)
 			}
@@ -212,23 +213,41 @@ func (s *Server) Serve(listener net.Listener) error {
 }
 
 func (s *Server) checkBalance(p *peer.Peer) *msg.OcResp {
-	balance, err := p.Balance(SERVER_PAYMENT_MIN_CONF, s.BtcConf)
-	if err != nil {
-		return msg.NewRespError(msg.SERVER_ERROR)
-	}
-	fmt.Printf("balance: %v\n", balance)
-	if (balance.Currency != msg.BTC) {
-		panic("TODO: support other currencies")
-	}
+	// Payments count toward max-balance once they have the confirmations the
+	// conf asks of the peer
+	minConf := s.Conf.MinConf(p.ID)
 	maxBalance, err := s.Conf.PolicyForCmd(conf.MAX_BALANCE)
 	if err != nil {
 		// TODO(ortutay): handle more configuration around max balance
 		panic(err)
 	}
+	if maxBalance == nil {
+		// No limit
+		return nil
+	}
+	balance, err := s.ledgerBalance(p)
+	if err != nil {
+		log.Printf("error while reading balance of %v: %v\n", p.ID, err)
+		return msg.NewRespError(msg.SERVER_ERROR)
+	}
+	fmt.Printf("balance: %v\n", balance)
 	maxAllowed := maxBalance.Args[0].(*msg.PaymentValue).Amount
 	fmt.Printf("max balance: %v\n", maxBalance.Args[0])
 	if balance.Amount > maxAllowed {
-		addr, err := p.PaymentAddr(-1, s.BtcConf)
+		// Payments are only synced from the chain once the cached balance is
+		// over the max, as the peer may have paid since
+		balance, err = p.Balance(minConf, s.Btc)
+		if err != nil {
+			return msg.NewRespError(msg.SERVER_ERROR)
+		}
+	}
+	if balance.Amount > maxAllowed {
+		addr, err := p.PaymentAddr(-1, s.Btc)
+		if err != nil {
+			return msg.NewRespError(msg.SERVER_ERROR)
+		}
+		// Pending payments will count once confirmed, so aren't asked for again
+		_, pending, err := p.PaidByConf(minConf, s.Btc)
 		if err != nil {
 			return msg.NewRespError(msg.SERVER_ERROR)
 		}
@@ -237,7 +256,7 @@ func (s *Server) checkBalance(p *peer.Peer) *msg.OcResp {
 		// much by doing this, and may waste money on miner fees, but nevertheless,
 		// we could have some smarter handling for that situation.
 		pr := msg.PaymentRequest{
-			Amount: balance.Amount,
+			Amount: balance.Amount - pending.Amount,
 			Currency: balance.Currency,
 			Addr: addr,
 		}
@@ -250,18 +269,29 @@ func (s *Server) checkBalance(p *peer.Peer) *msg.OcResp {
 	return nil
 }
 
+// The peer's balance in the ledger, with charges recorded since it was last
+// read, but without syncing payments from the chain.
+func (s *Server) ledgerBalance(p *peer.Peer) (*msg.PaymentValue, error) {
+	_, err := ledger.ImportCharges()
+	if err != nil {
+		return nil, err
+	}
+	balance, err := ledger.Balance(ledger.PeerAccount(p.ID))
+	if err != nil {
+		return nil, err
+	}
+	return &msg.PaymentValue{Amount: balance, Currency: msg.BTC}, nil
+}
+
 func (s *Server) isAllowedByPolicy(p *peer.Peer, req *msg.OcReq) (bool, msg.OcRespStatus) {
 	fmt.Printf("is allowed? %v\n", s)
 
-	paidPv, err := p.AmountPaid(SERVER_PAYMENT_MIN_CONF, s.BtcConf)
-	if err != nil {
-		return false, msg.SERVER_ERROR
+	if ok, status := s.isAllowedByCoinPolicy(req); !ok {
+		return false, status
 	}
-	consumedPv, err := p.AmountConsumed()
-	if err != nil {
-		return false, msg.SERVER_ERROR
+	if ok, status := s.isAllowedByKeyTypePolicy(req); !ok {
+		return false, status
 	}
-	fmt.Printf("paid: %v, consumed: %v\n", paidPv, consumedPv)
 
 	// policies := s.Conf.MatchingPolicies(req.Service, req.Method)
 	// for _, policy := range policies {
@@ -284,3 +314,90 @@ func (s *Server) isAllowedByPolicy(p *peer.Peer, req *msg.OcReq) (bool, msg.OcRe
 	// }
 	return true, msg.OK
 }
+
+// Checks the key-types policies against every key in the request's identity,
+// from its ID through its certs to the key that signed.
+func (s *Server) isAllowedByKeyTypePolicy(req *msg.OcReq) (bool, msg.OcRespStatus) {
+	if s.Conf == nil || req.ID == "" {
+		return true, msg.OK
+	}
+	var types []cred.KeyType
+	for _, policy := range s.Conf.MatchingPolicies(req.Service, req.Method) {
+		if policy.Cmd != conf.KEY_TYPES {
+			continue
+		}
+		if types == nil {
+			var err error
+			types, err = cred.ReqKeyTypes(req)
+			if err != nil {
+				return false, msg.INVALID_SIGNATURE
+			}
+		}
+		for _, t := range types {
+			if !keyTypeAllowed(policy, t) {
+				return false, msg.KEY_TYPE_DENIED
+			}
+		}
+	}
+	return true, msg.OK
+}
+
+func keyTypeAllowed(policy *conf.Policy, t cred.KeyType) bool {
+	for _, arg := range policy.Args {
+		if arg.(cred.KeyType) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the min-coins and min-coin-age policies against the confirmed coins
+// of the request's bitcoin address credentials.
+func (s *Server) isAllowedByCoinPolicy(req *msg.OcReq) (bool, msg.OcRespStatus) {
+	if s.Conf == nil {
+		return true, msg.OK
+	}
+	minCoins := int64(0)
+	minAge := 0
+	for _, policy := range s.Conf.MatchingPolicies(req.Service, req.Method) {
+		switch policy.Cmd {
+		case conf.MIN_COINS:
+			pv := policy.Args[0].(msg.PaymentValue)
+			if pv.Currency != msg.BTC {
+				return false, msg.SERVER_ERROR
+			}
+			if pv.Amount > minCoins {
+				minCoins = pv.Amount
+			}
+		case conf.MIN_COIN_AGE:
+			if age := policy.Args[0].(int); age > minAge {
+				minAge = age
+			}
+		}
+	}
+	if minCoins == 0 && minAge == 0 {
+		return true, msg.OK
+	}
+	if len(req.Coins) == 0 {
+		return false, msg.INSUFFICIENT_COINS
+	}
+	info, err := s.coinResolver().ResolveReq(req)
+	if err != nil {
+		log.Printf("error resolving coins %v: %v\n", req.Coins, err)
+		return false, msg.SERVER_ERROR
+	}
+	fmt.Printf("coins: %v, min coins: %v, min age: %v\n",
+		info.Balance(1), minCoins, minAge)
+	if info.Balance(1) < minCoins {
+		return false, msg.INSUFFICIENT_COINS
+	}
+	// With no min-coins, any balance must have been held for min-coin-age
+	held := minCoins
+	if held == 0 {
+		held = 1
+	}
+	if info.Age(held) < minAge {
+		return false, msg.INSUFFICIENT_COINS
+	}
+	return true, msg.OK
+}
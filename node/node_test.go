@@ -1,11 +1,13 @@
 package node
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"testing"
 
+	"github.com/ortutay/decloud/btc"
 	"github.com/ortutay/decloud/conf"
 	"github.com/ortutay/decloud/cred"
 	"github.com/ortutay/decloud/msg"
@@ -16,26 +18,27 @@ import (
 
 var _ = fmt.Printf
 
-func newClient(btcConf *util.BitcoindConf) (*Client, error) {
+func newClient(b btc.Backend) (*Client, error) {
 	c := Client{
-		BtcConf: btcConf,
-		Cred:    cred.Cred{OcCred: *cred.NewOcCred()},
+		Btc:  b,
+		Cred: cred.Cred{OcCred: *cred.NewOcCred()},
 	}
 	return &c, nil
 }
 
-// TODO(ortutay): rm dupe code
-func printBitcoindExpected() {
-	println("Note: bitcoind daemon expected to be running")
+// Returns a wallet holding confirmed coins.
+func newTestWallet(chain *btc.FakeChain, name string) *btc.FakeWallet {
+	w := chain.NewWallet(name)
+	for i := 0; i < 2; i++ {
+		addr, _ := w.NewAddress()
+		chain.Fund(addr, util.B2S(.05))
+	}
+	chain.Mine(1)
+	return w
 }
 
 func TestBtcSignRequest(t *testing.T) {
-	printBitcoindExpected()
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf(err.Error())
-	}
-	c, err := newClient(btcConf)
+	c, err := newClient(newTestWallet(btc.NewFakeChain(), "client"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -86,7 +89,7 @@ func TestPaymentRequired(t *testing.T) {
 			conf.Policy{
 				Selector: conf.PolicySelector{},
 				Cmd:      conf.MIN_FEE,
-				Args:     []interface{}{msg.PaymentValue{1, msg.BTC}},
+				Args:     []interface{}{msg.PaymentValue{Amount: 1, Currency: msg.BTC}},
 			},
 		},
 	}
@@ -116,11 +119,8 @@ func TestPaymentRequired(t *testing.T) {
 }
 
 func TestPaymentRoundTrip(t *testing.T) {
-	printBitcoindExpected()
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf(err.Error())
-	}
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
 
 	addr := ":9443"
 	services := make(map[string]Handler)
@@ -133,12 +133,20 @@ func TestPaymentRoundTrip(t *testing.T) {
 						Method:  calc.CALCULATE_METHOD,
 					},
 					Cmd:  conf.MIN_FEE,
-					Args: []interface{}{msg.PaymentValue{2e6, msg.BTC}},
+					Args: []interface{}{msg.PaymentValue{Amount: 2e6, Currency: msg.BTC}},
 				},
 			},
 		},
 	}
-	services[payment.SERVICE_NAME] = &payment.PaymentService{BitcoindConf: btcConf}
+	serverConf := &conf.Conf{
+		Policies: []conf.Policy{
+			conf.Policy{
+				Cmd:  conf.MAX_BALANCE,
+				Args: []interface{}{&msg.PaymentValue{Amount: 1e7, Currency: msg.BTC}},
+			},
+		},
+	}
+	services[payment.SERVICE_NAME] = &payment.PaymentService{Btc: server, Conf: serverConf}
 	mux := ServiceMux{
 		Services: services,
 	}
@@ -146,6 +154,8 @@ func TestPaymentRoundTrip(t *testing.T) {
 		Cred:    &cred.Cred{},
 		Addr:    addr,
 		Handler: &mux,
+		Btc:     server,
+		Conf:    serverConf,
 	}
 	listener, err := net.Listen("tcp", s.Addr)
 	defer listener.Close()
@@ -153,7 +163,7 @@ func TestPaymentRoundTrip(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	c, err := newClient(btcConf)
+	c, err := newClient(newTestWallet(chain, "client"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -219,18 +229,112 @@ func TestPaymentRoundTrip(t *testing.T) {
 	// We got the response, now send the actual payment
 	// (normally, we would want to verify the results)
 	go s.Serve(listener)
-	txid, err := c.SendBtcPayment(pv, pa)
+	_, err = c.SendBtcPayment(pv, pa)
 	if err != nil {
 		log.Fatal(err)
 	}
-	txidReq := payment.NewBtcTxidReq(txid)
+	chain.Mine(1)
+
+	// The server finds the payment on the chain, which settles the balance
+	go s.Serve(listener)
+	resp, err = c.SignAndSend(addr, payment.NewBalanceReq())
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("txid req: %v\n", txidReq)
-	resp, err = c.SignAndSend(addr, txidReq)
 	if resp.Status != msg.OK {
 		log.Fatalf("expected status %v, got %v", msg.OK, resp.Status)
 	}
-	fmt.Printf("resp: %v\n", resp)
+	var br payment.BalanceResponse
+	err = json.Unmarshal(resp.Body, &br)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if br.Balance.Amount != 0 {
+		t.Fatalf("expected balance of 0, got %v", br.Balance)
+	}
+}
+
+func TestCoinPolicy(t *testing.T) {
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	old, _ := client.NewAddress()
+	young, _ := client.NewAddress()
+	chain.Fund(old, util.B2S(1))
+	chain.Mine(100)
+	chain.Fund(young, util.B2S(1))
+	chain.Mine(1)
+
+	policies := func(minCoins float64, minAge int) *conf.Conf {
+		return &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: calc.SERVICE_NAME},
+				Cmd:      conf.MIN_COINS,
+				Args:     []interface{}{msg.PaymentValue{Amount: util.B2S(minCoins), Currency: msg.BTC}},
+			},
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: calc.SERVICE_NAME},
+				Cmd:      conf.MIN_COIN_AGE,
+				Args:     []interface{}{minAge},
+			},
+		}}
+	}
+	tests := []struct {
+		coins    []string
+		minCoins float64
+		minAge   int
+		status   msg.OcRespStatus
+	}{
+		{[]string{}, 1, 0, msg.INSUFFICIENT_COINS},
+		{[]string{old}, 1, 0, msg.OK},
+		{[]string{old}, 1.5, 0, msg.INSUFFICIENT_COINS},
+		{[]string{old, young}, 1.5, 0, msg.OK},
+		{[]string{old, young}, 1.5, 2, msg.INSUFFICIENT_COINS},
+		{[]string{old, young}, 1, 100, msg.OK},
+		{[]string{young}, 0, 2, msg.INSUFFICIENT_COINS},
+	}
+	for _, test := range tests {
+		s := Server{Btc: chain.NewWallet("server"), Conf: policies(test.minCoins, test.minAge)}
+		req := calc.NewCalcReq([]string{"1 2 +"})
+		req.Coins = test.coins
+		_, status := s.isAllowedByCoinPolicy(req)
+		if status != test.status {
+			t.Errorf("%v: expected %v, got %v", test, test.status, status)
+		}
+	}
+}
+
+func TestKeyTypePolicy(t *testing.T) {
+	s := Server{Conf: &conf.Conf{Policies: []conf.Policy{
+		conf.Policy{
+			Selector: conf.PolicySelector{Service: calc.SERVICE_NAME},
+			Cmd:      conf.KEY_TYPES,
+			Args:     []interface{}{cred.KEY_TYPE_ED25519, cred.KEY_TYPE_SECP256K1},
+		},
+	}}}
+	ed, _ := cred.NewOcCredOfType(cred.KEY_TYPE_ED25519)
+	p256 := cred.NewOcCred()
+	delegated, _ := cred.NewDelegatedOcCred(ed, []string{"*"}, 0)
+	tests := []struct {
+		ocCred *cred.OcCred
+		status msg.OcRespStatus
+	}{
+		{ed, msg.OK},
+		{p256, msg.KEY_TYPE_DENIED},
+		{delegated, msg.OK},
+	}
+	for _, test := range tests {
+		req := calc.NewCalcReq([]string{"1 2 +"})
+		test.ocCred.SignOcReq(req)
+		_, status := s.isAllowedByKeyTypePolicy(req)
+		if status != test.status {
+			t.Errorf("%v: expected %v, got %v", test.ocCred.KeyType(), test.status, status)
+		}
+	}
+
+	// Other services take any key
+	req := msg.OcReq{Service: "store", Method: "get"}
+	p256.SignOcReq(&req)
+	if ok, _ := s.isAllowedByKeyTypePolicy(&req); !ok {
+		t.Errorf("expected store requests to be allowed")
+	}
 }
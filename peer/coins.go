@@ -0,0 +1,206 @@
+package peer
+
+// Bitcoin addresses shown as coins are bound to the first ID that shows them,
+// so one wallet's coins can't vouch for many IDs. A binding records when it
+// was made and what the address held then. It ends when the owner signs a
+// release, or once the address's balance moves, eg. because the coins were
+// sold; then the next ID to show the address takes it. Balances are only
+// known with a coin resolver set; without one, or while the balance can't be
+// resolved, bindings last until released.
+// Bindings stored before they had timestamps are plain IDs, and are read as
+// bindings of unknown balance.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/coins"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// Releases may be dated this far ahead, for clock skew
+const RELEASE_MAX_SKEW = 10 * time.Minute
+
+const UNKNOWN_BALANCE = -1
+
+var (
+	NOT_BOUND       = errors.New("coin is not bound")
+	INVALID_RELEASE = errors.New("invalid coin release")
+)
+
+type CoinBinding struct {
+	Coin    string   `json:"coin"`
+	ID      msg.OcID `json:"id"`
+	Bound   int64    `json:"bound"`   // unix time; 0 if unknown
+	Balance int64    `json:"balance"` // satoshis when bound, or UNKNOWN_BALANCE
+}
+
+var (
+	coinResolver *coins.Resolver
+	coinLock     sync.Mutex
+)
+
+// Look up balances with r, so bindings expire when they move. Nil leaves
+// bindings until they are released.
+func SetCoinResolver(r *coins.Resolver) {
+	coinLock.Lock()
+	defer coinLock.Unlock()
+	coinResolver = r
+}
+
+func peerDBPath() string {
+	return util.AppDir() + "/peer-diskv.db"
+}
+
+// coin's balance, resolved with r, or UNKNOWN_BALANCE if it can't be. Slow;
+// don't hold coinLock.
+func coinBalance(r *coins.Resolver, coin string) int64 {
+	if r == nil {
+		return UNKNOWN_BALANCE
+	}
+	info, err := r.Resolve(coin)
+	if err != nil {
+		log.Printf("couldn't resolve coin %v: %v\n", coin, err)
+		return UNKNOWN_BALANCE
+	}
+	return info.Balance(0)
+}
+
+func parseCoinBinding(coin string, v []byte) (*CoinBinding, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	if v[0] != '{' {
+		return &CoinBinding{Coin: coin, ID: msg.OcID(v), Balance: UNKNOWN_BALANCE}, nil
+	}
+	var b CoinBinding
+	err := json.Unmarshal(v, &b)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// The binding of coin, or nil if it isn't bound.
+func CoinBindingOf(coin string) (*CoinBinding, error) {
+	v, _ := util.GetOrCreateDB(peerDBPath()).Read(coin)
+	return parseCoinBinding(coin, v)
+}
+
+// Coins bound to id.
+func CoinBindingsOf(id msg.OcID) ([]*CoinBinding, error) {
+	d := util.GetOrCreateDB(peerDBPath())
+	bindings := make([]*CoinBinding, 0)
+	for _, coin := range dbKeys(d) {
+		v, _ := d.Read(coin)
+		b, err := parseCoinBinding(coin, v)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil && b.ID == id {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings, nil
+}
+
+func putCoinBinding(b *CoinBinding) error {
+	ser, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return util.GetOrCreateDB(peerDBPath()).Write(b.Coin, ser)
+}
+
+func ocIDForCoin(coin string) (*msg.OcID, error) {
+	b, err := CoinBindingOf(coin)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return &b.ID, nil
+}
+
+func setOcIDForCoin(coin string, ocID *msg.OcID) error {
+	return putCoinBinding(&CoinBinding{
+		Coin:    coin,
+		ID:      *ocID,
+		Bound:   time.Now().Unix(),
+		Balance: UNKNOWN_BALANCE,
+	})
+}
+
+// Binds coin to id, unless another ID holds it. Returns COIN_REUSE if one
+// does. The balance is only looked up for new bindings, and when another ID
+// contests one; if it can't be, the stored binding stands.
+func bindCoin(coin string, id msg.OcID) error {
+	coinLock.Lock()
+	b, err := CoinBindingOf(coin)
+	r := coinResolver
+	coinLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if b != nil && b.ID == id {
+		return nil
+	}
+	balance := coinBalance(r, coin)
+
+	coinLock.Lock()
+	defer coinLock.Unlock()
+	cur, err := CoinBindingOf(coin)
+	if err != nil {
+		return err
+	}
+	if cur != nil && cur.ID == id {
+		return nil
+	}
+	if cur != nil {
+		// A binding made while resolving is as fresh as our balance
+		if b == nil || cur.ID != b.ID || cur.Bound != b.Bound ||
+			cur.Balance == UNKNOWN_BALANCE || balance == UNKNOWN_BALANCE ||
+			balance == cur.Balance {
+			return COIN_REUSE
+		}
+		log.Printf("binding of %v to %v expired; balance moved from %v to %v\n",
+			coin, cur.ID, cur.Balance, balance)
+	}
+	return putCoinBinding(&CoinBinding{
+		Coin:    coin,
+		ID:      id,
+		Bound:   time.Now().Unix(),
+		Balance: balance,
+	})
+}
+
+// What the owner of coin signs, with cred.OcCred.Sign, to release it. at is
+// when the release was made, which must be after the binding, so an old
+// release can't undo a later one.
+func CoinReleaseMessage(coin string, id msg.OcID, at int64) []byte {
+	return []byte(fmt.Sprintf("decloud coin release|%v|%v|%v", coin, id, at))
+}
+
+// Ends coin's binding, given the owner's signature of CoinReleaseMessage. The
+// signature must be by the owner's own key, not one it delegated to.
+func ReleaseCoin(coin string, at int64, sig string) error {
+	coinLock.Lock()
+	defer coinLock.Unlock()
+	b, err := CoinBindingOf(coin)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return NOT_BOUND
+	}
+	if at < b.Bound || at > time.Now().Add(RELEASE_MAX_SKEW).Unix() ||
+		!cred.VerifyOcSig(b.ID, CoinReleaseMessage(coin, b.ID, at), sig) {
+		return INVALID_RELEASE
+	}
+	log.Printf("%v released %v\n", b.ID, coin)
+	return util.GetOrCreateDB(peerDBPath()).Erase(coin)
+}
@@ -0,0 +1,192 @@
+package peer
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// Payment addresses derived from an extended public key, at xpub/peer/invoice.
+// Each peer gets its own index, and each invoice its own address, so every
+// payment maps to exactly one peer and invoice. The server needs no private
+// keys; its wallet only watches the addresses.
+
+const NEXT_PEER_KEY = "next-peer"
+
+var (
+	xpub   *btc.ExtPubKey
+	hdLock sync.Mutex
+)
+
+// Derive payment addresses from k instead of making them with the wallet. Nil
+// goes back to wallet addresses.
+func SetExtPubKey(k *btc.ExtPubKey) {
+	hdLock.Lock()
+	defer hdLock.Unlock()
+	xpub = k
+}
+
+// Where an address was derived.
+type AddrOwner struct {
+	OcID    msg.OcID `json:"ocID"`
+	Peer    uint32   `json:"peer"`
+	Invoice uint32   `json:"invoice"`
+}
+
+type hdState struct {
+	Peer        uint32 `json:"peer"`
+	NextInvoice uint32 `json:"nextInvoice"`
+}
+
+func hdDBPath() string {
+	return util.AppDir() + "/peer-hd-diskv.db"
+}
+
+func hdOwnerDBPath() string {
+	return util.AppDir() + "/peer-hd-owners-diskv.db"
+}
+
+// The peer and invoice that addr was derived for, or nil if it wasn't.
+func OwnerOfAddr(addr string) (*AddrOwner, error) {
+	d := util.GetOrCreateDB(hdOwnerDBPath())
+	ser, _ := d.Read(addr)
+	if len(ser) == 0 {
+		return nil, nil
+	}
+	var owner AddrOwner
+	err := json.Unmarshal(ser, &owner)
+	if err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// Caller must hold hdLock.
+func (p *Peer) hdState() (*hdState, error) {
+	d := util.GetOrCreateDB(hdDBPath())
+	ser, _ := d.Read(p.ID.String())
+	if len(ser) != 0 {
+		var st hdState
+		err := json.Unmarshal(ser, &st)
+		if err != nil {
+			return nil, err
+		}
+		return &st, nil
+	}
+	next, err := nextPeerIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &hdState{Peer: next}, nil
+}
+
+// Allocates a peer index. Caller must hold hdLock.
+func nextPeerIndex() (uint32, error) {
+	d := util.GetOrCreateDB(hdDBPath())
+	next := uint32(0)
+	if nextSer, _ := d.Read(NEXT_PEER_KEY); len(nextSer) != 0 {
+		n, err := strconv.ParseUint(string(nextSer), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		next = uint32(n)
+	}
+	if next >= btc.HARDENED_INDEX {
+		panic("out of peer indexes")
+	}
+	err := d.Write(NEXT_PEER_KEY, []byte(strconv.FormatUint(uint64(next+1), 10)))
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Derives the key for st's next invoice, skipping invalid children. An
+// invalid peer key has no invoices under it, so the peer moves to a new index.
+// Caller must hold hdLock.
+func (st *hdState) nextKey() (*btc.ExtPubKey, error) {
+	for {
+		peerKey, err := xpub.Child(st.Peer)
+		if err == btc.INVALID_CHILD {
+			st.Peer, err = nextPeerIndex()
+			if err != nil {
+				return nil, err
+			}
+			st.NextInvoice = 0
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		key, err := peerKey.Child(st.NextInvoice)
+		if err == btc.INVALID_CHILD {
+			st.NextInvoice++
+			continue
+		}
+		return key, err
+	}
+}
+
+// Returns the peer's latest address while nothing has been paid to it, and
+// derives the next one after.
+func (p *Peer) hdPaymentAddr(b btc.Backend) (string, error) {
+	hdLock.Lock()
+	defer hdLock.Unlock()
+	addrs := p.PaymentAddrs()
+	if len(addrs) > 0 {
+		last := addrs[len(addrs)-1]
+		received, err := b.ListReceived(0)
+		if err != nil {
+			return "", err
+		}
+		if received[last] == 0 {
+			if owner, _ := OwnerOfAddr(last); owner != nil {
+				return last, nil
+			}
+		}
+	}
+	st, err := p.hdState()
+	if err != nil {
+		return "", err
+	}
+	key, err := st.nextKey()
+	if err != nil {
+		return "", err
+	}
+	addr := key.Address()
+	err = b.WatchAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	owner := AddrOwner{OcID: p.ID, Peer: st.Peer, Invoice: st.NextInvoice}
+	st.NextInvoice++
+
+	ownerSer, err := json.Marshal(&owner)
+	if err != nil {
+		return "", err
+	}
+	err = util.GetOrCreateDB(hdOwnerDBPath()).Write(addr, ownerSer)
+	if err != nil {
+		return "", err
+	}
+	stSer, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	err = util.GetOrCreateDB(hdDBPath()).Write(p.ID.String(), stSer)
+	if err != nil {
+		return "", err
+	}
+	addrsSer, err := json.Marshal(append(addrs, addr))
+	if err != nil {
+		return "", err
+	}
+	err = util.GetOrCreateDB(addrDBPath()).Write(p.ID.String(), addrsSer)
+	if err != nil {
+		return "", err
+	}
+	return addr, nil
+}
@@ -0,0 +1,64 @@
+package peer
+
+import (
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// Brings the peer's ledger account up to date: charges recorded since the
+// last sync, and payments with at least minConf confirmations. Each payment
+// address, and the peer's open channels, is a source of payments in the
+// ledger, so payments that vanish are taken back out.
+func (p *Peer) SyncLedger(minConf int, b btc.Backend) error {
+	received, err := b.ListReceived(minConf)
+	if err != nil {
+		return err
+	}
+	return p.syncLedger(received)
+}
+
+func (p *Peer) syncLedger(received map[string]int64) error {
+	_, err := ledger.ImportCharges()
+	if err != nil {
+		return err
+	}
+	account := ledger.PeerAccount(p.ID)
+	for _, addr := range p.PaymentAddrs() {
+		_, err := ledger.SyncSource("addr/"+addr, account, received[addr])
+		if err != nil {
+			return err
+		}
+	}
+	// Channel payments are counted on chain once the channel closes
+	inChannels, err := channel.PaidInOpenChannels(p.ID)
+	if err != nil {
+		return err
+	}
+	_, err = ledger.SyncSource("channels/"+p.ID.String(), account, inChannels)
+	return err
+}
+
+// Syncs the ledger accounts of all peers that have been given payment
+// addresses, each at the confirmations minConf gives for it.
+func SyncLedgers(minConf func(id msg.OcID) int, b btc.Backend) error {
+	received := make(map[int]map[string]int64)
+	for id := range util.GetOrCreateDB(addrDBPath()).Keys() {
+		p := Peer{ID: msg.OcID(id)}
+		n := minConf(p.ID)
+		if _, ok := received[n]; !ok {
+			r, err := b.ListReceived(n)
+			if err != nil {
+				return err
+			}
+			received[n] = r
+		}
+		err := p.syncLedger(received[n])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package peer
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+	"github.com/peterbourgon/diskv"
+)
+
+// Moves data kept under long form OcIDs to their compact form: payment
+// addresses, HD invoice state, coin owners, channels, and ledger accounts.
+// Safe to run more than once. Returns the number of IDs migrated.
+func MigrateOcIDs() (int, error) {
+	migrated := make(map[msg.OcID]bool)
+	canonical := func(id msg.OcID) (msg.OcID, bool) {
+		if !cred.IsLegacyOcID(id) {
+			return id, false
+		}
+		newID, err := cred.CanonicalOcID(id)
+		if err != nil {
+			// Not an ID we can read; leave it be
+			return id, false
+		}
+		return newID, true
+	}
+
+	// Keyed by ID
+	for _, path := range []string{addrDBPath(), hdDBPath()} {
+		d := util.GetOrCreateDB(path)
+		for _, key := range dbKeys(d) {
+			newID, ok := canonical(msg.OcID(key))
+			if !ok {
+				continue
+			}
+			ser, err := d.Read(key)
+			if err != nil {
+				return 0, err
+			}
+			if existing, _ := d.Read(newID.String()); len(existing) != 0 {
+				if path != addrDBPath() {
+					// The ID has been used in both forms; keep the newer state
+					d.Erase(key)
+					continue
+				}
+				ser, err = mergeAddrs(existing, ser)
+				if err != nil {
+					return 0, err
+				}
+			}
+			err = d.Write(newID.String(), ser)
+			if err != nil {
+				return 0, err
+			}
+			err = d.Erase(key)
+			if err != nil {
+				return 0, err
+			}
+			migrated[newID] = true
+		}
+	}
+
+	// With IDs in the values
+	d := util.GetOrCreateDB(peerDBPath())
+	for _, coin := range dbKeys(d) {
+		b, err := CoinBindingOf(coin)
+		if err != nil {
+			return 0, err
+		}
+		if b == nil {
+			continue
+		}
+		if newID, ok := canonical(b.ID); ok {
+			b.ID = newID
+			err := putCoinBinding(b)
+			if err != nil {
+				return 0, err
+			}
+			migrated[newID] = true
+		}
+	}
+	d = util.GetOrCreateDB(hdOwnerDBPath())
+	for _, addr := range dbKeys(d) {
+		owner, err := OwnerOfAddr(addr)
+		if err != nil {
+			return 0, err
+		}
+		newID, ok := canonical(owner.OcID)
+		if !ok {
+			continue
+		}
+		owner.OcID = newID
+		ser, err := json.Marshal(owner)
+		if err != nil {
+			return 0, err
+		}
+		err = d.Write(addr, ser)
+		if err != nil {
+			return 0, err
+		}
+		migrated[newID] = true
+	}
+	changed := make([]*channel.Channel, 0)
+	err := channel.ForEach(func(ch *channel.Channel) {
+		if cred.IsLegacyOcID(ch.OcID) {
+			changed = append(changed, ch)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, ch := range changed {
+		newID, ok := canonical(ch.OcID)
+		if !ok {
+			continue
+		}
+		err := ledger.RenameSource("channels/"+ch.OcID.String(), "channels/"+newID.String())
+		if err != nil {
+			return 0, err
+		}
+		ch.OcID = newID
+		err = channel.Put(ch)
+		if err != nil {
+			return 0, err
+		}
+		migrated[newID] = true
+	}
+
+	accounts, err := ledger.Accounts()
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range accounts {
+		if !strings.HasPrefix(string(a), "peer/") {
+			continue
+		}
+		newID, ok := canonical(msg.OcID(strings.TrimPrefix(string(a), "peer/")))
+		if !ok {
+			continue
+		}
+		e, err := ledger.MoveBalance(a, ledger.PeerAccount(newID))
+		if err != nil {
+			return 0, err
+		}
+		if e != nil {
+			migrated[newID] = true
+		}
+	}
+	return len(migrated), nil
+}
+
+func dbKeys(d *diskv.Diskv) []string {
+	keys := make([]string, 0)
+	for key := range d.Keys() {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func mergeAddrs(a []byte, b []byte) ([]byte, error) {
+	var addrsA, addrsB []string
+	err := json.Unmarshal(a, &addrsA)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &addrsB)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	merged := make([]string, 0)
+	for _, addr := range append(addrsA, addrsB...) {
+		if !seen[addr] {
+			seen[addr] = true
+			merged = append(merged, addr)
+		}
+	}
+	return json.Marshal(merged)
+}
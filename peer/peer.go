@@ -6,9 +6,10 @@ import (
 	"encoding/json"
 	"math/rand"
 
-	"github.com/conformal/btcjson"
-
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
 	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
 	"github.com/ortutay/decloud/rep"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/util"
@@ -27,6 +28,7 @@ const (
 	UNEXPECTED        PeerError = "unexpected"
 	INVALID_SIGNATURE PeerError = "invalid-signature"
 	COIN_REUSE        PeerError = "coin-reuse"
+	REVOKED_KEY       PeerError = "revoked-key"
 	// TODO(ortutay): think about how to structure this...
 )
 
@@ -34,8 +36,8 @@ func (pe PeerError) Error() string {
 	return string(pe)
 }
 
-func NewPeerFromReq(req *msg.OcReq, btcConf *util.BitcoindConf) (*Peer, error) {
-	ok, err := cred.VerifyOcReqSig(req, btcConf)
+func NewPeerFromReq(req *msg.OcReq) (*Peer, error) {
+	ok, err := cred.VerifyOcReqSig(req)
 	if err != nil {
 		fmt.Printf("error while verifying sig: %v\n", err)
 		return nil, UNEXPECTED
@@ -43,20 +45,25 @@ func NewPeerFromReq(req *msg.OcReq, btcConf *util.BitcoindConf) (*Peer, error) {
 	if !ok {
 		return nil, INVALID_SIGNATURE
 	}
+	// Data is kept under the compact ID, whichever form the client sent
+	req.ID, err = cred.CanonicalOcID(req.ID)
+	if err != nil {
+		return nil, INVALID_SIGNATURE
+	}
+	err = checkRotations(req)
+	if err == REVOKED_KEY {
+		return nil, REVOKED_KEY
+	} else if err != nil {
+		fmt.Printf("error while checking rotations: %v\n", err)
+		return nil, UNEXPECTED
+	}
 	coins := make([]msg.BtcAddr, 0)
 	for _, coin := range req.Coins {
-		ocID, err := ocIDForCoin(coin)
-		if err != nil {
-			fmt.Printf("error while generating ocID for coin: %v\n", err)
-			return nil, UNEXPECTED
-		}
-		fmt.Printf("got oc ID for coin: %v\n", ocID)
-		if ocID != nil && *ocID != req.ID {
+		err := bindCoin(coin, req.ID)
+		if err == COIN_REUSE {
 			return nil, COIN_REUSE
-		}
-		err = setOcIDForCoin(coin, &req.ID)
-		if err != nil {
-			fmt.Printf("error while storing ocID for coin: %v\n", err)
+		} else if err != nil {
+			fmt.Printf("error while binding coin %v: %v\n", coin, err)
 			return nil, UNEXPECTED
 		}
 		coins = append(coins, msg.BtcAddr(coin))
@@ -64,76 +71,71 @@ func NewPeerFromReq(req *msg.OcReq, btcConf *util.BitcoindConf) (*Peer, error) {
 	return &Peer{ID: req.ID, Coins: coins}, nil
 }
 
-func (p *Peer) AmountPaid(minConf int, btcConf *util.BitcoindConf) (*msg.PaymentValue, error) {
-	cmd, err := btcjson.NewListReceivedByAddressCmd("", minConf, false)
+func (p *Peer) AmountPaid(minConf int, b btc.Backend) (*msg.PaymentValue, error) {
+	received, err := b.ListReceived(minConf)
 	if err != nil {
-		return nil, fmt.Errorf("error while making cmd: %v", err.Error())
-	}
-	resp, err := util.SendBtcRpc(cmd, btcConf)
-	ser, ok := resp.Result.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("error during bitcoind JSON-RPC: %v", resp)
-	}
-	addrs := p.readPaymentAddrs()
-	addrsMap := make(map[string]bool)
-	for _, addr := range addrs {
-		addrsMap[addr] = true
+		return nil, err
 	}
+	addrs := p.PaymentAddrs()
 	amt := int64(0)
-	for _, r := range ser {
-		result := r.(map[string]interface{})
-		if addrsMap[result["address"].(string)] {
-			satoshis := util.B2S(result["amount"].(float64))
-			fmt.Printf("addr: %v -> %v\n", result["address"], satoshis)
+	for _, addr := range addrs {
+		if satoshis, ok := received[addr]; ok {
+			fmt.Printf("addr: %v -> %v\n", addr, satoshis)
 			amt += satoshis
 		}
 	}
 	fmt.Printf("my addrs: %v\n", addrs)
+	// Channel payments are counted on chain once the channel closes
+	inChannels, err := channel.PaidInOpenChannels(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	amt += inChannels
 	return &msg.PaymentValue{Amount: amt, Currency: msg.BTC}, nil
 }
 
-func (p *Peer) AmountConsumed() (*msg.PaymentValue, error) {
-	return rep.PaymentValueServedToOcID(p.ID)
-}
-
-
-func (p *Peer) Balance(minConf int, btcConf *util.BitcoindConf) (*msg.PaymentValue, error) {
-	paidPv, err := p.AmountPaid(minConf, btcConf)
+// Amount paid with at least minConf confirmations, and amount paid but not
+// yet that confirmed. Channel payments count as confirmed.
+func (p *Peer) PaidByConf(minConf int, b btc.Backend) (*msg.PaymentValue, *msg.PaymentValue, error) {
+	confirmed, err := p.AmountPaid(minConf, b)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	consumedPv, err := p.AmountConsumed()
+	all, err := p.AmountPaid(0, b)
 	if err != nil {
-		return nil, err
-	}
-	if paidPv.Currency != msg.BTC || consumedPv.Currency != msg.BTC {
-		panic("TODO: support other currencies")
+		return nil, nil, err
 	}
-	pv := msg.PaymentValue{
-		Amount: consumedPv.Amount - paidPv.Amount,
+	pending := msg.PaymentValue{
+		Amount:   all.Amount - confirmed.Amount,
 		Currency: msg.BTC,
 	}
-	return &pv, nil
+	return confirmed, &pending, nil
 }
 
-func (p *Peer) fetchNewBtcAddr(btcConf *util.BitcoindConf) (string, error) {
-	cmd, err := btcjson.NewGetNewAddressCmd("")
+func (p *Peer) AmountConsumed() (*msg.PaymentValue, error) {
+	return rep.PaymentValueServedToOcID(p.ID)
+}
+
+// What the peer owes, counting payments with at least minConf confirmations;
+// negative if the peer has credit. Read from the ledger, after syncing it.
+func (p *Peer) Balance(minConf int, b btc.Backend) (*msg.PaymentValue, error) {
+	err := p.SyncLedger(minConf, b)
 	if err != nil {
-		return "", fmt.Errorf("error while making cmd: %v", err.Error())
+		return nil, err
 	}
-	resp, err := util.SendBtcRpc(cmd, btcConf)
-	addr, ok := resp.Result.(string)
-	if !ok {
-		return "", fmt.Errorf("error during bitcoind JSON-RPC: %v", resp)
+	balance, err := ledger.Balance(ledger.PeerAccount(p.ID))
+	if err != nil {
+		return nil, err
 	}
-	return addr, nil
+	return &msg.PaymentValue{Amount: balance, Currency: msg.BTC}, nil
 }
 
 func addrDBPath() string {
 	return util.AppDir() + "/peer-addrs-diskv.db"
 }
 
-func (p *Peer) readPaymentAddrs() ([]string) {
+// Addresses given to the peer for payment, if any have been made.
+func (p *Peer) PaymentAddrs() []string {
 	d := util.GetOrCreateDB(addrDBPath())
 	fmt.Printf("p: %v\n", p)
 	addrsSer, _ := d.Read(p.ID.String())
@@ -149,7 +151,16 @@ func (p *Peer) readPaymentAddrs() ([]string) {
 	}
 }
 
-func (p *Peer) PaymentAddr(maxToMake int, btcConf *util.BitcoindConf) (string, error) {
+// An address for the peer to pay to. With an extended public key set, this is
+// the peer's current invoice address; otherwise, one of up to maxToMake
+// wallet addresses, picked at random.
+func (p *Peer) PaymentAddr(maxToMake int, b btc.Backend) (string, error) {
+	hdLock.Lock()
+	useHd := xpub != nil
+	hdLock.Unlock()
+	if useHd {
+		return p.hdPaymentAddr(b)
+	}
 	if maxToMake == -1 {
 		// TODO(ortutay): This is a parameter for testing. See if there is a better
 		// solution.
@@ -162,7 +173,7 @@ func (p *Peer) PaymentAddr(maxToMake int, btcConf *util.BitcoindConf) (string, e
 		fmt.Printf("no addrs read, making...\n")
 		var addrs []string
 		for i := 0; i < maxToMake; i++ {
-			btcAddr, err := p.fetchNewBtcAddr(btcConf)
+			btcAddr, err := b.NewAddress()
 			if err != nil {
 				log.Printf("error while generating addresses: %v\n", err)
 				return "", err
@@ -190,27 +201,3 @@ func (p *Peer) PaymentAddr(maxToMake int, btcConf *util.BitcoindConf) (string, e
 	}
 	return addrs[rand.Int()%len(addrs)], nil
 }
-
-func peerDBPath() string {
-	return util.AppDir() + "/peer-diskv.db"
-}
-
-func ocIDForCoin(coin string) (*msg.OcID, error) {
-	fmt.Printf("get oc ID for coin: %v\n", coin)
-	d := util.GetOrCreateDB(peerDBPath())
-	v, _ := d.Read(coin)
-	if v == nil || len(v) == 0 {
-		return nil, nil
-	}
-	id := msg.OcID(v)
-	return &id, nil
-}
-
-func setOcIDForCoin(coin string, ocID *msg.OcID) error {
-	fmt.Printf("set oc ID for coin %v\n", coin)
-	d := util.GetOrCreateDB(peerDBPath())
-	err := d.Write(coin, []byte(ocID.String()))
-	util.Ferr(err)
-
-	return nil
-}
@@ -5,16 +5,21 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
-	"github.com/conformal/btcjson"
-
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/coins"
 	"github.com/ortutay/decloud/cred"
 	"github.com/ortutay/decloud/msg"
-	"github.com/ortutay/decloud/services/calc"
 	"github.com/ortutay/decloud/testutil"
 	"github.com/ortutay/decloud/util"
 )
 
+// Any request will do; calc can't be used since it imports peer
+func newTestReq() *msg.OcReq {
+	return &msg.OcReq{Service: "calc", Method: "calc", Args: []string{"1 2 +"}}
+}
+
 func TestGetNotFound(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
 	v, err := ocIDForCoin("1abc")
@@ -43,30 +48,42 @@ func TestGetAndSet(t *testing.T) {
 	}
 }
 
+// Returns a server wallet, and a client wallet holding confirmed coins.
+func newTestWallets(t *testing.T) (*btc.FakeChain, *btc.FakeWallet, *btc.FakeWallet) {
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	for i := 0; i < 2; i++ {
+		addr, err := client.NewAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.Fund(addr, util.B2S(1))
+	}
+	chain.Mine(1)
+	return chain, server, client
+}
+
 func TestPeerFromReq(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
+	_, _, client := newTestWallets(t)
 	ocCred := cred.NewOcCred()
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Fatal(err)
-	}
-	// TODO(ortutay): this test is flakey, as we may not have any BTC at all
-	btcCreds, err := cred.GetBtcCredInRange(0, util.B2S(1000), btcConf)
+	btcCreds, err := cred.GetBtcCredInRange(1, util.B2S(1000), client)
 	if err != nil {
 		t.Fatal(err)
 	}
-	req := calc.NewCalcReq([]string{"1 2 +"})
+	req := newTestReq()
 	err = ocCred.SignOcReq(req)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, bc := range *btcCreds {
-		err = bc.SignOcReq(req, btcConf)
+		err = bc.SignOcReq(req, client)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
-	p, err := NewPeerFromReq(req, btcConf)
+	p, err := NewPeerFromReq(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,42 +94,41 @@ func TestPeerFromReq(t *testing.T) {
 
 func TestPeerFromReqCoinReuse(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
+	_, _, client := newTestWallets(t)
 	ocCred1 := cred.NewOcCred()
 	ocCred2 := cred.NewOcCred()
-	btcConf, err := util.LoadBitcoindConf("")
+	btcCreds, err := cred.GetBtcCredInRange(1, util.B2S(1000), client)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// TODO(ortutay): this test is flakey, as we may not have any BTC at all
-	btcCreds, err := cred.GetBtcCredInRange(0, util.B2S(1000), btcConf)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req1 := calc.NewCalcReq([]string{"1 2 +"})
+	req1 := newTestReq()
 	err = ocCred1.SignOcReq(req1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	req2 := calc.NewCalcReq([]string{"1 2 +"})
+	req2 := newTestReq()
 	err = ocCred2.SignOcReq(req2)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, bc := range *btcCreds {
-		err = bc.SignOcReq(req1, btcConf)
-		err = bc.SignOcReq(req2, btcConf)
+		err = bc.SignOcReq(req1, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bc.SignOcReq(req2, client)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
-	p1, err := NewPeerFromReq(req1, btcConf)
+	p1, err := NewPeerFromReq(req1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if p1.ID != req1.ID {
 		t.FailNow()
 	}
-	p2, err := NewPeerFromReq(req2, btcConf)
+	p2, err := NewPeerFromReq(req2)
 	if err == nil || err != COIN_REUSE {
 		t.Fatal("Expected COIN_REUSE error")
 	}
@@ -123,16 +139,13 @@ func TestPeerFromReqCoinReuse(t *testing.T) {
 
 func TestGetAddr(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf("%v", err)
-	}
+	_, server, _ := newTestWallets(t)
 	p := Peer{ID: msg.OcID("123id")}
-	addr1, err := p.PaymentAddr(1, btcConf)
+	addr1, err := p.PaymentAddr(1, server)
 	if err != nil {
 		log.Fatal(err)
 	}
-	addr2, err := p.PaymentAddr(1, btcConf)
+	addr2, err := p.PaymentAddr(1, server)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -143,52 +156,445 @@ func TestGetAddr(t *testing.T) {
 
 func TestAmountPaid(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Fatal(err)
-	}
+	chain, server, client := newTestWallets(t)
 	peer := Peer{ID: msg.OcID("123id")}
 	otherPeer := Peer{ID: msg.OcID("456otherid")}
 
-	addr, err := peer.PaymentAddr(1, btcConf)
+	addr, err := peer.PaymentAddr(1, server)
 	if err != nil {
 		t.Fatal(err)
 	}
-	otherAddr, err := otherPeer.PaymentAddr(1, btcConf)
+	otherAddr, err := otherPeer.PaymentAddr(1, server)
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Printf("addr %v other addr %v\n", addr, otherAddr)
 
-	// Send some BTC to ourselves.
+	// Pay the peer's address, and another peer's address.
 	amt := int64(1e6)
-	cmd, err := btcjson.NewSendToAddressCmd("", addr, amt)
+	_, err = client.Send(addr, amt)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	sendBtcResp, err := util.SendBtcRpc(cmd, btcConf)
-	_, ok := sendBtcResp.Result.(string)
-	if !ok {
-		log.Fatal(sendBtcResp)
+	_, err = client.Send(otherAddr, 1e6)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Send some BTC to another address.
-	cmd, err = btcjson.NewSendToAddressCmd("", otherAddr, 1e6)
+	// Verify balance
+	pv, err := peer.AmountPaid(0, server)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	sendBtcResp, err = util.SendBtcRpc(cmd, btcConf)
-	_, ok = sendBtcResp.Result.(string)
-	if !ok {
-		log.Fatal(sendBtcResp)
+	if pv.Amount != amt {
+		t.Fatalf("%v != %v", pv.Amount, amt)
 	}
 
-	// Verify balance
-	pv, err := peer.AmountPaid(0, btcConf)
+	// Unconfirmed payments don't count towards confirmed balance
+	pv, err = peer.AmountPaid(1, server)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if pv.Amount != 0 {
+		t.Fatalf("expected 0 confirmed, got %v", pv.Amount)
+	}
+	chain.Mine(1)
+	pv, err = peer.AmountPaid(1, server)
+	if err != nil {
+		t.Fatal(err)
 	}
 	if pv.Amount != amt {
-		t.Fatalf("%v != %v", paid, amt)
+		t.Fatalf("%v != %v", pv.Amount, amt)
+	}
+}
+
+func TestPaidByConf(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, server, client := newTestWallets(t)
+	peer := Peer{ID: msg.OcID("123id")}
+	addr, err := peer.PaymentAddr(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(addr, 1000)
+	chain.Mine(1)
+	client.Send(addr, 500)
+
+	confirmed, pending, err := peer.PaidByConf(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.Amount != 1000 || pending.Amount != 500 {
+		t.Fatalf("expected 1000 confirmed and 500 pending, got %v and %v",
+			confirmed.Amount, pending.Amount)
+	}
+	confirmed, pending, _ = peer.PaidByConf(0, server)
+	if confirmed.Amount != 1500 || pending.Amount != 0 {
+		t.Fatalf("expected 1500 confirmed, got %v and %v",
+			confirmed.Amount, pending.Amount)
+	}
+}
+
+func TestHdPaymentAddr(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	_, server, client := newTestWallets(t)
+	k, err := btc.NewMasterExtPubKey([]byte("test seed for hd addresses"), btc.TESTNET_XPUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetExtPubKey(k)
+	defer SetExtPubKey(nil)
+
+	alice := Peer{ID: msg.OcID("alice-id")}
+	bob := Peer{ID: msg.OcID("bob-id")}
+	a1, err := alice.PaymentAddr(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, _ := bob.PaymentAddr(1, server)
+	expected, _ := k.Derive([]uint32{0, 0})
+	if a1 != expected.Address() || a1 == b1 {
+		t.Fatalf("unexpected addresses %v %v", a1, b1)
+	}
+
+	// The address is reused until it is paid
+	if again, _ := alice.PaymentAddr(1, server); again != a1 {
+		t.Fatalf("expected %v again, got %v", a1, again)
+	}
+	client.Send(a1, 1000)
+	a2, _ := alice.PaymentAddr(1, server)
+	if a2 == a1 {
+		t.Fatalf("expected a new address after payment")
+	}
+	owner, err := OwnerOfAddr(a2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.OcID != alice.ID || owner.Peer != 0 || owner.Invoice != 1 {
+		t.Fatalf("unexpected owner: %+v", owner)
+	}
+	owner, _ = OwnerOfAddr(b1)
+	if owner.OcID != bob.ID || owner.Peer != 1 || owner.Invoice != 0 {
+		t.Fatalf("unexpected owner: %+v", owner)
+	}
+
+	// Watched addresses count toward payments, without the server's keys
+	client.Send(a2, 500)
+	pv, err := alice.AmountPaid(0, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 1500 {
+		t.Fatalf("expected 1500 paid, got %v", pv.Amount)
+	}
+}
+
+func TestMigrateOcIDs(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, server, client := newTestWallets(t)
+	ocCred := cred.NewOcCred()
+	legacy, _ := cred.LegacyOcID(ocCred.ID())
+	old := Peer{ID: legacy}
+	addr, err := old.PaymentAddr(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Send(addr, 1000)
+	chain.Mine(1)
+	balance, err := old.Balance(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setOcIDForCoin("1coin", &legacy)
+
+	n, err := MigrateOcIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 ID migrated, got %v", n)
+	}
+	p := Peer{ID: ocCred.ID()}
+	if addrs := p.PaymentAddrs(); len(addrs) != 1 || addrs[0] != addr {
+		t.Fatalf("expected %v, got %v", addr, addrs)
+	}
+	if addrs := old.PaymentAddrs(); len(addrs) != 0 {
+		t.Fatalf("expected nothing left under the long form, got %v", addrs)
+	}
+	migrated, err := p.Balance(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Amount != balance.Amount || balance.Amount != -1000 {
+		t.Fatalf("expected balance %v, got %v", balance, migrated)
+	}
+	if id, _ := ocIDForCoin("1coin"); id == nil || *id != p.ID {
+		t.Fatalf("expected coin owned by %v, got %v", p.ID, id)
+	}
+	if n, _ := MigrateOcIDs(); n != 0 {
+		t.Fatalf("expected nothing to migrate twice, got %v", n)
+	}
+
+	// Requests under the long form are seen as the compact ID
+	req := newTestReq()
+	ocCred.SignOcReq(req)
+	req.ID = legacy
+	fromReq, err := NewPeerFromReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromReq.ID != p.ID || req.ID != p.ID {
+		t.Fatalf("expected %v, got %v", p.ID, fromReq.ID)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	root := cred.NewOcCred()
+	device, err := cred.NewDelegatedOcCred(root, []string{"*"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDevice := func(o *cred.OcCred) (*Peer, error) {
+		req := newTestReq()
+		o.SignOcReq(req)
+		return NewPeerFromReq(req)
+	}
+	p, err := fromDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != root.ID() {
+		t.Fatalf("expected the device to act for %v, got %v", root.ID(), p.ID)
+	}
+
+	rotated, _ := cred.NewRotatedOcCred(root)
+	p, err = fromDevice(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != root.ID() || RotatedTo(root.ID()) != rotated.ID() {
+		t.Fatalf("expected the rotation to be recorded, got %v", p.ID)
+	}
+
+	// The old key, and keys it delegated to, are refused
+	if _, err := fromDevice(root); err != REVOKED_KEY {
+		t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+	}
+	if _, err := fromDevice(device); err != REVOKED_KEY {
+		t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+	}
+	// Once the window has passed, a second rotation of the old key loses
+	r := getRotation(root.ID())
+	r.Seen -= int64(ROTATION_WINDOW.Seconds())
+	putRotation(root.ID(), r)
+	other, _ := cred.NewRotatedOcCred(root)
+	if _, err := fromDevice(other); err != REVOKED_KEY {
+		t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+	}
+	newDevice, _ := cred.NewDelegatedOcCred(rotated, []string{"calc.*"}, 0)
+	if p, err := fromDevice(newDevice); err != nil || p.ID != root.ID() {
+		t.Fatalf("expected the new key's delegate to act for %v, got %v %v", root.ID(), p, err)
+	}
+}
+
+func TestContestedRotation(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	root := cred.NewOcCred()
+	send := func(o *cred.OcCred) error {
+		req := newTestReq()
+		o.SignOcReq(req)
+		_, err := NewPeerFromReq(req)
+		return err
+	}
+	// A thief with the old key rotates first; the owner's rotation within the
+	// window contests it, and neither new key is accepted
+	thief, _ := cred.NewRotatedOcCred(root)
+	if err := send(thief); err != nil {
+		t.Fatal(err)
+	}
+	owner, _ := cred.NewRotatedOcCred(root)
+	if err := send(owner); err != REVOKED_KEY {
+		t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+	}
+	for _, o := range []*cred.OcCred{thief, owner, root} {
+		if err := send(o); err != REVOKED_KEY {
+			t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+		}
+	}
+	// The operator settles it for the owner
+	SettleRotation(root.ID(), owner.ID())
+	if err := send(owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(thief); err != REVOKED_KEY {
+		t.Fatalf("expected %v, got %v", REVOKED_KEY, err)
+	}
+
+	// Rotations recorded before the window existed stand
+	id := owner.ID()
+	util.GetOrCreateDB(rotationDBPath()).Write(id.String(), []byte("other-id"))
+	if RotatedTo(id) != "other-id" || getRotation(id).Seen != 0 {
+		t.Fatalf("expected a standing legacy rotation, got %+v", getRotation(id))
+	}
+}
+
+// A request from ocCred showing coin, held in client's wallet.
+func newCoinReq(t *testing.T, ocCred *cred.OcCred, coin string, client *btc.FakeWallet) *msg.OcReq {
+	req := newTestReq()
+	err := ocCred.SignOcReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := cred.BtcCred{Addr: coin}
+	err = bc.SignOcReq(req, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestCoinBindingExpires(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, _, client := newTestWallets(t)
+	SetCoinResolver(&coins.Resolver{Btc: client})
+	defer SetCoinResolver(nil)
+	coin, _ := client.NewAddress()
+	chain.Fund(coin, 1000)
+	chain.Mine(1)
+	alice, bob := cred.NewOcCred(), cred.NewOcCred()
+
+	_, err := NewPeerFromReq(newCoinReq(t, alice, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := CoinBindingOf(coin)
+	if err != nil || b.ID != alice.ID() || b.Balance != 1000 || b.Bound == 0 {
+		t.Fatalf("expected a binding to %v holding 1000, got %v %v", alice.ID(), b, err)
+	}
+	_, err = NewPeerFromReq(newCoinReq(t, bob, coin, client))
+	if err != COIN_REUSE {
+		t.Fatalf("expected %v, got %v", COIN_REUSE, err)
+	}
+
+	// Once the balance moves, the coins may have changed hands
+	chain.Fund(coin, 500)
+	chain.Mine(1)
+	_, err = NewPeerFromReq(newCoinReq(t, bob, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = CoinBindingOf(coin)
+	if b.ID != bob.ID() || b.Balance != 1500 {
+		t.Fatalf("expected a binding to %v holding 1500, got %v", bob.ID(), b)
+	}
+	bindings, _ := CoinBindingsOf(bob.ID())
+	if len(bindings) != 1 || bindings[0].Coin != coin {
+		t.Fatalf("expected %v bound to %v, got %v", coin, bob.ID(), bindings)
+	}
+	if bindings, _ := CoinBindingsOf(alice.ID()); len(bindings) != 0 {
+		t.Fatalf("expected nothing bound to %v, got %v", alice.ID(), bindings)
+	}
+}
+
+// A backend whose address lookups fail.
+type unresolvable struct {
+	*btc.FakeWallet
+}
+
+func (u unresolvable) AddressUnspent(addr string) ([]btc.Unspent, error) {
+	return nil, fmt.Errorf("lookup of %v failed", addr)
+}
+
+func TestCoinBindingUnresolved(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain, _, client := newTestWallets(t)
+	SetCoinResolver(&coins.Resolver{Btc: client})
+	defer SetCoinResolver(nil)
+	coin, _ := client.NewAddress()
+	chain.Fund(coin, 1000)
+	chain.Mine(1)
+	alice, bob := cred.NewOcCred(), cred.NewOcCred()
+	_, err := NewPeerFromReq(newCoinReq(t, alice, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The balance moved, but can't be seen, so the binding stands
+	SetCoinResolver(&coins.Resolver{Btc: unresolvable{client}})
+	chain.Fund(coin, 500)
+	chain.Mine(1)
+	_, err = NewPeerFromReq(newCoinReq(t, bob, coin, client))
+	if err != COIN_REUSE {
+		t.Fatalf("expected %v, got %v", COIN_REUSE, err)
+	}
+	// The owner needs no lookup
+	_, err = NewPeerFromReq(newCoinReq(t, alice, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := CoinBindingOf(coin)
+	if b.ID != alice.ID() || b.Balance != 1000 {
+		t.Fatalf("expected the binding to %v to stand, got %v", alice.ID(), b)
+	}
+}
+
+func TestReleaseCoin(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	_, _, client := newTestWallets(t)
+	coin, _ := client.NewAddress()
+	alice, bob := cred.NewOcCred(), cred.NewOcCred()
+	_, err := NewPeerFromReq(newCoinReq(t, alice, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := CoinBindingOf(coin)
+	now := time.Now().Unix()
+
+	bobSig, _ := bob.Sign(CoinReleaseMessage(coin, alice.ID(), now))
+	staleSig, _ := alice.Sign(CoinReleaseMessage(coin, alice.ID(), b.Bound-1))
+	futureAt := time.Now().Add(time.Hour).Unix()
+	futureSig, _ := alice.Sign(CoinReleaseMessage(coin, alice.ID(), futureAt))
+	for _, test := range []struct {
+		at  int64
+		sig string
+	}{{now, bobSig}, {b.Bound - 1, staleSig}, {futureAt, futureSig}, {now + 1, staleSig}} {
+		if err := ReleaseCoin(coin, test.at, test.sig); err != INVALID_RELEASE {
+			t.Fatalf("expected %v for %v, got %v", INVALID_RELEASE, test, err)
+		}
+	}
+
+	sig, _ := alice.Sign(CoinReleaseMessage(coin, alice.ID(), now))
+	err = ReleaseCoin(coin, now, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseCoin(coin, now, sig); err != NOT_BOUND {
+		t.Fatalf("expected %v, got %v", NOT_BOUND, err)
+	}
+	_, err = NewPeerFromReq(newCoinReq(t, bob, coin, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's release doesn't carry over to Bob's binding
+	if err := ReleaseCoin(coin, now, sig); err != INVALID_RELEASE {
+		t.Fatalf("expected %v, got %v", INVALID_RELEASE, err)
+	}
+}
+
+func TestLegacyCoinBinding(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	_, _, client := newTestWallets(t)
+	coin, _ := client.NewAddress()
+	alice := cred.NewOcCred()
+	util.GetOrCreateDB(peerDBPath()).Write(coin, []byte(alice.ID()))
+	b, err := CoinBindingOf(coin)
+	if err != nil || b.ID != alice.ID() || b.Balance != UNKNOWN_BALANCE {
+		t.Fatalf("expected a binding to %v, got %v %v", alice.ID(), b, err)
+	}
+	_, err = NewPeerFromReq(newCoinReq(t, cred.NewOcCred(), coin, client))
+	if err != COIN_REUSE {
+		t.Fatalf("expected %v, got %v", COIN_REUSE, err)
 	}
 }
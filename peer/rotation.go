@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// Rotations are recorded the first time they are seen in a request, and from
+// then on the old key, and keys it delegated to, are refused. For
+// ROTATION_WINDOW after a rotation is first seen, a different rotation of the
+// same key contests it: the ID may have leaked, and either rotation could be
+// the thief's, so neither wins and the ID's keys are all refused. After the
+// window, the first rotation stands, so a leaked key can't undo a rotation
+// away from it.
+
+const ROTATION_WINDOW = 7 * 24 * time.Hour
+
+// Checks and records are done together, so two rotations can't both win
+var rotationLock sync.Mutex
+
+type rotation struct {
+	To        msg.OcID `json:"to"`
+	Seen      int64    `json:"seen"`
+	Contested bool     `json:"contested,omitempty"`
+}
+
+func rotationDBPath() string {
+	return util.AppDir() + "/peer-rotations-diskv.db"
+}
+
+// The rotation of id, or nil if none has been seen. Rotations recorded as
+// just the new key predate the window, and stand.
+func getRotation(id msg.OcID) *rotation {
+	v, _ := util.GetOrCreateDB(rotationDBPath()).Read(id.String())
+	if len(v) == 0 {
+		return nil
+	}
+	var r rotation
+	if json.Unmarshal(v, &r) != nil {
+		return &rotation{To: msg.OcID(v)}
+	}
+	return &r
+}
+
+func putRotation(id msg.OcID, r *rotation) error {
+	ser, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return util.GetOrCreateDB(rotationDBPath()).Write(id.String(), ser)
+}
+
+// The key that replaced id, if a rotation of it has been seen.
+func RotatedTo(id msg.OcID) msg.OcID {
+	if r := getRotation(id); r != nil {
+		return r.To
+	}
+	return ""
+}
+
+// Settles a contested rotation of id in favor of the key to. It stands, as
+// if seen before the window.
+func SettleRotation(id msg.OcID, to msg.OcID) error {
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	return putRotation(id, &rotation{To: to})
+}
+
+// Records the rotations in req's cert chain, and checks that none conflicts
+// with one seen before, and that the key the chain ends up at is current.
+// req's chain must already be verified.
+func checkRotations(req *msg.OcReq) error {
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	now := time.Now()
+	cur := req.ID
+	for _, r := range cred.Rotations(req) {
+		seen := getRotation(r[0])
+		switch {
+		case seen == nil:
+			err := putRotation(r[0], &rotation{To: r[1], Seen: now.Unix()})
+			if err != nil {
+				return err
+			}
+		case seen.Contested:
+			return REVOKED_KEY
+		case seen.To == r[1]:
+		case now.Sub(time.Unix(seen.Seen, 0)) < ROTATION_WINDOW:
+			seen.Contested = true
+			err := putRotation(r[0], seen)
+			if err != nil {
+				return err
+			}
+			return REVOKED_KEY
+		default:
+			return REVOKED_KEY
+		}
+		cur = r[1]
+	}
+	if RotatedTo(cur) != "" {
+		return REVOKED_KEY
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package price
+
+// Prices of BTC in other currencies, for servers that price services in USD
+// or EUR, but settle in BTC. Rates are the price of 1 BTC in whole units of
+// the currency, as decimal strings, eg. "60000.50".
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/msg"
+)
+
+type Quote struct {
+	Currency msg.Currency `json:"currency"`
+	Rate     string       `json:"rate"`
+	Time     int64        `json:"time"`
+}
+
+type Oracle interface {
+	// The current price of 1 BTC in currency
+	Quote(currency msg.Currency) (*Quote, error)
+}
+
+func parseRate(rate string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid rate %v", rate)
+	}
+	return r, nil
+}
+
+func unit(c msg.Currency) *big.Rat {
+	u := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(c.Decimals())), nil)
+	return new(big.Rat).SetInt(u)
+}
+
+func round(r *big.Rat) int64 {
+	// Half up; amounts are not negative
+	n := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	n.Add(n, r.Denom())
+	n.Quo(n, new(big.Int).Mul(r.Denom(), big.NewInt(2)))
+	return n.Int64()
+}
+
+// Converts pv to satoshis, at rate for pv's currency.
+func ToBtc(pv *msg.PaymentValue, rate string) (*msg.PaymentValue, error) {
+	if pv.Currency == msg.BTC {
+		return &msg.PaymentValue{Amount: pv.Amount, Currency: msg.BTC}, nil
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	v := new(big.Rat).SetInt64(pv.Amount)
+	v.Quo(v, unit(pv.Currency))
+	v.Quo(v, r)
+	v.Mul(v, unit(msg.BTC))
+	return &msg.PaymentValue{Amount: round(v), Currency: msg.BTC}, nil
+}
+
+// Converts satoshis to currency, at rate.
+func FromBtc(satoshis int64, currency msg.Currency, rate string) (*msg.PaymentValue, error) {
+	if currency == msg.BTC {
+		return &msg.PaymentValue{Amount: satoshis, Currency: msg.BTC}, nil
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	v := new(big.Rat).SetInt64(satoshis)
+	v.Quo(v, unit(msg.BTC))
+	v.Mul(v, r)
+	v.Mul(v, unit(currency))
+	neg := v.Sign() < 0
+	if neg {
+		v.Neg(v)
+	}
+	amount := round(v)
+	if neg {
+		amount = -amount
+	}
+	return &msg.PaymentValue{Amount: amount, Currency: currency}, nil
+}
+
+// Converts pv to BTC at the oracle's current rate. Returns the quote used,
+// which is nil if pv is already in BTC.
+func Convert(o Oracle, pv *msg.PaymentValue) (*msg.PaymentValue, *Quote, error) {
+	if pv.Currency == msg.BTC {
+		return &msg.PaymentValue{Amount: pv.Amount, Currency: msg.BTC}, nil, nil
+	}
+	if o == nil {
+		return nil, nil, fmt.Errorf("no price oracle to convert %v", pv.Currency)
+	}
+	q, err := o.Quote(pv.Currency)
+	if err != nil {
+		return nil, nil, err
+	}
+	btcPv, err := ToBtc(pv, q.Rate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return btcPv, q, nil
+}
+
+// Fixed rates, by currency.
+type StaticOracle map[msg.Currency]string
+
+func (so StaticOracle) Quote(currency msg.Currency) (*Quote, error) {
+	return quoteFromTable(so, currency, time.Now().Unix())
+}
+
+// Quotes currency from rates taken at unix time t.
+func quoteFromTable(rates map[msg.Currency]string, currency msg.Currency, t int64) (*Quote, error) {
+	rate, ok := rates[currency]
+	if !ok {
+		return nil, fmt.Errorf("no rate for %v", currency)
+	}
+	_, err := parseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	return &Quote{Currency: currency, Rate: rate, Time: t}, nil
+}
+
+// Rates read from a JSON file of currency to rate, eg. {"USD": "60000"},
+// each time a quote is needed, so the file can be updated by other programs.
+type FileOracle struct {
+	Path string
+}
+
+func (fo *FileOracle) Quote(currency msg.Currency) (*Quote, error) {
+	data, err := ioutil.ReadFile(fo.Path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[msg.Currency]string
+	err = json.Unmarshal(data, &rates)
+	if err != nil {
+		return nil, fmt.Errorf("malformed rates file %v: %v", fo.Path, err)
+	}
+	return quoteFromTable(rates, currency, time.Now().Unix())
+}
+
+// Rates fetched from an HTTP server returning the same JSON as FileOracle's
+// file; typically a local service that tracks an exchange. The server should
+// say when the rates were taken, as a "time" of unix seconds in the JSON or a
+// Last-Modified header; rates older than MaxAge are refused.
+type HttpOracle struct {
+	URL       string
+	Client    *http.Client  // nil uses a client with HTTP_TIMEOUT
+	CacheTime time.Duration // how long fetched rates are reused
+	MaxAge    time.Duration
+
+	mu      sync.Mutex
+	rates   map[msg.Currency]string
+	time    int64 // when the source took the rates
+	fetched time.Time
+}
+
+const HTTP_TIMEOUT = 10 * time.Second
+const HTTP_CACHE_TIME = 30 * time.Second
+const MAX_RATE_AGE = 10 * time.Minute
+
+func NewHttpOracle(url string) *HttpOracle {
+	return &HttpOracle{
+		URL:       url,
+		Client:    &http.Client{Timeout: HTTP_TIMEOUT},
+		CacheTime: HTTP_CACHE_TIME,
+		MaxAge:    MAX_RATE_AGE,
+	}
+}
+
+func (ho *HttpOracle) Quote(currency msg.Currency) (*Quote, error) {
+	ho.mu.Lock()
+	defer ho.mu.Unlock()
+	if ho.rates == nil || time.Since(ho.fetched) >= ho.CacheTime {
+		err := ho.fetch()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ho.MaxAge > 0 && time.Since(time.Unix(ho.time, 0)) > ho.MaxAge {
+		return nil, fmt.Errorf("rates from %v are stale, taken at %v",
+			ho.URL, time.Unix(ho.time, 0))
+	}
+	return quoteFromTable(ho.rates, currency, ho.time)
+}
+
+// Fetches the rates and their time. Call with mu held.
+func (ho *HttpOracle) fetch() error {
+	client := ho.Client
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_TIMEOUT}
+	}
+	resp, err := client.Get(ho.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rates request to %v failed: %v", ho.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return fmt.Errorf("malformed rates from %v: %v", ho.URL, err)
+	}
+	var taken int64
+	if t, ok := fields["time"]; ok {
+		err = json.Unmarshal(t, &taken)
+		if err != nil || taken <= 0 {
+			return fmt.Errorf("malformed rates time from %v: %s", ho.URL, t)
+		}
+		delete(fields, "time")
+	} else if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		taken = lm.Unix()
+	} else {
+		return fmt.Errorf("rates from %v have no time", ho.URL)
+	}
+	rates := make(map[msg.Currency]string)
+	for c, r := range fields {
+		var rate string
+		err = json.Unmarshal(r, &rate)
+		if err != nil {
+			return fmt.Errorf("malformed rates from %v: %v", ho.URL, err)
+		}
+		rates[msg.Currency(c)] = rate
+	}
+	ho.rates = rates
+	ho.time = taken
+	ho.fetched = time.Now()
+	return nil
+}
+
+// Makes an oracle from a description: "USD=60000,EUR=55000" for static rates,
+// a URL, or a file path. Empty means no oracle.
+func NewOracle(spec string) (Oracle, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewHttpOracle(spec), nil
+	case strings.Contains(spec, "="):
+		so := make(StaticOracle)
+		for _, pair := range strings.Split(spec, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("expected currency=rate, got %v", pair)
+			}
+			_, err := parseRate(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			so[msg.Currency(strings.ToUpper(kv[0]))] = kv[1]
+		}
+		return so, nil
+	default:
+		return &FileOracle{Path: spec}, nil
+	}
+}
@@ -0,0 +1,179 @@
+package price
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ortutay/decloud/msg"
+)
+
+func TestToBtc(t *testing.T) {
+	// $6.00 at $60,000/BTC is 10000 satoshis
+	pv, err := ToBtc(&msg.PaymentValue{Amount: 600, Currency: msg.USD}, "60000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 10000 || pv.Currency != msg.BTC {
+		t.Fatalf("expected 10000 satoshis, got %v", pv)
+	}
+	// Rounds to the nearest satoshi: 1 cent at 30000.5 is 33.3327...
+	pv, _ = ToBtc(&msg.PaymentValue{Amount: 1, Currency: msg.EUR}, "30000.5")
+	if pv.Amount != 33 {
+		t.Fatalf("expected 33 satoshis, got %v", pv)
+	}
+	_, err = ToBtc(&msg.PaymentValue{Amount: 1, Currency: msg.USD}, "")
+	if err == nil {
+		t.Fatalf("expected error for missing rate")
+	}
+	_, err = ToBtc(&msg.PaymentValue{Amount: 1, Currency: msg.USD}, "-5")
+	if err == nil {
+		t.Fatalf("expected error for negative rate")
+	}
+}
+
+func TestFromBtc(t *testing.T) {
+	pv, err := FromBtc(12345678, msg.USD, "60000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0.12345678 BTC is $7407.4068
+	if pv.Amount != 740741 || pv.Currency != msg.USD {
+		t.Fatalf("expected 740741 cents, got %v", pv)
+	}
+	pv, _ = FromBtc(-12345678, msg.USD, "60000")
+	if pv.Amount != -740741 {
+		t.Fatalf("expected -740741 cents, got %v", pv)
+	}
+}
+
+func TestStaticOracle(t *testing.T) {
+	o, err := NewOracle("usd=60000,EUR=55000.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := o.Quote(msg.EUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Rate != "55000.25" || q.Currency != msg.EUR {
+		t.Fatalf("unexpected quote: %+v", q)
+	}
+	_, err = o.Quote(msg.Currency("GBP"))
+	if err == nil {
+		t.Fatalf("expected error for unknown currency")
+	}
+	_, err = NewOracle("USD=abc")
+	if err == nil {
+		t.Fatalf("expected error for invalid rate")
+	}
+}
+
+func TestFileOracle(t *testing.T) {
+	f, err := ioutil.TempFile("", "rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"USD": "60000"}`)
+	f.Close()
+	o, _ := NewOracle(f.Name())
+	pv, q, err := Convert(o, &msg.PaymentValue{Amount: 600, Currency: msg.USD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 10000 || q.Rate != "60000" {
+		t.Fatalf("unexpected conversion: %v at %+v", pv, q)
+	}
+	// Updates to the file are picked up
+	ioutil.WriteFile(f.Name(), []byte(`{"USD": "30000"}`), 0600)
+	pv, _, _ = Convert(o, &msg.PaymentValue{Amount: 600, Currency: msg.USD})
+	if pv.Amount != 20000 {
+		t.Fatalf("expected 20000 satoshis, got %v", pv)
+	}
+}
+
+func TestHttpOracle(t *testing.T) {
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		fmt.Fprintf(w, `{"USD": "60000", "EUR": "50000", "time": %d}`, time.Now().Unix()-60)
+	}))
+	defer ts.Close()
+	o, _ := NewOracle(ts.URL)
+	q, err := o.Quote(msg.EUR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Rate != "50000" || q.Time > time.Now().Unix()-60 {
+		t.Fatalf("unexpected quote: %+v", q)
+	}
+	// Cached
+	o.Quote(msg.USD)
+	if fetches != 1 {
+		t.Fatalf("expected 1 fetch, got %v", fetches)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	o, _ = NewOracle(down.URL)
+	_, err = o.Quote(msg.USD)
+	if err == nil {
+		t.Fatalf("expected error from failing server")
+	}
+}
+
+func TestHttpOracleTime(t *testing.T) {
+	modified := time.Now().Add(-time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stale":
+			fmt.Fprintf(w, `{"USD": "60000", "time": %d}`, time.Now().Unix()-3600)
+		case "/modified":
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			fmt.Fprint(w, `{"USD": "60000"}`)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprintf(w, `{"USD": "60000", "time": %d}`, time.Now().Unix())
+		default:
+			fmt.Fprint(w, `{"USD": "60000"}`)
+		}
+	}))
+	defer ts.Close()
+	_, err := NewHttpOracle(ts.URL + "/stale").Quote(msg.USD)
+	if err == nil {
+		t.Fatalf("expected error for stale rates")
+	}
+	_, err = NewHttpOracle(ts.URL + "/untimed").Quote(msg.USD)
+	if err == nil {
+		t.Fatalf("expected error for rates without a time")
+	}
+	q, err := NewHttpOracle(ts.URL + "/modified").Quote(msg.USD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Time != modified.Unix() {
+		t.Fatalf("expected time %v, got %v", modified.Unix(), q.Time)
+	}
+	o := NewHttpOracle(ts.URL + "/slow")
+	o.Client.Timeout = 50 * time.Millisecond
+	_, err = o.Quote(msg.USD)
+	if err == nil {
+		t.Fatalf("expected timeout")
+	}
+}
+
+func TestConvertBtc(t *testing.T) {
+	pv, q, err := Convert(nil, &msg.PaymentValue{Amount: 5, Currency: msg.BTC})
+	if err != nil || pv.Amount != 5 || q != nil {
+		t.Fatalf("unexpected conversion: %v %v %v", pv, q, err)
+	}
+	_, _, err = Convert(nil, &msg.PaymentValue{Amount: 5, Currency: msg.USD})
+	if err == nil {
+		t.Fatalf("expected error without oracle")
+	}
+}
@@ -11,7 +11,9 @@ import (
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/ortutay/decloud/cred"
 	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/price"
 	"github.com/ortutay/decloud/util"
 )
 
@@ -29,6 +31,9 @@ const (
 	FAILURE               = "failure"
 )
 
+// Schema version from which OcIDs are in the compact form
+const OC_ID_SCHEMA_VERSION = 1
+
 type Role string
 
 func (s Role) String() string {
@@ -49,7 +54,12 @@ type Record struct {
 	Status       Status            `json:"status"`
 	PaymentType  msg.PaymentType   `json:"paymentType"`
 	PaymentValue *msg.PaymentValue `json:"paymentValue"`
+	Addr         string            `json:"addr,omitempty"` // Of the server, in client records; of the client, in refunds; of the escrow, in escrow releases
+	Rate         string            `json:"rate,omitempty"` // Price of 1 BTC in PaymentValue's currency, if not BTC
+	Txid         string            `json:"txid,omitempty"` // Of the payment, if made on chain
 	Perf         interface{}       `json:"-"` // Service specific
+
+	RowID int64 `json:"-"` // Set on records read from the db
 }
 
 type Cursor interface {
@@ -74,6 +84,14 @@ func openOrCreate() (*sql.DB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error while intializing table: %v", err.Error())
 		}
+	} else {
+		err = addColumns(db)
+		if err == nil {
+			err = migrateOcIDs(db)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while migrating table: %v", err.Error())
+		}
 	}
 	return db, nil
 }
@@ -150,13 +168,16 @@ func PaidRate(sel *Record) (float64, error) {
 
 func PaymentValueServedToOcID(id msg.OcID) (*msg.PaymentValue, error) {
 	value := int64(0)
+	var convErr error
 	reducer := func(rec *Record) {
 		if ((rec.Status == SUCCESS_UNPAID || rec.Status == SUCCESS_PAID) &&
 			rec.PaymentValue != nil){
-			if rec.PaymentValue.Currency != msg.BTC {
-				panic("TODO: support other currency types")
+			amount, err := rec.BtcAmount()
+			if err != nil {
+				convErr = err
+				return
 			}
-			value += rec.PaymentValue.Amount
+			value += amount
 		}
 	}
 	sel := Record{Role: SERVER, ID: id}
@@ -164,9 +185,94 @@ func PaymentValueServedToOcID(id msg.OcID) (*msg.PaymentValue, error) {
 	if err != nil {
 		return nil, err
 	}
+	if convErr != nil {
+		return nil, convErr
+	}
 	return &msg.PaymentValue{Amount: value, Currency: msg.BTC}, nil
 }
 
+// The record's payment value in satoshis, converted at the recorded rate.
+func (rec *Record) BtcAmount() (int64, error) {
+	if rec.PaymentValue == nil {
+		return 0, nil
+	}
+	pv, err := price.ToBtc(rec.PaymentValue, rec.Rate)
+	if err != nil {
+		return 0, fmt.Errorf("can't convert %v: %v", rec.PaymentValue, err)
+	}
+	return pv.Amount, nil
+}
+
+func SetStatus(rowID int64, status Status) error {
+	db, err := openOrCreate()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(`UPDATE rep SET status = "%s" WHERE id = %d`,
+		qesc(status.String()), rowID))
+	return err
+}
+
+// Records txid on a record without changing its status, eg. for a payout
+// that's sent but not yet accounted for.
+func SetTxid(rowID int64, txid string) error {
+	db, err := openOrCreate()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(`UPDATE rep SET paymentTxid = "%s" WHERE id = %d`,
+		qesc(txid), rowID))
+	return err
+}
+
+// Marks a record SUCCESS_PAID by txid.
+func SetPaid(rowID int64, txid string) error {
+	db, err := openOrCreate()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(`UPDATE rep SET status = "%s", paymentTxid = "%s" WHERE id = %d`,
+		qesc(SUCCESS_PAID), qesc(txid), rowID))
+	return err
+}
+
+// Sets records like sel, that are SUCCESS_PAID by a txn that has vanished from
+// the chain, to status. confs gives the confirmations of a txn, or -1 if it
+// has vanished. Returns the reversed records.
+func ReverseVanished(sel *Record, confs func(txid string) (int, error), status Status) ([]*Record, error) {
+	paid := *sel
+	paid.Status = SUCCESS_PAID
+	var withTxid []*Record
+	err := Reduce(&paid, func(rec *Record) {
+		if rec.Txid != "" {
+			withTxid = append(withTxid, rec)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	reversed := make([]*Record, 0)
+	for _, rec := range withTxid {
+		n, err := confs(rec.Txid)
+		if err != nil {
+			return reversed, err
+		}
+		if n >= 0 {
+			continue
+		}
+		err = SetStatus(rec.RowID, status)
+		if err != nil {
+			return reversed, err
+		}
+		rec.Status = status
+		reversed = append(reversed, rec)
+	}
+	return reversed, nil
+}
+
 func PrettyPrint(sel *Record) error {
 	Reduce(sel, func(r *Record) {
 		fmt.Printf("%+v\n", *r)
@@ -175,25 +281,59 @@ func PrettyPrint(sel *Record) error {
 }
 
 func Reduce(sel *Record, reduceFn func(rec *Record)) error {
+	return reduceQuery(selectLikeRecord(sel), reduceFn)
+}
+
+// Calls reduceFn on the records put after the one with rowID, in the order
+// they were put.
+func ReduceAfter(rowID int64, reduceFn func(rec *Record)) error {
+	query := selectLikeRecord(&Record{}) + fmt.Sprintf(" AND id > %d ORDER BY id", rowID)
+	return reduceQuery(query, reduceFn)
+}
+
+// Returns up to limit records like sel, oldest first, skipping the first
+// offset.
+func Select(sel *Record, offset int, limit int) ([]*Record, error) {
+	query := selectLikeRecord(sel) +
+		fmt.Sprintf(" ORDER BY timestamp, id LIMIT %d OFFSET %d", limit, offset)
+	recs := make([]*Record, 0)
+	err := reduceQuery(query, func(rec *Record) {
+		recs = append(recs, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func Count(sel *Record) (int, error) {
+	n := 0
+	err := Reduce(sel, func(rec *Record) {
+		n++
+	})
+	return n, err
+}
+
+func reduceQuery(query string, reduceFn func(rec *Record)) error {
 	db, err := openOrCreate()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	query := selectLikeRecord(sel)
 	rows, err := db.Query(query)
 	if err != nil {
 		return fmt.Errorf("error while querying %v: %v", query, err.Error())
 	}
 	for rows.Next() {
-		var role, service, method, ocID, status, pvType, pvCurr, perfHex []byte
-		var pvAmt int64
+		var role, service, method, ocID, status, pvType, pvCurr, addr, rate, txid, perfHex []byte
+		var pvAmt, rowID int64
 		var timestamp int
 		err := rows.Scan(
 			&role, &service, &method, &timestamp, &ocID, &status, &pvType, &pvAmt,
-			&pvCurr, &perfHex)
+			&pvCurr, &addr, &rate, &txid, &perfHex, &rowID)
 		var rec Record
+		rec.RowID = rowID
 
 		if len(role) != 0 {
 			rec.Role = Role(role)
@@ -221,6 +361,15 @@ func Reduce(sel *Record, reduceFn func(rec *Record)) error {
 			}
 			rec.PaymentValue = &pv
 		}
+		if len(addr) != 0 {
+			rec.Addr = string(addr)
+		}
+		if len(rate) != 0 {
+			rec.Rate = string(rate)
+		}
+		if len(txid) != 0 {
+			rec.Txid = string(txid)
+		}
 		if len(perfHex) != 0 {
 			panic("TODO: implement perf decoding")
 		}
@@ -249,12 +398,70 @@ CREATE TABLE rep (
   paymentType TEXT,
   paymentValueAmount INTEGER,
   paymentValueCurrency TEXT,
-  perf BINARY
+  perf BINARY,
+  addr TEXT,
+  rate TEXT,
+  paymentTxid TEXT
 )`
 	_, err := db.Exec(sql)
 	return err
 }
 
+// Tables made by older versions lack columns added since.
+func addColumns(db *sql.DB) error {
+	for _, col := range []string{"addr", "rate", "paymentTxid"} {
+		rows, err := db.Query("SELECT " + col + " FROM rep LIMIT 1")
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE rep ADD COLUMN " + col + " TEXT")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrites long form OcIDs to the compact form, once. The schema version
+// records that it's done.
+func migrateOcIDs(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil || version >= OC_ID_SCHEMA_VERSION {
+		return err
+	}
+	rows, err := db.Query(`SELECT DISTINCT ocID FROM rep WHERE ocID LIKE "%,%"`)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		newID, err := cred.CanonicalOcID(msg.OcID(id))
+		if err != nil {
+			log.Printf("not migrating unreadable ID %v: %v\n", id, err)
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf(`UPDATE rep SET ocID = "%s" WHERE ocID = "%s"`,
+			qesc(newID.String()), qesc(id)))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", OC_ID_SCHEMA_VERSION))
+	return err
+}
+
 func recordFromSqlRow() *Record {
 	return nil
 }
@@ -281,17 +488,17 @@ func recordToSqlInsert(rec *Record) string {
 		pvCurr = rec.PaymentValue.Currency.String()
 	}
 	return fmt.Sprintf(`
-INSERT INTO rep(role, service, method, timestamp, ocID, status, paymentType, paymentValueAmount, paymentValueCurrency, perf)
-VALUES ("%s", "%s", "%s", "%d", "%s", "%s", "%s", "%d", "%s", x'%s');`,
+INSERT INTO rep(role, service, method, timestamp, ocID, status, paymentType, paymentValueAmount, paymentValueCurrency, addr, rate, paymentTxid, perf)
+VALUES ("%s", "%s", "%s", "%d", "%s", "%s", "%s", "%d", "%s", "%s", "%s", "%s", x'%s');`,
 		qesc(rec.Role.String()), qesc(rec.Service), qesc(rec.Method),
 		rec.Timestamp, rec.ID.String(), rec.Status.String(),
-		rec.PaymentType.String(), pvAmt, pvCurr, perfHex)
+		rec.PaymentType.String(), pvAmt, pvCurr, qesc(rec.Addr), qesc(rec.Rate), qesc(rec.Txid), perfHex)
 }
 
 func selectLikeRecord(rec *Record) string {
 	var buf bytes.Buffer
 
-	buf.WriteString("SELECT role, service, method, timestamp, ocID, status, paymentType, paymentValueAmount, paymentValueCurrency, perf FROM rep WHERE 1")
+	buf.WriteString("SELECT role, service, method, timestamp, ocID, status, paymentType, paymentValueAmount, paymentValueCurrency, addr, rate, paymentTxid, perf, id FROM rep WHERE 1")
 	// buf.WriteString("SELECT status FROM rep WHERE 1")
 	if rec.Role != "" {
 		buf.WriteString(fmt.Sprintf(` AND role = "%s"`, qesc(rec.Role.String())))
@@ -315,6 +522,12 @@ func selectLikeRecord(rec *Record) string {
 		buf.WriteString(fmt.Sprintf(` AND paymentType = "%s"`,
 			rec.PaymentType.String()))
 	}
+	if rec.Txid != "" {
+		buf.WriteString(fmt.Sprintf(` AND paymentTxid = "%s"`, qesc(rec.Txid)))
+	}
+	if rec.Addr != "" {
+		buf.WriteString(fmt.Sprintf(` AND addr = "%s"`, qesc(rec.Addr)))
+	}
 	if rec.PaymentValue != nil {
 		buf.WriteString(fmt.Sprintf(` AND paymentValueAmount = %d AND paymentValueCurreny = "%s"`,
 			rec.PaymentValue.Amount, rec.PaymentValue.Currency.String()))
@@ -1,9 +1,11 @@
 package rep
 
 import (
+	"database/sql"
 	"os"
 	"testing"
 
+	"github.com/ortutay/decloud/cred"
 	"github.com/ortutay/decloud/msg"
 	"github.com/ortutay/decloud/testutil"
 )
@@ -124,3 +126,151 @@ func TestPaymentValueServedToOcID(t *testing.T) {
 		t.Fatalf("%v != %v", 3000, pv.Amount)
 	}
 }
+
+func TestSelectByAddr(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	Put(&Record{Role: CLIENT, Status: SUCCESS_UNPAID, Addr: "host-a:9443"})
+	Put(&Record{Role: CLIENT, Status: SUCCESS_UNPAID, Addr: "host-b:9443"})
+	n := 0
+	err := Reduce(&Record{Addr: "host-a:9443"}, func(rec *Record) {
+		if rec.Addr != "host-a:9443" {
+			t.Errorf("unexpected record: %+v", rec)
+		}
+		n++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 record, got %v", n)
+	}
+}
+
+func TestAddAddrColumn(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	db, err := sql.Open("sqlite3", sqliteDBPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE rep (
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  role TEXT, service TEXT, method TEXT, timestamp INTEGER, ocID TEXT,
+  status TEXT, paymentType TEXT, paymentValueAmount INTEGER,
+  paymentValueCurrency TEXT, perf BINARY)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Put(&Record{Role: CLIENT, Status: SUCCESS_PAID, Addr: "host-a:9443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := SuccessRate(&Record{Addr: "host-a:9443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 1 {
+		t.Fatalf("expected success rate 1, got %v", rate)
+	}
+}
+
+func TestMigrateOcIDs(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ocCred := cred.NewOcCred()
+	legacy, _ := cred.LegacyOcID(ocCred.ID())
+	_, err := Put(&Record{Role: SERVER, ID: legacy, Status: SUCCESS_UNPAID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = Reduce(&Record{ID: ocCred.ID()}, func(rec *Record) { count++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected the record under the compact ID, got %v", count)
+	}
+	err = Reduce(&Record{ID: legacy}, func(rec *Record) { count++ })
+	if count != 1 {
+		t.Fatalf("expected no records under the long form ID")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	id := msg.OcID("id-123")
+	for _, ts := range []int{30, 10, 20} {
+		Put(&Record{Role: SERVER, ID: id, Timestamp: ts})
+	}
+	Put(&Record{Role: SERVER, ID: "id-other", Timestamp: 5})
+	recs, err := Select(&Record{ID: id}, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Timestamp != 20 || recs[1].Timestamp != 30 {
+		t.Fatalf("unexpected records: %v", recs)
+	}
+	n, err := Count(&Record{ID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 records, got %v", n)
+	}
+}
+
+func TestPaymentValueServedInFiat(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	id := msg.OcID("id-123")
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_UNPAID,
+		PaymentValue: &msg.PaymentValue{Amount: 1000, Currency: msg.BTC}})
+	// $5.00 at $50,000/BTC is 10000 satoshis
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_UNPAID, Rate: "50000",
+		PaymentValue: &msg.PaymentValue{Amount: 500, Currency: msg.USD}})
+	pv, err := PaymentValueServedToOcID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Amount != 11000 {
+		t.Fatalf("expected 11000, got %v", pv.Amount)
+	}
+
+	// Without a rate, the value can't be known
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_UNPAID,
+		PaymentValue: &msg.PaymentValue{Amount: 500, Currency: msg.EUR}})
+	_, err = PaymentValueServedToOcID(id)
+	if err == nil {
+		t.Fatalf("expected error for record without rate")
+	}
+}
+
+func TestReverseVanished(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	id := msg.OcID("id-123")
+	pv := msg.PaymentValue{Amount: 1000, Currency: msg.BTC}
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_PAID, Txid: "t-kept", PaymentValue: &pv})
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_PAID, Txid: "t-gone", PaymentValue: &pv})
+	Put(&Record{Role: SERVER, ID: id, Status: SUCCESS_PAID, PaymentValue: &pv})
+	confs := func(txid string) (int, error) {
+		if txid == "t-gone" {
+			return -1, nil
+		}
+		return 3, nil
+	}
+	reversed, err := ReverseVanished(&Record{Role: SERVER}, confs, SUCCESS_UNPAID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reversed) != 1 || reversed[0].Txid != "t-gone" {
+		t.Fatalf("unexpected reversed records: %v", reversed)
+	}
+	n, _ := Count(&Record{Status: SUCCESS_UNPAID, Txid: "t-gone"})
+	if n != 1 {
+		t.Fatalf("expected record to be reversed")
+	}
+	// Reversed records are not reversed again
+	reversed, _ = ReverseVanished(&Record{Role: SERVER}, confs, SUCCESS_UNPAID)
+	if len(reversed) != 0 {
+		t.Fatalf("unexpected reversed records: %v", reversed)
+	}
+}
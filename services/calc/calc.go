@@ -10,8 +10,11 @@ import (
 	"time"
 
 	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
 	"github.com/ortutay/decloud/conf"
 	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/price"
 	"github.com/ortutay/decloud/rep"
 )
 
@@ -115,7 +118,9 @@ func Measure(req *msg.OcReq) (*Work, error) {
 }
 
 type CalcService struct {
-	Conf *conf.Conf
+	Conf   *conf.Conf
+	Btc    btc.Backend
+	Prices price.Oracle // for fees or payments not in BTC
 }
 
 func (cs CalcService) paymentForWork(work *Work, method string) (*msg.PaymentValue, error) {
@@ -142,6 +147,41 @@ func (cs CalcService) paymentForWork(work *Work, method string) (*msg.PaymentVal
 	return &pv, nil
 }
 
+// Checks that the offered payment covers the fee, converting at current
+// prices if they are in different currencies. Attached and channel payments
+// settle in BTC, so must be offered in BTC. Returns the rate to record the fee
+// at, if it is not in BTC.
+func (cs CalcService) checkOffer(fee *msg.PaymentValue, offered *msg.PaymentValue, pt msg.PaymentType) (string, msg.OcRespStatus, error) {
+	if pt != msg.DEFER && offered.Currency != msg.BTC {
+		return "", msg.CURRENCY_UNSUPPORTED, nil
+	}
+	rate := ""
+	feeBtc := fee
+	if fee.Currency != msg.BTC {
+		var quote *price.Quote
+		var err error
+		feeBtc, quote, err = price.Convert(cs.Prices, fee)
+		if err != nil {
+			return "", "", fmt.Errorf("can't price fee of %v: %v", fee, err)
+		}
+		rate = quote.Rate
+	}
+	if offered.Currency == fee.Currency {
+		if offered.Amount < fee.Amount {
+			return "", msg.TOO_LOW, nil
+		}
+		return rate, msg.OK, nil
+	}
+	offeredBtc, _, err := price.Convert(cs.Prices, offered)
+	if err != nil {
+		return "", msg.CURRENCY_UNSUPPORTED, nil
+	}
+	if offeredBtc.Amount < feeBtc.Amount {
+		return "", msg.TOO_LOW, nil
+	}
+	return rate, msg.OK, nil
+}
+
 func (cs CalcService) Handle(req *msg.OcReq) (*msg.OcResp, error) {
 	println(fmt.Sprintf("calc got request: %v", req))
 	if req.Service != SERVICE_NAME {
@@ -199,20 +239,23 @@ func (cs CalcService) calculate(req *msg.OcReq) (*msg.OcResp, error) {
 		log.Printf("server error: %v", err.Error())
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
-	var submitTxn string
 	if pv.Amount != 0 {
 		fmt.Printf("want payment: %v, got payment: %v\n", pv, req.PaymentValue)
 		if req.PaymentType == msg.NONE || req.PaymentValue == nil {
 			return msg.NewRespError(msg.PAYMENT_REQUIRED), nil
 		}
-		if req.PaymentValue.Currency != pv.Currency {
-			return msg.NewRespError(msg.CURRENCY_UNSUPPORTED), nil
+		rate, status, err := cs.checkOffer(pv, req.PaymentValue, req.PaymentType)
+		if err != nil {
+			log.Printf("server error: %v", err.Error())
+			return msg.NewRespError(msg.SERVER_ERROR), nil
 		}
-		if req.PaymentValue.Amount < pv.Amount {
-			return msg.NewRespError(msg.TOO_LOW), nil
+		if status != msg.OK {
+			return msg.NewRespError(status), nil
 		}
 
 		var repStatus rep.Status
+		var submitErr error
+		var txid string
 		switch req.PaymentType {
 		case msg.DEFER:
 			// TODO(ortutay): check if we accept deferred payment for the request
@@ -220,11 +263,47 @@ func (cs CalcService) calculate(req *msg.OcReq) (*msg.OcResp, error) {
 			// failure case
 			repStatus = rep.SUCCESS_UNPAID
 		case msg.ATTACHED:
-			if !btc.TxnIsValid(req.PaymentTxn, req.PaymentValue) {
-				return msg.NewRespError(msg.INVALID_TXN), nil
+			if cs.Btc == nil {
+				return msg.NewRespError(msg.SERVER_ERROR), nil
+			}
+			// The txn must pay the peer's own addresses, so that it is credited
+			// against the amount recorded below
+			p := peer.Peer{ID: req.ID}
+			addrs := p.PaymentAddrs()
+			if len(addrs) == 0 {
+				// The peer has nowhere to pay yet; give it an address
+				addr, err := p.PaymentAddr(-1, cs.Btc)
+				if err != nil {
+					log.Printf("server error: %v", err.Error())
+					return msg.NewRespError(msg.SERVER_ERROR), nil
+				}
+				return msg.NewRespErrorWithBody(msg.PAYMENT_REQUIRED, []byte(addr)), nil
+			}
+			txn, err := btc.CheckTxn(req.PaymentTxn, req.PaymentValue, addrs, cs.Btc)
+			if err != nil {
+				log.Printf("attached txn from %v not accepted: %v", req.ID, err)
+				return msg.NewRespError(btc.StatusForTxnError(err)), nil
+			}
+			submitErr = btc.SubmitTxn(txn, cs.Btc)
+			if submitErr != nil {
+				repStatus = rep.FAILURE
+			} else {
+				repStatus = rep.SUCCESS_PAID
+			}
+			txid = txn.Txid
+		case msg.CHANNEL:
+			if cs.Btc == nil {
+				return msg.NewRespError(msg.SERVER_ERROR), nil
+			}
+			u, err := channel.DecodeUpdate(req.PaymentTxn)
+			if err != nil {
+				return msg.NewRespError(channel.StatusForError(err)), nil
+			}
+			_, err = channel.Accept(cs.Btc, req.ID, u, req.PaymentValue.Amount)
+			if err != nil {
+				log.Printf("channel update from %v not accepted: %v", req.ID, err)
+				return msg.NewRespError(channel.StatusForError(err)), nil
 			}
-			submitTxn = req.PaymentTxn
-			// TODO(ortutay): same note as above about pre-emptive success mark
 			repStatus = rep.SUCCESS_PAID
 		}
 		rec := rep.Record{
@@ -234,8 +313,10 @@ func (cs CalcService) calculate(req *msg.OcReq) (*msg.OcResp, error) {
 			Timestamp:    int(time.Now().Unix()),
 			ID:           req.ID,
 			Status:       repStatus,
-			PaymentType:  msg.DEFER,
+			PaymentType:  req.PaymentType,
 			PaymentValue: pv,
+			Rate:         rate,
+			Txid:         txid,
 			Perf:         nil,
 		}
 		fmt.Printf("rep rec: %v\n", rec)
@@ -244,6 +325,9 @@ func (cs CalcService) calculate(req *msg.OcReq) (*msg.OcResp, error) {
 			return nil, fmt.Errorf("local database error: %v", err)
 		}
 		fmt.Printf("stored rep rec, %v %v\n", id, err)
+		if submitErr != nil {
+			return msg.NewRespError(btc.StatusForTxnError(submitErr)), nil
+		}
 	}
 
 	var results []string
@@ -282,8 +366,5 @@ func (cs CalcService) calculate(req *msg.OcReq) (*msg.OcResp, error) {
 		results = append(results, fmt.Sprintf("%v", stack[0]))
 	}
 	resp := msg.NewRespOk([]byte(strings.Join(results, " ")))
-	if submitTxn != "" {
-		_ = btc.SubmitTxn(submitTxn)
-	}
 	return resp, nil
 }
@@ -1,9 +1,21 @@
 package calc
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
 	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/price"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/testutil"
 )
 
 var _ = fmt.Printf
@@ -62,3 +74,249 @@ func TestCalculate_InvalidExpr(t *testing.T) {
 		log.Fatal(err)
 	}
 }
+
+func TestCalculate_AttachedPayment(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	clientAddr, _ := client.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	fee := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+	cs := CalcService{
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: SERVICE_NAME},
+				Cmd:      conf.MIN_FEE,
+				Args:     []interface{}{fee},
+			},
+		}},
+		Btc: server,
+	}
+	id := msg.OcID("peer-id")
+	p := peer.Peer{ID: id}
+	peerAddr, err := p.PaymentAddr(1, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnHex, err := client.CreateTxn(peerAddr, fee.Amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawTxn, _ := hex.DecodeString(txnHex)
+
+	req := NewCalcReq([]string{"1 2 +"})
+	req.ID = id
+	req.PaymentType = msg.ATTACHED
+	req.PaymentValue = &fee
+	req.PaymentTxn = base64.StdEncoding.EncodeToString(rawTxn)
+	resp, err := cs.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK || string(resp.Body) != "3" {
+		t.Fatalf("expected OK 3, got %v %v", resp.Status, string(resp.Body))
+	}
+	received, _ := server.ListReceived(0)
+	if received[peerAddr] != fee.Amount {
+		t.Fatalf("expected txn to be broadcast, got %v received", received[peerAddr])
+	}
+	served, err := rep.PaymentValueServedToOcID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.Amount != fee.Amount {
+		t.Fatalf("expected %v recorded, got %v", fee.Amount, served.Amount)
+	}
+
+	// Inputs of the accepted txn can't be attached again
+	resp, err = cs.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.INVALID_TXN {
+		t.Fatalf("expected %v, got %v", msg.INVALID_TXN, resp.Status)
+	}
+}
+
+func TestCalculate_ChannelPayment(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	clientAddr, _ := client.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	fee := msg.PaymentValue{Amount: 1e5, Currency: msg.BTC}
+	cs := CalcService{
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: SERVICE_NAME},
+				Cmd:      conf.MIN_FEE,
+				Args:     []interface{}{fee},
+			},
+		}},
+		Btc: server,
+	}
+	id := msg.OcID("peer-id")
+	p := peer.Peer{ID: id}
+	peerAddr, _ := p.PaymentAddr(1, server)
+	clientPubKey, _ := client.NewPubKey()
+	offer, err := channel.Open(server, id, clientPubKey, peerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, refundHex, err := channel.NewClientChannel(client, offer, clientPubKey, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = channel.SignRefund(server, id, offer.ID, cc.FundingTxn, refundHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SendRawTxn(cc.FundingTxn)
+	chain.Mine(1)
+
+	u, err := cc.Pay(client, fee.Amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := NewCalcReq([]string{"1 2 +"})
+	req.ID = id
+	req.PaymentType = msg.CHANNEL
+	req.PaymentValue = &fee
+	req.PaymentTxn = u.Encode()
+	resp, err := cs.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK || string(resp.Body) != "3" {
+		t.Fatalf("expected OK 3, got %v %v", resp.Status, string(resp.Body))
+	}
+	cc.Accepted(fee.Amount)
+	balance, err := p.Balance(0, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Amount != 0 {
+		t.Fatalf("expected channel payment to cover the fee, got balance %v",
+			balance.Amount)
+	}
+
+	// The same update pays nothing more
+	resp, err = cs.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.TOO_LOW {
+		t.Fatalf("expected %v, got %v", msg.TOO_LOW, resp.Status)
+	}
+}
+
+func TestCalculate_FiatFee(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	fee := msg.PaymentValue{Amount: 100, Currency: msg.USD}
+	cs := CalcService{
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: SERVICE_NAME},
+				Cmd:      conf.MIN_FEE,
+				Args:     []interface{}{fee},
+			},
+		}},
+		Prices: price.StaticOracle{msg.USD: "50000", msg.EUR: "40000"},
+	}
+	id := msg.OcID("peer-id")
+	// $1.00 at $50,000/BTC is 2000 satoshis
+	for _, c := range []struct {
+		pv     msg.PaymentValue
+		status msg.OcRespStatus
+	}{
+		{msg.PaymentValue{Amount: 99, Currency: msg.USD}, msg.TOO_LOW},
+		{msg.PaymentValue{Amount: 100, Currency: msg.USD}, msg.OK},
+		{msg.PaymentValue{Amount: 1999, Currency: msg.BTC}, msg.TOO_LOW},
+		{msg.PaymentValue{Amount: 2000, Currency: msg.BTC}, msg.OK},
+		{msg.PaymentValue{Amount: 80, Currency: msg.EUR}, msg.OK},
+	} {
+		req := NewCalcReq([]string{"1 2 +"})
+		req.ID = id
+		req.AttachDeferredPayment(&c.pv)
+		resp, err := cs.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != c.status {
+			t.Fatalf("expected %v for %v, got %v", c.status, c.pv, resp.Status)
+		}
+	}
+	// Charges are recorded in USD, at the rate when charged
+	cs.Prices = price.StaticOracle{msg.USD: "100000"}
+	served, err := rep.PaymentValueServedToOcID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served.Amount != 3*2000 {
+		t.Fatalf("expected %v served, got %v", 3*2000, served.Amount)
+	}
+
+	cs.Prices = nil
+	req := NewCalcReq([]string{"1 2 +"})
+	req.AttachDeferredPayment(&fee)
+	resp, _ := cs.Handle(req)
+	if resp.Status != msg.SERVER_ERROR {
+		t.Fatalf("expected %v without prices, got %v", msg.SERVER_ERROR, resp.Status)
+	}
+}
+
+func TestCalculate_AttachedPaymentNoAddr(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	server := chain.NewWallet("server")
+	client := chain.NewWallet("client")
+	clientAddr, _ := client.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	fee := msg.PaymentValue{Amount: 1e6, Currency: msg.BTC}
+	cs := CalcService{
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{
+				Selector: conf.PolicySelector{Service: SERVICE_NAME},
+				Cmd:      conf.MIN_FEE,
+				Args:     []interface{}{fee},
+			},
+		}},
+		Btc: server,
+	}
+	attach := func(addr string) *msg.OcResp {
+		txnHex, err := client.CreateTxn(addr, fee.Amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawTxn, _ := hex.DecodeString(txnHex)
+		req := NewCalcReq([]string{"1 2 +"})
+		req.ID = msg.OcID("peer-id")
+		req.PaymentType = msg.ATTACHED
+		req.PaymentValue = &fee
+		req.PaymentTxn = base64.StdEncoding.EncodeToString(rawTxn)
+		resp, err := cs.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A peer that never asked for an address is given one to pay
+	serverAddr, _ := server.NewAddress()
+	resp := attach(serverAddr)
+	if resp.Status != msg.PAYMENT_REQUIRED || len(resp.Body) == 0 {
+		t.Fatalf("expected %v with an address, got %v", msg.PAYMENT_REQUIRED, resp.Status)
+	}
+	resp = attach(string(resp.Body))
+	if resp.Status != msg.OK || string(resp.Body) != "3" {
+		t.Fatalf("expected OK 3, got %v %v", resp.Status, string(resp.Body))
+	}
+}
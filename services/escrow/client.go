@@ -0,0 +1,122 @@
+package escrow
+
+import (
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/rep"
+)
+
+// Client side state of an escrow.
+type ClientEscrow struct {
+	Offer         Offer        `json:"offer"`
+	PubKey        string       `json:"pubKey"`
+	ArbiterPubKey string       `json:"arbiterPubKey"`
+	Funding       btc.OutPoint `json:"funding"`
+	FundingTxn    string       `json:"fundingTxn"`
+	Capacity      int64        `json:"capacity"`
+}
+
+// A new key for arbitrating escrows, and its signature by the arbiter's ID,
+// for clients to send when opening an escrow.
+func NewArbiterKey(b btc.Backend, ocCred *cred.OcCred) (string, string, error) {
+	pubKey, err := b.NewPubKey()
+	if err != nil {
+		return "", "", err
+	}
+	sig, err := ocCred.Sign([]byte(ArbiterKeyMessage(pubKey)))
+	if err != nil {
+		return "", "", err
+	}
+	return pubKey, sig, nil
+}
+
+// Makes the funding txn for an escrow offered by a server, paying amount into
+// it. The funding txn should be sent to the server to broadcast.
+func NewClientEscrow(b btc.Backend, offer *Offer, pubKey string, arbiterPubKey string, amount int64) (*ClientEscrow, error) {
+	addr, err := b.AddMultisigAddr(2, []string{pubKey, offer.ServerPubKey, arbiterPubKey})
+	if err != nil {
+		return nil, err
+	}
+	if addr != offer.ID {
+		return nil, INVALID_FUNDING
+	}
+	fundingHex, err := b.CreateTxn(addr, amount)
+	if err != nil {
+		return nil, err
+	}
+	funding, err := b.DecodeTxn(fundingHex)
+	if err != nil {
+		return nil, err
+	}
+	for i, out := range funding.Outs {
+		if out.Addr == addr {
+			return &ClientEscrow{
+				Offer:         *offer,
+				PubKey:        pubKey,
+				ArbiterPubKey: arbiterPubKey,
+				Funding:       btc.OutPoint{Txid: funding.Txid, Vout: i},
+				FundingTxn:    fundingHex,
+				Capacity:      out.Amount,
+			}, nil
+		}
+	}
+	return nil, INVALID_FUNDING
+}
+
+// The client's completion receipt: the payout releasing the funds to the
+// server, signed by the client.
+func (ce *ClientEscrow) Release(b btc.Backend) (string, error) {
+	return signPayout(b, ce.Funding, ce.Offer.ServerAddr, ce.Capacity, ce.FundingTxn)
+}
+
+// The payout for outcome, signed by the arbiter. e is from the server's
+// status method.
+func SignDecision(b btc.Backend, e *Escrow, outcome Outcome) (string, error) {
+	if e.State != FUNDED {
+		return "", WRONG_STATE
+	}
+	return signPayout(b, e.Funding, e.PayoutAddr(outcome), e.Capacity, "")
+}
+
+func signPayout(b btc.Backend, funding btc.OutPoint, addr string, capacity int64, fundingHex string) (string, error) {
+	txnHex, err := b.CreateRawTxn([]btc.OutPoint{funding},
+		[]btc.TxOut{btc.TxOut{Addr: addr, Amount: capacity - ESCROW_FEE}}, 0)
+	if err != nil {
+		return "", err
+	}
+	var prevTxns []string
+	if fundingHex != "" {
+		prevTxns = append(prevTxns, fundingHex)
+	}
+	signed, _, err := b.SignRawTxn(txnHex, prevTxns)
+	return signed, err
+}
+
+// Records the outcome of an escrow with the server at addr in rep, as the
+// server does: a payment on release, and a failure on refund.
+func RecordOutcome(addr string, ocID msg.OcID, e *Escrow) error {
+	if e.State != RELEASED && e.State != REFUNDED {
+		return WRONG_STATE
+	}
+	rec := rep.Record{
+		Role:         rep.CLIENT,
+		Service:      SERVICE_NAME,
+		Method:       RELEASE_METHOD,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           ocID,
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.TXID,
+		PaymentValue: &msg.PaymentValue{Amount: e.Amount, Currency: msg.BTC},
+		Addr:         addr,
+		Txid:         e.PayoutTxid,
+	}
+	if e.State == REFUNDED {
+		rec.Method = string(REFUND)
+		rec.Status = rep.FAILURE
+	}
+	_, err := rep.Put(&rec)
+	return err
+}
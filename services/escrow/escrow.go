@@ -0,0 +1,563 @@
+package escrow
+
+// Escrow for jobs too large to defer payment for, or to pay up front. The
+// client locks funds in a 2-of-3 multisig address with keys of the client,
+// the server, and an arbiter both trust. The server does the job, and is paid
+// when the client signs a txn releasing the funds to it: the client's
+// completion receipt. If they disagree, the arbiter decides, by signing a txn
+// that either releases the funds to the server or refunds the client. The
+// server adds its signature in either case, and broadcasts the payout.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/util"
+)
+
+const (
+	SERVICE_NAME = "escrow"
+
+	// [client-pubkey] [refund-addr] [arbiter-id] [arbiter-pubkey] [arbiter-sig] [amount]
+	// arbiter-sig is by the arbiter's ID, of ArbiterKeyMessage; amount is in
+	// satoshis. Returns the offer.
+	OPEN_METHOD = "open"
+
+	// [escrow-id] [funding-txn]
+	// the server broadcasts the funding txn
+	FUND_METHOD = "fund"
+
+	// [escrow-id] [payout-txn]
+	// payout-txn pays the server, signed by the client. Returns the txid.
+	RELEASE_METHOD = "release"
+
+	// [escrow-id] [outcome] [payout-txn]
+	// from the arbiter; payout-txn pays according to outcome, signed by the
+	// arbiter. Returns the txid.
+	DECIDE_METHOD = "decide"
+
+	// [escrow-id]
+	// for the client or arbiter; returns the escrow
+	STATUS_METHOD = "status"
+)
+
+// In satoshis; taken from the funds by the payout
+const ESCROW_FEE = 1e4
+
+// Confirmations the funding txn needs before a payout, at least; a min-conf
+// policy for the client can require more
+const MIN_FUNDING_CONF = 1
+
+type State string
+
+const (
+	OPENING  State = "opening" // waiting for funds
+	FUNDED         = "funded"
+	RELEASED       = "released" // paid to the server
+	REFUNDED       = "refunded" // paid back to the client
+)
+
+type Outcome string
+
+const (
+	RELEASE Outcome = "release"
+	REFUND  Outcome = "refund"
+)
+
+type EscrowError string
+
+const (
+	UNKNOWN_ESCROW  EscrowError = "unknown-escrow"
+	WRONG_PARTY     EscrowError = "wrong-party"
+	WRONG_STATE     EscrowError = "wrong-state"
+	INVALID_ARBITER EscrowError = "invalid-arbiter"
+	INVALID_FUNDING EscrowError = "invalid-funding"
+	INVALID_PAYOUT  EscrowError = "invalid-payout"
+	UNCONFIRMED     EscrowError = "funding-unconfirmed"
+)
+
+func (ee EscrowError) Error() string {
+	return string(ee)
+}
+
+// Server side state of an escrow.
+type Escrow struct {
+	ID            string   `json:"id"` // the multisig address
+	OcID          msg.OcID `json:"ocID"`
+	ArbiterID     msg.OcID `json:"arbiterID"`
+	ClientPubKey  string   `json:"clientPubKey"`
+	ServerPubKey  string   `json:"serverPubKey"`
+	ArbiterPubKey string   `json:"arbiterPubKey"`
+	ServerAddr    string   `json:"serverAddr"` // paid on release
+	RefundAddr    string   `json:"refundAddr"` // paid on refund
+	Amount        int64    `json:"amount"`
+	State         State    `json:"state"`
+
+	Funding  btc.OutPoint `json:"funding"`
+	Capacity int64        `json:"capacity"`
+
+	PayoutTxid string   `json:"payoutTxid,omitempty"`
+	DecidedBy  msg.OcID `json:"decidedBy,omitempty"` // the client or the arbiter
+}
+
+// What the server sends a client opening an escrow.
+type Offer struct {
+	ID           string `json:"id"`
+	ServerPubKey string `json:"serverPubKey"`
+	ServerAddr   string `json:"serverAddr"`
+}
+
+// What an arbiter signs with its ID, so that clients can't name an arbiter
+// with a key they hold themselves.
+func ArbiterKeyMessage(pubKey string) string {
+	return fmt.Sprintf("decloud escrow arbiter key %v", pubKey)
+}
+
+func NewOpenReq(clientPubKey string, refundAddr string, arbiterID msg.OcID, arbiterPubKey string, arbiterSig string, amount int64) *msg.OcReq {
+	return newReq(OPEN_METHOD, []string{clientPubKey, refundAddr,
+		arbiterID.String(), arbiterPubKey, arbiterSig,
+		strconv.FormatInt(amount, 10)})
+}
+
+func NewFundReq(id string, fundingHex string) *msg.OcReq {
+	return newReq(FUND_METHOD, []string{id, fundingHex})
+}
+
+func NewReleaseReq(id string, payoutHex string) *msg.OcReq {
+	return newReq(RELEASE_METHOD, []string{id, payoutHex})
+}
+
+func NewDecideReq(id string, outcome Outcome, payoutHex string) *msg.OcReq {
+	return newReq(DECIDE_METHOD, []string{id, string(outcome), payoutHex})
+}
+
+func NewStatusReq(id string) *msg.OcReq {
+	return newReq(STATUS_METHOD, []string{id})
+}
+
+func newReq(method string, args []string) *msg.OcReq {
+	msg := msg.OcReq{
+		ID:          "",
+		Sig:         "",
+		Coins:       []string{},
+		CoinSigs:    []string{},
+		Nonce:       "",
+		Service:     SERVICE_NAME,
+		Method:      method,
+		Args:        args,
+		PaymentType: "",
+		PaymentTxn:  "",
+		Body:        []byte(""),
+	}
+	return &msg
+}
+
+func dbPath() string {
+	return util.AppDir() + "/escrows.db"
+}
+
+func Get(id string) (*Escrow, error) {
+	d := util.GetOrCreateDB(dbPath())
+	ser, err := d.Read(id)
+	if err != nil || len(ser) == 0 {
+		return nil, UNKNOWN_ESCROW
+	}
+	var e Escrow
+	err = json.Unmarshal(ser, &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func Put(e *Escrow) error {
+	ser, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	d := util.GetOrCreateDB(dbPath())
+	return d.Write(e.ID, ser)
+}
+
+// Each escrow is locked from reading it through writing it back, so
+// concurrent requests can't both act on the same state
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*sync.Mutex)
+)
+
+// Locks the escrow id; returns the unlock function.
+func lock(id string) func() {
+	locksMu.Lock()
+	l, ok := locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		locks[id] = l
+	}
+	locksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+type EscrowService struct {
+	Btc  btc.Backend
+	Conf *conf.Conf
+}
+
+func (es *EscrowService) Handle(req *msg.OcReq) (*msg.OcResp, error) {
+	methods := make(map[string]func(*msg.OcReq) (*msg.OcResp, error))
+	methods[OPEN_METHOD] = es.open
+	methods[FUND_METHOD] = es.fund
+	methods[RELEASE_METHOD] = es.release
+	methods[DECIDE_METHOD] = es.decide
+	methods[STATUS_METHOD] = es.status
+
+	if es.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	if method, ok := methods[req.Method]; ok {
+		return method(req)
+	} else {
+		return msg.NewRespError(msg.METHOD_UNSUPPORTED), nil
+	}
+}
+
+func StatusForError(err error) msg.OcRespStatus {
+	switch err {
+	case UNKNOWN_ESCROW, WRONG_PARTY, WRONG_STATE, INVALID_ARBITER,
+		INVALID_FUNDING, INVALID_PAYOUT, UNCONFIRMED:
+		return msg.INVALID_ESCROW
+	default:
+		return msg.SERVER_ERROR
+	}
+}
+
+func errorResp(err error) *msg.OcResp {
+	status := StatusForError(err)
+	if status == msg.SERVER_ERROR {
+		log.Printf("escrow error: %v\n", err)
+		return msg.NewRespError(status)
+	}
+	return msg.NewRespErrorWithBody(status, []byte(err.Error()))
+}
+
+func (es *EscrowService) open(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 6 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	clientPubKey, refundAddr := req.Args[0], req.Args[1]
+	arbiterID, arbiterPubKey, arbiterSig := msg.OcID(req.Args[2]), req.Args[3], req.Args[4]
+	amount, err := strconv.ParseInt(req.Args[5], 10, 64)
+	if err != nil || amount <= ESCROW_FEE || refundAddr == "" {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	arbiterID, err = cred.CanonicalOcID(arbiterID)
+	if err != nil || arbiterID == p.ID ||
+		!cred.VerifyOcSig(arbiterID, []byte(ArbiterKeyMessage(arbiterPubKey)), arbiterSig) {
+		return errorResp(INVALID_ARBITER), nil
+	}
+	serverPubKey, err := es.Btc.NewPubKey()
+	if err != nil {
+		return errorResp(err), nil
+	}
+	serverAddr, err := es.Btc.NewAddress()
+	if err != nil {
+		return errorResp(err), nil
+	}
+	addr, err := es.Btc.AddMultisigAddr(2,
+		[]string{clientPubKey, serverPubKey, arbiterPubKey})
+	if err != nil {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	e := Escrow{
+		ID:            addr,
+		OcID:          p.ID,
+		ArbiterID:     arbiterID,
+		ClientPubKey:  clientPubKey,
+		ServerPubKey:  serverPubKey,
+		ArbiterPubKey: arbiterPubKey,
+		ServerAddr:    serverAddr,
+		RefundAddr:    refundAddr,
+		Amount:        amount,
+		State:         OPENING,
+	}
+	err = Put(&e)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	body, err := json.Marshal(&Offer{
+		ID:           e.ID,
+		ServerPubKey: e.ServerPubKey,
+		ServerAddr:   e.ServerAddr,
+	})
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
+// The escrow, if the request is from one of the IDs in parties.
+func getForParty(req *msg.OcReq, parties func(e *Escrow) []msg.OcID) (*Escrow, error) {
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+	e, err := Get(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range parties(e) {
+		// Escrows opened before IDs were compact have the long form
+		if id, _ = cred.CanonicalOcID(id); id == p.ID {
+			return e, nil
+		}
+	}
+	return nil, WRONG_PARTY
+}
+
+func client(e *Escrow) []msg.OcID {
+	return []msg.OcID{e.OcID}
+}
+
+func arbiter(e *Escrow) []msg.OcID {
+	return []msg.OcID{e.ArbiterID}
+}
+
+func clientOrArbiter(e *Escrow) []msg.OcID {
+	return []msg.OcID{e.OcID, e.ArbiterID}
+}
+
+func (es *EscrowService) fund(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 2 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	e, err := getForParty(req, client)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	defer lock(e.ID)()
+	e, err = Get(e.ID)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	if e.State != OPENING {
+		return errorResp(WRONG_STATE), nil
+	}
+	funding, err := es.Btc.DecodeTxn(req.Args[1])
+	if err != nil {
+		return errorResp(INVALID_FUNDING), nil
+	}
+	vout := -1
+	for i, out := range funding.Outs {
+		if out.Addr == e.ID && out.Amount >= e.Amount {
+			vout = i
+			break
+		}
+	}
+	if vout == -1 {
+		return errorResp(INVALID_FUNDING), nil
+	}
+	err = es.Btc.SendRawTxn(req.Args[1])
+	if err != nil {
+		log.Printf("broadcast of escrow %v funding failed: %v\n", e.ID, err)
+		return errorResp(INVALID_FUNDING), nil
+	}
+	e.Funding = btc.OutPoint{Txid: funding.Txid, Vout: vout}
+	e.Capacity = funding.Outs[vout].Amount
+	e.State = FUNDED
+	err = Put(e)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	return msg.NewRespOk([]byte(funding.Txid)), nil
+}
+
+func (es *EscrowService) release(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 2 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	e, err := getForParty(req, client)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	txid, err := es.payout(e, RELEASE, req.Args[1], req.ID)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	return msg.NewRespOk([]byte(txid)), nil
+}
+
+func (es *EscrowService) decide(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 3 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	outcome := Outcome(req.Args[1])
+	if outcome != RELEASE && outcome != REFUND {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	e, err := getForParty(req, arbiter)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	txid, err := es.payout(e, outcome, req.Args[2], req.ID)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	return msg.NewRespOk([]byte(txid)), nil
+}
+
+func (es *EscrowService) status(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 1 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	e, err := getForParty(req, clientOrArbiter)
+	if err != nil {
+		return errorResp(err), nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
+// Where outcome pays the funds.
+func (e *Escrow) PayoutAddr(outcome Outcome) string {
+	if outcome == RELEASE {
+		return e.ServerAddr
+	}
+	return e.RefundAddr
+}
+
+// Checks that the payout spends the funds to the address for outcome, less
+// at most the fee, then signs and broadcasts it. Our signature completes the
+// txn only if the other party's is valid.
+func (es *EscrowService) payout(e *Escrow, outcome Outcome, payoutHex string, decidedBy msg.OcID) (string, error) {
+	defer lock(e.ID)()
+	// Read again under the lock, in case another payout just finished
+	e, err := Get(e.ID)
+	if err != nil {
+		return "", err
+	}
+	if e.State != FUNDED {
+		return "", WRONG_STATE
+	}
+	minConf := es.Conf.MinConf(e.OcID)
+	if minConf < MIN_FUNDING_CONF {
+		minConf = MIN_FUNDING_CONF
+	}
+	confs, err := es.Btc.TxnConfirmations(e.Funding.Txid)
+	if err != nil {
+		return "", err
+	}
+	if confs < minConf {
+		return "", UNCONFIRMED
+	}
+	txn, err := es.Btc.DecodeTxn(payoutHex)
+	if err != nil {
+		return "", INVALID_PAYOUT
+	}
+	if len(txn.Inputs) != 1 || txn.Inputs[0] != e.Funding || txn.LockTime != 0 ||
+		len(txn.Outs) != 1 || txn.Outs[0].Addr != e.PayoutAddr(outcome) ||
+		txn.Outs[0].Amount < e.Capacity-ESCROW_FEE {
+		return "", INVALID_PAYOUT
+	}
+	signed, complete, err := es.Btc.SignRawTxn(payoutHex, nil)
+	if err != nil {
+		return "", err
+	}
+	if !complete {
+		return "", INVALID_PAYOUT
+	}
+	err = es.Btc.SendRawTxn(signed)
+	if err != nil {
+		return "", fmt.Errorf("broadcast of escrow %v payout failed: %v", e.ID, err)
+	}
+	e.State = RELEASED
+	if outcome == REFUND {
+		e.State = REFUNDED
+	}
+	e.PayoutTxid = txn.Txid
+	e.DecidedBy = decidedBy
+	err = Put(e)
+	if err != nil {
+		return "", err
+	}
+	return txn.Txid, recordOutcome(e)
+}
+
+// Ref of the ledger payment for escrow id's release.
+func LedgerRef(id string) string {
+	return "escrow/" + id
+}
+
+// Records the outcome in rep, as a charge paid by the escrow on release, and
+// a failure on refund. Released funds are posted to the ledger as a payment
+// for the charge, so they don't count toward the client's balance. The
+// release record's Addr is the escrow's, so the payment can be reversed if
+// the payout vanishes. An arbiter's decision is also recorded under the
+// arbiter's ID, with nothing to pay.
+func recordOutcome(e *Escrow) error {
+	rec := rep.Record{
+		Role:         rep.SERVER,
+		Service:      SERVICE_NAME,
+		Method:       RELEASE_METHOD,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           e.OcID,
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.TXID,
+		PaymentValue: &msg.PaymentValue{Amount: e.Amount, Currency: msg.BTC},
+		Addr:         e.ID,
+		Txid:         e.PayoutTxid,
+	}
+	if e.State == REFUNDED {
+		rec.Method = string(REFUND)
+		rec.Status = rep.FAILURE
+	}
+	_, err := rep.Put(&rec)
+	if err != nil {
+		return err
+	}
+	if e.DecidedBy == e.ArbiterID {
+		_, err = rep.Put(&rep.Record{
+			Role:         rep.SERVER,
+			Service:      SERVICE_NAME,
+			Method:       DECIDE_METHOD,
+			Timestamp:    rec.Timestamp,
+			ID:           e.DecidedBy,
+			Status:       rep.SUCCESS_PAID,
+			PaymentType:  msg.NONE,
+			PaymentValue: &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+			Addr:         e.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if e.State == REFUNDED {
+		return nil
+	}
+	return ledger.Post(&ledger.Entry{
+		Kind:   ledger.PAYMENT,
+		Debit:  ledger.WALLET,
+		Credit: ledger.PeerAccount(e.OcID),
+		Amount: e.Amount,
+		Ref:    LedgerRef(e.ID),
+		Memo:   "escrow released in " + e.PayoutTxid,
+	})
+}
@@ -0,0 +1,224 @@
+package escrow
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/testutil"
+)
+
+type party struct {
+	t      *testing.T
+	ocCred *cred.OcCred
+	wallet *btc.FakeWallet
+	es     *EscrowService
+}
+
+func (p *party) send(req *msg.OcReq) *msg.OcResp {
+	err := p.ocCred.SignOcReq(req)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	resp, err := p.es.Handle(req)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return resp
+}
+
+func (p *party) sendOk(req *msg.OcReq) *msg.OcResp {
+	resp := p.send(req)
+	if resp.Status != msg.OK {
+		p.t.Fatalf("expected OK, got %v %s", resp.Status, resp.Body)
+	}
+	return resp
+}
+
+func expectStatus(t *testing.T, resp *msg.OcResp, status msg.OcRespStatus, body EscrowError) {
+	if resp.Status != status || string(resp.Body) != string(body) {
+		t.Fatalf("expected %v %v, got %v %s", status, body, resp.Status, resp.Body)
+	}
+}
+
+// Opens and funds an escrow of amount from client, with arbiter. The funding
+// is confirmed.
+func openEscrow(t *testing.T, chain *btc.FakeChain, client *party, arbiter *party, amount int64) (*ClientEscrow, string) {
+	arbiterPubKey, arbiterSig, err := NewArbiterKey(arbiter.wallet, arbiter.ocCred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPubKey, _ := client.wallet.NewPubKey()
+	refundAddr, _ := client.wallet.NewAddress()
+	resp := client.sendOk(NewOpenReq(clientPubKey, refundAddr, arbiter.ocCred.ID(),
+		arbiterPubKey, arbiterSig, amount))
+	var offer Offer
+	err = json.Unmarshal(resp.Body, &offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := NewClientEscrow(client.wallet, &offer, clientPubKey, arbiterPubKey, amount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.sendOk(NewFundReq(offer.ID, ce.FundingTxn))
+	chain.Mine(1)
+	return ce, refundAddr
+}
+
+func TestEscrow(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	es := EscrowService{Btc: chain.NewWallet("server")}
+	client := &party{t, cred.NewOcCred(), chain.NewWallet("client"), &es}
+	arbiter := &party{t, cred.NewOcCred(), chain.NewWallet("arbiter"), &es}
+	stranger := &party{t, cred.NewOcCred(), chain.NewWallet("stranger"), &es}
+	clientAddr, _ := client.wallet.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	// The arbiter's key must be signed by the arbiter's ID
+	pubKey, _ := client.wallet.NewPubKey()
+	arbiterPubKey, _ := client.wallet.NewPubKey()
+	sig, _ := client.ocCred.Sign([]byte(ArbiterKeyMessage(arbiterPubKey)))
+	resp := client.send(NewOpenReq(pubKey, clientAddr, arbiter.ocCred.ID(),
+		arbiterPubKey, sig, 1e6))
+	expectStatus(t, resp, msg.INVALID_ESCROW, INVALID_ARBITER)
+
+	// Released by the client's receipt
+	ce, _ := openEscrow(t, chain, client, arbiter, 1e6)
+	expectStatus(t, stranger.send(NewStatusReq(ce.Offer.ID)), msg.INVALID_ESCROW, WRONG_PARTY)
+	payout, err := ce.Release(client.wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, client.send(NewDecideReq(ce.Offer.ID, RELEASE, payout)),
+		msg.INVALID_ESCROW, WRONG_PARTY)
+	client.sendOk(NewReleaseReq(ce.Offer.ID, payout))
+	expectStatus(t, client.send(NewReleaseReq(ce.Offer.ID, payout)),
+		msg.INVALID_ESCROW, WRONG_STATE)
+	received, _ := es.Btc.ListReceived(0)
+	if received[ce.Offer.ServerAddr] != 1e6-ESCROW_FEE {
+		t.Fatalf("expected server to be paid %v, got %v",
+			1e6-ESCROW_FEE, received[ce.Offer.ServerAddr])
+	}
+	var e Escrow
+	json.Unmarshal(arbiter.sendOk(NewStatusReq(ce.Offer.ID)).Body, &e)
+	if e.State != RELEASED || e.DecidedBy != client.ocCred.ID() {
+		t.Fatalf("unexpected escrow: %+v", e)
+	}
+	err = RecordOutcome("server-addr", client.ocCred.ID(), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range []rep.Role{rep.SERVER, rep.CLIENT} {
+		n, _ := rep.Count(&rep.Record{Role: role, Service: SERVICE_NAME,
+			Status: rep.SUCCESS_PAID, Txid: e.PayoutTxid})
+		if n != 1 {
+			t.Fatalf("expected %v record of release", role)
+		}
+	}
+	// The release pays for its own charge
+	ledger.ImportCharges()
+	balance, _ := ledger.Balance(ledger.PeerAccount(client.ocCred.ID()))
+	if balance != 0 {
+		t.Fatalf("expected balance of 0, got %v", balance)
+	}
+
+	// Refunded by the arbiter; the payout must go to the client
+	ce, refundAddr := openEscrow(t, chain, client, arbiter, 2e6)
+	json.Unmarshal(arbiter.sendOk(NewStatusReq(ce.Offer.ID)).Body, &e)
+	wrong, _ := SignDecision(arbiter.wallet, &e, RELEASE)
+	expectStatus(t, arbiter.send(NewDecideReq(ce.Offer.ID, REFUND, wrong)),
+		msg.INVALID_ESCROW, INVALID_PAYOUT)
+	payout, err = SignDecision(arbiter.wallet, &e, REFUND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arbiter.sendOk(NewDecideReq(ce.Offer.ID, REFUND, payout))
+	received, _ = client.wallet.ListReceived(0)
+	if received[refundAddr] != 2e6-ESCROW_FEE {
+		t.Fatalf("expected client to be refunded %v, got %v",
+			2e6-ESCROW_FEE, received[refundAddr])
+	}
+	n, _ := rep.Count(&rep.Record{Role: rep.SERVER, Service: SERVICE_NAME,
+		Method: string(REFUND), Status: rep.FAILURE})
+	if n != 1 {
+		t.Fatalf("expected record of refund")
+	}
+	n, _ = rep.Count(&rep.Record{Role: rep.SERVER, Service: SERVICE_NAME,
+		Method: DECIDE_METHOD, ID: arbiter.ocCred.ID(), Addr: ce.Offer.ID})
+	if n != 1 {
+		t.Fatalf("expected record of the arbiter's decision")
+	}
+}
+
+func TestConcurrentPayouts(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	es := EscrowService{Btc: chain.NewWallet("server")}
+	client := &party{t, cred.NewOcCred(), chain.NewWallet("client"), &es}
+	arbiter := &party{t, cred.NewOcCred(), chain.NewWallet("arbiter"), &es}
+	clientAddr, _ := client.wallet.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	ce, _ := openEscrow(t, chain, client, arbiter, 1e6)
+	release, _ := ce.Release(client.wallet)
+	var e Escrow
+	json.Unmarshal(arbiter.sendOk(NewStatusReq(ce.Offer.ID)).Body, &e)
+	refund, _ := SignDecision(arbiter.wallet, &e, REFUND)
+	resps := make(chan *msg.OcResp)
+	go func() { resps <- client.send(NewReleaseReq(ce.Offer.ID, release)) }()
+	go func() { resps <- arbiter.send(NewDecideReq(ce.Offer.ID, REFUND, refund)) }()
+	ok := 0
+	for i := 0; i < 2; i++ {
+		if resp := <-resps; resp.Status == msg.OK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("expected one payout to succeed, got %v", ok)
+	}
+	n, _ := rep.Count(&rep.Record{Role: rep.SERVER, Service: SERVICE_NAME, ID: client.ocCred.ID()})
+	if n != 1 {
+		t.Fatalf("expected one record of the outcome, got %v", n)
+	}
+}
+
+func TestPayoutNeedsConfirmedFunding(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	es := EscrowService{
+		Btc: chain.NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.MIN_CONF, Args: []interface{}{3}},
+		}},
+	}
+	client := &party{t, cred.NewOcCred(), chain.NewWallet("client"), &es}
+	arbiter := &party{t, cred.NewOcCred(), chain.NewWallet("arbiter"), &es}
+	clientAddr, _ := client.wallet.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+
+	ce, _ := openEscrow(t, chain, client, arbiter, 1e6)
+	payout, err := ce.Release(client.wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, client.send(NewReleaseReq(ce.Offer.ID, payout)),
+		msg.INVALID_ESCROW, UNCONFIRMED)
+	var e Escrow
+	json.Unmarshal(arbiter.sendOk(NewStatusReq(ce.Offer.ID)).Body, &e)
+	decision, _ := SignDecision(arbiter.wallet, &e, REFUND)
+	expectStatus(t, arbiter.send(NewDecideReq(ce.Offer.ID, REFUND, decision)),
+		msg.INVALID_ESCROW, UNCONFIRMED)
+	chain.Mine(2)
+	client.sendOk(NewReleaseReq(ce.Offer.ID, payout))
+}
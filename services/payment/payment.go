@@ -3,10 +3,18 @@ package payment
 import (
 	"strings"
 	"encoding/json"
+	"log"
+	"time"
 
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
 	"github.com/ortutay/decloud/msg"
-	"github.com/ortutay/decloud/util"
 	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/price"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/services/escrow"
 	"github.com/ortutay/decloud/conf"
 )
 
@@ -14,8 +22,23 @@ const (
 	SERVICE_NAME        = "payment"
 	PAYMENT_ADDR_METHOD = "addr"
 	BALANCE_METHOD = "balance"
+
+	// [client-pubkey]
+	// returns the channel offer
+	CHANNEL_OPEN_METHOD = "channel-open"
+
+	// [channel-id] [funding-txn] [refund-txn]
+	// returns the refund txn, signed by the server
+	CHANNEL_REFUND_METHOD = "channel-refund"
+
+	// [channel-id]
+	// returns the txid of the closing txn, if anything was paid
+	CHANNEL_CLOSE_METHOD = "channel-close"
 )
 
+// How often to look for expiring channels
+const CHANNEL_CHECK_PERIOD = 10 * time.Minute
+
 const ADDRS_PER_ID int = 2
 
 func NewPaymentAddrReq(currency msg.Currency) *msg.OcReq {
@@ -35,15 +58,44 @@ func NewPaymentAddrReq(currency msg.Currency) *msg.OcReq {
 	return &msg
 }
 
+func NewBalanceReq() *msg.OcReq {
+	msg := msg.OcReq{
+		ID:          "",
+		Sig:         "",
+		Coins:       []string{},
+		CoinSigs:    []string{},
+		Nonce:       "",
+		Service:     SERVICE_NAME,
+		Method:      BALANCE_METHOD,
+		Args:        []string{},
+		PaymentType: "",
+		PaymentTxn:  "",
+		Body:        []byte(""),
+	}
+	return &msg
+}
+
 type PaymentService struct {
 	Conf *conf.Conf
-	BitcoindConf *util.BitcoindConf
+	Btc  btc.Backend
+	Cred *cred.OcCred // signs invoices and receipts
+	Prices price.Oracle // for balances in currencies other than BTC
+
+	lastWake int64
 }
 
 func (ps *PaymentService) Handle(req *msg.OcReq) (*msg.OcResp, error) {
 	methods := make(map[string]func(*msg.OcReq) (*msg.OcResp, error))
 	methods[PAYMENT_ADDR_METHOD] = ps.getPaymentAddr
 	methods[BALANCE_METHOD] = ps.balance
+	methods[CHANNEL_OPEN_METHOD] = ps.channelOpen
+	methods[CHANNEL_REFUND_METHOD] = ps.channelRefund
+	methods[CHANNEL_CLOSE_METHOD] = ps.channelClose
+	methods[HISTORY_METHOD] = ps.history
+	methods[INVOICE_METHOD] = ps.invoice
+	methods[RECEIPT_METHOD] = ps.receipt
+	methods[REFUND_METHOD] = ps.refund
+	methods[RELEASE_COIN_METHOD] = ps.releaseCoin
 
 	if method, ok := methods[req.Method]; ok {
 		return method(req)
@@ -56,14 +108,32 @@ type BalanceResponse struct {
 	Balance *msg.PaymentValue `json:"balance"`
 	MaxBalance *msg.PaymentValue `json:"maxBalance"`
 	Addr string `json:"addr"`
+
+	// Totals charged in each currency, and the balance in each at current
+	// rates, if the server prices in currencies other than BTC
+	Charged []*msg.PaymentValue `json:"charged,omitempty"`
+	Balances []*msg.PaymentValue `json:"balances,omitempty"`
+	Rates []*price.Quote `json:"rates,omitempty"`
+
+	// Payments counted in the balance, with enough confirmations, and those
+	// waiting for more. Pending payments still count toward the balance
+	// once confirmed, so clients should not pay them again.
+	Confirmed *msg.PaymentValue `json:"confirmed,omitempty"`
+	Pending *msg.PaymentValue `json:"pending,omitempty"`
+	MinConf int `json:"minConf"`
 }
 
 func (ps *PaymentService) balance(req *msg.OcReq) (*msg.OcResp, error) {
-	p, err := peer.NewPeerFromReq(req, ps.BitcoindConf)
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	minConf := ps.Conf.MinConf(p.ID)
+	balance, err := p.Balance(minConf, ps.Btc)
 	if err != nil {
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
-	balance, err := p.Balance(0, ps.BitcoindConf)
+	confirmed, pending, err := p.PaidByConf(minConf, ps.Btc)
 	if err != nil {
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
@@ -73,7 +143,7 @@ func (ps *PaymentService) balance(req *msg.OcReq) (*msg.OcResp, error) {
 		panic(err)
 	}
 	maxBalance := maxBalanceConf.Args[0].(*msg.PaymentValue)
-	btcAddr, err := p.PaymentAddr(ADDRS_PER_ID, ps.BitcoindConf)
+	btcAddr, err := p.PaymentAddr(ADDRS_PER_ID, ps.Btc)
 	if err != nil {
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
@@ -81,6 +151,14 @@ func (ps *PaymentService) balance(req *msg.OcReq) (*msg.OcResp, error) {
 		Balance: balance,
 		MaxBalance: maxBalance,
 		Addr: btcAddr,
+		Confirmed: confirmed,
+		Pending: pending,
+		MinConf: minConf,
+	}
+	err = ps.addCurrencyBalances(p, &resp)
+	if err != nil {
+		log.Printf("error while reading charges: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
 	body, err := json.Marshal(&resp)
 	if err != nil {
@@ -89,6 +167,46 @@ func (ps *PaymentService) balance(req *msg.OcReq) (*msg.OcResp, error) {
 	return msg.NewRespOk(body), nil
 }
 
+func (ps *PaymentService) addCurrencyBalances(p *peer.Peer, resp *BalanceResponse) error {
+	charged := make(map[msg.Currency]int64)
+	var currencies []msg.Currency
+	err := rep.Reduce(&rep.Record{Role: rep.SERVER, ID: p.ID}, func(rec *rep.Record) {
+		c := newCharge(rec)
+		if !c.IsBilled() {
+			return
+		}
+		if _, ok := charged[c.PaymentValue.Currency]; !ok {
+			currencies = append(currencies, c.PaymentValue.Currency)
+		}
+		charged[c.PaymentValue.Currency] += c.PaymentValue.Amount
+	})
+	if err != nil {
+		return err
+	}
+	if len(currencies) == 0 || (len(currencies) == 1 && currencies[0] == msg.BTC) {
+		return nil
+	}
+	for _, c := range currencies {
+		resp.Charged = append(resp.Charged,
+			&msg.PaymentValue{Amount: charged[c], Currency: c})
+		if c == msg.BTC || ps.Prices == nil {
+			continue
+		}
+		quote, err := ps.Prices.Quote(c)
+		if err != nil {
+			log.Printf("no rate for %v: %v\n", c, err)
+			continue
+		}
+		pv, err := price.FromBtc(resp.Balance.Amount, c, quote.Rate)
+		if err != nil {
+			return err
+		}
+		resp.Rates = append(resp.Rates, quote)
+		resp.Balances = append(resp.Balances, pv)
+	}
+	return nil
+}
+
 func (ps *PaymentService) getPaymentAddr(req *msg.OcReq) (*msg.OcResp, error) {
 	if len(req.Args) > 1 {
 		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
@@ -97,17 +215,17 @@ func (ps *PaymentService) getPaymentAddr(req *msg.OcReq) (*msg.OcResp, error) {
 	if len(req.Args) == 1 {
 		reqCurrency = strings.ToUpper(req.Args[0])
 	}
-	p, err := peer.NewPeerFromReq(req, ps.BitcoindConf)
+	p, err := peer.NewPeerFromReq(req)
 	if err != nil {
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
 	switch reqCurrency {
 	case string(msg.BTC):
-		if ps.BitcoindConf == nil {
+		if ps.Btc == nil {
 			return msg.NewRespError(msg.SERVER_ERROR), nil
 		}
 		// TODO(ortutay): smarter handling to map request ID to address
-		btcAddr, err := p.PaymentAddr(ADDRS_PER_ID, ps.BitcoindConf)
+		btcAddr, err := p.PaymentAddr(ADDRS_PER_ID, ps.Btc)
 		if err != nil {
 			return msg.NewRespError(msg.SERVER_ERROR), nil
 		}
@@ -117,3 +235,163 @@ func (ps *PaymentService) getPaymentAddr(req *msg.OcReq) (*msg.OcResp, error) {
 		return msg.NewRespError(msg.CURRENCY_UNSUPPORTED), nil
 	}
 }
+
+func NewChannelOpenReq(clientPubKey string) *msg.OcReq {
+	return newReq(CHANNEL_OPEN_METHOD, []string{clientPubKey})
+}
+
+func NewChannelRefundReq(id string, fundingHex string, refundHex string) *msg.OcReq {
+	return newReq(CHANNEL_REFUND_METHOD, []string{id, fundingHex, refundHex})
+}
+
+func NewChannelCloseReq(id string) *msg.OcReq {
+	return newReq(CHANNEL_CLOSE_METHOD, []string{id})
+}
+
+func newReq(method string, args []string) *msg.OcReq {
+	msg := msg.OcReq{
+		ID:          "",
+		Sig:         "",
+		Coins:       []string{},
+		CoinSigs:    []string{},
+		Nonce:       "",
+		Service:     SERVICE_NAME,
+		Method:      method,
+		Args:        args,
+		PaymentType: "",
+		PaymentTxn:  "",
+		Body:        []byte(""),
+	}
+	return &msg
+}
+
+func (ps *PaymentService) channelOpen(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 1 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	// Paying one of the peer's addresses means the close is credited to them
+	serverAddr, err := p.PaymentAddr(ADDRS_PER_ID, ps.Btc)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	offer, err := channel.Open(ps.Btc, p.ID, req.Args[0], serverAddr)
+	if err != nil {
+		log.Printf("error while opening channel: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	body, err := json.Marshal(offer)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
+func (ps *PaymentService) channelRefund(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 3 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	refundHex, err := channel.SignRefund(ps.Btc, p.ID, req.Args[0],
+		req.Args[1], req.Args[2])
+	if err != nil {
+		log.Printf("refund for channel %v not signed: %v\n", req.Args[0], err)
+		return msg.NewRespError(channel.StatusForError(err)), nil
+	}
+	return msg.NewRespOk([]byte(refundHex)), nil
+}
+
+func (ps *PaymentService) channelClose(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 1 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	ch, err := channel.Get(req.Args[0])
+	if err != nil {
+		return msg.NewRespError(channel.StatusForError(err)), nil
+	}
+	if ch.OcID != p.ID {
+		return msg.NewRespError(channel.StatusForError(channel.WRONG_OWNER)), nil
+	}
+	txid, err := channel.Close(ps.Btc, ch.ID)
+	if err != nil {
+		log.Printf("error while closing channel %v: %v\n", ch.ID, err)
+		return msg.NewRespError(channel.StatusForError(err)), nil
+	}
+	return msg.NewRespOk([]byte(txid)), nil
+}
+
+// Closes channels before their refunds unlock, reverses attached payments
+// whose txns vanished from the chain, and syncs payments into the ledger.
+func (ps *PaymentService) PeriodicWake() {
+	if ps.Btc == nil {
+		return
+	}
+	now := time.Now().Unix()
+	if now-ps.lastWake < int64(CHANNEL_CHECK_PERIOD.Seconds()) {
+		return
+	}
+	ps.lastWake = now
+	err := channel.CloseExpiring(ps.Btc)
+	if err != nil {
+		log.Printf("error while closing expiring channels: %v\n", err)
+	}
+	err = ps.reverseVanished()
+	if err != nil {
+		log.Printf("error while checking payments: %v\n", err)
+	}
+	err = peer.SyncLedgers(ps.Conf.MinConf, ps.Btc)
+	if err != nil {
+		log.Printf("error while syncing ledger: %v\n", err)
+	}
+}
+
+// The service stays owed for, so the records become unpaid; the payments
+// themselves no longer count, as they are read from the chain. Refunds that
+// vanished fail, which gives the credit back.
+func (ps *PaymentService) reverseVanished() error {
+	refunds, err := rep.ReverseVanished(refundSelector("", ""),
+		ps.Btc.TxnConfirmations, rep.FAILURE)
+	for _, rec := range refunds {
+		log.Printf("refund %v to %v vanished, reversed\n", rec.Txid, rec.ID)
+		_, lerr := ledger.Reverse(ledger.RepRef(rec.RowID), "refund "+rec.Txid+" vanished")
+		if lerr != nil {
+			return lerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	reversed, err := rep.ReverseVanished(&rep.Record{Role: rep.SERVER},
+		ps.Btc.TxnConfirmations, rep.SUCCESS_UNPAID)
+	for _, rec := range reversed {
+		log.Printf("payment %v from %v vanished, reversed\n", rec.Txid, rec.ID)
+		if rec.Service != escrow.SERVICE_NAME || rec.Addr == "" {
+			continue
+		}
+		// The escrow's payment for its release is in the ledger too
+		_, lerr := ledger.Reverse(escrow.LedgerRef(rec.Addr), "escrow release "+rec.Txid+" vanished")
+		if lerr != nil {
+			return lerr
+		}
+	}
+	return err
+}
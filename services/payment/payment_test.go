@@ -1,25 +1,606 @@
 package payment
 
 import (
+	"encoding/json"
 	"log"
+	"strings"
 	"testing"
 	"os"
 
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/price"
+	"github.com/ortutay/decloud/rep"
+	"github.com/ortutay/decloud/services/escrow"
 	"github.com/ortutay/decloud/msg"
-	"github.com/ortutay/decloud/util"
 	"github.com/ortutay/decloud/testutil"
 )
 
 func TestGetAddr(t *testing.T) {
 	defer os.RemoveAll(testutil.InitDir(t))
-	btcConf, err := util.LoadBitcoindConf("")
-	if err != nil {
-		t.Errorf("%v", err)
-	}
 	req := NewPaymentAddrReq(msg.BTC)
-	ps := PaymentService{BitcoindConf: btcConf}
-	_, err = ps.getPaymentAddr(req)
+	ps := PaymentService{Btc: btc.NewFakeChain().NewWallet("server")}
+	_, err := ps.getPaymentAddr(req)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+func TestChannelOpenAndClose(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	clientAddr, _ := client.NewAddress()
+	chain.Fund(clientAddr, 5e6)
+	chain.Mine(1)
+	ps := PaymentService{Btc: chain.NewWallet("server")}
+	ocCred := cred.NewOcCred()
+	signed := func(req *msg.OcReq) *msg.OcReq {
+		err := ocCred.SignOcReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	clientPubKey, _ := client.NewPubKey()
+	resp, err := ps.Handle(signed(NewChannelOpenReq(clientPubKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	var offer channel.Offer
+	err = json.Unmarshal(resp.Body, &offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, refundHex, err := channel.NewClientChannel(client, &offer, clientPubKey, 1e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = ps.Handle(signed(NewChannelRefundReq(offer.ID, cc.FundingTxn, refundHex)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	resp, err = ps.Handle(signed(NewChannelCloseReq(offer.ID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	resp, _ = ps.Handle(signed(NewChannelCloseReq(offer.ID)))
+	if resp.Status != msg.INVALID_CHANNEL {
+		t.Fatalf("expected %v, got %v", msg.INVALID_CHANNEL, resp.Status)
+	}
+}
+
+func TestHistoryInvoiceAndReceipt(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	ps := PaymentService{Btc: chain.NewWallet("server"), Cred: cred.NewOcCred()}
+	ocCred := cred.NewOcCred()
+	send := func(req *msg.OcReq) *msg.OcResp {
+		err := ocCred.SignOcReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ps.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != msg.OK {
+			t.Fatalf("expected OK, got %v", resp.Status)
+		}
+		return resp
+	}
+
+	for i, status := range []rep.Status{rep.SUCCESS_UNPAID, rep.FAILURE, rep.SUCCESS_PAID} {
+		rep.Put(&rep.Record{
+			Role:         rep.SERVER,
+			Service:      "calc",
+			Method:       "calc",
+			Timestamp:    100 * (i + 1),
+			ID:           ocCred.ID(),
+			Status:       status,
+			PaymentType:  msg.DEFER,
+			PaymentValue: &msg.PaymentValue{Amount: 1000, Currency: msg.BTC},
+		})
+	}
+	p := peer.Peer{ID: ocCred.ID()}
+	addr, _ := p.PaymentAddr(1, ps.Btc)
+	chain.Fund(addr, 2000)
+	chain.Mine(1)
+	// A refund of credit, posted as payRefund does; it isn't a charge
+	refund := rep.Record{
+		Role:         rep.SERVER,
+		Service:      SERVICE_NAME,
+		Method:       REFUND_METHOD,
+		Timestamp:    350,
+		ID:           ocCred.ID(),
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.TXID,
+		PaymentValue: &msg.PaymentValue{Amount: 500, Currency: msg.BTC},
+	}
+	refund.RowID, _ = rep.Put(&refund)
+	ledger.Post(&ledger.Entry{
+		Kind:   ledger.REFUND,
+		Debit:  ledger.PeerAccount(ocCred.ID()),
+		Credit: ledger.WALLET,
+		Amount: 500,
+		Ref:    ledger.RepRef(refund.RowID),
+	})
+
+	var history HistoryResponse
+	json.Unmarshal(send(NewHistoryReq(1, 2)).Body, &history)
+	if history.TotalCharges != 4 || len(history.Charges) != 2 ||
+		history.Charges[0].Timestamp != 300 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	if len(history.Receipts) != 1 || history.Receipts[0].Confirmed != 2000 {
+		t.Fatalf("unexpected receipts: %+v", history.Receipts)
+	}
+
+	var st Statement
+	var inv Invoice
+	json.Unmarshal(send(NewInvoiceReq(150, 400)).Body, &st)
+	err := st.Verify(&inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ServerID != ps.Cred.ID() || inv.OcID != ocCred.ID() {
+		t.Fatalf("unexpected statement: %+v", st)
+	}
+	// Only the successful charge is billed in the period, and the refund
+	// comes out of what was paid
+	if len(inv.Charges) != 1 || inv.Charges[0].Timestamp != 300 ||
+		inv.Prior.Amount != 1000 || inv.Charged.Amount != 1000 ||
+		inv.Paid.Amount != 1500 || inv.Balance.Amount != 500 {
+		t.Fatalf("unexpected invoice: %+v", inv)
+	}
+	// Charges after the period still count toward the balance due
+	json.Unmarshal(send(NewInvoiceReq(50, 150)).Body, &st)
+	st.Verify(&inv)
+	if len(inv.Charges) != 1 || inv.Charged.Amount != 1000 || inv.Later.Amount != 1000 ||
+		inv.Paid.Amount != 1500 || inv.Balance.Amount != 500 {
+		t.Fatalf("unexpected invoice: %+v", inv)
+	}
+
+	var receipt Receipt
+	json.Unmarshal(send(NewReceiptReq(addr)).Body, &st)
+	err = st.Verify(&receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Addr != addr || receipt.Confirmed.Amount != 2000 {
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	}
+	// A tampered statement doesn't verify
+	st.Body = []byte(strings.Replace(string(st.Body), "2000", "9500", -1))
+	if st.Verify(&receipt) == nil {
+		t.Fatalf("expected tampered receipt to fail")
+	}
+
+	req := NewReceiptReq("not-my-addr")
+	ocCred.SignOcReq(req)
+	resp, _ := ps.Handle(req)
+	if resp.Status != msg.INVALID_ARGUMENTS {
+		t.Fatalf("expected %v, got %v", msg.INVALID_ARGUMENTS, resp.Status)
+	}
+}
+
+func TestMultiCurrencyBalance(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	maxBalance := msg.PaymentValue{Amount: 1e8, Currency: msg.BTC}
+	ps := PaymentService{
+		Btc: btc.NewFakeChain().NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.MAX_BALANCE, Args: []interface{}{&maxBalance}},
+		}},
+		Prices: price.StaticOracle{msg.USD: "100000"},
+	}
+	ocCred := cred.NewOcCred()
+	charge := func(pv msg.PaymentValue, rate string) {
+		rep.Put(&rep.Record{
+			Role:         rep.SERVER,
+			ID:           ocCred.ID(),
+			Status:       rep.SUCCESS_UNPAID,
+			PaymentType:  msg.DEFER,
+			PaymentValue: &pv,
+			Rate:         rate,
+		})
+	}
+	// $5.00 at $50,000/BTC is 10000 satoshis
+	charge(msg.PaymentValue{Amount: 500, Currency: msg.USD}, "50000")
+	charge(msg.PaymentValue{Amount: 2000, Currency: msg.BTC}, "")
+
+	req := NewBalanceReq()
+	ocCred.SignOcReq(req)
+	resp, err := ps.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var br BalanceResponse
+	json.Unmarshal(resp.Body, &br)
+	if br.Balance.Amount != 12000 || br.Balance.Currency != msg.BTC {
+		t.Fatalf("expected balance of 12000 satoshis, got %v", br.Balance)
+	}
+	if len(br.Charged) != 2 || br.Charged[0].Amount != 500 || br.Charged[1].Amount != 2000 {
+		t.Fatalf("unexpected charged: %v", br.Charged)
+	}
+	// Valued at the current rate, 12000 satoshis is $12.00
+	if len(br.Balances) != 1 || br.Balances[0].Amount != 1200 ||
+		br.Balances[0].Currency != msg.USD || br.Rates[0].Rate != "100000" {
+		t.Fatalf("unexpected balances: %v at %v", br.Balances, br.Rates)
+	}
+}
+
+func TestBalanceConfirmations(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	maxBalance := msg.PaymentValue{Amount: 1e8, Currency: msg.BTC}
+	ps := PaymentService{
+		Btc: chain.NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.MAX_BALANCE, Args: []interface{}{&maxBalance}},
+			conf.Policy{Cmd: conf.MIN_CONF, Args: []interface{}{2}},
+		}},
+	}
+	ocCred := cred.NewOcCred()
+	balance := func() *BalanceResponse {
+		req := NewBalanceReq()
+		ocCred.SignOcReq(req)
+		resp, err := ps.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var br BalanceResponse
+		json.Unmarshal(resp.Body, &br)
+		return &br
+	}
+	rep.Put(&rep.Record{
+		Role:         rep.SERVER,
+		ID:           ocCred.ID(),
+		Status:       rep.SUCCESS_UNPAID,
+		PaymentType:  msg.DEFER,
+		PaymentValue: &msg.PaymentValue{Amount: 5000, Currency: msg.BTC},
+	})
+	p := peer.Peer{ID: ocCred.ID()}
+	addr, _ := p.PaymentAddr(1, ps.Btc)
+	txid := chain.Fund(addr, 3000)
+	chain.Mine(1)
+
+	br := balance()
+	if br.Balance.Amount != 5000 || br.Pending.Amount != 3000 ||
+		br.Confirmed.Amount != 0 || br.MinConf != 2 {
+		t.Fatalf("unexpected balance: %+v", br)
+	}
+	chain.Mine(1)
+	br = balance()
+	if br.Balance.Amount != 2000 || br.Pending.Amount != 0 || br.Confirmed.Amount != 3000 {
+		t.Fatalf("unexpected balance: %+v", br)
+	}
+
+	// Trusted IDs can be held to fewer confirmations
+	ps.Conf.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{ID: ocCred.ID()},
+		Cmd:      conf.MIN_CONF,
+		Args:     []interface{}{0},
+	})
+	chain.Fund(addr, 1000)
+	if br = balance(); br.Balance.Amount != 1000 {
+		t.Fatalf("expected unconfirmed payment to count, got %+v", br)
+	}
+
+	// A payment lost in a reorg no longer counts, and the charge it paid for
+	// is owed again
+	rep.Put(&rep.Record{
+		Role:         rep.SERVER,
+		ID:           ocCred.ID(),
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.ATTACHED,
+		PaymentValue: &msg.PaymentValue{Amount: 3000, Currency: msg.BTC},
+		Txid:         txid,
+	})
+	chain.Reorg(2, txid)
+	err := ps.reverseVanished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := rep.Count(&rep.Record{Status: rep.SUCCESS_UNPAID, Txid: txid})
+	if n != 1 {
+		t.Fatalf("expected payment record to be reversed")
+	}
+	if br = balance(); br.Balance.Amount != 7000 {
+		t.Fatalf("expected balance of 7000, got %+v", br)
+	}
+}
+
+func TestEscrowReleaseVanished(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	ps := PaymentService{Btc: chain.NewWallet("server")}
+	serverAddr, _ := ps.Btc.NewAddress()
+	txid := chain.Fund(serverAddr, 1e6)
+	chain.Mine(1)
+	id := cred.NewOcCred().ID()
+	// As the escrow service records a release
+	rep.Put(&rep.Record{
+		Role:         rep.SERVER,
+		Service:      escrow.SERVICE_NAME,
+		Method:       escrow.RELEASE_METHOD,
+		ID:           id,
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.TXID,
+		PaymentValue: &msg.PaymentValue{Amount: 1e6, Currency: msg.BTC},
+		Addr:         "escrow-addr",
+		Txid:         txid,
+	})
+	ledger.ImportCharges()
+	ledger.Post(&ledger.Entry{
+		Kind:   ledger.PAYMENT,
+		Debit:  ledger.WALLET,
+		Credit: ledger.PeerAccount(id),
+		Amount: 1e6,
+		Ref:    escrow.LedgerRef("escrow-addr"),
+	})
+	if balance, _ := ledger.Balance(ledger.PeerAccount(id)); balance != 0 {
+		t.Fatalf("expected balance of 0, got %v", balance)
+	}
+
+	chain.Reorg(0, txid)
+	err := ps.reverseVanished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := ledger.Balance(ledger.PeerAccount(id)); balance != 1e6 {
+		t.Fatalf("expected balance of 1000000, got %v", balance)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	refundAddr, _ := client.NewAddress()
+	refundMin := msg.PaymentValue{Amount: 1000, Currency: msg.BTC}
+	ps := PaymentService{
+		Btc: chain.NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.REFUND_MIN, Args: []interface{}{&refundMin}},
+			conf.Policy{Cmd: conf.REFUND_COOLDOWN, Args: []interface{}{3600}},
+		}},
+	}
+	ocCred := cred.NewOcCred()
+	refund := func(amount int64) *msg.OcResp {
+		req, err := NewRefundReq(client, ocCred.ID(), refundAddr, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ocCred.SignOcReq(req)
+		resp, err := ps.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	declined := func(resp *msg.OcResp, reason RefundError) {
+		if resp.Status != msg.REFUND_DECLINED || string(resp.Body) != string(reason) {
+			t.Fatalf("expected refund declined for %v, got %v %s",
+				reason, resp.Status, resp.Body)
+		}
+	}
+
+	declined(refund(0), NO_CREDIT)
+	rep.Put(&rep.Record{
+		Role:         rep.SERVER,
+		ID:           ocCred.ID(),
+		Status:       rep.SUCCESS_PAID,
+		PaymentType:  msg.DEFER,
+		PaymentValue: &msg.PaymentValue{Amount: 1000, Currency: msg.BTC},
+	})
+	p := peer.Peer{ID: ocCred.ID()}
+	addr, _ := p.PaymentAddr(1, ps.Btc)
+	chain.Fund(addr, 5000)
+	chain.Mine(1)
+
+	declined(refund(500), BELOW_MIN)
+	declined(refund(5000), NO_CREDIT)
+
+	// Only the ID that signed for the address can ask for a refund to it
+	req, _ := NewRefundReq(client, "other-id", refundAddr, 0)
+	ocCred.SignOcReq(req)
+	if resp, _ := ps.Handle(req); resp.Status != msg.INVALID_SIGNATURE {
+		t.Fatalf("expected %v, got %v", msg.INVALID_SIGNATURE, resp.Status)
+	}
+
+	resp := refund(0)
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v %s", resp.Status, resp.Body)
+	}
+	var rr RefundResponse
+	json.Unmarshal(resp.Body, &rr)
+	if rr.Amount.Amount != 4000 || rr.Status != rep.SUCCESS_PAID || rr.Txid == "" {
+		t.Fatalf("unexpected refund: %+v", rr)
+	}
+	received, _ := client.ListReceived(0)
+	if received[refundAddr] != 4000 {
+		t.Fatalf("expected 4000 refunded, got %v", received[refundAddr])
+	}
+	balance, _ := p.Balance(0, ps.Btc)
+	if balance.Amount != 0 {
+		t.Fatalf("expected balance of 0, got %v", balance.Amount)
+	}
+
+	chain.Fund(addr, 2000)
+	declined(refund(0), COOLDOWN)
+}
+
+func TestRefundApproval(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	refundAddr, _ := client.NewAddress()
+	ps := PaymentService{
+		Btc: chain.NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.REFUND_APPROVAL, Args: []interface{}{true}},
+		}},
+	}
+	ocCred := cred.NewOcCred()
+	refund := func() *msg.OcResp {
+		req, _ := NewRefundReq(client, ocCred.ID(), refundAddr, 0)
+		ocCred.SignOcReq(req)
+		resp, err := ps.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	p := peer.Peer{ID: ocCred.ID()}
+	addr, _ := p.PaymentAddr(1, ps.Btc)
+	chain.Fund(addr, 3000)
+	chain.Mine(1)
+
+	resp := refund()
+	var rr RefundResponse
+	json.Unmarshal(resp.Body, &rr)
+	if resp.Status != msg.OK || rr.Status != rep.PENDING || rr.Amount.Amount != 3000 {
+		t.Fatalf("expected pending refund, got %v %+v", resp.Status, rr)
+	}
+	// The pending refund holds the credit
+	if resp = refund(); resp.Status != msg.REFUND_DECLINED {
+		t.Fatalf("expected %v, got %v", msg.REFUND_DECLINED, resp.Status)
+	}
+	err := DenyRefund(rr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := PendingRefunds(); len(pending) != 0 {
+		t.Fatalf("expected no pending refunds, got %v", pending)
+	}
+
+	json.Unmarshal(refund().Body, &rr)
+	rec, err := ps.ApproveRefund(rr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ps.ApproveRefund(rr.ID); err != UNKNOWN_REFUND {
+		t.Fatalf("expected %v, got %v", UNKNOWN_REFUND, err)
+	}
+	if balance, _ := p.Balance(0, ps.Btc); balance.Amount != 0 {
+		t.Fatalf("expected balance of 0, got %v", balance.Amount)
+	}
+
+	// A refund lost in a reorg gives the credit back
+	chain.Reorg(0, rec.Txid)
+	err = ps.reverseVanished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := p.Balance(0, ps.Btc); balance.Amount != -3000 {
+		t.Fatalf("expected balance of -3000, got %v", balance.Amount)
+	}
+}
+
+func TestRefundSentOnce(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	refundAddr, _ := client.NewAddress()
+	ps := PaymentService{
+		Btc: chain.NewWallet("server"),
+		Conf: &conf.Conf{Policies: []conf.Policy{
+			conf.Policy{Cmd: conf.REFUND_APPROVAL, Args: []interface{}{true}},
+		}},
+	}
+	ocCred := cred.NewOcCred()
+	refund := func() *msg.OcResp {
+		req, _ := NewRefundReq(client, ocCred.ID(), refundAddr, 0)
+		ocCred.SignOcReq(req)
+		resp, err := ps.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	p := peer.Peer{ID: ocCred.ID()}
+	addr, _ := p.PaymentAddr(1, ps.Btc)
+	chain.Fund(addr, 3000)
+	chain.Mine(1)
+
+	var rr RefundResponse
+	json.Unmarshal(refund().Body, &rr)
+	// Taking the refund's ref makes posting it fail after it is sent
+	ledger.Post(&ledger.Entry{
+		Kind:   ledger.ADJUSTMENT,
+		Debit:  ledger.REVENUE,
+		Credit: ledger.WALLET,
+		Amount: 1,
+		Ref:    ledger.RepRef(rr.ID),
+	})
+	if _, err := ps.ApproveRefund(rr.ID); err == nil {
+		t.Fatalf("expected error recording refund")
+	}
+	if pending, _ := PendingRefunds(); len(pending) != 0 {
+		t.Fatalf("expected no pending refunds, got %v", pending)
+	}
+	if _, err := ps.ApproveRefund(rr.ID); err != UNKNOWN_REFUND {
+		t.Fatalf("expected %v, got %v", UNKNOWN_REFUND, err)
+	}
+	// The sent refund still holds the credit
+	if resp := refund(); resp.Status != msg.REFUND_DECLINED {
+		t.Fatalf("expected %v, got %v", msg.REFUND_DECLINED, resp.Status)
+	}
+	if received, _ := client.ListReceived(0); received[refundAddr] != 3000 {
+		t.Fatalf("expected one refund of 3000, got %v", received[refundAddr])
+	}
+}
+
+func TestReleaseCoin(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	client := chain.NewWallet("client")
+	coin, _ := client.NewAddress()
+	ps := PaymentService{Btc: chain.NewWallet("server")}
+	alice, bob := cred.NewOcCred(), cred.NewOcCred()
+	req := newReq(BALANCE_METHOD, []string{})
+	alice.SignOcReq(req)
+	bc := cred.BtcCred{Addr: coin}
+	bc.SignOcReq(req, client)
+	_, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice signs the release, and Bob sends it
+	release, err := NewReleaseCoinReq(alice, coin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.SignOcReq(release)
+	resp, err := ps.Handle(release)
+	if err != nil || resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v %v", resp, err)
+	}
+	if b, _ := peer.CoinBindingOf(coin); b != nil {
+		t.Fatalf("expected %v released, got %v", coin, b)
+	}
+	if resp, _ := ps.Handle(release); resp.Status != msg.INVALID_ARGUMENTS {
+		t.Fatalf("expected %v for an unbound coin, got %v", msg.INVALID_ARGUMENTS, resp.Status)
+	}
+
+	device, _ := cred.NewDelegatedOcCred(alice, []string{"*"}, 0)
+	if _, err := NewReleaseCoinReq(device, coin); err != NOT_IDENTITY_KEY {
+		t.Fatalf("expected %v, got %v", NOT_IDENTITY_KEY, err)
+	}
+}
@@ -0,0 +1,310 @@
+package payment
+
+// Refunds of prepaid credit. A client with a negative balance, eg. after
+// paying a PLEASE_PAY for more than it then used, or before leaving a server,
+// can ask for the credit back at a bitcoin address it signs for. Refunds are
+// rep records with the "refund" method: PENDING while waiting for the
+// operator, SUCCESS_PAID once sent, and FAILURE if denied or the payout
+// vanished. Paid refunds are posted to the ledger, so the balance goes back
+// up.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/rep"
+)
+
+// [addr] [sig] [amount]
+// sig is by addr, of RefundMessage; amount is in satoshis, and defaults to
+// all of the credit
+const REFUND_METHOD = "refund"
+
+type RefundError string
+
+const (
+	NO_CREDIT      RefundError = "no-credit"
+	BELOW_MIN      RefundError = "below-min"
+	COOLDOWN       RefundError = "cooldown"
+	UNKNOWN_REFUND RefundError = "unknown-refund"
+)
+
+func (re RefundError) Error() string {
+	return string(re)
+}
+
+// Refunds are decided one at a time, so credit isn't paid out twice
+var refundLock sync.Mutex
+
+type RefundResponse struct {
+	ID     int64             `json:"id"`
+	Addr   string            `json:"addr"`
+	Amount *msg.PaymentValue `json:"amount"`
+	Status rep.Status        `json:"status"`
+	Txid   string            `json:"txid,omitempty"`
+}
+
+func newRefundResponse(rec *rep.Record) *RefundResponse {
+	return &RefundResponse{
+		ID:     rec.RowID,
+		Addr:   rec.Addr,
+		Amount: rec.PaymentValue,
+		Status: rec.Status,
+		Txid:   rec.Txid,
+	}
+}
+
+// What the refund address signs, tying it to the ID whose credit it gets.
+func RefundMessage(ocID msg.OcID, addr string) string {
+	return fmt.Sprintf("decloud refund of credit for %v to %v", ocID, addr)
+}
+
+// Asks for amount satoshis of ocID's credit to be paid to addr, which must be
+// in b's wallet. Zero asks for all of it.
+func NewRefundReq(b btc.Backend, ocID msg.OcID, addr string, amount int64) (*msg.OcReq, error) {
+	sig, err := b.SignMessage(addr, RefundMessage(ocID, addr))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{addr, sig}
+	if amount != 0 {
+		args = append(args, strconv.FormatInt(amount, 10))
+	}
+	return newReq(REFUND_METHOD, args), nil
+}
+
+func (ps *PaymentService) refund(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 2 && len(req.Args) != 3 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	addr, sig := req.Args[0], req.Args[1]
+	ok, err := ps.Btc.VerifyMessage(addr, sig, RefundMessage(p.ID, addr))
+	if err != nil || !ok {
+		return msg.NewRespError(msg.INVALID_SIGNATURE), nil
+	}
+	amount := int64(0)
+	if len(req.Args) == 3 {
+		amount, err = strconv.ParseInt(req.Args[2], 10, 64)
+		if err != nil || amount <= 0 {
+			return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+		}
+	}
+
+	refundLock.Lock()
+	defer refundLock.Unlock()
+	credit, err := ps.refundableCredit(p.ID)
+	if err != nil {
+		log.Printf("error while reading credit of %v: %v\n", p.ID, err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	if amount == 0 {
+		amount = credit
+	}
+	err = ps.checkRefund(p.ID, amount, credit)
+	if err != nil {
+		return msg.NewRespErrorWithBody(msg.REFUND_DECLINED, []byte(err.Error())), nil
+	}
+	rec := rep.Record{
+		Role:         rep.SERVER,
+		Service:      SERVICE_NAME,
+		Method:       REFUND_METHOD,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           p.ID,
+		Status:       rep.PENDING,
+		PaymentType:  msg.TXID,
+		PaymentValue: &msg.PaymentValue{Amount: amount, Currency: msg.BTC},
+		Addr:         addr,
+	}
+	rec.RowID, err = rep.Put(&rec)
+	if err != nil {
+		log.Printf("error while recording refund: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	if !ps.refundNeedsApproval() {
+		err = ps.payRefund(&rec)
+		if err != nil {
+			log.Printf("error while paying refund %v: %v\n", rec.RowID, err)
+			return msg.NewRespError(msg.SERVER_ERROR), nil
+		}
+	}
+	body, err := json.Marshal(newRefundResponse(&rec))
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
+func refundSelector(ocID msg.OcID, status rep.Status) *rep.Record {
+	return &rep.Record{
+		Role:    rep.SERVER,
+		Service: SERVICE_NAME,
+		Method:  REFUND_METHOD,
+		ID:      ocID,
+		Status:  status,
+	}
+}
+
+// Satoshis of ocID's credit that aren't already waiting to be refunded.
+func (ps *PaymentService) refundableCredit(ocID msg.OcID) (int64, error) {
+	p := peer.Peer{ID: ocID}
+	balance, err := p.Balance(ps.Conf.MinConf(ocID), ps.Btc)
+	if err != nil {
+		return 0, err
+	}
+	credit := -balance.Amount
+	err = rep.Reduce(refundSelector(ocID, rep.PENDING), func(rec *rep.Record) {
+		credit -= rec.PaymentValue.Amount
+	})
+	if err != nil {
+		return 0, err
+	}
+	return credit, nil
+}
+
+func (ps *PaymentService) checkRefund(ocID msg.OcID, amount int64, credit int64) error {
+	if amount <= 0 || amount > credit {
+		return NO_CREDIT
+	}
+	if policy := ps.refundPolicy(conf.REFUND_MIN); policy != nil {
+		if amount < policy.Args[0].(*msg.PaymentValue).Amount {
+			return BELOW_MIN
+		}
+	}
+	if policy := ps.refundPolicy(conf.REFUND_COOLDOWN); policy != nil {
+		since := int(time.Now().Unix()) - policy.Args[0].(int)
+		recent := false
+		err := rep.Reduce(refundSelector(ocID, ""), func(rec *rep.Record) {
+			if rec.Status != rep.FAILURE && rec.Timestamp > since {
+				recent = true
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if recent {
+			return COOLDOWN
+		}
+	}
+	return nil
+}
+
+func (ps *PaymentService) refundPolicy(cmd conf.PolicyCmd) *conf.Policy {
+	if ps.Conf == nil {
+		return nil
+	}
+	policy, err := ps.Conf.PolicyForCmd(cmd)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+func (ps *PaymentService) refundNeedsApproval() bool {
+	policy := ps.refundPolicy(conf.REFUND_APPROVAL)
+	return policy != nil && policy.Args[0].(bool)
+}
+
+// Caller must hold refundLock. If the payout fails, the refund fails, and the
+// credit is available again. Once sent, the record carries the txid, so it is
+// never paid again, even if accounting for it fails.
+func (ps *PaymentService) payRefund(rec *rep.Record) error {
+	txid, err := ps.Btc.Send(rec.Addr, rec.PaymentValue.Amount)
+	if err != nil {
+		rep.SetStatus(rec.RowID, rep.FAILURE)
+		rec.Status = rep.FAILURE
+		return err
+	}
+	rec.Txid = txid
+	err = rep.SetTxid(rec.RowID, txid)
+	if err == nil {
+		err = ledger.Post(&ledger.Entry{
+			Kind:   ledger.REFUND,
+			Debit:  ledger.PeerAccount(rec.ID),
+			Credit: ledger.WALLET,
+			Amount: rec.PaymentValue.Amount,
+			Ref:    ledger.RepRef(rec.RowID),
+			Memo:   "to " + rec.Addr + " in " + txid,
+		})
+	}
+	if err == nil {
+		err = rep.SetPaid(rec.RowID, txid)
+	}
+	if err != nil {
+		// Sent, so the record must not be retried; the operator has to fix it
+		log.Printf("refund %v sent in %v, but not recorded: %v\n", rec.RowID, txid, err)
+		return err
+	}
+	rec.Status = rep.SUCCESS_PAID
+	log.Printf("refunded %v to %v for %v in %v\n",
+		rec.PaymentValue.Amount, rec.Addr, rec.ID, txid)
+	return nil
+}
+
+// Refunds waiting for the operator. Those with a txid are already sent.
+func PendingRefunds() ([]*rep.Record, error) {
+	recs := make([]*rep.Record, 0)
+	err := rep.Reduce(refundSelector("", rep.PENDING), func(rec *rep.Record) {
+		if rec.Txid == "" {
+			recs = append(recs, rec)
+		}
+	})
+	return recs, err
+}
+
+func pendingRefund(id int64) (*rep.Record, error) {
+	pending, err := PendingRefunds()
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range pending {
+		if rec.RowID == id {
+			return rec, nil
+		}
+	}
+	return nil, UNKNOWN_REFUND
+}
+
+// Pays a pending refund, if the ID still has the credit for it.
+func (ps *PaymentService) ApproveRefund(id int64) (*rep.Record, error) {
+	refundLock.Lock()
+	defer refundLock.Unlock()
+	rec, err := pendingRefund(id)
+	if err != nil {
+		return nil, err
+	}
+	credit, err := ps.refundableCredit(rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	// This refund is already taken out of the credit
+	if credit < 0 {
+		return nil, NO_CREDIT
+	}
+	return rec, ps.payRefund(rec)
+}
+
+func DenyRefund(id int64) error {
+	refundLock.Lock()
+	defer refundLock.Unlock()
+	rec, err := pendingRefund(id)
+	if err != nil {
+		return err
+	}
+	return rep.SetStatus(rec.RowID, rep.FAILURE)
+}
@@ -0,0 +1,53 @@
+package payment
+
+// Releases of coin bindings. The ID a bitcoin address is bound to signs a
+// release, eg. after selling the coins, and anyone, such as the buyer, can
+// send it; the address is then free for another ID to show.
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+)
+
+// [addr] [at] [sig]
+// sig is by the ID addr is bound to, of peer.CoinReleaseMessage
+const RELEASE_COIN_METHOD = "release-coin"
+
+var NOT_IDENTITY_KEY = errors.New("coin releases must be signed by the identity's own key")
+
+// Releases addr from o's identity. o must be the identity's own key.
+func NewReleaseCoinReq(o *cred.OcCred, addr string) (*msg.OcReq, error) {
+	if o.ID() != o.Identity() {
+		return nil, NOT_IDENTITY_KEY
+	}
+	at := time.Now().Unix()
+	sig, err := o.Sign(peer.CoinReleaseMessage(addr, o.Identity(), at))
+	if err != nil {
+		return nil, err
+	}
+	return newReq(RELEASE_COIN_METHOD, []string{addr, strconv.FormatInt(at, 10), sig}), nil
+}
+
+func (ps *PaymentService) releaseCoin(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 3 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	at, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	err = peer.ReleaseCoin(req.Args[0], at, req.Args[2])
+	if err == peer.NOT_BOUND {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	} else if err == peer.INVALID_RELEASE {
+		return msg.NewRespError(msg.INVALID_SIGNATURE), nil
+	} else if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk([]byte("")), nil
+}
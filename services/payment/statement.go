@@ -0,0 +1,339 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ortutay/decloud/channel"
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/ledger"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
+	"github.com/ortutay/decloud/rep"
+)
+
+const (
+	// [page] [page-size]
+	// returns the peer's charges, oldest first, and what they have paid
+	HISTORY_METHOD = "history"
+
+	// [from] [to], unix times
+	// returns a statement of charges in the period, signed by the server
+	INVOICE_METHOD = "invoice"
+
+	// [addr]
+	// returns a statement of what was received at one of the peer's payment
+	// addresses, signed by the server
+	RECEIPT_METHOD = "receipt"
+)
+
+const (
+	HISTORY_PAGE_SIZE     = 50
+	HISTORY_MAX_PAGE_SIZE = 500
+)
+
+// A record of service, as seen by the customer.
+type Charge struct {
+	Timestamp    int               `json:"timestamp"`
+	Service      string            `json:"service"`
+	Method       string            `json:"method"`
+	Status       rep.Status        `json:"status"`
+	PaymentType  msg.PaymentType   `json:"paymentType"`
+	PaymentValue *msg.PaymentValue `json:"paymentValue"`
+	Rate         string            `json:"rate,omitempty"` // BTC price, if not charged in BTC
+}
+
+// Whether the charge counts towards the balance. Refunds are paid out of
+// credit, rather than billed.
+func (c *Charge) IsBilled() bool {
+	return (c.Status == rep.SUCCESS_UNPAID || c.Status == rep.SUCCESS_PAID) &&
+		c.PaymentValue != nil && !(c.Service == SERVICE_NAME && c.Method == REFUND_METHOD)
+}
+
+func newCharge(rec *rep.Record) Charge {
+	return Charge{
+		Timestamp:    rec.Timestamp,
+		Service:      rec.Service,
+		Method:       rec.Method,
+		Status:       rec.Status,
+		PaymentType:  rec.PaymentType,
+		PaymentValue: rec.PaymentValue,
+		Rate:         rec.Rate,
+	}
+}
+
+// Amount received at one payment address.
+type AddrReceipt struct {
+	Addr      string `json:"addr"`
+	Received  int64  `json:"received"` // including unconfirmed
+	Confirmed int64  `json:"confirmed"`
+}
+
+type HistoryResponse struct {
+	Charges      []Charge      `json:"charges"`
+	Page         int           `json:"page"`
+	PageSize     int           `json:"pageSize"`
+	TotalCharges int           `json:"totalCharges"`
+	Receipts     []AddrReceipt `json:"receipts"`
+	InChannels   int64         `json:"inChannels"` // paid in open channels
+}
+
+// Drawn from the peer's ledger account, so refunds and payments net out as
+// they do in the balance.
+type Invoice struct {
+	OcID    msg.OcID        `json:"ocID"`
+	From    int64           `json:"from"`
+	To      int64           `json:"to"`
+	Issued  int64           `json:"issued"`
+	Charges []*ledger.Entry `json:"charges"` // in the period
+
+	// In BTC; charges in other currencies count at the rate they were made
+	Prior   *msg.PaymentValue `json:"prior"`   // charged before the period
+	Charged *msg.PaymentValue `json:"charged"` // charged in the period
+	Later   *msg.PaymentValue `json:"later"`   // charged after the period, to issue time
+	Paid    *msg.PaymentValue `json:"paid"`    // to date, less refunds and reversals
+	Balance *msg.PaymentValue `json:"balance"` // due at issue time
+}
+
+type Receipt struct {
+	OcID      msg.OcID          `json:"ocID"`
+	Addr      string            `json:"addr"`
+	Received  *msg.PaymentValue `json:"received"`
+	Confirmed *msg.PaymentValue `json:"confirmed"`
+	Issued    int64             `json:"issued"`
+}
+
+// An invoice or receipt, signed by the server that issued it.
+type Statement struct {
+	Body     json.RawMessage `json:"body"`
+	ServerID msg.OcID        `json:"serverID"`
+	Sig      string          `json:"sig"`
+}
+
+func newStatement(c *cred.OcCred, v interface{}) (*Statement, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := c.Sign(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Statement{Body: body, ServerID: c.ID(), Sig: sig}, nil
+}
+
+// Checks the statement's signature, and decodes its body into v.
+func (st *Statement) Verify(v interface{}) error {
+	if !cred.VerifyOcSig(st.ServerID, st.Body, st.Sig) {
+		return fmt.Errorf("invalid signature on statement from %v", st.ServerID)
+	}
+	return json.Unmarshal(st.Body, v)
+}
+
+func NewHistoryReq(page int, pageSize int) *msg.OcReq {
+	return newReq(HISTORY_METHOD,
+		[]string{strconv.Itoa(page), strconv.Itoa(pageSize)})
+}
+
+func NewInvoiceReq(from int64, to int64) *msg.OcReq {
+	return newReq(INVOICE_METHOD, []string{
+		strconv.FormatInt(from, 10), strconv.FormatInt(to, 10)})
+}
+
+func NewReceiptReq(addr string) *msg.OcReq {
+	return newReq(RECEIPT_METHOD, []string{addr})
+}
+
+func parseIntArgs(args []string, defaults []int64) ([]int64, error) {
+	if len(args) > len(defaults) {
+		return nil, fmt.Errorf("too many arguments")
+	}
+	vals := make([]int64, len(defaults))
+	copy(vals, defaults)
+	for i, arg := range args {
+		v, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid argument %v", arg)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func (ps *PaymentService) history(req *msg.OcReq) (*msg.OcResp, error) {
+	vals, err := parseIntArgs(req.Args, []int64{0, HISTORY_PAGE_SIZE})
+	if err != nil || vals[1] == 0 || vals[1] > HISTORY_MAX_PAGE_SIZE {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	page, pageSize := int(vals[0]), int(vals[1])
+	if ps.Btc == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	sel := rep.Record{Role: rep.SERVER, ID: p.ID}
+	recs, err := rep.Select(&sel, page*pageSize, pageSize)
+	if err != nil {
+		log.Printf("error while reading history: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	total, err := rep.Count(&sel)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	receipts, err := ps.receipts(p)
+	if err != nil {
+		log.Printf("error while reading receipts: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	inChannels, err := channel.PaidInOpenChannels(p.ID)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	resp := HistoryResponse{
+		Charges:      make([]Charge, 0),
+		Page:         page,
+		PageSize:     pageSize,
+		TotalCharges: total,
+		Receipts:     receipts,
+		InChannels:   inChannels,
+	}
+	for _, rec := range recs {
+		resp.Charges = append(resp.Charges, newCharge(rec))
+	}
+	body, err := json.Marshal(&resp)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
+func (ps *PaymentService) receipts(p *peer.Peer) ([]AddrReceipt, error) {
+	received, err := ps.Btc.ListReceived(0)
+	if err != nil {
+		return nil, err
+	}
+	confirmed, err := ps.Btc.ListReceived(1)
+	if err != nil {
+		return nil, err
+	}
+	receipts := make([]AddrReceipt, 0)
+	for _, addr := range p.PaymentAddrs() {
+		receipts = append(receipts, AddrReceipt{
+			Addr:      addr,
+			Received:  received[addr],
+			Confirmed: confirmed[addr],
+		})
+	}
+	return receipts, nil
+}
+
+func (ps *PaymentService) invoice(req *msg.OcReq) (*msg.OcResp, error) {
+	now := time.Now().Unix()
+	vals, err := parseIntArgs(req.Args, []int64{0, now})
+	if err != nil || vals[0] > vals[1] {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil || ps.Cred == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	err = p.SyncLedger(ps.Conf.MinConf(p.ID), ps.Btc)
+	if err != nil {
+		log.Printf("error while syncing ledger: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	account := ledger.PeerAccount(p.ID)
+	entries, err := ledger.Entries(account, 0, -1)
+	if err != nil {
+		log.Printf("error while reading ledger: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	inv := Invoice{
+		OcID:    p.ID,
+		From:    vals[0],
+		To:      vals[1],
+		Issued:  now,
+		Charges: make([]*ledger.Entry, 0),
+		Prior:   &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+		Charged: &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+		Later:   &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+		Paid:    &msg.PaymentValue{Amount: 0, Currency: msg.BTC},
+	}
+	for _, e := range entries {
+		// What the entry adds to what the peer owes
+		owed := e.Amount
+		if e.Credit == account {
+			owed = -e.Amount
+		}
+		switch {
+		case e.Kind != ledger.CHARGE:
+			inv.Paid.Amount -= owed
+		case e.Timestamp < inv.From:
+			inv.Prior.Amount += owed
+		case e.Timestamp <= inv.To:
+			inv.Charges = append(inv.Charges, e)
+			inv.Charged.Amount += owed
+		default:
+			inv.Later.Amount += owed
+		}
+	}
+	inv.Balance = &msg.PaymentValue{
+		Amount:   inv.Prior.Amount + inv.Charged.Amount + inv.Later.Amount - inv.Paid.Amount,
+		Currency: msg.BTC,
+	}
+	return ps.signedResp(&inv)
+}
+
+func (ps *PaymentService) receipt(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 1 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if ps.Btc == nil || ps.Cred == nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	p, err := peer.NewPeerFromReq(req)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	receipts, err := ps.receipts(p)
+	if err != nil {
+		log.Printf("error while reading receipts: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	for _, r := range receipts {
+		if r.Addr != req.Args[0] {
+			continue
+		}
+		return ps.signedResp(&Receipt{
+			OcID:      p.ID,
+			Addr:      r.Addr,
+			Received:  &msg.PaymentValue{Amount: r.Received, Currency: msg.BTC},
+			Confirmed: &msg.PaymentValue{Amount: r.Confirmed, Currency: msg.BTC},
+			Issued:    time.Now().Unix(),
+		})
+	}
+	// Only the peer's own addresses get receipts
+	return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+}
+
+func (ps *PaymentService) signedResp(v interface{}) (*msg.OcResp, error) {
+	st, err := newStatement(ps.Cred, v)
+	if err != nil {
+		log.Printf("error while signing statement: %v\n", err)
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	body, err := json.Marshal(st)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/util"
+)
+
+// Metadata tables used by the store service
+const (
+	BLOB_TABLE      = "blob-to-blocks"
+	CONTAINER_TABLE = "containers"
+	JOURNAL_TABLE   = "journal"
+)
+
+// Kinds of backend, as given to the STORE_BACKEND policy
+const (
+	FS_BACKEND   = "fs"
+	BOLT_BACKEND = "bolt"
+	S3_BACKEND   = "s3"
+)
+
+// A Backend holds block data, and small metadata values in named tables.
+// Reads of missing keys return nil data and no error.
+type Backend interface {
+	PutBlock(id BlockID, data []byte) error
+	GetBlock(id BlockID) ([]byte, error)
+	HasBlock(id BlockID) (bool, error)
+	DeleteBlock(id BlockID) error
+	BlockIDs() ([]BlockID, error)
+
+	PutMeta(table string, key string, value []byte) error
+	GetMeta(table string, key string) ([]byte, error)
+	DeleteMeta(table string, key string) error
+	MetaKeys(table string) ([]string, error)
+}
+
+// Opens the backend configured by the STORE_BACKEND and STORE_DIR policies.
+// Defaults to files under the app dir.
+func NewBackendFromConf(c *conf.Conf) (Backend, error) {
+	dir := util.ServiceDir(SERVICE_NAME)
+	kind := FS_BACKEND
+	var args []interface{}
+	if c != nil {
+		dirPolicy, err := c.PolicyForCmd(conf.STORE_DIR)
+		if err != nil {
+			return nil, err
+		}
+		if dirPolicy != nil {
+			dir = util.ExpandHome(dirPolicy.Args[0].(string))
+		}
+		backendPolicy, err := c.PolicyForCmd(conf.STORE_BACKEND)
+		if err != nil {
+			return nil, err
+		}
+		if backendPolicy != nil {
+			kind = backendPolicy.Args[0].(string)
+			args = backendPolicy.Args[1:]
+		}
+	}
+	switch kind {
+	case FS_BACKEND:
+		return NewFSBackend(moveLegacyStore(dir))
+	case BOLT_BACKEND:
+		return NewBoltBackend(dir + "/store.bolt")
+	case S3_BACKEND:
+		if len(args) != 2 {
+			return nil, fmt.Errorf("s3 backend needs endpoint and bucket")
+		}
+		return NewS3BackendFromEnv(args[0].(string), args[1].(string))
+	default:
+		return nil, fmt.Errorf("unknown store backend: %v", kind)
+	}
+}
+
+// Where the store was kept before STORE_DIR was honored.
+func legacyStoreDir() string {
+	return util.AppDir() + "/services/" + SERVICE_NAME
+}
+
+// The blocks dir and table databases, relative to a store dir.
+func storeDirEntries() []string {
+	entries := []string{"blocks"}
+	for _, table := range []string{BLOB_TABLE, CONTAINER_TABLE, JOURNAL_TABLE} {
+		entries = append(entries, table+".db")
+	}
+	return entries
+}
+
+func hasStoreData(dir string) bool {
+	for _, entry := range storeDirEntries() {
+		files, _ := ioutil.ReadDir(dir + "/" + entry)
+		if len(files) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves a store kept in the legacy dir to dir, unless dir already has one.
+// Returns the dir to use: dir, or the legacy dir if the move failed, eg.
+// because dir is on another filesystem.
+func moveLegacyStore(dir string) string {
+	legacy := legacyStoreDir()
+	if filepath.Clean(legacy) == filepath.Clean(dir) ||
+		!hasStoreData(legacy) || hasStoreData(dir) {
+		return dir
+	}
+	err := util.MakeDir(dir)
+	if err != nil {
+		log.Printf("error while creating %v, keeping store in %v: %v\n", dir, legacy, err)
+		return legacy
+	}
+	moved := make([]string, 0)
+	for _, entry := range storeDirEntries() {
+		if _, err := os.Stat(legacy + "/" + entry); os.IsNotExist(err) {
+			continue
+		}
+		// Empty dirs made by an earlier start in dir
+		os.Remove(dir + "/" + entry)
+		err = os.Rename(legacy+"/"+entry, dir+"/"+entry)
+		if err != nil {
+			break
+		}
+		moved = append(moved, entry)
+	}
+	if err != nil {
+		for _, entry := range moved {
+			os.Rename(dir+"/"+entry, legacy+"/"+entry)
+		}
+		log.Printf("error while moving store to %v, keeping it in %v: %v\n", dir, legacy, err)
+		return legacy
+	}
+	log.Printf("moved store from %v to %v\n", legacy, dir)
+	return dir
+}
+
+// Stores each block as a file, and metadata in diskv databases. All files are
+// written atomically, via a synced temp file and rename.
+type FSBackend struct {
+	Dir string
+}
+
+func NewFSBackend(dir string) (*FSBackend, error) {
+	err := util.MakeDir(dir + "/blocks")
+	if err != nil {
+		return nil, err
+	}
+	fb := FSBackend{Dir: dir}
+	err = fb.removeTempFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &fb, nil
+}
+
+// Removes temp files left behind by writes interrupted by a crash.
+func (fb *FSBackend) removeTempFiles() error {
+	dirs := []string{fb.Dir + "/blocks"}
+	for _, table := range []string{BLOB_TABLE, CONTAINER_TABLE, JOURNAL_TABLE} {
+		dirs = append(dirs, fb.table(table))
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if !util.IsTempFile(f.Name()) {
+				continue
+			}
+			err := os.Remove(dir + "/" + f.Name())
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fb *FSBackend) blockPath(id BlockID) string {
+	return fb.Dir + "/blocks/" + id.String()
+}
+
+func (fb *FSBackend) table(name string) string {
+	return fb.Dir + "/" + name + ".db"
+}
+
+func (fb *FSBackend) PutBlock(id BlockID, data []byte) error {
+	return util.WriteFileAtomic(fb.blockPath(id), data, 0644)
+}
+
+func (fb *FSBackend) GetBlock(id BlockID) ([]byte, error) {
+	data, err := ioutil.ReadFile(fb.blockPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (fb *FSBackend) HasBlock(id BlockID) (bool, error) {
+	_, err := os.Stat(fb.blockPath(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (fb *FSBackend) DeleteBlock(id BlockID) error {
+	err := os.Remove(fb.blockPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+var blockIDRe = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func (fb *FSBackend) BlockIDs() ([]BlockID, error) {
+	files, err := ioutil.ReadDir(fb.Dir + "/blocks")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]BlockID, 0)
+	for _, f := range files {
+		if blockIDRe.MatchString(f.Name()) {
+			ids = append(ids, BlockID(f.Name()))
+		}
+	}
+	return ids, nil
+}
+
+func (fb *FSBackend) PutMeta(table string, key string, value []byte) error {
+	// diskv writes in place, so write the file it would use ourselves
+	err := util.MakeDir(fb.table(table))
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(fb.table(table)+"/"+key, value, 0644)
+}
+
+func (fb *FSBackend) GetMeta(table string, key string) ([]byte, error) {
+	d := util.GetOrCreateDB(fb.table(table))
+	if !d.Has(key) {
+		return nil, nil
+	}
+	return d.Read(key)
+}
+
+func (fb *FSBackend) DeleteMeta(table string, key string) error {
+	d := util.GetOrCreateDB(fb.table(table))
+	if !d.Has(key) {
+		return nil
+	}
+	return d.Erase(key)
+}
+
+func (fb *FSBackend) MetaKeys(table string) ([]string, error) {
+	d := util.GetOrCreateDB(fb.table(table))
+	keys := make([]string, 0)
+	for key := range d.Keys() {
+		if util.IsTempFile(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
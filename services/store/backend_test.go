@@ -0,0 +1,264 @@
+package store
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/testutil"
+	"github.com/ortutay/decloud/util"
+)
+
+func testBackend(t *testing.T, b Backend) {
+	id := BlockID(strings.Repeat("ab", 32))
+	if data, err := b.GetBlock(id); err != nil || data != nil {
+		t.Fatalf("expected missing block, got %v, %v", data, err)
+	}
+	if has, err := b.HasBlock(id); err != nil || has {
+		t.Fatalf("expected missing block, got %v, %v", has, err)
+	}
+	if err := b.PutBlock(id, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := b.HasBlock(id); err != nil || !has {
+		t.Fatalf("expected block, got %v, %v", has, err)
+	}
+	if data, err := b.GetBlock(id); err != nil || string(data) != "abc" {
+		t.Fatalf("expected abc, got %v, %v", string(data), err)
+	}
+	ids, err := b.BlockIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("expected [%v], got %v", id, ids)
+	}
+	if err := b.DeleteBlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := b.HasBlock(id); has {
+		t.Fatalf("expected %v to be deleted", id)
+	}
+	if err := b.DeleteBlock(id); err != nil {
+		t.Fatalf("expected delete of missing block to succeed, got %v", err)
+	}
+
+	if data, err := b.GetMeta(CONTAINER_TABLE, "k1"); err != nil || data != nil {
+		t.Fatalf("expected missing key, got %v, %v", data, err)
+	}
+	for _, key := range []string{"k1", "k2"} {
+		if err := b.PutMeta(CONTAINER_TABLE, key, []byte("v-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.PutMeta(BLOB_TABLE, "other", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := b.GetMeta(CONTAINER_TABLE, "k2"); string(data) != "v-k2" {
+		t.Fatalf("expected v-k2, got %v", string(data))
+	}
+	keys, err := b.MetaKeys(CONTAINER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "k1,k2" {
+		t.Fatalf("expected [k1 k2], got %v", keys)
+	}
+	if err := b.DeleteMeta(CONTAINER_TABLE, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := b.GetMeta(CONTAINER_TABLE, "k1"); data != nil {
+		t.Fatalf("expected k1 to be deleted")
+	}
+	keys, _ = b.MetaKeys(CONTAINER_TABLE)
+	if len(keys) != 1 || keys[0] != "k2" {
+		t.Fatalf("expected [k2], got %v", keys)
+	}
+}
+
+// Runs a put, renew and get through the service on the given backend.
+func testServiceOnBackend(t *testing.T, b Backend) {
+	ss := StoreService{Backend: b}
+	blobID := putBlob(t, &ss, NewPutReq("1h", []byte("abc")))
+	req := NewRenewReq(blobID, "1h")
+	req.ID = testOcID
+	if resp, err := ss.Handle(req); err != nil || resp.Status != msg.OK {
+		t.Fatalf("renew failed: %v, %v", resp, err)
+	}
+	req = NewGetReq(blobID)
+	req.ID = testOcID
+	resp, err := ss.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "abc" {
+		t.Fatalf("expected abc, got %v", string(resp.Body))
+	}
+}
+
+func TestFSBackend(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b, err := NewFSBackend(util.AppDir() + "/fs-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+	testServiceOnBackend(t, b)
+}
+
+func TestMoveLegacyStore(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	legacy, err := NewFSBackend(util.ServiceDir(SERVICE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := StoreService{Backend: legacy}
+	blobID := putBlob(t, &ss, NewPutReq("1h", []byte("abc")))
+
+	c := conf.Conf{}
+	c.AddPolicy(&conf.Policy{
+		Selector: conf.PolicySelector{Service: SERVICE_NAME},
+		Cmd:      conf.STORE_DIR,
+		Args:     []interface{}{util.AppDir() + "/new-store"},
+	})
+	for i := 0; i < 2; i++ {
+		b, err := NewBackendFromConf(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.(*FSBackend).Dir != util.AppDir()+"/new-store" {
+			t.Fatalf("expected the configured dir, got %v", b.(*FSBackend).Dir)
+		}
+		ss := StoreService{Backend: b}
+		if !testContainer(t, &ss).HasBlobID(blobID) {
+			t.Fatalf("expected %v to be moved", blobID)
+		}
+		if blob, err := NewBlobFromBackend(b, blobID); err != nil || blob == nil {
+			t.Fatalf("expected %v to be moved, got %v", blobID, err)
+		}
+	}
+	if hasStoreData(legacyStoreDir()) {
+		t.Fatalf("expected the legacy dir to be emptied")
+	}
+}
+
+func TestBoltBackend(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	// In a dir that doesn't exist yet
+	b, err := NewBoltBackend(util.AppDir() + "/bolt/store.bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	testBackend(t, b)
+	testServiceOnBackend(t, b)
+}
+
+const (
+	testAccessKey = "test-access-key"
+	testSecretKey = "test-secret-key"
+)
+
+// In memory stand-in for an S3 bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if !VerifyS3Request(req, body, testAccessKey, testSecretKey) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	prefix := "/" + f.bucket
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && req.Method == "GET":
+		var result listBucketResult
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{k})
+		}
+		out, _ := xml.Marshal(struct {
+			XMLName xml.Name `xml:"ListBucketResult"`
+			listBucketResult
+		}{listBucketResult: result})
+		w.Write(out)
+	case req.Method == "PUT":
+		f.objects[key] = body
+	case req.Method == "GET" || req.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case req.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Backend(t *testing.T) (*S3Backend, *httptest.Server) {
+	server := httptest.NewServer(&fakeS3{
+		bucket:  "test-bucket",
+		objects: make(map[string][]byte),
+	})
+	os.Setenv("AWS_ACCESS_KEY_ID", testAccessKey)
+	os.Setenv("AWS_SECRET_ACCESS_KEY", testSecretKey)
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	b, err := NewS3BackendFromEnv(server.URL, "test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, server
+}
+
+func TestS3Backend(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b, server := newTestS3Backend(t)
+	defer server.Close()
+	testBackend(t, b)
+	testServiceOnBackend(t, b)
+}
+
+func TestS3BadSignature(t *testing.T) {
+	b, server := newTestS3Backend(t)
+	defer server.Close()
+	b.SecretKey = "wrong"
+	err := b.PutBlock(BlockID(strings.Repeat("ab", 32)), []byte("abc"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected signature failure, got %v", err)
+	}
+}
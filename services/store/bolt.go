@@ -0,0 +1,129 @@
+package store
+
+import (
+	"path/filepath"
+
+	"github.com/ortutay/decloud/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+const BOLT_BLOCKS_BUCKET = "blocks"
+
+// Keeps blocks and metadata in a single embedded bbolt database, one bucket
+// per table.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	err := util.MakeDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+func (bb *BoltBackend) Close() error {
+	return bb.db.Close()
+}
+
+func (bb *BoltBackend) put(bucket string, key string, value []byte) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (bb *BoltBackend) get(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v != nil {
+			// Only valid for the life of the transaction
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (bb *BoltBackend) delete(bucket string, key string) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (bb *BoltBackend) keys(bucket string) ([]string, error) {
+	keys := make([]string, 0)
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (bb *BoltBackend) PutBlock(id BlockID, data []byte) error {
+	return bb.put(BOLT_BLOCKS_BUCKET, id.String(), data)
+}
+
+func (bb *BoltBackend) GetBlock(id BlockID) ([]byte, error) {
+	return bb.get(BOLT_BLOCKS_BUCKET, id.String())
+}
+
+func (bb *BoltBackend) HasBlock(id BlockID) (bool, error) {
+	data, err := bb.get(BOLT_BLOCKS_BUCKET, id.String())
+	return data != nil, err
+}
+
+func (bb *BoltBackend) DeleteBlock(id BlockID) error {
+	return bb.delete(BOLT_BLOCKS_BUCKET, id.String())
+}
+
+func (bb *BoltBackend) BlockIDs() ([]BlockID, error) {
+	keys, err := bb.keys(BOLT_BLOCKS_BUCKET)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]BlockID, len(keys))
+	for i, key := range keys {
+		ids[i] = BlockID(key)
+	}
+	return ids, nil
+}
+
+func (bb *BoltBackend) PutMeta(table string, key string, value []byte) error {
+	return bb.put("meta-"+table, key, value)
+}
+
+func (bb *BoltBackend) GetMeta(table string, key string) ([]byte, error) {
+	return bb.get("meta-"+table, key)
+}
+
+func (bb *BoltBackend) DeleteMeta(table string, key string) error {
+	return bb.delete("meta-"+table, key)
+}
+
+func (bb *BoltBackend) MetaKeys(table string) ([]string, error) {
+	return bb.keys("meta-" + table)
+}
@@ -0,0 +1,325 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/util"
+)
+
+// A JournalEntry is written before a new blob is stored, and erased once the
+// owner's container refers to it. An entry left behind means the put was
+// interrupted, and its writes are rolled back on recovery.
+type JournalEntry struct {
+	BlobID   BlobID    `json:"blobId"`
+	OwnerID  msg.OcID  `json:"ownerId"`
+	BlockIDs []BlockID `json:"blockIds"`
+	Started  int64     `json:"started"`
+}
+
+func (je *JournalEntry) key() string {
+	return util.Sha256AsString([]byte(je.OwnerID.String() + "/" + je.BlobID.String()))
+}
+
+func beginPut(b Backend, owner msg.OcID, blob *Blob) (*JournalEntry, error) {
+	je := JournalEntry{
+		BlobID:   blob.ID,
+		OwnerID:  owner,
+		BlockIDs: blob.BlockIDs(),
+		Started:  time.Now().Unix(),
+	}
+	ser, err := json.Marshal(je)
+	if err != nil {
+		return nil, err
+	}
+	err = b.PutMeta(JOURNAL_TABLE, je.key(), ser)
+	if err != nil {
+		return nil, fmt.Errorf("error while writing journal: %v", err.Error())
+	}
+	return &je, nil
+}
+
+func (je *JournalEntry) finish(b Backend) error {
+	return b.DeleteMeta(JOURNAL_TABLE, je.key())
+}
+
+// Undoes whatever part of the put was written, unless it completed.
+func (je *JournalEntry) rollback(b Backend) error {
+	referenced, err := isBlobReferenced(b, je.BlobID)
+	if err != nil {
+		return err
+	}
+	if !referenced {
+		err := b.DeleteMeta(BLOB_TABLE, je.BlobID.String())
+		if err != nil {
+			return err
+		}
+		err = deleteUnreferencedBlocks(b, je.BlockIDs)
+		if err != nil {
+			return err
+		}
+	}
+	return je.finish(b)
+}
+
+func readJournal(b Backend) ([]*JournalEntry, error) {
+	keys, err := b.MetaKeys(JOURNAL_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*JournalEntry, 0)
+	for _, key := range keys {
+		ser, err := b.GetMeta(JOURNAL_TABLE, key)
+		if err != nil {
+			return nil, err
+		}
+		var je JournalEntry
+		if ser == nil || json.Unmarshal(ser, &je) != nil {
+			// The entry itself was never completely written; nothing else was.
+			err := b.DeleteMeta(JOURNAL_TABLE, key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries = append(entries, &je)
+	}
+	return entries, nil
+}
+
+type CheckReport struct {
+	// Puts that were interrupted and rolled back
+	Interrupted []BlobID
+	// Blocks whose data does not match their ID, e.g. truncated writes
+	CorruptBlocks []BlockID
+	// Blobs with missing or corrupt blocks; their data is lost
+	BrokenBlobs []BlobID
+	// Blobs that no container refers to
+	OrphanBlobs []BlobID
+	// Container entries for blobs that are not stored
+	DanglingRefs []BlobID
+	// Blocks that no blob refers to
+	OrphanBlocks []BlockID
+}
+
+func (r *CheckReport) IsClean() bool {
+	return len(r.Interrupted) == 0 && len(r.CorruptBlocks) == 0 &&
+		len(r.BrokenBlobs) == 0 && len(r.OrphanBlobs) == 0 &&
+		len(r.DanglingRefs) == 0 && len(r.OrphanBlocks) == 0
+}
+
+func (r *CheckReport) String() string {
+	return fmt.Sprintf("interrupted puts: %v, corrupt blocks: %v, "+
+		"broken blobs: %v, orphan blobs: %v, dangling refs: %v, "+
+		"orphan blocks: %v", len(r.Interrupted), len(r.CorruptBlocks),
+		len(r.BrokenBlobs), len(r.OrphanBlobs), len(r.DanglingRefs),
+		len(r.OrphanBlocks))
+}
+
+// Checks that every container refers to stored blobs, every blob has all of
+// its blocks intact, and that nothing is left unreferenced. If repair is set,
+// interrupted puts are rolled back and anything inconsistent is removed.
+func Check(b Backend, repair bool) (*CheckReport, error) {
+	var report CheckReport
+
+	entries, err := readJournal(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, je := range entries {
+		report.Interrupted = append(report.Interrupted, je.BlobID)
+		if repair {
+			err := je.rollback(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	blockIDs, err := b.BlockIDs()
+	if err != nil {
+		return nil, err
+	}
+	goodBlocks := make(map[BlockID]bool)
+	for _, id := range blockIDs {
+		data, err := b.GetBlock(id)
+		if err != nil {
+			return nil, err
+		}
+		block, err := NewBlock(data)
+		if err == nil && block.ID == id {
+			goodBlocks[id] = true
+			continue
+		}
+		report.CorruptBlocks = append(report.CorruptBlocks, id)
+		if repair {
+			err := b.DeleteBlock(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	containerKeys, err := b.MetaKeys(CONTAINER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	containers := make([]*Container, 0)
+	referenced := make(map[BlobID]bool)
+	for _, key := range containerKeys {
+		container, err := NewContainerFromBackend(b, msg.OcID(key))
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, container)
+		for _, id := range container.BlobIDs {
+			referenced[id] = true
+		}
+	}
+
+	blobKeys, err := b.MetaKeys(BLOB_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	goodBlobs := make(map[BlobID]bool)
+	usedBlocks := make(map[BlockID]bool)
+	for _, key := range blobKeys {
+		id := BlobID(key)
+		ids, err := blobBlockIDs(b, id)
+		broken := err != nil || ids == nil
+		for _, blockID := range ids {
+			if !goodBlocks[blockID] {
+				broken = true
+			}
+		}
+		if broken {
+			report.BrokenBlobs = append(report.BrokenBlobs, id)
+		} else if !referenced[id] {
+			report.OrphanBlobs = append(report.OrphanBlobs, id)
+		} else {
+			goodBlobs[id] = true
+			for _, blockID := range ids {
+				usedBlocks[blockID] = true
+			}
+			continue
+		}
+		if repair {
+			err := b.DeleteMeta(BLOB_TABLE, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, container := range containers {
+		dangling := make([]BlobID, 0)
+		for _, id := range container.BlobIDs {
+			if !goodBlobs[id] {
+				dangling = append(dangling, id)
+			}
+		}
+		report.DanglingRefs = append(report.DanglingRefs, dangling...)
+		if repair && len(dangling) > 0 {
+			for _, id := range dangling {
+				container.RemoveBlobID(id)
+			}
+			err := container.Write(b)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for id := range goodBlocks {
+		if usedBlocks[id] {
+			continue
+		}
+		report.OrphanBlocks = append(report.OrphanBlocks, id)
+		if repair {
+			err := b.DeleteBlock(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &report, nil
+}
+
+// Rolls back interrupted writes and repairs inconsistencies. Should be run at
+// startup, before handling requests.
+func (ss *StoreService) Recover() (*CheckReport, error) {
+	b, err := ss.backend()
+	if err != nil {
+		return nil, err
+	}
+	report, err := Check(b, true)
+	if err != nil {
+		return nil, fmt.Errorf("error during store check: %v", err.Error())
+	}
+	if !report.IsClean() {
+		log.Printf("store repaired: %v\n", report)
+	}
+	// After the check, so interrupted puts are rolled back under the ID they
+	// were journaled with
+	n, err := migrateOcIDs(b)
+	if err != nil {
+		return nil, fmt.Errorf("error while migrating containers: %v", err.Error())
+	}
+	if n != 0 {
+		log.Printf("moved %v containers to compact IDs\n", n)
+	}
+	return report, nil
+}
+
+// Moves containers kept under long form OcIDs to the compact form. Returns
+// the number moved.
+func migrateOcIDs(b Backend) (int, error) {
+	keys, err := b.MetaKeys(CONTAINER_TABLE)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, key := range keys {
+		oldID := msg.OcID(key)
+		if !cred.IsLegacyOcID(oldID) {
+			continue
+		}
+		newID, err := cred.CanonicalOcID(oldID)
+		if err != nil {
+			log.Printf("not migrating container of unreadable ID %v: %v\n", key, err)
+			continue
+		}
+		container, err := NewContainerFromBackend(b, oldID)
+		if err != nil {
+			return moved, err
+		}
+		existing, err := NewContainerFromBackend(b, newID)
+		if err != nil {
+			return moved, err
+		}
+		for _, id := range container.BlobIDs {
+			if !existing.HasBlobID(id) {
+				existing.BlobIDs = append(existing.BlobIDs, id)
+			}
+			if lease, ok := container.Leases[id]; ok {
+				existing.SetLease(id, lease)
+			}
+		}
+		// Written before the old one is deleted, so blobs are never unreferenced
+		err = existing.Write(b)
+		if err != nil {
+			return moved, err
+		}
+		err = b.DeleteMeta(CONTAINER_TABLE, key)
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
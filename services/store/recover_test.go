@@ -0,0 +1,178 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ortutay/decloud/cred"
+	"github.com/ortutay/decloud/testutil"
+	"github.com/ortutay/decloud/util"
+)
+
+func newTestFSBackend(t *testing.T) *FSBackend {
+	b, err := NewFSBackend(util.ServiceDir(SERVICE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testBlob(t *testing.T, data string) *Blob {
+	blob, err := NewBlobFromReader(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestRecoverInterruptedPut(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b := newTestFSBackend(t)
+	blob := testBlob(t, strings.Repeat("x", BYTES_PER_BLOCK+10))
+
+	// Crash after the blocks and block list, before the container
+	_, err := beginPut(b, testOcID, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storeBlob(b, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := StoreService{Backend: b}
+	report, err := ss.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Interrupted) != 1 || report.Interrupted[0] != blob.ID {
+		t.Fatalf("expected %v interrupted, got %v", blob.ID, report.Interrupted)
+	}
+	if data, _ := b.GetMeta(BLOB_TABLE, blob.ID.String()); data != nil {
+		t.Fatalf("expected %v to be rolled back", blob.ID)
+	}
+	ids, _ := b.BlockIDs()
+	if len(ids) != 0 {
+		t.Fatalf("expected no blocks, got %v", ids)
+	}
+	keys, _ := b.MetaKeys(JOURNAL_TABLE)
+	if len(keys) != 0 {
+		t.Fatalf("expected empty journal, got %v", keys)
+	}
+}
+
+func TestRecoverCompletedPut(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b := newTestFSBackend(t)
+	ss := StoreService{Backend: b}
+	blobID := putBlob(t, &ss, NewPutReq("1h", []byte("abc")))
+
+	report, err := Check(b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsClean() {
+		t.Fatalf("expected clean store, got %v", report)
+	}
+	if !testContainer(t, &ss).HasBlobID(blobID) {
+		t.Fatalf("expected %v in container", blobID)
+	}
+}
+
+func TestRecoverTruncatedBlock(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b := newTestFSBackend(t)
+	ss := StoreService{Backend: b}
+	blobID := putBlob(t, &ss, NewPutReq("1h", []byte("abc")))
+	keptID := putBlob(t, &ss, NewPutReq("1h", []byte("def")))
+	blob, err := NewBlobFromBackend(b, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(b.blockPath(blob.Blocks[0].ID), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutBlock(BlockID(util.Sha256AsString([]byte("orphan"))), []byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ss.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.CorruptBlocks) != 1 || len(report.BrokenBlobs) != 1 ||
+		len(report.DanglingRefs) != 1 || len(report.OrphanBlocks) != 1 {
+		t.Fatalf("unexpected report: %v", report)
+	}
+	container := testContainer(t, &ss)
+	if container.HasBlobID(blobID) || !container.HasBlobID(keptID) {
+		t.Fatalf("expected only %v in container, got %v", keptID, container.BlobIDs)
+	}
+	if _, ok := container.Leases[blobID]; ok {
+		t.Fatalf("expected lease for %v to be removed", blobID)
+	}
+
+	report, err = Check(b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsClean() {
+		t.Fatalf("expected clean store after repair, got %v", report)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b := newTestFSBackend(t)
+	tmp := b.Dir + "/blocks/.abc.tmp123"
+	err := ioutil.WriteFile(tmp, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestFSBackend(t)
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected %v to be removed", tmp)
+	}
+}
+
+func TestRecoverMigratesOcIDs(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	b := newTestFSBackend(t)
+	ocCred := cred.NewOcCred()
+	legacy, _ := cred.LegacyOcID(ocCred.ID())
+	blob := testBlob(t, "some data")
+	err := storeBlob(b, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, _ := NewContainerFromBackend(b, legacy)
+	err = container.WriteNewBlobID(b, blob.ID, &Lease{Expires: 1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := StoreService{Backend: b}
+	_, err = ss.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := b.MetaKeys(CONTAINER_TABLE)
+	if len(keys) != 1 || keys[0] != string(ocCred.ID()) {
+		t.Fatalf("expected the container under the compact ID, got %v", keys)
+	}
+	container, _ = NewContainerFromBackend(b, ocCred.ID())
+	if !container.HasBlobID(blob.ID) || container.Leases[blob.ID].Expires != 1234 ||
+		container.ID != ocIDToContainerID(ocCred.ID()) {
+		t.Fatalf("unexpected container: %v", container)
+	}
+	if !ownsContainer(ocCred.ID(), ocIDToContainerID(legacy)) {
+		t.Fatalf("expected the old container ID to still be accepted")
+	}
+	if ownsContainer(cred.NewOcCred().ID(), ocIDToContainerID(legacy)) {
+		t.Fatalf("expected another ID's container to be refused")
+	}
+}
@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const S3_DEFAULT_REGION = "us-east-1"
+
+// Keeps blocks and metadata as objects in an S3 compatible object store,
+// addressed path-style: [endpoint]/[bucket]/[key].
+type S3Backend struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// Reads credentials from the usual AWS environment variables.
+func NewS3BackendFromEnv(endpoint string, bucket string) (*S3Backend, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New(
+			"s3 backend needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = S3_DEFAULT_REGION
+	}
+	return &S3Backend{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    http.DefaultClient,
+	}, nil
+}
+
+func blockKey(id BlockID) string {
+	return "blocks/" + id.String()
+}
+
+func metaKey(table string, key string) string {
+	return "meta/" + table + "/" + key
+}
+
+func (sb *S3Backend) PutBlock(id BlockID, data []byte) error {
+	_, err := sb.do("PUT", blockKey(id), nil, data)
+	return err
+}
+
+func (sb *S3Backend) GetBlock(id BlockID) ([]byte, error) {
+	return sb.do("GET", blockKey(id), nil, nil)
+}
+
+func (sb *S3Backend) HasBlock(id BlockID) (bool, error) {
+	data, err := sb.do("HEAD", blockKey(id), nil, nil)
+	return data != nil, err
+}
+
+func (sb *S3Backend) DeleteBlock(id BlockID) error {
+	_, err := sb.do("DELETE", blockKey(id), nil, nil)
+	return err
+}
+
+func (sb *S3Backend) BlockIDs() ([]BlockID, error) {
+	keys, err := sb.list("blocks/")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]BlockID, len(keys))
+	for i, key := range keys {
+		ids[i] = BlockID(key)
+	}
+	return ids, nil
+}
+
+func (sb *S3Backend) PutMeta(table string, key string, value []byte) error {
+	_, err := sb.do("PUT", metaKey(table, key), nil, value)
+	return err
+}
+
+func (sb *S3Backend) GetMeta(table string, key string) ([]byte, error) {
+	return sb.do("GET", metaKey(table, key), nil, nil)
+}
+
+func (sb *S3Backend) DeleteMeta(table string, key string) error {
+	_, err := sb.do("DELETE", metaKey(table, key), nil, nil)
+	return err
+}
+
+func (sb *S3Backend) MetaKeys(table string) ([]string, error) {
+	return sb.list("meta/" + table + "/")
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Lists keys under prefix, with the prefix removed.
+func (sb *S3Backend) list(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := sb.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing listing: %v", err.Error())
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, prefix))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Sends a signed request. Returns nil data for objects that do not exist.
+func (sb *S3Backend) do(method string, key string, query url.Values, body []byte) ([]byte, error) {
+	path := "/" + s3Escape(sb.Bucket)
+	if key != "" {
+		parts := strings.Split(key, "/")
+		for i, part := range parts {
+			parts[i] = s3Escape(part)
+		}
+		path += "/" + strings.Join(parts, "/")
+	}
+	rawQuery := canonicalQuery(query)
+	u, err := url.Parse(sb.Endpoint + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	SignS3Request(req, path, rawQuery, body, sb.Region, sb.AccessKey,
+		sb.SecretKey, time.Now())
+
+	client := sb.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error during s3 request: %v", err.Error())
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %v %v: %v %v",
+			method, key, resp.Status, string(data))
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+// AWS signature version 4, with the payload hash sent in
+// x-amz-content-sha256 as S3 requires.
+func SignS3Request(req *http.Request, path string, rawQuery string, body []byte, region string, accessKey string, secretKey string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	signature := s3Signature(req.Method, req.URL.Host, path, rawQuery,
+		payloadHash, amzDate, region, secretKey)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, S3_SIGNED_HEADERS, signature))
+}
+
+const S3_SIGNED_HEADERS = "host;x-amz-content-sha256;x-amz-date"
+
+func s3Signature(method, host, path, rawQuery, payloadHash, amzDate, region, secretKey string) string {
+	date := amzDate[:8]
+	canonicalHeaders := "host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		method, path, rawQuery, canonicalHeaders, S3_SIGNED_HEADERS, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	k := hmacSha256([]byte("AWS4"+secretKey), []byte(date))
+	k = hmacSha256(k, []byte(region))
+	k = hmacSha256(k, []byte("s3"))
+	k = hmacSha256(k, []byte("aws4_request"))
+	return hex.EncodeToString(hmacSha256(k, []byte(stringToSign)))
+}
+
+// Checks the signature on a request signed by SignS3Request.
+func VerifyS3Request(req *http.Request, body []byte, accessKey string, secretKey string) bool {
+	auth := req.Header.Get("Authorization")
+	amzDate := req.Header.Get("X-Amz-Date")
+	if len(amzDate) < 8 || req.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		return false
+	}
+	prefix := "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + amzDate[:8] + "/"
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	region := strings.Split(strings.TrimPrefix(auth, prefix), "/")[0]
+	signature := s3Signature(req.Method, req.Host, req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()), sha256Hex(body), amzDate, region,
+		secretKey)
+	return strings.HasSuffix(auth, "Signature="+signature)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent encodes everything but unreserved characters, as SigV4 requires
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSha256(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
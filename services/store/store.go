@@ -3,16 +3,19 @@ package store
 import (
 	"time"
 	"bytes"
-	"os"
-	"io/ioutil"
 	"log"
 	"encoding/hex"
 	"encoding/json"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"sync"
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/channel"
 	"github.com/ortutay/decloud/conf"
+	"github.com/ortutay/decloud/cred"
 	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/peer"
 	"github.com/ortutay/decloud/util"
 	"github.com/ortutay/decloud/rep"
 )
@@ -30,10 +33,14 @@ const (
 	// returns [container-id] for the node
 	ALLOC_METHOD = "alloc"
 
-	// [container-id] [blob-id] optional body: [block-list]
+	// [container-id] [blob-id] [duration] optional body: [block-list]
 	// returns {ok|error|block-list-request}
 	PUT_METHOD = "put"
 
+	// [container-id] [blob-id] [duration]
+	// extends the lease on a stored blob
+	RENEW_METHOD = "renew"
+
 	// [container-id] [blob-id]
 	GET_METHOD = "get"
 
@@ -47,6 +54,12 @@ const BYTES_PER_BLOCK = 4096
 const MAX_BLOB_BYTES = 50 * 1e6 // 50 MB
 const MAX_CONTAINER_BYTES = 500 * 1e6 // 500 MB
 
+// How often stored data is billed, in seconds
+const BILLING_PERIOD = 10
+
+// Used when a put request does not specify how long to store for
+const DEFAULT_DURATION = "1h"
+
 type BlockID string
 
 func (b BlockID) String() string {
@@ -58,13 +71,6 @@ type Block struct {
 	Data []byte
 }
 
-func blockPath(id BlockID) string {
- 	dir := util.ServiceDir(SERVICE_NAME) + "/blocks"
-	err := util.MakeDir(dir)
-	util.Ferr(err)
-	return dir + "/" + id.String()
-}
-
 func NewBlock(data []byte) (*Block, error) {
 	if len(data) > BYTES_PER_BLOCK {
 		return nil, fmt.Errorf("block with size %v exceeds max %v",
@@ -112,38 +118,39 @@ func NewBlobFromReader(r io.Reader) (*Blob, error) {
 			return nil, err
 		}
 		block, err := NewBlock(buf[:n])
-		util.Ferr(err)
-		util.Ferr(err)
+		if err != nil {
+			return nil, err
+		}
 		blocks = append(blocks, block)
 	}
 	return NewBlob(blocks)
 }
 
-func NewBlobFromDisk(id BlobID) (*Blob, error) {
-	d := util.GetOrCreateDB(blobToBlocksDB())
-	idsSer, err := d.Read(id.String())
-	if idsSer == nil || len(idsSer) == 0 {
+func NewBlobFromBackend(b Backend, id BlobID) (*Blob, error) {
+	ids, err := blobBlockIDs(b, id)
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
 		return nil, fmt.Errorf("not found")
 	}
-	var ids []BlockID
-	err = json.Unmarshal(idsSer, &ids)
-	util.Ferr(err)
 	var blocks []*Block
 	for _, id := range ids {
 		block, err := func () (*Block, error) {
-			f, err := os.Open(blockPath(id))
-			defer f.Close()
+			data, err := b.GetBlock(id)
 			if err != nil {
 				return nil, err
 			}
-			data, err := ioutil.ReadAll(f)
-			if len(data) > BYTES_PER_BLOCK {
-				log.Fatalf("too big block %v of size %v", id, len(data))
+			if data == nil {
+				return nil, fmt.Errorf("missing block %v", id)
 			}
 			block, err := NewBlock(data)
-			util.Ferr(err)
+			if err != nil {
+				return nil, fmt.Errorf("corrupt block %v: %v", id, err.Error())
+			}
 			if block.ID != id {
-				log.Fatalf("mismatched id's %v != %v", id, block.ID)
+				return nil, fmt.Errorf("corrupt block %v: data hashes to %v",
+					id, block.ID)
 			}
 			return block, nil
 		}()
@@ -185,33 +192,90 @@ func (c ContainerID) String() string {
 	return string(c)
 }
 
+// A Lease records how long a blob is to be stored, and how much the owner
+// has agreed to pay for it.
+type Lease struct {
+	Expires     int64             `json:"expires"`
+	PaymentType msg.PaymentType   `json:"paymentType,omitempty"`
+	Budget      *msg.PaymentValue `json:"budget,omitempty"`
+	Charged     int64             `json:"charged"`
+}
+
+func (l *Lease) IsExpired(now int64) bool {
+	return l.Expires != 0 && now >= l.Expires
+}
+
+func (l *Lease) IsOverBudget() bool {
+	return l.Budget != nil && l.Charged >= l.Budget.Amount
+}
+
+// Whether the budget was paid up front, rather than billed as used.
+func (l *Lease) IsPrepaid() bool {
+	return l.PaymentType == msg.ATTACHED || l.PaymentType == msg.CHANNEL
+}
+
+func (l *Lease) Extend(now int64, d time.Duration) {
+	if l.Expires < now {
+		l.Expires = now
+	}
+	l.Expires += int64(d.Seconds())
+}
+
 type Container struct {
 	ID ContainerID `json:"id"`
 	OwnerID msg.OcID `json:"ownerId"`
 	BlobIDs []BlobID `json:"blobIds"`
+	Leases map[BlobID]*Lease `json:"leases,omitempty"`
 }
 
-func NewContainerFromDisk(id msg.OcID) *Container {
-	d := util.GetOrCreateDB(containersDB())
+func NewContainerFromBackend(b Backend, id msg.OcID) (*Container, error) {
 	containerID := ocIDToContainerID(id)
-	ser, _ := d.Read(id.String())
+	ser, err := b.GetMeta(CONTAINER_TABLE, id.String())
+	if err != nil {
+		return nil, err
+	}
 	if ser == nil || len(ser) == 0 {
-		return &Container{ID: containerID, OwnerID: id}
+		return &Container{ID: containerID, OwnerID: id}, nil
 	} else {
 		var container Container
 		err := json.Unmarshal(ser, &container)
-		util.Ferr(err)
-		return &container
+		if err != nil {
+			return nil, fmt.Errorf("error while reading container: %v", err.Error())
+		}
+		return &container, nil
 	}
 }
 
-func (c *Container) WriteNewBlobID(id BlobID) {
-	d := util.GetOrCreateDB(containersDB())
+func (c *Container) WriteNewBlobID(b Backend, id BlobID, lease *Lease) error {
 	c.BlobIDs = append(c.BlobIDs, id)
-	blobIDsSer, err := json.Marshal(c)
-	util.Ferr(err)
-	err = d.Write(c.OwnerID.String(), blobIDsSer)
-	util.Ferr(err)
+	c.SetLease(id, lease)
+	return c.Write(b)
+}
+
+func (c *Container) SetLease(id BlobID, lease *Lease) {
+	if c.Leases == nil {
+		c.Leases = make(map[BlobID]*Lease)
+	}
+	c.Leases[id] = lease
+}
+
+func (c *Container) RemoveBlobID(targetID BlobID) {
+	blobIDs := make([]BlobID, 0)
+	for _, id := range c.BlobIDs {
+		if id != targetID {
+			blobIDs = append(blobIDs, id)
+		}
+	}
+	c.BlobIDs = blobIDs
+	delete(c.Leases, targetID)
+}
+
+func (c *Container) Write(b Backend) error {
+	ser, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return b.PutMeta(CONTAINER_TABLE, c.OwnerID.String(), ser)
 }
 
 func (c *Container) HasBlobID(targetID BlobID) bool {
@@ -223,10 +287,6 @@ func (c *Container) HasBlobID(targetID BlobID) bool {
 	return false
 }
 
-func containersDB() string {
- 	return util.ServiceDir(SERVICE_NAME) + "/containers.db"
-}
-
 type WorkPut struct {
 	Blocks  int `json:"blocks"`
 	Seconds int `json:"seconds"`
@@ -264,12 +324,30 @@ func (wp *WorkHash) Quote() *msg.PaymentValue {
 	return nil
 }
 
-func NewPutReq() *msg.OcReq {
-	return nil
+func NewPutReq(duration string, body []byte) *msg.OcReq {
+	req := msg.OcReq{
+		Service: SERVICE_NAME,
+		Method:  PUT_METHOD,
+		Args:    []string{".", ".", duration},
+	}
+	req.SetBody(body)
+	return &req
 }
 
-func NewGetReq() *msg.OcReq {
-	return nil
+func NewRenewReq(blobID BlobID, duration string) *msg.OcReq {
+	return &msg.OcReq{
+		Service: SERVICE_NAME,
+		Method:  RENEW_METHOD,
+		Args:    []string{".", blobID.String(), duration},
+	}
+}
+
+func NewGetReq(blobID BlobID) *msg.OcReq {
+	return &msg.OcReq{
+		Service: SERVICE_NAME,
+		Method:  GET_METHOD,
+		Args:    []string{".", blobID.String()},
+	}
 }
 
 func NewHashReq() *msg.OcReq {
@@ -278,7 +356,43 @@ func NewHashReq() *msg.OcReq {
 
 type StoreService struct {
 	Conf *conf.Conf
+	// Where blocks and indexes are kept; if nil, opened from Conf on first use
+	Backend Backend
+	// Used to check balances of clients storing without a budget; if nil,
+	// such leases run until their term is up.
+	Btc btc.Backend
 	lastWake int64
+
+	locksMu sync.Mutex
+	locks   map[msg.OcID]*sync.Mutex
+}
+
+// Locks id's container, so puts, renewals and wakes reading and writing it
+// don't drop each other's changes. Returns the unlock function.
+func (ss *StoreService) lockContainer(id msg.OcID) func() {
+	ss.locksMu.Lock()
+	if ss.locks == nil {
+		ss.locks = make(map[msg.OcID]*sync.Mutex)
+	}
+	l, ok := ss.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		ss.locks[id] = l
+	}
+	ss.locksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (ss *StoreService) backend() (Backend, error) {
+	if ss.Backend == nil {
+		b, err := NewBackendFromConf(ss.Conf)
+		if err != nil {
+			return nil, fmt.Errorf("error while opening backend: %v", err.Error())
+		}
+		ss.Backend = b
+	}
+	return ss.Backend, nil
 }
 
 func (ss *StoreService) Handle(req *msg.OcReq) (*msg.OcResp, error) {
@@ -286,10 +400,14 @@ func (ss *StoreService) Handle(req *msg.OcReq) (*msg.OcResp, error) {
 	if req.Service != SERVICE_NAME {
 		panic(fmt.Sprintf("unexpected service %s", req.Service))
 	}
+	if _, err := ss.backend(); err != nil {
+		return nil, err
+	}
 
 	methods := make(map[string]func(*msg.OcReq) (*msg.OcResp, error))
 	methods[ALLOC_METHOD] = ss.alloc
 	methods[PUT_METHOD] = ss.put
+	methods[RENEW_METHOD] = ss.renew
 	methods[GET_METHOD] = ss.get
 
 	if method, ok := methods[req.Method]; ok {
@@ -305,41 +423,79 @@ func costForBytesSeconds(bytes int, seconds int) *msg.PaymentValue {
 }
 
 func (ss *StoreService) PeriodicWake() {
-	now := time.Now().Unix()
+	ss.wake(time.Now().Unix())
+}
+
+func (ss *StoreService) wake(now int64) {
 	if ss.lastWake == 0 {
 		ss.lastWake = now
 	}
-	period := int64(10)
+	period := int64(BILLING_PERIOD)
 	if now - ss.lastWake < period {
 		return
 	}
 	ss.lastWake = now
-	d := util.GetOrCreateDB(containersDB())
-	keys := d.Keys()
-	for {
-		key := <-keys
-		if len(key) == 0 {
-			break
+	b, err := ss.backend()
+	if err != nil {
+		log.Printf("%v\n", err)
+		return
+	}
+	keys, err := b.MetaKeys(CONTAINER_TABLE)
+	if err != nil {
+		log.Printf("error while listing containers: %v\n", err)
+		return
+	}
+	for _, key := range keys {
+		ss.wakeContainer(b, msg.OcID(key), now, period)
+	}
+}
+
+func (ss *StoreService) wakeContainer(b Backend, id msg.OcID, now int64, period int64) {
+	defer ss.lockContainer(id)()
+	bytesUsed := 0
+	deferredCost := int64(0)
+	container, err := NewContainerFromBackend(b, id)
+	if err != nil {
+		log.Printf("error while reading container %v: %v\n", id, err)
+		return
+	}
+	seenBlocks := make(map[string]bool)
+	expired := make([]BlobID, 0)
+	for _, blobID := range container.BlobIDs {
+		// TODO(ortutay): don't read blocks from disk just to find sizes
+		blob, err := NewBlobFromBackend(b, blobID)
+		if err != nil {
+			continue
 		}
-		bytesUsed := 0
-		id := msg.OcID(key)
-		container := NewContainerFromDisk(id)
-		seenBlocks := make(map[string]bool)
-		for _, blobID := range container.BlobIDs {
-			// TODO(ortutay): don't read blocks from disk just to find sizes
-			blob, err := NewBlobFromDisk(blobID)
-			if err != nil {
+		blobBytes := 0
+		for _, block := range blob.Blocks {
+			if _, ok := seenBlocks[block.ID.String()]; ok {
 				continue
 			}
-			for _, block := range blob.Blocks {
-				if _, ok := seenBlocks[block.ID.String()]; ok {
-					continue
-				}
-				seenBlocks[block.ID.String()] = true
-				bytesUsed += len(block.Data)
-			}
+			seenBlocks[block.ID.String()] = true
+			blobBytes += len(block.Data)
+		}
+		bytesUsed += blobBytes
+		costPv := costForBytesSeconds(blobBytes, int(period))
+		lease := container.Leases[blobID]
+		if lease == nil {
+			// Stored before leases existed; bill as deferred, keep forever
+			deferredCost += costPv.Amount
+			continue
+		}
+		lease.Charged += costPv.Amount
+		if !lease.IsPrepaid() {
+			// Prepaid leases were recorded in full at put time
+			deferredCost += costPv.Amount
 		}
-		costPv := costForBytesSeconds(bytesUsed, int(period))
+		if lease.IsExpired(now) || lease.IsOverBudget() {
+			expired = append(expired, blobID)
+		} else if lease.Budget == nil && ss.creditExhausted(id) {
+			expired = append(expired, blobID)
+		}
+	}
+	if deferredCost != 0 {
+		costPv := msg.PaymentValue{Amount: deferredCost, Currency: msg.BTC}
 		fmt.Printf("bytes %v used by %v..., cost += %f %v\n",
 			bytesUsed, id.String()[:8], util.S2B(costPv.Amount), costPv.Currency)
 		rec := rep.Record{
@@ -349,11 +505,45 @@ func (ss *StoreService) PeriodicWake() {
 			Timestamp: int(now),
 			ID: id,
 			Status: rep.SUCCESS_UNPAID,
-			PaymentValue: costPv,
+			PaymentType: msg.DEFER,
+			PaymentValue: &costPv,
 			Perf: nil,
 		}
 		rep.Put(&rec)
 	}
+	for _, blobID := range expired {
+		fmt.Printf("lease on %v for %v... is up, removing\n",
+			blobID, id.String()[:8])
+		container.RemoveBlobID(blobID)
+	}
+	err = container.Write(b)
+	if err != nil {
+		log.Printf("error while writing container %v: %v\n", id, err)
+		return
+	}
+	for _, blobID := range expired {
+		err := gcBlob(b, blobID)
+		if err != nil {
+			log.Printf("error while collecting %v: %v\n", blobID, err)
+		}
+	}
+}
+
+func (ss *StoreService) creditExhausted(id msg.OcID) bool {
+	if ss.Btc == nil || ss.Conf == nil {
+		return false
+	}
+	maxBalance, err := ss.Conf.PolicyForCmd(conf.MAX_BALANCE)
+	if err != nil || maxBalance == nil {
+		return false
+	}
+	p := peer.Peer{ID: id}
+	balance, err := p.Balance(ss.Conf.MinConf(id), ss.Btc)
+	if err != nil {
+		log.Printf("error while getting balance for %v: %v\n", id, err)
+		return false
+	}
+	return balance.Amount > maxBalance.Args[0].(*msg.PaymentValue).Amount
 }
 
 func (ss *StoreService) quote(req *msg.OcReq) (*msg.OcResp, error) {
@@ -364,42 +554,237 @@ func ocIDToContainerID(id msg.OcID) ContainerID {
 	return ContainerID(util.Sha256AsString([]byte(id.String())))
 }
 
+// Whether containerID is id's container. Clients may still use the container
+// ID they were given under the long form of their ID.
+func ownsContainer(id msg.OcID, containerID ContainerID) bool {
+	if containerID == ocIDToContainerID(id) {
+		return true
+	}
+	legacyID, err := cred.LegacyOcID(id)
+	return err == nil && containerID == ocIDToContainerID(legacyID)
+}
+
 func (ss *StoreService) alloc(req *msg.OcReq) (*msg.OcResp, error) {
 	// TODO(ortutay): may want multiple contianers per client
 	id := ocIDToContainerID(req.ID)
 	return msg.NewRespOk([]byte(id.String())), nil
 }
 
-func blobToBlocksDB() string {
- 	return util.ServiceDir(SERVICE_NAME) + "/blob-to-blocks.db"
-}
-
-func storeBlob(blob *Blob) error {
-	// TODO(ortutay): in the case of a failed write, we need to garbage collect
+// Writes blocks before the block list, so a stored block list always refers
+// to complete blocks. Callers journal the write so a partial one is undone.
+func storeBlob(b Backend, blob *Blob) error {
 	for _, block := range blob.Blocks {
-		path := blockPath(block.ID)
-		if _, err := os.Stat(path); err == nil {
+		if has, err := b.HasBlock(block.ID); err != nil {
+			return err
+		} else if has {
 			continue
 		}
-		func () {
-			f, err := os.Create(path)
-			defer f.Close()
-			util.Ferr(err)
-			_, err = f.Write(block.Data)
-			util.Ferr(err)
-		}()
+		err := b.PutBlock(block.ID, block.Data)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Write blob -> blocks mapping
 	ids := blob.BlockIDs()
-	d := util.GetOrCreateDB(blobToBlocksDB())
 	ser, err := json.Marshal(ids)
-	util.Ferr(err)
-	err = d.Write(blob.ID.String(), ser)
-	util.Ferr(err)
+	if err != nil {
+		return err
+	}
+	return b.PutMeta(BLOB_TABLE, blob.ID.String(), ser)
+}
+
+// Removes a blob, and any of its blocks, that are no longer referenced by any
+// container.
+func gcBlob(b Backend, id BlobID) error {
+	referenced, err := isBlobReferenced(b, id)
+	if err != nil || referenced {
+		return err
+	}
+	ids, err := blobBlockIDs(b, id)
+	if err != nil {
+		return err
+	}
+	if ids == nil {
+		return fmt.Errorf("not found")
+	}
+	err = b.DeleteMeta(BLOB_TABLE, id.String())
+	if err != nil {
+		return err
+	}
+	return deleteUnreferencedBlocks(b, ids)
+}
+
+func isBlobReferenced(b Backend, id BlobID) (bool, error) {
+	keys, err := b.MetaKeys(CONTAINER_TABLE)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		container, err := NewContainerFromBackend(b, msg.OcID(key))
+		if err != nil {
+			return false, err
+		}
+		if container.HasBlobID(id) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reads a blob's block list without reading the blocks. Returns nil if the
+// blob is not stored.
+func blobBlockIDs(b Backend, id BlobID) ([]BlockID, error) {
+	ser, err := b.GetMeta(BLOB_TABLE, id.String())
+	if err != nil || ser == nil {
+		return nil, err
+	}
+	var ids []BlockID
+	err = json.Unmarshal(ser, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt block list for %v: %v", id, err.Error())
+	}
+	return ids, nil
+}
+
+// Deletes those of the given blocks that no stored blob refers to.
+func deleteUnreferencedBlocks(b Backend, ids []BlockID) error {
+	// TODO(ortutay): keep block reference counts instead of scanning
+	inUse := make(map[BlockID]bool)
+	blobKeys, err := b.MetaKeys(BLOB_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, key := range blobKeys {
+		blobIDs, err := blobBlockIDs(b, BlobID(key))
+		if err != nil {
+			continue
+		}
+		for _, blockID := range blobIDs {
+			inUse[blockID] = true
+		}
+	}
+	for _, blockID := range ids {
+		if inUse[blockID] {
+			continue
+		}
+		err := b.DeleteBlock(blockID)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Builds the lease for a put request. The payment attached to the request, if
+// any, is the budget for storing the blob. An attached transaction is checked
+// here, but not broadcast until recordPrepaidLease; likewise a channel update
+// is not accepted until then. Returns an error response if the payment can't
+// be taken.
+func (ss *StoreService) newLeaseFromReq(req *msg.OcReq, d time.Duration) (*Lease, *btc.Txn, *msg.OcResp) {
+	lease := Lease{}
+	lease.Extend(time.Now().Unix(), d)
+	if req.PaymentValue == nil {
+		return &lease, nil, nil
+	}
+	if req.PaymentValue.Currency != msg.BTC {
+		return nil, nil, msg.NewRespError(msg.CURRENCY_UNSUPPORTED)
+	}
+	var txn *btc.Txn
+	switch req.PaymentType {
+	case msg.DEFER:
+	case msg.ATTACHED:
+		if ss.Btc == nil {
+			return nil, nil, msg.NewRespError(msg.SERVER_ERROR)
+		}
+		// Paying the peer's own addresses credits their balance, offsetting
+		// the prepaid amount recorded against it
+		p := peer.Peer{ID: req.ID}
+		addrs := p.PaymentAddrs()
+		if len(addrs) == 0 {
+			// The peer has nowhere to pay yet; give it an address
+			addr, err := p.PaymentAddr(-1, ss.Btc)
+			if err != nil {
+				log.Printf("error while making payment address: %v\n", err)
+				return nil, nil, msg.NewRespError(msg.SERVER_ERROR)
+			}
+			return nil, nil, msg.NewRespErrorWithBody(msg.PAYMENT_REQUIRED, []byte(addr))
+		}
+		var err error
+		txn, err = btc.CheckTxn(req.PaymentTxn, req.PaymentValue, addrs, ss.Btc)
+		if err != nil {
+			log.Printf("attached txn from %v not accepted: %v\n", req.ID, err)
+			return nil, nil, msg.NewRespError(btc.StatusForTxnError(err))
+		}
+	case msg.CHANNEL:
+		if ss.Btc == nil {
+			return nil, nil, msg.NewRespError(msg.SERVER_ERROR)
+		}
+		_, err := channel.DecodeUpdate(req.PaymentTxn)
+		if err != nil {
+			return nil, nil, msg.NewRespError(channel.StatusForError(err))
+		}
+	default:
+		return nil, nil, msg.NewRespError(msg.BAD_REQUEST)
+	}
+	budget := msg.PaymentValue(*req.PaymentValue)
+	lease.PaymentType = req.PaymentType
+	lease.Budget = &budget
+	return &lease, txn, nil
+}
+
+// Broadcasts the transaction, or accepts the channel update, paying for a
+// prepaid lease, and records the outcome.
+func (ss *StoreService) recordPrepaidLease(req *msg.OcReq, lease *Lease, txn *btc.Txn) error {
+	var status rep.Status = rep.SUCCESS_PAID
+	var submitErr error
+	switch lease.PaymentType {
+	case msg.ATTACHED:
+		submitErr = btc.SubmitTxn(txn, ss.Btc)
+		if submitErr != nil {
+			status = rep.FAILURE
+		}
+	case msg.CHANNEL:
+		u, err := channel.DecodeUpdate(req.PaymentTxn)
+		if err != nil {
+			return err
+		}
+		// A rejected update pays nothing, so is not recorded
+		_, err = channel.Accept(ss.Btc, req.ID, u, lease.Budget.Amount)
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	rec := rep.Record{
+		Role:         rep.SERVER,
+		Service:      SERVICE_NAME,
+		Method:       req.Method,
+		Timestamp:    int(time.Now().Unix()),
+		ID:           req.ID,
+		Status:       status,
+		PaymentType:  lease.PaymentType,
+		PaymentValue: lease.Budget,
+		Perf:         nil,
+	}
+	if txn != nil {
+		rec.Txid = txn.Txid
+	}
+	_, err := rep.Put(&rec)
+	if err != nil {
+		return err
+	}
+	return submitErr
+}
+
+func statusForPaymentError(err error) msg.OcRespStatus {
+	if _, ok := err.(channel.ChannelError); ok {
+		return channel.StatusForError(err)
+	}
+	return btc.StatusForTxnError(err)
+}
+
 func updateIndexes(cont *Container) error {
 	fmt.Printf("updateIndexes\n")
 	return nil
@@ -408,6 +793,11 @@ func updateIndexes(cont *Container) error {
 func (ss *StoreService) put(req *msg.OcReq) (*msg.OcResp, error) {
 	var containerID ContainerID
 	var blobID BlobID
+	duration := DEFAULT_DURATION
+	if len(req.Args) == 3 {
+		duration = req.Args[2]
+		req.Args = req.Args[:2]
+	}
 	if len(req.Args) == 0 {
 		containerID = ocIDToContainerID(req.ID)
 		// blob will be read from request
@@ -424,21 +814,35 @@ func (ss *StoreService) put(req *msg.OcReq) (*msg.OcResp, error) {
 		} else {
 			containerID = ContainerID(req.Args[0])
 		}
-		blobID = BlobID(req.Args[1])
+		if req.Args[1] != "." {
+			blobID = BlobID(req.Args[1])
+		}
 	} else {
 		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
 	}
 
-	if containerID != ocIDToContainerID(req.ID) {
+	if !ownsContainer(req.ID, containerID) {
 		resp := msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
 			[]byte("Cannot access that container"))
 		return resp, nil
 	}
 
+	d, err := util.DurationParseString(duration)
+	if err != nil || d <= 0 {
+		return msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
+			[]byte(fmt.Sprintf("Invalid duration %v", duration))), nil
+	}
+	lease, txn, resp := ss.newLeaseFromReq(req, d)
+	if resp != nil {
+		return resp, nil
+	}
+
 	fmt.Printf("put request for: %v %v\n", containerID, blobID)
+	defer ss.lockContainer(req.ID)()
 
 	// Store blob if it is new
-	blob, err := NewBlobFromDisk(blobID)
+	var journal *JournalEntry
+	blob, err := NewBlobFromBackend(ss.Backend, blobID)
 	if blob == nil {
 		if req.Body == nil || len(req.Body) == 0 {
 			// TODO(ortutay): Neither "OK" nor "error" are appropriate status codes
@@ -456,24 +860,154 @@ func (ss *StoreService) put(req *msg.OcReq) (*msg.OcResp, error) {
 		if err != nil {
 			return msg.NewRespError(msg.SERVER_ERROR), nil
 		}
-		err := storeBlob(blob)
+		journal, err = beginPut(ss.Backend, req.ID, blob)
 		if err != nil {
+			log.Printf("%v\n", err)
+			return msg.NewRespError(msg.SERVER_ERROR), nil
+		}
+		err = storeBlob(ss.Backend, blob)
+		if err != nil {
+			log.Printf("error while storing blob %v: %v\n", blob.ID, err)
+			ss.rollbackPut(journal)
 			return msg.NewRespError(msg.SERVER_ERROR), nil
 		}
 	}
-	
+
 	// Append blob-id to container-id
-	container := NewContainerFromDisk(req.ID)
-	for _, id := range container.BlobIDs {
-		if id == blob.ID {
-			return msg.NewRespOk([]byte("")), nil
+	container, err := NewContainerFromBackend(ss.Backend, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if container.HasBlobID(blob.ID) {
+		// Already stored; the duration and payment go to its lease, as in renew
+		ss.finishPut(journal)
+		_, resp := extendLease(container, blob.ID, lease, d)
+		if resp != nil {
+			return resp, nil
+		}
+		err = ss.recordPrepaidLease(req, lease, txn)
+		if err != nil {
+			log.Printf("error while recording payment: %v\n", err)
+			return msg.NewRespError(statusForPaymentError(err)), nil
+		}
+		err = container.Write(ss.Backend)
+		if err != nil {
+			return nil, err
 		}
+		return msg.NewRespOk([]byte(blob.ID.String())), nil
+	}
+	err = ss.recordPrepaidLease(req, lease, txn)
+	if err != nil {
+		log.Printf("error while recording payment: %v\n", err)
+		ss.rollbackPut(journal)
+		return msg.NewRespError(statusForPaymentError(err)), nil
 	}
-	container.WriteNewBlobID(blob.ID)
+	err = container.WriteNewBlobID(ss.Backend, blob.ID, lease)
+	if err != nil {
+		ss.rollbackPut(journal)
+		return nil, err
+	}
+	ss.finishPut(journal)
 
 	return msg.NewRespOk([]byte(blob.ID.String())), nil
 }
 
+// Journal errors are logged rather than returned; an entry left behind is
+// resolved by the next Recover.
+func (ss *StoreService) finishPut(journal *JournalEntry) {
+	if journal == nil {
+		return
+	}
+	if err := journal.finish(ss.Backend); err != nil {
+		log.Printf("error while clearing journal for %v: %v\n", journal.BlobID, err)
+	}
+}
+
+func (ss *StoreService) rollbackPut(journal *JournalEntry) {
+	if journal == nil {
+		return
+	}
+	if err := journal.rollback(ss.Backend); err != nil {
+		log.Printf("error while rolling back %v: %v\n", journal.BlobID, err)
+	}
+}
+
+// Extends blobID's lease in container by d, adding the budget paid for extra.
+// Returns an error response if extra's payment can't go to the lease.
+func extendLease(container *Container, blobID BlobID, extra *Lease, d time.Duration) (*Lease, *msg.OcResp) {
+	lease := container.Leases[blobID]
+	if extra.Budget != nil && lease != nil && lease.Budget != nil &&
+		lease.PaymentType != extra.PaymentType {
+		return nil, msg.NewRespErrorWithBody(msg.BAD_REQUEST,
+			[]byte("Cannot change payment type of lease"))
+	}
+	if lease == nil {
+		lease = &Lease{}
+		container.SetLease(blobID, lease)
+	}
+	lease.Extend(time.Now().Unix(), d)
+	if extra.Budget != nil {
+		if lease.Budget == nil {
+			lease.Budget = &msg.PaymentValue{Amount: lease.Charged, Currency: msg.BTC}
+		}
+		lease.PaymentType = extra.PaymentType
+		lease.Budget.Amount += extra.Budget.Amount
+	}
+	return lease, nil
+}
+
+func (ss *StoreService) renew(req *msg.OcReq) (*msg.OcResp, error) {
+	if len(req.Args) != 3 {
+		return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+	}
+	if req.Args[0] != "." &&
+		!ownsContainer(req.ID, ContainerID(req.Args[0])) {
+		resp := msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
+			[]byte("Cannot access that container"))
+		return resp, nil
+	}
+	blobID := BlobID(req.Args[1])
+	d, err := util.DurationParseString(req.Args[2])
+	if err != nil || d <= 0 {
+		return msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
+			[]byte(fmt.Sprintf("Invalid duration %v", req.Args[2]))), nil
+	}
+
+	defer ss.lockContainer(req.ID)()
+	container, err := NewContainerFromBackend(ss.Backend, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !container.HasBlobID(blobID) {
+		resp := msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
+			[]byte("Cannot access that blob"))
+		return resp, nil
+	}
+	extra, txn, resp := ss.newLeaseFromReq(req, d)
+	if resp != nil {
+		return resp, nil
+	}
+	lease, resp := extendLease(container, blobID, extra, d)
+	if resp != nil {
+		return resp, nil
+	}
+	err = ss.recordPrepaidLease(req, extra, txn)
+	if err != nil {
+		log.Printf("error while recording payment: %v\n", err)
+		return msg.NewRespError(statusForPaymentError(err)), nil
+	}
+	err = container.Write(ss.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return msg.NewRespError(msg.SERVER_ERROR), nil
+	}
+	return msg.NewRespOk(body), nil
+}
+
 // func (ss *StoreService) diff(req *msg.OcReq) (*msg.OcResp, error) {
 // 	return nil, nil
 // }
@@ -497,20 +1031,23 @@ func (ss *StoreService) get(req *msg.OcReq) (*msg.OcResp, error) {
 
 	fmt.Printf("get %v %v\n", containerID, blobID)
 
-	if containerID != ocIDToContainerID(req.ID) {
+	if !ownsContainer(req.ID, containerID) {
 		resp := msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
 			[]byte("Cannot access that container"))
 		return resp, nil
 	}
 
-	container := NewContainerFromDisk(req.ID)
+	container, err := NewContainerFromBackend(ss.Backend, req.ID)
+	if err != nil {
+		return nil, err
+	}
 	if !container.HasBlobID(blobID) {
 		resp := msg.NewRespErrorWithBody(msg.INVALID_ARGUMENTS,
 			[]byte("Cannot access that blob"))
 		return resp, nil
 	}
 
-	blob, err := NewBlobFromDisk(blobID)
+	blob, err := NewBlobFromBackend(ss.Backend, blobID)
 	if err != nil {
 		return msg.NewRespError(msg.SERVER_ERROR), nil
 	}
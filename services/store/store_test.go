@@ -5,7 +5,12 @@ import (
 	"os"
 	"testing"
 	"strings"
+	"time"
+	"github.com/ortutay/decloud/btc"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/rep"
 	"github.com/ortutay/decloud/testutil"
+	"github.com/ortutay/decloud/util"
 )
 
 func TestStoreBlob(t *testing.T) {
@@ -15,8 +20,15 @@ func TestStoreBlob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	storeBlob(blob)
-	blob2, err := NewBlobFromDisk(blob.ID)
+	b, err := NewFSBackend(util.ServiceDir(SERVICE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storeBlob(b, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob2, err := NewBlobFromBackend(b, blob.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,3 +41,182 @@ func TestStoreBlob(t *testing.T) {
 	// TODO(ortutay): verify that files were written
 	// TODO(ortutay): verify only 2 files were written
 }
+
+// Longer than 8 chars, since the service logs ID prefixes
+var testOcID = msg.OcID("ctest-id-123")
+
+func putBlob(t *testing.T, ss *StoreService, req *msg.OcReq) BlobID {
+	req.ID = testOcID
+	resp, err := ss.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	return BlobID(resp.Body)
+}
+
+func testContainer(t *testing.T, ss *StoreService) *Container {
+	container, err := NewContainerFromBackend(ss.Backend, testOcID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return container
+}
+
+func TestLeaseExpires(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	blobID := putBlob(t, &ss, NewPutReq("25s", []byte("abc")))
+	container := testContainer(t, &ss)
+	if !container.HasBlobID(blobID) {
+		t.Fatalf("expected %v in container", blobID)
+	}
+
+	now := time.Now().Unix()
+	ss.wake(now)
+	ss.wake(now + BILLING_PERIOD)
+	container = testContainer(t, &ss)
+	if !container.HasBlobID(blobID) {
+		t.Fatalf("expected %v in container", blobID)
+	}
+	if container.Leases[blobID].Charged == 0 {
+		t.Fatalf("expected lease to be charged")
+	}
+
+	ss.wake(now + 3*BILLING_PERIOD)
+	container = testContainer(t, &ss)
+	if container.HasBlobID(blobID) {
+		t.Fatalf("expected %v to have expired", blobID)
+	}
+	if _, err := NewBlobFromBackend(ss.Backend, blobID); err == nil {
+		t.Fatalf("expected %v to be removed from disk", blobID)
+	}
+}
+
+func TestLeaseOverBudget(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	req := NewPutReq("1h", []byte("abc"))
+	req.AttachDeferredPayment(&msg.PaymentValue{Amount: 1000, Currency: msg.BTC})
+	blobID := putBlob(t, &ss, req)
+
+	now := time.Now().Unix()
+	ss.wake(now)
+	ss.wake(now + BILLING_PERIOD)
+	container := testContainer(t, &ss)
+	if container.HasBlobID(blobID) {
+		t.Fatalf("expected %v to have expired", blobID)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	blobID := putBlob(t, &ss, NewPutReq("25s", []byte("abc")))
+	before := testContainer(t, &ss).Leases[blobID].Expires
+
+	req := NewRenewReq(blobID, "1h")
+	req.ID = testOcID
+	resp, err := ss.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.OK {
+		t.Fatalf("expected OK, got %v", resp.Status)
+	}
+	after := testContainer(t, &ss).Leases[blobID].Expires
+	if after != before+3600 {
+		t.Fatalf("expected expiry %v, got %v", before+3600, after)
+	}
+
+	now := time.Now().Unix()
+	ss.wake(now)
+	ss.wake(now + 3*BILLING_PERIOD)
+	if !testContainer(t, &ss).HasBlobID(blobID) {
+		t.Fatalf("expected %v in container", blobID)
+	}
+}
+
+func TestPutExistingExtendsLease(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	blobID := putBlob(t, &ss, NewPutReq("25s", []byte("abc")))
+	before := testContainer(t, &ss).Leases[blobID]
+
+	req := NewPutReq("1h", []byte("abc"))
+	req.AttachDeferredPayment(&msg.PaymentValue{Amount: 1000, Currency: msg.BTC})
+	if putBlob(t, &ss, req) != blobID {
+		t.Fatalf("expected the same blob")
+	}
+	after := testContainer(t, &ss).Leases[blobID]
+	if after.Expires != before.Expires+3600 {
+		t.Fatalf("expected expiry %v, got %v", before.Expires+3600, after.Expires)
+	}
+	if after.Budget == nil || after.Budget.Amount != 1000 || after.PaymentType != msg.DEFER {
+		t.Fatalf("expected the payment to go to the lease, got %+v", after)
+	}
+}
+
+func TestPutAttachedNoAddr(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	chain := btc.NewFakeChain()
+	ss := StoreService{Btc: chain.NewWallet("server")}
+	req := NewPutReq("1h", []byte("abc"))
+	req.ID = testOcID
+	req.PaymentType = msg.ATTACHED
+	req.PaymentValue = &msg.PaymentValue{Amount: 1000, Currency: msg.BTC}
+	resp, err := ss.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != msg.PAYMENT_REQUIRED || len(resp.Body) == 0 {
+		t.Fatalf("expected %v with an address, got %v", msg.PAYMENT_REQUIRED, resp.Status)
+	}
+}
+
+func TestWakeDuringPuts(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	putBlob(t, &ss, NewPutReq("1h", []byte("first")))
+
+	now := time.Now().Unix()
+	ss.wake(now)
+	done := make(chan BlobID)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			done <- putBlob(t, &ss, NewPutReq("1h", []byte(fmt.Sprintf("blob %v", i))))
+		}(i)
+	}
+	for i := 1; i <= 10; i++ {
+		ss.wake(now + int64(i)*BILLING_PERIOD)
+	}
+	for i := 0; i < 10; i++ {
+		blobID := <-done
+		if !testContainer(t, &ss).HasBlobID(blobID) {
+			t.Fatalf("expected %v in container", blobID)
+		}
+	}
+}
+
+func TestWakeSkipsZeroCost(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	ss := StoreService{}
+	putBlob(t, &ss, NewPutReq("25s", []byte("abc")))
+
+	now := time.Now().Unix()
+	ss.wake(now)
+	ss.wake(now + 3*BILLING_PERIOD)
+	sel := rep.Record{Role: rep.SERVER, Service: SERVICE_NAME, ID: testOcID}
+	before, err := rep.Count(&sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The container is empty now
+	ss.wake(now + 4*BILLING_PERIOD)
+	after, _ := rep.Count(&sel)
+	if after != before {
+		t.Fatalf("expected no records for an empty container, got %v", after-before)
+	}
+}
@@ -0,0 +1,246 @@
+package stripe
+
+// Stripes a file across several store servers. The file is Reed-Solomon
+// encoded into N shards, each of which is put on a different server. Any K
+// servers are enough to get the file back. A manifest recording where each
+// shard went is kept locally.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ortutay/decloud/erasure"
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/services/store"
+	"github.com/ortutay/decloud/util"
+)
+
+// Sends a signed request to the server at addr; satisfied by node.Client.
+type Sender interface {
+	SignAndSend(addr string, req *msg.OcReq) (*msg.OcResp, error)
+}
+
+type Shard struct {
+	Index  int          `json:"index"`
+	Addr   string       `json:"addr"`
+	BlobID store.BlobID `json:"blobId"`
+}
+
+type Manifest struct {
+	Name     string  `json:"name"`
+	Size     int     `json:"size"`
+	K        int     `json:"k"`
+	N        int     `json:"n"`
+	Duration string  `json:"duration"`
+	Created  int64   `json:"created"`
+	Shards   []Shard `json:"shards"`
+}
+
+var DUPLICATE_ADDR = errors.New("each shard must go to a different server")
+
+func manifestDBPath() string {
+	return util.AppDir() + "/stripe-manifests.db"
+}
+
+func (m *Manifest) Store() error {
+	ser, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	d := util.GetOrCreateDB(manifestDBPath())
+	return d.Write(manifestKey(m.Name), ser)
+}
+
+func LoadManifest(name string) (*Manifest, error) {
+	d := util.GetOrCreateDB(manifestDBPath())
+	ser, _ := d.Read(manifestKey(name))
+	if ser == nil || len(ser) == 0 {
+		return nil, fmt.Errorf("no manifest for %v", name)
+	}
+	var m Manifest
+	err := json.Unmarshal(ser, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading manifest: %v", err.Error())
+	}
+	return &m, nil
+}
+
+// Names may contain characters that aren't safe in filenames
+func manifestKey(name string) string {
+	return util.Sha256AsString([]byte(name))
+}
+
+// Encodes data into len(addrs) shards, any k of which can rebuild it, and puts
+// one shard on each server. The servers must all differ, or losing one could
+// lose more than one shard.
+func Put(s Sender, name string, data []byte, k int, addrs []string, duration string) (*Manifest, error) {
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			return nil, DUPLICATE_ADDR
+		}
+		seen[addr] = true
+	}
+	codec, err := erasure.NewCodec(k, len(addrs))
+	if err != nil {
+		return nil, err
+	}
+	m := Manifest{
+		Name:     name,
+		Size:     len(data),
+		K:        k,
+		N:        len(addrs),
+		Duration: duration,
+		Created:  time.Now().Unix(),
+	}
+	for i, shard := range codec.Encode(data) {
+		blobID, err := putShard(s, addrs[i], shard, duration)
+		if err != nil {
+			return nil, fmt.Errorf("error while storing shard %v on %v: %v",
+				i, addrs[i], err.Error())
+		}
+		m.Shards = append(m.Shards, Shard{Index: i, Addr: addrs[i], BlobID: blobID})
+	}
+	err = m.Store()
+	if err != nil {
+		return nil, fmt.Errorf("error while storing manifest: %v", err.Error())
+	}
+	return &m, nil
+}
+
+func putShard(s Sender, addr string, shard []byte, duration string) (store.BlobID, error) {
+	// The server names blobs by the hash of their data, so we can compute the
+	// ID ourselves (the server sends back nothing if it already has the blob)
+	blobID := store.BlobID(util.Sha256AsString(shard))
+	resp, err := s.SignAndSend(addr, store.NewPutReq(duration, shard))
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != msg.OK {
+		return "", fmt.Errorf("got status %v", resp.Status)
+	}
+	if len(resp.Body) > 0 && store.BlobID(resp.Body) != blobID {
+		return "", fmt.Errorf("server returned unexpected blob ID %v", string(resp.Body))
+	}
+	return blobID, nil
+}
+
+// Fetches a shard and checks it against the manifest. Returns nil if the
+// server does not return the correct data.
+func getShard(s Sender, shard *Shard) []byte {
+	resp, err := s.SignAndSend(shard.Addr, store.NewGetReq(shard.BlobID))
+	if err != nil {
+		log.Printf("error while getting shard %v from %v: %v\n",
+			shard.Index, shard.Addr, err)
+		return nil
+	}
+	if resp.Status != msg.OK {
+		log.Printf("got status %v for shard %v from %v\n",
+			resp.Status, shard.Index, shard.Addr)
+		return nil
+	}
+	if store.BlobID(util.Sha256AsString(resp.Body)) != shard.BlobID {
+		log.Printf("shard %v from %v is corrupt\n", shard.Index, shard.Addr)
+		return nil
+	}
+	return resp.Body
+}
+
+// Gets the file back from any K servers.
+func Get(s Sender, m *Manifest) ([]byte, error) {
+	codec, err := erasure.NewCodec(m.K, m.N)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([][]byte, m.N)
+	have := 0
+	for i := range m.Shards {
+		if have == m.K {
+			break
+		}
+		shard := &m.Shards[i]
+		shards[shard.Index] = getShard(s, shard)
+		if shards[shard.Index] != nil {
+			have++
+		}
+	}
+	return codec.Decode(shards, m.Size)
+}
+
+// Fetches every shard, and returns the indexes of those that the server could
+// not produce.
+func Audit(s Sender, m *Manifest) []int {
+	failed := make([]int, 0)
+	for i := range m.Shards {
+		if getShard(s, &m.Shards[i]) == nil {
+			failed = append(failed, m.Shards[i].Index)
+		}
+	}
+	return failed
+}
+
+// Audits every shard, and moves any that failed onto spare servers. Returns
+// the indexes of the shards that were repaired.
+func Repair(s Sender, m *Manifest, spares []string) ([]int, error) {
+	codec, err := erasure.NewCodec(m.K, m.N)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([][]byte, m.N)
+	failed := make([]int, 0)
+	for i := range m.Shards {
+		shard := &m.Shards[i]
+		shards[shard.Index] = getShard(s, shard)
+		if shards[shard.Index] == nil {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) == 0 {
+		return failed, nil
+	}
+	err = codec.Reconstruct(shards)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, shard := range m.Shards {
+		inUse[shard.Addr] = true
+	}
+	repaired := make([]int, 0)
+	for _, i := range failed {
+		shard := &m.Shards[i]
+		placed := false
+		for _, addr := range spares {
+			if inUse[addr] {
+				continue
+			}
+			inUse[addr] = true
+			blobID, err := putShard(s, addr, shards[shard.Index], m.Duration)
+			if err != nil {
+				log.Printf("error while moving shard %v to %v: %v\n",
+					shard.Index, addr, err)
+				continue
+			}
+			shard.Addr = addr
+			shard.BlobID = blobID
+			placed = true
+			break
+		}
+		if !placed {
+			break
+		}
+		repaired = append(repaired, shard.Index)
+	}
+	err = m.Store()
+	if err != nil {
+		return repaired, fmt.Errorf("error while storing manifest: %v", err.Error())
+	}
+	if len(repaired) < len(failed) {
+		return repaired, errors.New("not enough spare servers to repair all shards")
+	}
+	return repaired, nil
+}
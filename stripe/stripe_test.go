@@ -0,0 +1,145 @@
+package stripe
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ortutay/decloud/msg"
+	"github.com/ortutay/decloud/services/store"
+	"github.com/ortutay/decloud/testutil"
+	"github.com/ortutay/decloud/util"
+)
+
+// In memory stand-ins for store servers, keyed by address
+type fakeServers struct {
+	blobs map[string]map[store.BlobID][]byte
+	down  map[string]bool
+}
+
+func newFakeServers(addrs ...string) *fakeServers {
+	fs := fakeServers{
+		blobs: make(map[string]map[store.BlobID][]byte),
+		down:  make(map[string]bool),
+	}
+	for _, addr := range addrs {
+		fs.blobs[addr] = make(map[store.BlobID][]byte)
+	}
+	return &fs
+}
+
+func (fs *fakeServers) SignAndSend(addr string, req *msg.OcReq) (*msg.OcResp, error) {
+	if fs.down[addr] {
+		return nil, errors.New("connection refused")
+	}
+	blobs := fs.blobs[addr]
+	switch req.Method {
+	case store.PUT_METHOD:
+		id := store.BlobID(util.Sha256AsString(req.Body))
+		blobs[id] = req.Body
+		return msg.NewRespOk([]byte(id)), nil
+	case store.GET_METHOD:
+		data, ok := blobs[store.BlobID(req.Args[1])]
+		if !ok {
+			return msg.NewRespError(msg.INVALID_ARGUMENTS), nil
+		}
+		return msg.NewRespOk(data), nil
+	}
+	return msg.NewRespError(msg.METHOD_UNSUPPORTED), nil
+}
+
+func TestPutGet(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	addrs := []string{"a:9443", "b:9443", "c:9443", "d:9443"}
+	fs := newFakeServers(addrs...)
+	data := []byte(strings.Repeat("some file data ", 100))
+	_, err := Put(fs, "file.txt", data, 2, addrs, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadManifest("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.K != 2 || m.N != 4 || len(m.Shards) != 4 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+
+	fs.down["a:9443"] = true
+	fs.down["c:9443"] = true
+	out, err := Get(fs, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("got back different data")
+	}
+
+	fs.down["d:9443"] = true
+	_, err = Get(fs, m)
+	if err == nil {
+		t.Fatalf("expected error with only 1 of 2 servers up")
+	}
+}
+
+func TestPutRejectsDuplicateAddrs(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	addrs := []string{"a:9443", "b:9443", "a:9443"}
+	fs := newFakeServers(addrs...)
+	_, err := Put(fs, "file.txt", []byte("data"), 2, addrs, "1h")
+	if err != DUPLICATE_ADDR {
+		t.Fatalf("expected %v, got %v", DUPLICATE_ADDR, err)
+	}
+	if len(fs.blobs["a:9443"]) != 0 {
+		t.Fatalf("expected nothing stored")
+	}
+}
+
+func TestAuditAndRepair(t *testing.T) {
+	defer os.RemoveAll(testutil.InitDir(t))
+	addrs := []string{"a:9443", "b:9443", "c:9443"}
+	spares := []string{"b:9443", "e:9443"}
+	fs := newFakeServers(append(addrs, "e:9443")...)
+	data := []byte("data that must survive a server going away")
+	m, err := Put(fs, "file.txt", data, 2, addrs, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := Audit(fs, m); len(failed) != 0 {
+		t.Fatalf("expected no failures, got %v", failed)
+	}
+
+	// Server loses the shard
+	for id := range fs.blobs["a:9443"] {
+		delete(fs.blobs["a:9443"], id)
+	}
+	failed := Audit(fs, m)
+	if len(failed) != 1 || failed[0] != 0 {
+		t.Fatalf("expected shard 0 to fail, got %v", failed)
+	}
+	repaired, err := Repair(fs, m, spares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 1 || repaired[0] != 0 {
+		t.Fatalf("expected shard 0 repaired, got %v", repaired)
+	}
+	m, err = LoadManifest("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Shards[0].Addr != "e:9443" {
+		t.Fatalf("expected shard moved to spare, got %v", m.Shards[0].Addr)
+	}
+
+	fs.down["b:9443"] = true
+	out, err := Get(fs, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("got back different data")
+	}
+}
@@ -0,0 +1,51 @@
+package testutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/ortutay/decloud/util"
+)
+
+// Answers a JSON-RPC call; a non-nil error is sent as the RPC error.
+type RpcHandler func(method string, params []interface{}) (interface{}, error)
+
+// Starts a fake bitcoind JSON-RPC server, and returns a conf pointing to it.
+// Callers should Close the server.
+func NewMockBitcoind(handler RpcHandler) (*httptest.Server, *util.BitcoindConf) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var req struct {
+				ID     interface{}   `json:"id"`
+				Method string        `json:"method"`
+				Params []interface{} `json:"params"`
+			}
+			resp := make(map[string]interface{})
+			if err := json.Unmarshal(body, &req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			result, err := handler(req.Method, req.Params)
+			resp["id"] = req.ID
+			resp["result"] = result
+			resp["error"] = nil
+			if err != nil {
+				resp["result"] = nil
+				resp["error"] = map[string]interface{}{
+					"code":    -1,
+					"message": err.Error(),
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		}))
+	conf := util.BitcoindConf{
+		User:     "user",
+		Password: "password",
+		Server:   strings.TrimPrefix(server.URL, "http://"),
+	}
+	return server, &conf
+}
@@ -6,13 +6,16 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
 	"os/user"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/conformal/btcjson"
 	"github.com/peterbourgon/diskv"
@@ -122,6 +125,52 @@ func StoreAppData(filename string, data []byte, perm os.FileMode) error {
 	return nil
 }
 
+// Writes to a temp file in the same directory, syncs it, and renames it over
+// path, so readers see either the old or the new contents.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := path.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = func() error {
+		defer f.Close()
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Sync the directory so the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
+
+// Temp files left by WriteFileAtomic are named ".[base].tmp[random]"
+const TEMP_FILE_SUFFIX = ".tmp"
+
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, TEMP_FILE_SUFFIX)
+}
+
 func normalizeFilename(filename string) (string, error) {
 	if path.IsAbs(filename) {
 		return filename, nil
@@ -138,9 +187,13 @@ func normalizeFilename(filename string) (string, error) {
 	}
 }
 
-func AppDir() string {
+func ExpandHome(dir string) string {
 	re := regexp.MustCompile("^~")
-	dir := string(re.ReplaceAll([]byte(appDir), []byte(os.Getenv("HOME"))))
+	return string(re.ReplaceAll([]byte(dir), []byte(os.Getenv("HOME"))))
+}
+
+func AppDir() string {
+	dir := ExpandHome(appDir)
 	err := MakeDir(dir)
 	Ferr(err)
 	return dir
@@ -224,6 +277,25 @@ func ByteSizeParseString(str string) (ByteSize, error) {
 	return 0, fmt.Errorf("could not parse: %v", str)
 }
 
+// Like time.ParseDuration, but also understands "d" (days), since storage terms
+// are usually given in days or longer.
+func DurationParseString(str string) (time.Duration, error) {
+	re := regexp.MustCompile("^([0-9]+) *d$")
+	m := re.FindStringSubmatch(strings.TrimSpace(str))
+	if len(m) == 2 {
+		days, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, fmt.Errorf("could not parse: %v", str)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse: %v", str)
+	}
+	return d, nil
+}
+
 // TODO(ortutay): for safety and convenience, we should have a single BTC type
 func B2S(btc float64) int64 {
 	return int64(btc * 1e8)
@@ -2,7 +2,10 @@ package util
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestParseByteSize(t *testing.T) {
@@ -60,3 +63,56 @@ func TestStringB2STooManyDecimals(t *testing.T) {
 		t.Fatalf("expected error on too many decimals")
 	}
 }
+
+func TestDurationParseString(t *testing.T) {
+	d, err := DurationParseString("1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != time.Hour {
+		t.Fatalf("%v != %v", d, time.Hour)
+	}
+	d, err = DurationParseString("30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != 30*24*time.Hour {
+		t.Fatalf("%v != %v", d, 30*24*time.Hour)
+	}
+	_, err = DurationParseString("forever")
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "util-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/f"
+	for _, data := range []string{"abc", "de"} {
+		err := WriteFileAtomic(filename, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != data {
+			t.Fatalf("%v != %v", string(read), data)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected only f in %v, got %v files", dir, len(files))
+	}
+	if !IsTempFile(".f.tmp123") || IsTempFile("f") {
+		t.Fatalf("IsTempFile mismatch")
+	}
+}